@@ -0,0 +1,286 @@
+package gospf
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+// Severities of audit findings.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// Size budgets of records: a TXT string holds 255 bytes, and longer records
+// may not fit in a DNS response over UDP.
+const (
+	txtStringSize = 255
+	udpRecordSize = 450
+)
+
+// AuditReport summarizes the policy of a domain, see Audit.
+type AuditReport struct {
+	Domain string `json:"domain"`
+	// Error is the PermError or None result when the policy can't be loaded,
+	// the other fields are then empty.
+	Error       string `json:"error,omitempty"`
+	DNSLookups  int    `json:"dns_lookups"`
+	VoidLookups int    `json:"void_lookups"`
+	// Depth is the depth of the include and redirect tree, 0 without them.
+	Depth int `json:"depth"`
+	// Nodes are the records of the tree in evaluation order.
+	Nodes []AuditNode `json:"nodes"`
+	// RedirectChains are the domains of chains of redirects, starting with
+	// the domain that redirects.
+	RedirectChains [][]string `json:"redirect_chains"`
+	// AuthorizedIPv4 and AuthorizedIPv6 are the numbers of addresses that pass.
+	AuthorizedIPv4 *big.Int `json:"authorized_ipv4"`
+	AuthorizedIPv6 *big.Int `json:"authorized_ipv6"`
+	// Providers are the names of the providers the domain sends via, see
+	// (*SPF).ProviderNames.
+	Providers []string  `json:"providers"`
+	Findings  []Finding `json:"findings"`
+}
+
+// AuditNode is a record of the tree of a policy.
+type AuditNode struct {
+	Domain   string `json:"domain"`
+	Term     string `json:"term,omitempty"` // term that includes or redirects to the record, empty for the root
+	Depth    int    `json:"depth"`
+	Record   string `json:"record"`
+	Size     int    `json:"size"`               // length of the record in bytes
+	Provider string `json:"provider,omitempty"` // name of the provider of Domain, see (*SPF).Provider
+}
+
+// Finding is a problem or a remark about a policy.
+type Finding struct {
+	Severity string `json:"severity"` // SeverityError, SeverityWarning or SeverityInfo
+	Domain   string `json:"domain"`
+	Message  string `json:"message"`
+}
+
+// Audit loads the policy of domain and summarizes it, see (*SPF).Audit.
+// Policies that are a PermError or missing get a report with the Error;
+// a TempError is returned.
+func Audit(domain string, dnsResolver dns.DnsResolver, opts ...Option) (*AuditReport, error) {
+	spf, err := New(domain, dnsResolver, opts...)
+	switch e := err.(type) {
+	case nil:
+		return spf.Audit(), nil
+	case *PermError, *NoneError:
+		result, problem := errorToResult(e)
+		report := &AuditReport{Domain: domain, Error: result + ": " + problem}
+		report.finding(SeverityError, domain, "%v: %v", result, problem)
+		return report, nil
+	}
+	return nil, err
+}
+
+// Audit summarizes the instance: its lookups, its tree of records, the
+// addresses it authorizes, and its problems such as deprecated mechanisms,
+// permissive all terms and lookups near the limits.
+func (spf *SPF) Audit() *AuditReport {
+	report := &AuditReport{
+		Domain:         spf.Domain,
+		DNSLookups:     spf.DNSLookupCount(),
+		Providers:      spf.ProviderNames(),
+		VoidLookups:    spf.VoidLookupCount(),
+		Nodes:          make([]AuditNode, 0),
+		RedirectChains: make([][]string, 0),
+		Findings:       make([]Finding, 0),
+	}
+	report.audit(spf, "", 0, false)
+
+	if report.DNSLookups >= DNSLookupLimit-2 {
+		report.finding(SeverityWarning, spf.Domain, "%v of %v DNS lookups, close to the limit", report.DNSLookups, DNSLookupLimit)
+	}
+	if report.VoidLookups > 0 {
+		report.finding(SeverityWarning, spf.Domain, "%v of %v void lookups (names without answer)", report.VoidLookups, VoidLookupLimit)
+	}
+	pass := spf.Addresses()["Pass"]
+	report.AuthorizedIPv4, report.AuthorizedIPv6 = pass.IPv4().Size(), pass.IPv6().Size()
+	// more than a /8 or a /32 is rarely intended
+	if report.AuthorizedIPv4.Cmp(new(big.Int).Lsh(big.NewInt(1), 24)) > 0 || report.AuthorizedIPv6.Cmp(new(big.Int).Lsh(big.NewInt(1), 96)) > 0 {
+		report.finding(SeverityWarning, spf.Domain, "authorizes %v IPv4 and %v IPv6 addresses", FormatCount(report.AuthorizedIPv4), FormatCount(report.AuthorizedIPv6))
+	}
+	return report
+}
+
+// audit adds the node of spf and its includes and redirect.
+func (report *AuditReport) audit(spf *SPF, term string, depth int, redirected bool) {
+	if depth > report.Depth {
+		report.Depth = depth
+	}
+	report.Nodes = append(report.Nodes, AuditNode{Domain: spf.Domain, Term: term, Depth: depth, Record: spf.record, Size: len(spf.record), Provider: spf.Provider()})
+	switch size := len(spf.record); {
+	case size > udpRecordSize:
+		report.finding(SeverityWarning, spf.Domain, "the record is %v bytes long, it may not fit in a DNS response over UDP", size)
+	case size > txtStringSize:
+		report.finding(SeverityInfo, spf.Domain, "the record is %v bytes long, it must be split in strings of at most %v bytes", size, txtStringSize)
+	}
+
+	for i, directive := range spf.directives {
+		switch {
+		case directive.Mechanism == "ptr":
+			report.finding(SeverityWarning, spf.Domain, "%v is deprecated, it's slow and unreliable (RFC 7208 § 5.5)", directive.term)
+		case directive.Mechanism == "exists" || strings.Contains(directive.term, "%{"):
+			report.finding(SeverityInfo, spf.Domain, "%v depends on the evaluated address, macros aren't supported by gospf", directive.term)
+		case directive.Mechanism == "all" && i < len(spf.directives)-1:
+			report.finding(SeverityWarning, spf.Domain, "the terms after %v are ignored", directive.term)
+		}
+	}
+	switch spf.All {
+	case "+", "":
+		report.finding(SeverityError, spf.Domain, "%vall authorizes every address", spf.All)
+	case "?":
+		if depth == 0 || redirected {
+			report.finding(SeverityWarning, spf.Domain, "?all makes other senders neutral, it doesn't protect the domain")
+		}
+	case "undefined":
+		if spf.Redirect == nil && (depth == 0 || redirected) {
+			report.finding(SeverityWarning, spf.Domain, "no all term, other senders get no result")
+		}
+	}
+	for _, modifier := range spf.modifiers {
+		if modifier.Key == "redirect" && spf.All != "undefined" {
+			report.finding(SeverityWarning, spf.Domain, "%v is ignored because of the all term", modifier.term)
+		}
+	}
+
+	for _, include := range spf.Includes {
+		report.audit(include.SPF, include.Term, depth+1, false)
+	}
+	if spf.Redirect != nil && spf.All == "undefined" {
+		if !redirected {
+			chain := []string{spf.Domain}
+			for r := spf.Redirect; r != nil; r = r.Redirect {
+				chain = append(chain, r.Domain)
+				if r.All != "undefined" {
+					break
+				}
+			}
+			report.RedirectChains = append(report.RedirectChains, chain)
+		}
+		report.audit(spf.Redirect, "redirect="+spf.Redirect.Domain, depth+1, true)
+	}
+}
+
+func (report *AuditReport) finding(severity string, domain string, format string, args ...interface{}) {
+	report.Findings = append(report.Findings, Finding{Severity: severity, Domain: domain, Message: fmt.Sprintf(format, args...)})
+}
+
+// FormatCount formats a number of addresses, as a power of two when it's
+// large, e.g. "2^24" or "2^24.6".
+func FormatCount(n *big.Int) string {
+	if n == nil {
+		return "0"
+	}
+	if n.Cmp(big.NewInt(1<<16)) < 0 {
+		return n.String()
+	}
+	bits := n.BitLen() - 1
+	if new(big.Int).Lsh(big.NewInt(1), uint(bits)).Cmp(n) == 0 {
+		return fmt.Sprintf("2^%v", bits)
+	}
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return fmt.Sprintf("2^%.1f", math.Log2(f))
+}
+
+func (report *AuditReport) String() string {
+	out := "SPF audit of " + report.Domain + "\n"
+	if report.Error != "" {
+		return out + report.Error + "\n"
+	}
+	out += fmt.Sprintf("DNS lookups:  %v of %v\n", report.DNSLookups, DNSLookupLimit)
+	out += fmt.Sprintf("Void lookups: %v of %v\n", report.VoidLookups, VoidLookupLimit)
+	out += fmt.Sprintf("Tree depth:   %v\n", report.Depth)
+	out += fmt.Sprintf("Authorizes %v IPv4 and %v IPv6 addresses\n", FormatCount(report.AuthorizedIPv4), FormatCount(report.AuthorizedIPv6))
+	if len(report.Providers) > 0 {
+		out += "Sends via " + strings.Join(report.Providers, ", ") + "\n"
+	}
+	out += "\nRecords:\n"
+	for _, node := range report.Nodes {
+		name := node.Domain
+		if node.Term != "" {
+			name = node.Term
+		}
+		if node.Provider != "" {
+			name += " [" + node.Provider + "]"
+		}
+		out += fmt.Sprintf("  %v%v (%v bytes): %v\n", strings.Repeat("  ", node.Depth), name, node.Size, node.Record)
+	}
+	if len(report.RedirectChains) > 0 {
+		out += "\nRedirect chains:\n"
+		for _, chain := range report.RedirectChains {
+			out += "  " + strings.Join(chain, " -> ") + "\n"
+		}
+	}
+	if len(report.Findings) > 0 {
+		out += "\nFindings:\n"
+		for _, f := range report.Findings {
+			out += fmt.Sprintf("  [%v] %v: %v\n", f.Severity, f.Domain, f.Message)
+		}
+	}
+	return out
+}
+
+var auditTemplate = template.Must(template.New("audit").Funcs(template.FuncMap{
+	"count":  FormatCount,
+	"indent": func(depth int) int { return depth * 24 },
+	"join":   strings.Join,
+	"limits": func() [2]int { return [2]int{DNSLookupLimit, VoidLookupLimit} },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>SPF audit of {{.Domain}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 4px 12px; border-bottom: 1px solid #ddd; vertical-align: top; }
+code { font-size: 90%; word-break: break-all; }
+.error { color: #b00020; font-weight: bold; }
+.warning { color: #a65e00; }
+.info { color: #555; }
+</style>
+</head>
+<body>
+<h1>SPF audit of {{.Domain}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{else}}
+<table>
+<tr><th>DNS lookups</th><td>{{.DNSLookups}} of {{index limits 0}}</td></tr>
+<tr><th>Void lookups</th><td>{{.VoidLookups}} of {{index limits 1}}</td></tr>
+<tr><th>Tree depth</th><td>{{.Depth}}</td></tr>
+<tr><th>Authorized addresses</th><td>{{count .AuthorizedIPv4}} IPv4, {{count .AuthorizedIPv6}} IPv6</td></tr>
+{{if .Providers}}<tr><th>Sends via</th><td>{{join .Providers ", "}}</td></tr>
+{{end}}</table>
+<h2>Records</h2>
+<table>
+<tr><th>Domain</th><th>Provider</th><th>Size</th><th>Record</th></tr>
+{{range .Nodes}}<tr><td style="padding-left: {{indent .Depth}}px">{{if .Term}}{{.Term}}{{else}}{{.Domain}}{{end}}</td><td>{{.Provider}}</td><td>{{.Size}}</td><td><code>{{.Record}}</code></td></tr>
+{{end}}</table>
+{{if .RedirectChains}}<h2>Redirect chains</h2>
+<ul>
+{{range .RedirectChains}}<li>{{join . " → "}}</li>
+{{end}}</ul>
+{{end}}{{end}}
+<h2>Findings</h2>
+{{if .Findings}}<table>
+{{range .Findings}}<tr><td class="{{.Severity}}">{{.Severity}}</td><td>{{.Domain}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+{{else}}<p>No findings.</p>
+{{end}}</body>
+</html>
+`))
+
+// WriteHTML writes the report as a standalone HTML page.
+func (report *AuditReport) WriteHTML(w io.Writer) error {
+	return auditTemplate.Execute(w, report)
+}
@@ -0,0 +1,121 @@
+package gospf
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+const auditZone = `
+$ORIGIN example.com.
+@          TXT   "v=spf1 ip4:192.0.2.0/24 ptr include:_spf.esp.example redirect=_old.example.com ~all"
+_old       TXT   "v=spf1 redirect=_older.example.com"
+_older     TXT   "v=spf1 ip4:198.51.100.0/24 ?all"
+wide       TXT   "v=spf1 ip4:10.0.0.0/8 ip4:11.0.0.0/9 -all"
+open       TXT   "v=spf1 mx all"
+late       TXT   "v=spf1 -all ip4:192.0.2.1 +all"
+$ORIGIN esp.example.
+_spf       TXT   "v=spf1 ip4:203.0.113.0/25 include:_ip.esp.example -all"
+_ip        TXT   "v=spf1 ip6:2001:db8::/126 -all"
+`
+
+func TestAudit(t *testing.T) {
+	Convey("Testing audit reports", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(auditZone), ""), ShouldEqual, nil)
+
+		messages := func(report *AuditReport) []string {
+			out := make([]string, 0, len(report.Findings))
+			for _, f := range report.Findings {
+				out = append(out, f.Severity+" "+f.Domain+": "+f.Message)
+			}
+			return out
+		}
+
+		Convey("The tree, the lookups and the problems of a policy are reported", func() {
+			report, err := Audit("example.com", z)
+			So(err, ShouldEqual, nil)
+			So(report.Error, ShouldEqual, "")
+			So(report.Depth, ShouldEqual, 2)
+			So(len(report.Nodes), ShouldEqual, 3)
+			So(report.Nodes[1].Term, ShouldEqual, "include:_spf.esp.example")
+			So(report.Nodes[2].Depth, ShouldEqual, 2)
+			So(report.Nodes[2].Size, ShouldEqual, len("v=spf1 ip6:2001:db8::/126 -all"))
+			So(report.AuthorizedIPv4.Int64(), ShouldEqual, 256+128)
+			So(report.AuthorizedIPv6.Int64(), ShouldEqual, 4)
+			So(messages(report), ShouldContain, "warning example.com: ptr is deprecated, it's slow and unreliable (RFC 7208 § 5.5)")
+			So(messages(report), ShouldContain, "warning example.com: redirect=_old.example.com is ignored because of the all term")
+			So(report.RedirectChains, ShouldBeEmpty)
+			So(report.String(), ShouldContainSubstring, "\n    include:_spf.esp.example (")
+
+			data, err := json.Marshal(report)
+			So(err, ShouldEqual, nil)
+			So(string(data), ShouldContainSubstring, `"authorized_ipv4":384`)
+		})
+
+		Convey("Redirect chains and neutral defaults are reported", func() {
+			report, err := Audit("_old.example.com", z)
+			So(err, ShouldEqual, nil)
+			So(report.RedirectChains, ShouldResemble, [][]string{{"_old.example.com", "_older.example.com"}})
+			So(messages(report), ShouldResemble, []string{
+				"warning _older.example.com: ?all makes other senders neutral, it doesn't protect the domain",
+			})
+			So(report.String(), ShouldContainSubstring, "_old.example.com -> _older.example.com")
+		})
+
+		Convey("Terms after all are reported as ignored, like the evaluation ignores them", func() {
+			report, err := Audit("late.example.com", z)
+			So(err, ShouldEqual, nil)
+			So(messages(report), ShouldContain, "warning late.example.com: the terms after -all are ignored")
+			So(report.AuthorizedIPv4.Sign(), ShouldEqual, 0)
+			So(messages(report), ShouldNotContain, "error late.example.com: +all authorizes every address")
+
+			spf, err := New("late.example.com", z)
+			So(err, ShouldEqual, nil)
+			result, err := spf.CheckIP("192.0.2.1")
+			So(err, ShouldEqual, nil)
+			So(result, ShouldEqual, "Fail")
+		})
+
+		Convey("Permissive policies are reported", func() {
+			report, err := Audit("wide.example.com", z)
+			So(err, ShouldEqual, nil)
+			So(report.AuthorizedIPv4.Cmp(big.NewInt((1<<24)+(1<<23))), ShouldEqual, 0)
+			So(messages(report), ShouldResemble, []string{
+				"warning wide.example.com: authorizes 2^24.6 IPv4 and 0 IPv6 addresses",
+			})
+
+			report, err = Audit("open.example.com", z)
+			So(err, ShouldEqual, nil)
+			So(messages(report), ShouldResemble, []string{
+				"error open.example.com: all authorizes every address",
+				"warning open.example.com: 1 of 2 void lookups (names without answer)",
+				"warning open.example.com: authorizes 2^32 IPv4 and 2^128 IPv6 addresses",
+			})
+		})
+
+		Convey("Invalid and missing policies get a report", func() {
+			report, err := Audit("missing.example.com", z)
+			So(err, ShouldEqual, nil)
+			So(report.Error, ShouldStartWith, "None: ")
+			So(len(report.Findings), ShouldEqual, 1)
+
+			var html bytes.Buffer
+			So(report.WriteHTML(&html), ShouldEqual, nil)
+			So(html.String(), ShouldContainSubstring, "<title>SPF audit of missing.example.com</title>")
+		})
+
+		Convey("Counts of addresses are formatted", func() {
+			So(FormatCount(big.NewInt(384)), ShouldEqual, "384")
+			So(FormatCount(big.NewInt(1<<24)), ShouldEqual, "2^24")
+			So(FormatCount(big.NewInt(3<<24)), ShouldEqual, "2^25.6")
+			So(FormatCount(nil), ShouldEqual, "0")
+		})
+	})
+}
@@ -0,0 +1,38 @@
+package gospf
+
+import (
+	"github.com/mistralmail/gospf/dns"
+)
+
+// DefaultBestGuess is a common best-guess record (see WithBestGuess): the
+// hosts of the domain and of its mail exchangers and their /24 networks pass,
+// as do the hosts whose validated names are in the domain, others are neutral.
+const DefaultBestGuess = "v=spf1 a/24 mx/24 ptr ?all"
+
+// WithBestGuess evaluates record, e.g. DefaultBestGuess, as the policy of
+// domains that publish no SPF record, instead of returning a NoneError. The
+// results are marked with BestGuess, as they're weaker than the ones of a
+// published policy. When the best guess fails, e.g. because of the void
+// lookup limit for a domain that doesn't exist, the result stays None.
+// An empty record disables the best guess.
+func WithBestGuess(record string) Option {
+	return func(o *options) {
+		o.bestGuess = record
+	}
+}
+
+// newPolicy creates the SPF instance of domain for New and NewForIP, from
+// the published record or else the best-guess record.
+func newPolicy(domain string, dnsResolver dns.DnsResolver, o *options, family addressFamily) (*SPF, error) {
+	spf, err := newSPF(domain, dnsResolver, o, family, 0, 0)
+	if _, ok := err.(*NoneError); !ok || o.bestGuess == "" {
+		return spf, err
+	}
+	guess := emptySPF(domain, dnsResolver, o, family, 0, 0)
+	guess.BestGuess = true
+	if guess.load(o.bestGuess) != nil {
+		// an invalid best guess is no better than no record
+		return nil, err
+	}
+	return guess, nil
+}
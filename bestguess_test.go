@@ -0,0 +1,109 @@
+package gospf
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+const bestGuessZone = `
+$ORIGIN example.com.
+@          TXT  "google-site-verification=abc"
+           A    192.0.2.10
+           MX   10 mail.example.net.
+$ORIGIN example.net.
+mail       A    198.51.100.20
+@          TXT  "v=spf1 ip4:203.0.113.0/24 -all"
+$ORIGIN 113.0.203.in-addr.arpa.
+5          PTR  host.example.com.
+$ORIGIN example.com.
+host       A    203.0.113.5
+`
+
+func TestBestGuess(t *testing.T) {
+	Convey("Testing best-guess records", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(bestGuessZone), ""), ShouldEqual, nil)
+
+		Convey("Domains without record get the best-guess result", func() {
+			tests := []struct {
+				ip        string
+				sender    string
+				result    string
+				mechanism string
+				bestGuess bool
+			}{
+				{"192.0.2.77", "user@example.com", "Pass", "a/24", true},
+				{"198.51.100.1", "user@example.com", "Pass", "mx/24", true},
+				{"203.0.113.5", "user@example.com", "Pass", "ptr", true},
+				{"203.0.113.6", "user@example.com", "Neutral", "?all", true},
+				{"203.0.113.6", "user@example.net", "Pass", "ip4:203.0.113.0/24", false},
+				// a, mx and ptr are void lookups for a domain that doesn't
+				// exist, the best guess exceeds the limit and fails
+				{"192.0.2.77", "user@none.example.com", "None", "", false},
+			}
+			for _, test := range tests {
+				result, err := Check(test.ip, test.sender, "mx.example.org", z, WithBestGuess(DefaultBestGuess))
+				So(err, ShouldEqual, nil)
+				So(result.Result, ShouldEqual, test.result)
+				So(result.Mechanism, ShouldEqual, test.mechanism)
+				So(result.BestGuess, ShouldEqual, test.bestGuess)
+			}
+
+			result, err := Check("192.0.2.77", "user@example.com", "mx.example.org", z)
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "None")
+			So(result.BestGuess, ShouldEqual, false)
+
+			result, err = Check("192.0.2.77", "user@example.com", "mx.example.org", z, WithBestGuess("v=spf1 -all"))
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "Fail")
+			So(result.BestGuess, ShouldEqual, true)
+			So(result.Trace[0], ShouldEqual, "example.com: no SPF record, evaluating the best guess")
+			So(result.Explanation(), ShouldEqual, "domain of user@example.com does not provide an SPF record, best guess fail for 192.0.2.77")
+			So(result.AuthenticationResults("mx.example.org"), ShouldEqual, "mx.example.org; spf=fail (best guess) smtp.mailfrom=user@example.com")
+
+			result, err = Check("192.0.2.77", "user@example.com", "mx.example.org", z, WithBestGuess("spf1 -all"))
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "None")
+			So(result.BestGuess, ShouldEqual, false)
+		})
+
+		Convey("Cached and coalesced policies keep apart best guesses", func() {
+			c := NewPolicyCache(0)
+			spf, err := New("example.com", z, WithPolicyCache(c), WithBestGuess(DefaultBestGuess))
+			So(err, ShouldEqual, nil)
+			So(spf.BestGuess, ShouldEqual, true)
+			_, err = New("example.com", z, WithPolicyCache(c))
+			So(err, ShouldHaveSameTypeAs, &NoneError{})
+
+			var g Group
+			spf, err = New("example.com", z, WithGroup(&g), WithBestGuess(DefaultBestGuess))
+			So(err, ShouldEqual, nil)
+			So(spf.BestGuess, ShouldEqual, true)
+		})
+
+		Convey("Snapshots keep the best-guess flag", func() {
+			spf, err := New("example.com", z, WithBestGuess(DefaultBestGuess))
+			So(err, ShouldEqual, nil)
+			data, err := spf.MarshalJSON()
+			So(err, ShouldEqual, nil)
+			So(string(data), ShouldContainSubstring, `"best_guess":true`)
+			restored, err := Restore(data, z)
+			So(err, ShouldEqual, nil)
+			So(restored.BestGuess, ShouldEqual, true)
+
+			data, err = spf.MarshalBinary()
+			So(err, ShouldEqual, nil)
+			restored, err = Restore(data, z)
+			So(err, ShouldEqual, nil)
+			So(restored.BestGuess, ShouldEqual, true)
+			evaluation, err := restored.Evaluate("192.0.2.77")
+			So(err, ShouldEqual, nil)
+			So(evaluation.BestGuess, ShouldEqual, true)
+		})
+	})
+}
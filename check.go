@@ -0,0 +1,283 @@
+package gospf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+// Result is the outcome of check_host() for one identity of an SMTP session.
+type Result struct {
+	Result   string // "Pass", "Fail", "SoftFail", "Neutral", "None", "TempError" or "PermError"
+	IP       string // client IP
+	Sender   string // checked <sender>, e.g. "user@example.com" or "postmaster@mail.example.com"
+	Helo     string // HELO/EHLO name given by the client
+	Identity string // "mailfrom" or "helo"
+	Domain   string // domain whose policy was evaluated
+	Problem  string // cause of a TempError or PermError
+	// Mechanism is the mechanism that determined the result, e.g. "-all",
+	// and MechanismDomain the domain whose record contains it.
+	Mechanism       string
+	MechanismDomain string
+	// Local is set when the result is from the receiver's local policy (see
+	// WithLocalPolicy), Mechanism is then its term, e.g. "local:192.0.2.0/24".
+	Local bool
+	// BestGuess is set when the domain publishes no record and the result
+	// is from the best-guess record (see WithBestGuess).
+	BestGuess bool
+	Trace     []string // evaluation steps, see SPF.Evaluate
+}
+
+/*
+Check evaluates the SPF policy of an SMTP session for the client ip.
+The MAIL FROM identity (sender) is checked, or the HELO identity
+when the reverse-path is null. The local policy given with WithLocalPolicy
+is evaluated first.
+
+	RFC 7208 2.4.
+		When the reverse-path is null, this document defines the "MAIL FROM"
+		identity to be the mailbox composed of the local-part "postmaster"
+		and the "HELO" identity (which might or might not have been checked
+		separately before).
+
+	RFC 7208 4.3.
+		If the <domain> is malformed (e.g., label longer than 63 characters,
+		zero-length label not at the end, etc.) or is not a multi-label
+		domain name, or if the DNS lookup returns "Name Error" (RCODE 3, also
+		known as "NXDOMAIN" [RFC2308]), check_host() immediately returns the
+		result "none".
+
+		If the <sender> has no local-part, substitute the string "postmaster"
+		for the local-part.
+
+An error is only returned for an invalid client IP.
+*/
+func Check(ip string, sender string, helo string, dnsResolver dns.DnsResolver, opts ...Option) (*Result, error) {
+	if net.ParseIP(ip) == nil {
+		return nil, fmt.Errorf("Invalid IP address: %v", ip)
+	}
+	o := newOptions(opts)
+	var start time.Time
+	if o.metrics != nil {
+		start = time.Now()
+	}
+
+	result := &Result{
+		IP:       ip,
+		Helo:     helo,
+		Identity: "mailfrom",
+	}
+	sender = strings.Trim(sender, "<>")
+	if sender == "" {
+		sender = "postmaster@" + helo
+		result.Identity = "helo"
+	}
+	index := strings.LastIndex(sender, "@")
+	if index == -1 {
+		sender = "postmaster@" + sender
+		index = len("postmaster")
+	} else if index == 0 {
+		sender = "postmaster" + sender
+		index = len("postmaster")
+	}
+	result.Sender = sender
+	result.Domain = strings.TrimSuffix(sender[index+1:], ".")
+
+	if evaluation := o.evaluateLocal(ip, o.resolver(dnsResolver)); evaluation != nil {
+		result.Result = evaluation.Result
+		result.Mechanism = evaluation.Mechanism
+		result.Local = true
+		result.Trace = evaluation.Trace
+		o.observe(Event{Kind: ResultEvent, Domain: result.Domain, IP: ip, Result: result.Result, Term: result.Mechanism})
+		if o.metrics != nil {
+			o.metrics.CheckDone(result.Result, time.Since(start), 0)
+		}
+		return result, nil
+	}
+
+	if !isValidDomain(result.Domain) {
+		result.Result = "None"
+		result.Problem = "Invalid domain: " + result.Domain
+		o.observe(Event{Kind: ResultEvent, Domain: result.Domain, IP: ip, Result: result.Result})
+		if o.metrics != nil {
+			o.metrics.CheckDone(result.Result, time.Since(start), 0)
+		}
+		return result, nil
+	}
+
+	dnsLookups := 0
+	spf, err := NewForIP(result.Domain, ip, dnsResolver, opts...)
+	if err == nil {
+		dnsLookups = spf.DNSLookupCount()
+		var evaluation *Evaluation
+		// the local policy didn't match above
+		evaluation, err = spf.evaluatePublished(ip)
+		if err == nil {
+			result.Result = evaluation.Result
+			result.Mechanism = evaluation.Mechanism
+			result.MechanismDomain = evaluation.Domain
+			result.Trace = evaluation.Trace
+			result.BestGuess = evaluation.BestGuess
+		}
+	}
+	if err != nil {
+		result.Result, result.Problem = errorToResult(err)
+		if spf == nil {
+			// Evaluate wasn't called and didn't report the result
+			o.observe(Event{Kind: ResultEvent, Domain: result.Domain, IP: ip, Result: result.Result, Err: err})
+		}
+	}
+	if o.metrics != nil {
+		o.metrics.CheckDone(result.Result, time.Since(start), dnsLookups)
+	}
+
+	return result, nil
+}
+
+// errorToResult returns the result and the problem description of an
+// error returned by New or CheckIP.
+func errorToResult(err error) (string, string) {
+	switch e := err.(type) {
+	case *NoneError:
+		return "None", e.Message
+	case *TempError:
+		return "TempError", e.Message
+	case *PermError:
+		return "PermError", e.Message
+	}
+	return "PermError", err.Error()
+}
+
+// isValidDomain checks whether domain is a multi-label domain name
+// without empty labels or labels longer than 63 characters.
+func isValidDomain(domain string) bool {
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// Explanation returns a human readable explanation of the result, the
+// comment of the Received-SPF header field.
+func (r *Result) Explanation() string {
+	if r.Local && r.Mechanism == "" {
+		return fmt.Sprintf("%v is not trusted by the local policy of the receiver", r.IP)
+	}
+	if r.Local {
+		return fmt.Sprintf("%v is trusted by the local policy of the receiver (%v)", r.IP, r.Mechanism)
+	}
+	if r.BestGuess {
+		return fmt.Sprintf("domain of %v does not provide an SPF record, best guess %v for %v", r.Sender, strings.ToLower(r.Result), r.IP)
+	}
+	switch r.Result {
+	case "Pass":
+		return fmt.Sprintf("domain of %v designates %v as permitted sender", r.Sender, r.IP)
+	case "Fail":
+		return fmt.Sprintf("domain of %v does not designate %v as permitted sender", r.Sender, r.IP)
+	case "SoftFail":
+		return fmt.Sprintf("domain of transitioning %v does not designate %v as permitted sender", r.Sender, r.IP)
+	case "Neutral":
+		return fmt.Sprintf("%v is neither permitted nor denied by domain of %v", r.IP, r.Sender)
+	case "None":
+		return fmt.Sprintf("domain of %v does not provide an SPF record", r.Sender)
+	case "TempError":
+		return fmt.Sprintf("error in processing during lookup of %v", r.Sender)
+	case "PermError":
+		return fmt.Sprintf("permanent error in processing domain of %v", r.Sender)
+	}
+	return ""
+}
+
+/*
+ReceivedSPF returns the value of a Received-SPF header field recording the
+result, as described in RFC 7208 Section 9.1. receiver is the host name of
+the receiving MTA and can be empty.
+
+	RFC 7208 9.1.
+		Received-SPF: pass (mybox.example.org: domain of
+		 myname@example.com designates 192.0.2.1 as permitted sender)
+		    receiver=mybox.example.org; client-ip=192.0.2.1;
+		    envelope-from="myname@example.com"; helo=foo.example.com;
+*/
+func (r *Result) ReceivedSPF(receiver string) string {
+	comment := r.Explanation()
+	if receiver != "" {
+		comment = receiver + ": " + comment
+	}
+
+	out := r.Result + " (" + comment + ")"
+	pairs := make([]string, 0, 6)
+	if receiver != "" {
+		pairs = append(pairs, "receiver="+headerValue(receiver))
+	}
+	pairs = append(pairs, "client-ip="+headerValue(r.IP))
+	if r.Identity == "mailfrom" {
+		pairs = append(pairs, "envelope-from="+headerValue(r.Sender))
+	}
+	if r.Helo != "" {
+		pairs = append(pairs, "helo="+headerValue(r.Helo))
+	}
+	if r.Problem != "" && (r.Result == "TempError" || r.Result == "PermError") {
+		pairs = append(pairs, "problem="+headerValue(r.Problem))
+	}
+	pairs = append(pairs, "identity="+r.Identity)
+
+	return out + " " + strings.Join(pairs, "; ") + ";"
+}
+
+/*
+AuthenticationResults returns the value of an Authentication-Results header
+field recording the result, as described in RFC 8601. authservID identifies
+the receiving host, usually its host name.
+
+	RFC 8601 2.7.2.
+		spf:  This method is defined in [SPF].  ...
+		      smtp.mailfrom or smtp.helo
+*/
+func (r *Result) AuthenticationResults(authservID string) string {
+	out := authservID + "; spf=" + strings.ToLower(r.Result)
+	if r.Problem != "" && (r.Result == "TempError" || r.Result == "PermError") {
+		out += " (" + strings.NewReplacer("(", "[", ")", "]", "\r", "", "\n", "").Replace(r.Problem) + ")"
+	} else if r.Local {
+		out += " (local policy)"
+	} else if r.BestGuess {
+		out += " (best guess)"
+	}
+	if r.Identity == "helo" {
+		return out + " smtp.helo=" + headerValue(r.Helo)
+	}
+	// RFC 8601 § 2.2 allows an unquoted [ local-part "@" ] domain-name as pvalue
+	index := strings.LastIndex(r.Sender, "@")
+	local, domain := r.Sender[:index+1], r.Sender[index+1:]
+	if index > 0 && headerValue(local[:index]) == local[:index] && headerValue(domain) == domain {
+		return out + " smtp.mailfrom=" + local + domain
+	}
+	return out + " smtp.mailfrom=" + headerValue(r.Sender)
+}
+
+// headerValue returns value as a dot-atom, or as a quoted-string
+// when it contains other characters (RFC 5322 § 3.2.3).
+func headerValue(value string) string {
+	atom := value != "" && !strings.HasPrefix(value, ".") && !strings.HasSuffix(value, ".") &&
+		!strings.Contains(value, "..")
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune("!#$%&'*+-/=?^_`{|}~.", c)) {
+			atom = false
+			break
+		}
+	}
+	if atom {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", "", "\n", "").Replace(value) + `"`
+}
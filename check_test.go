@@ -0,0 +1,125 @@
+package gospf
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+const checkZone = `
+$ORIGIN example.com.
+@        TXT  "v=spf1 ip4:192.0.2.1 ~ip4:192.0.2.2 ?ip4:192.0.2.3 -all"
+mail     TXT  "v=spf1 a -all"
+         A    192.0.2.10
+broken   TXT  "v=spf1 include:nospf.example.com -all"
+slow     TXT  "v=spf1 a:timeout.example.com -all"
+`
+
+func TestCheck(t *testing.T) {
+	Convey("Testing Check()", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(checkZone), ""), ShouldEqual, nil)
+		z.Fail("timeout.example.com", dns.Timeout)
+
+		tests := []struct {
+			ip       string
+			sender   string
+			helo     string
+			result   string
+			identity string
+			sndr     string
+			domain   string
+		}{
+			{"192.0.2.1", "user@example.com", "mail.example.com", "Pass", "mailfrom", "user@example.com", "example.com"},
+			{"192.0.2.1", "<user@example.com>", "", "Pass", "mailfrom", "user@example.com", "example.com"},
+			{"192.0.2.2", "user@example.com", "mail.example.com", "SoftFail", "mailfrom", "user@example.com", "example.com"},
+			{"192.0.2.3", "user@example.com", "mail.example.com", "Neutral", "mailfrom", "user@example.com", "example.com"},
+			{"192.0.2.4", "user@example.com", "mail.example.com", "Fail", "mailfrom", "user@example.com", "example.com"},
+			{"192.0.2.10", "", "mail.example.com", "Pass", "helo", "postmaster@mail.example.com", "mail.example.com"},
+			{"192.0.2.10", "<>", "mail.example.com", "Pass", "helo", "postmaster@mail.example.com", "mail.example.com"},
+			{"192.0.2.1", "@example.com", "mail.example.com", "Pass", "mailfrom", "postmaster@example.com", "example.com"},
+			{"192.0.2.1", "user@nospf.example.com", "mail.example.com", "None", "mailfrom", "user@nospf.example.com", "nospf.example.com"},
+			{"192.0.2.1", "user@localhost", "mail.example.com", "None", "mailfrom", "user@localhost", "localhost"},
+			{"192.0.2.1", "user@broken.example.com", "mail.example.com", "PermError", "mailfrom", "user@broken.example.com", "broken.example.com"},
+			{"192.0.2.1", "user@slow.example.com", "mail.example.com", "TempError", "mailfrom", "user@slow.example.com", "slow.example.com"},
+		}
+
+		for _, test := range tests {
+			result, err := Check(test.ip, test.sender, test.helo, z)
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, test.result)
+			So(result.Identity, ShouldEqual, test.identity)
+			So(result.Sender, ShouldEqual, test.sndr)
+			So(result.Domain, ShouldEqual, test.domain)
+		}
+
+		_, err := Check("not-an-ip", "user@example.com", "", z)
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func TestReceivedSPF(t *testing.T) {
+	Convey("Testing Result.ReceivedSPF()", t, func() {
+		r := &Result{
+			Result:   "Pass",
+			IP:       "192.0.2.1",
+			Sender:   "myname@example.com",
+			Helo:     "foo.example.com",
+			Identity: "mailfrom",
+			Domain:   "example.com",
+		}
+		So(r.ReceivedSPF("mybox.example.org"), ShouldEqual,
+			"Pass (mybox.example.org: domain of myname@example.com designates 192.0.2.1 as permitted sender) "+
+				`receiver=mybox.example.org; client-ip=192.0.2.1; envelope-from="myname@example.com"; `+
+				"helo=foo.example.com; identity=mailfrom;")
+
+		r.Result = "PermError"
+		r.Problem = `Unknown "mechanism"`
+		So(r.ReceivedSPF(""), ShouldEqual,
+			"PermError (permanent error in processing domain of myname@example.com) "+
+				`client-ip=192.0.2.1; envelope-from="myname@example.com"; helo=foo.example.com; `+
+				`problem="Unknown \"mechanism\""; identity=mailfrom;`)
+
+		r = &Result{
+			Result:   "SoftFail",
+			IP:       "2001:db8::1",
+			Sender:   "postmaster@foo.example.com",
+			Helo:     "foo.example.com",
+			Identity: "helo",
+		}
+		So(r.ReceivedSPF("mx.example.org"), ShouldEqual,
+			"SoftFail (mx.example.org: domain of transitioning postmaster@foo.example.com does not designate 2001:db8::1 as permitted sender) "+
+				`receiver=mx.example.org; client-ip="2001:db8::1"; helo=foo.example.com; identity=helo;`)
+	})
+}
+
+func TestAuthenticationResults(t *testing.T) {
+	Convey("Testing Result.AuthenticationResults()", t, func() {
+		r := &Result{
+			Result:   "SoftFail",
+			IP:       "192.0.2.1",
+			Sender:   "myname@example.com",
+			Helo:     "foo.example.com",
+			Identity: "mailfrom",
+		}
+		So(r.AuthenticationResults("mx.example.org"), ShouldEqual,
+			"mx.example.org; spf=softfail smtp.mailfrom=myname@example.com")
+
+		r.Sender = "my name@example.com"
+		So(r.AuthenticationResults("mx.example.org"), ShouldEqual,
+			`mx.example.org; spf=softfail smtp.mailfrom="my name@example.com"`)
+
+		r = &Result{
+			Result:   "PermError",
+			Sender:   "postmaster@foo.example.com",
+			Helo:     "foo.example.com",
+			Identity: "helo",
+			Problem:  "Unknown mechanism (foo)",
+		}
+		So(r.AuthenticationResults("mx.example.org"), ShouldEqual,
+			"mx.example.org; spf=permerror (Unknown mechanism [foo]) smtp.helo=foo.example.com")
+	})
+}
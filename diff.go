@@ -0,0 +1,239 @@
+package gospf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/ipset"
+)
+
+// diffResults are the results compared by Compare, in report order.
+var diffResults = []string{"Pass", "Fail", "SoftFail", "Neutral"}
+
+// NewFromRecord creates an SPF instance like New, but from record as if
+// domain published it, e.g. to try a record before publishing it. Its
+// includes and redirect are looked up with dnsResolver.
+func NewFromRecord(domain string, record string, dnsResolver dns.DnsResolver, opts ...Option) (*SPF, error) {
+	o := newOptions(opts)
+	spf := emptySPF(domain, o.resolver(dnsResolver), o, familyAny, 0, 0)
+	if err := spf.load(record); err != nil {
+		return nil, err
+	}
+	return spf, nil
+}
+
+// Addresses returns the addresses that get each result ("Pass", "Fail",
+// "SoftFail" or "Neutral") when evaluated against the instance, following
+// the record order like CheckIP.
+// The ptr mechanisms are ignored, as they depend on the reverse DNS of the
+// address at evaluation time (see DynamicTerms).
+func (spf *SPF) Addresses() map[string]*ipset.Set {
+	results := make(map[string]*ipset.Set)
+	add := func(result string, s *ipset.Set) {
+		results[result] = results[result].Union(s)
+	}
+	everything, _ := ipset.Parse("0.0.0.0/0", "::/0")
+	// RFC 7208 4.7: addresses that match no mechanism are neutral
+	add("Neutral", spf.addresses(everything, add))
+	for _, result := range diffResults {
+		if results[result] == nil {
+			results[result] = &ipset.Set{}
+		}
+	}
+	return results
+}
+
+// addresses adds the addresses of remaining that match the instance to
+// their result, in record order like evaluate, and returns the others.
+func (spf *SPF) addresses(remaining *ipset.Set, add func(result string, s *ipset.Set)) *ipset.Set {
+	for _, m := range spf.mechanisms {
+		result := qualifierToResult(m.directive.Qualifier)
+		switch m.directive.Mechanism {
+		case "all":
+			add(result, remaining)
+			return &ipset.Set{}
+		case "ptr":
+			// depends on the reverse DNS of the address, see DynamicTerms
+		case "include":
+			// includes match where the included policy passes
+			pass := &ipset.Set{}
+			spf.Includes[m.include].SPF.addresses(remaining, func(result string, s *ipset.Set) {
+				if result == "Pass" {
+					pass = pass.Union(s)
+				}
+			})
+			add(result, pass)
+			remaining = remaining.Difference(pass)
+		default:
+			matched := ipset.New(m.nets...).Intersect(remaining)
+			add(result, matched)
+			remaining = remaining.Difference(matched)
+		}
+	}
+
+	if spf.All == "undefined" && spf.Redirect != nil {
+		return spf.Redirect.addresses(remaining, add)
+	}
+	return remaining
+}
+
+// DynamicTerms returns the terms of the instance, its includes and its
+// redirect whose outcome isn't known before an evaluation, as
+// "domain: term": ptr and exists mechanisms, and terms with macros.
+func (spf *SPF) DynamicTerms() []string {
+	terms := make([]string, 0)
+	for _, directive := range spf.directives {
+		if directive.Mechanism == "ptr" || directive.Mechanism == "exists" || strings.Contains(directive.term, "%{") {
+			terms = append(terms, spf.Domain+": "+directive.term)
+		}
+	}
+	for _, modifier := range spf.modifiers {
+		if modifier.Key == "redirect" && strings.Contains(modifier.term, "%{") {
+			terms = append(terms, spf.Domain+": "+modifier.term)
+		}
+	}
+	for _, include := range spf.Includes {
+		terms = append(terms, include.SPF.DynamicTerms()...)
+	}
+	if spf.Redirect != nil {
+		terms = append(terms, spf.Redirect.DynamicTerms()...)
+	}
+	return terms
+}
+
+// PolicyDiff is the difference between two policies, see Compare.
+type PolicyDiff struct {
+	// Results are the results whose addresses changed, in the order Pass,
+	// Fail, SoftFail and Neutral.
+	Results []ResultDiff `json:"results"`
+	// OldLookups and NewLookups are the DNS lookup counts of the policies.
+	OldLookups int `json:"old_dns_lookups"`
+	NewLookups int `json:"new_dns_lookups"`
+	// AddedDynamic and RemovedDynamic are the dynamic terms (see
+	// DynamicTerms) only in the new and the old policy. Dynamic are the ones
+	// of both. The addresses they match can't be compared.
+	AddedDynamic   []string `json:"added_dynamic_terms"`
+	RemovedDynamic []string `json:"removed_dynamic_terms"`
+	Dynamic        []string `json:"dynamic_terms"`
+}
+
+// ResultDiff are the addresses that got or lost a result.
+type ResultDiff struct {
+	Result  string     `json:"result"`
+	Added   *ipset.Set `json:"added"`
+	Removed *ipset.Set `json:"removed"`
+}
+
+/*
+Compare returns the addresses that got or lost each result between the
+policies before and after, e.g. the published record and a new one:
+
+	before, _ := gospf.New("example.com", resolver)
+	after, _ := gospf.NewFromRecord("example.com", "v=spf1 ip4:192.0.2.0/24 -all", resolver)
+	diff := gospf.Compare(before, after)
+
+The addresses of the a and mx mechanisms are the ones they resolved to
+when the policies were loaded.
+*/
+func Compare(before *SPF, after *SPF) *PolicyDiff {
+	diff := &PolicyDiff{
+		Results:    make([]ResultDiff, 0),
+		OldLookups: before.DNSLookupCount(),
+		NewLookups: after.DNSLookupCount(),
+	}
+	old, changed := before.Addresses(), after.Addresses()
+	for _, result := range diffResults {
+		added, removed := changed[result].Difference(old[result]), old[result].Difference(changed[result])
+		if !added.IsEmpty() || !removed.IsEmpty() {
+			diff.Results = append(diff.Results, ResultDiff{Result: result, Added: added, Removed: removed})
+		}
+	}
+
+	oldDynamic, newDynamic := before.DynamicTerms(), after.DynamicTerms()
+	diff.AddedDynamic = missingTerms(newDynamic, oldDynamic)
+	diff.RemovedDynamic = missingTerms(oldDynamic, newDynamic)
+	diff.Dynamic = missingTerms(newDynamic, diff.AddedDynamic)
+	return diff
+}
+
+// missingTerms returns the terms of a that aren't in b.
+func missingTerms(a []string, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, term := range b {
+		in[term] = true
+	}
+	out := make([]string, 0)
+	for _, term := range a {
+		if !in[term] {
+			out = append(out, term)
+			in[term] = true
+		}
+	}
+	return out
+}
+
+// Changed reports whether the policies differ in their addresses, lookup
+// counts or dynamic terms.
+func (d *PolicyDiff) Changed() bool {
+	return len(d.Results) > 0 || d.OldLookups != d.NewLookups || len(d.AddedDynamic) > 0 || len(d.RemovedDynamic) > 0
+}
+
+func (d *PolicyDiff) String() string {
+	if !d.Changed() && len(d.Dynamic) == 0 {
+		return "no changes\n"
+	}
+	out := ""
+	for _, result := range d.Results {
+		out += result.Result + ":\n"
+		for _, r := range result.Added.Ranges() {
+			out += "  + " + r.String() + "\n"
+		}
+		for _, r := range result.Removed.Ranges() {
+			out += "  - " + r.String() + "\n"
+		}
+	}
+	if d.OldLookups != d.NewLookups {
+		out += fmt.Sprintf("DNS lookups: %v -> %v\n", d.OldLookups, d.NewLookups)
+	}
+	for _, term := range d.AddedDynamic {
+		out += "Dynamic term added: " + term + "\n"
+	}
+	for _, term := range d.RemovedDynamic {
+		out += "Dynamic term removed: " + term + "\n"
+	}
+	for _, term := range d.Dynamic {
+		out += "Dynamic term not compared: " + term + "\n"
+	}
+	return out
+}
+
+// DiffPolicies compares two policies of domain, given as records
+// ("v=spf1 ...") or as names of domains whose published policies are used,
+// see Compare. domain is only needed for records.
+func DiffPolicies(domain string, before string, after string, dnsResolver dns.DnsResolver, opts ...Option) (*PolicyDiff, error) {
+	load := func(policy string) (*SPF, error) {
+		if !IsRecord(policy) {
+			return New(policy, dnsResolver, opts...)
+		}
+		if domain == "" {
+			return nil, fmt.Errorf("a domain is needed to evaluate %q", policy)
+		}
+		return NewFromRecord(domain, policy, dnsResolver, opts...)
+	}
+	beforeSPF, err := load(before)
+	if err != nil {
+		return nil, err
+	}
+	afterSPF, err := load(after)
+	if err != nil {
+		return nil, err
+	}
+	return Compare(beforeSPF, afterSPF), nil
+}
+
+// IsRecord reports whether policy is an SPF record rather than a domain.
+func IsRecord(policy string) bool {
+	policy = strings.ToLower(policy)
+	return policy == "v=spf1" || strings.HasPrefix(policy, "v=spf1 ")
+}
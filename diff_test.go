@@ -0,0 +1,112 @@
+package gospf
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+const diffZone = `
+$ORIGIN example.com.
+@          TXT   "v=spf1 ip4:192.0.2.0/24 a include:_spf.esp.example ~all"
+           A     198.51.100.1
+_old       TXT   "v=spf1 redirect=example.com"
+$ORIGIN esp.example.
+_spf       TXT   "v=spf1 ip4:203.0.113.0/25 ip6:2001:db8::/32 exists:%{i}._ip.esp.example -all"
+_ip        A     127.0.0.2
+`
+
+func TestDiff(t *testing.T) {
+	Convey("Testing semantic diffs of policies", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(diffZone), ""), ShouldEqual, nil)
+
+		Convey("Addresses are grouped by result in evaluation order", func() {
+			spf, err := NewFromRecord("example.com", "v=spf1 -ip4:192.0.2.1 ip4:192.0.2.0/30 ?ip4:192.0.2.0/29", z)
+			So(err, ShouldEqual, nil)
+			addresses := spf.Addresses()
+			So(addresses["Fail"].String(), ShouldEqual, "192.0.2.1/32")
+			So(addresses["Pass"].String(), ShouldEqual, "192.0.2.0/32 192.0.2.2/31")
+			_, neutral, _ := net.ParseCIDR("192.0.2.4/30")
+			So(addresses["Neutral"].ContainsNet(*neutral), ShouldEqual, true)
+			// addresses that match no mechanism are neutral too
+			So(addresses["Neutral"].Contains([]byte{192, 0, 2, 8}), ShouldEqual, true)
+			So(addresses["SoftFail"].IsEmpty(), ShouldEqual, true)
+			_, ok := addresses["None"]
+			So(ok, ShouldEqual, false)
+
+			for _, ip := range []string{"192.0.2.0", "192.0.2.1", "192.0.2.5", "192.0.2.8"} {
+				result, err := spf.CheckIP(ip)
+				So(err, ShouldEqual, nil)
+				So(addresses[result].Contains(net.ParseIP(ip)), ShouldEqual, true)
+			}
+		})
+
+		Convey("Moving a term changes the result of its addresses", func() {
+			diff, err := DiffPolicies("example.com", "v=spf1 ip4:192.0.2.0/24 -ip4:192.0.2.1 -all", "v=spf1 -ip4:192.0.2.1 ip4:192.0.2.0/24 -all", z)
+			So(err, ShouldEqual, nil)
+			So(diff.Changed(), ShouldEqual, true)
+			So(diff.String(), ShouldEqual, `Pass:
+  - 192.0.2.1/32
+Fail:
+  + 192.0.2.1/32
+`)
+		})
+
+		Convey("Policies of domains and records are compared", func() {
+			diff, err := DiffPolicies("example.com", "example.com", "v=spf1 ip4:192.0.2.0/25 ip4:198.51.100.1 -all", z)
+			So(err, ShouldEqual, nil)
+			So(diff.Changed(), ShouldEqual, true)
+			So(len(diff.Results), ShouldEqual, 3)
+			So(diff.Results[0].Result, ShouldEqual, "Pass")
+			So(diff.Results[0].Added.String(), ShouldEqual, "")
+			So(diff.Results[0].Removed.String(), ShouldEqual, "192.0.2.128/25 203.0.113.0/25 2001:db8::/32")
+			So(diff.Results[1].Result, ShouldEqual, "Fail")
+			So(diff.Results[2].Result, ShouldEqual, "SoftFail")
+			So(diff.OldLookups, ShouldEqual, 3)
+			So(diff.NewLookups, ShouldEqual, 0)
+			So(diff.RemovedDynamic, ShouldResemble, []string{"_spf.esp.example: exists:%{i}._ip.esp.example"})
+			So(diff.String(), ShouldContainSubstring, "DNS lookups: 3 -> 0\n")
+
+			diff, err = DiffPolicies("", "_old.example.com", "example.com", z)
+			So(err, ShouldEqual, nil)
+			So(diff.Results, ShouldBeEmpty)
+			So(diff.OldLookups, ShouldEqual, 4)
+			So(diff.Changed(), ShouldEqual, true)
+			So(diff.Dynamic, ShouldResemble, []string{"_spf.esp.example: exists:%{i}._ip.esp.example"})
+
+			_, err = DiffPolicies("", "example.com", "v=spf1 -all", z)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Added and removed ranges are reported per result", func() {
+			diff, err := DiffPolicies("example.com",
+				"v=spf1 ip4:192.0.2.0/24 ~ip4:198.51.100.0/24 -all",
+				"v=spf1 ip4:192.0.2.0/25 ip4:192.0.2.128/25 ip4:203.0.113.7 ~ip4:198.51.100.0/25 ptr -all", z)
+			So(err, ShouldEqual, nil)
+			So(diff.String(), ShouldEqual, `Pass:
+  + 203.0.113.7/32
+Fail:
+  + 198.51.100.128/25
+  - 203.0.113.7/32
+SoftFail:
+  - 198.51.100.128/25
+DNS lookups: 0 -> 1
+Dynamic term added: example.com: ptr
+`)
+			data, err := json.Marshal(diff)
+			So(err, ShouldEqual, nil)
+			So(string(data), ShouldContainSubstring, `{"result":"Pass","added":["203.0.113.7/32"],"removed":[]}`)
+
+			diff, err = DiffPolicies("example.com", "v=spf1 ip4:192.0.2.0/24 -all", "v=spf1 ip4:192.0.2.0/25 ip4:192.0.2.128/25 -all", z)
+			So(err, ShouldEqual, nil)
+			So(diff.Changed(), ShouldEqual, false)
+			So(diff.String(), ShouldEqual, "no changes\n")
+		})
+	})
+}
@@ -0,0 +1,100 @@
+// Package dmarc checks whether SPF results are aligned with the RFC 5322
+// From domain of a message, as DMARC requires (RFC 7489 § 3.1.2).
+//
+//	result, err := gospf.Check(ip, sender, helo, resolver)
+//	if err == nil && dmarc.SPFAlignment(result, fromDomain).Aligned(dmarc.Relaxed) {
+//		// SPF passes DMARC
+//	}
+//
+// Organizational domains are computed with the Public Suffix List; an
+// embedded snapshot is used by default, so no network access is needed.
+package dmarc
+
+import (
+	"github.com/mistralmail/gospf"
+)
+
+// Alignment is the alignment of an SPF-authenticated domain with the From domain.
+type Alignment int
+
+const (
+	// NotAligned means SPF didn't pass or the domains differ.
+	NotAligned Alignment = iota
+	// RelaxedAlignment means the domains have the same organizational domain.
+	RelaxedAlignment
+	// StrictAlignment means the domains are identical.
+	StrictAlignment
+)
+
+func (a Alignment) String() string {
+	switch a {
+	case RelaxedAlignment:
+		return "relaxed"
+	case StrictAlignment:
+		return "strict"
+	}
+	return "none"
+}
+
+// Mode is the SPF alignment mode of a DMARC policy, the value of its aspf tag.
+type Mode string
+
+const (
+	// Relaxed mode accepts domains with the same organizational domain (the default).
+	Relaxed Mode = "r"
+	// Strict mode only accepts identical domains.
+	Strict Mode = "s"
+)
+
+// Aligned reports whether a satisfies the mode.
+func (a Alignment) Aligned(mode Mode) bool {
+	if mode == Strict {
+		return a == StrictAlignment
+	}
+	return a != NotAligned
+}
+
+// SPFAlignment returns the alignment of an SPF check result with the domain
+// of the RFC 5322 From header, using the embedded Public Suffix List.
+func SPFAlignment(result *gospf.Result, fromDomain string) Alignment {
+	return Default().SPFAlignment(result, fromDomain)
+}
+
+// OrganizationalDomain returns the organizational domain of domain, using
+// the embedded Public Suffix List. See List.OrganizationalDomain.
+func OrganizationalDomain(domain string) string {
+	return Default().OrganizationalDomain(domain)
+}
+
+// SPFAlignment returns the alignment of an SPF check result with the domain
+// of the RFC 5322 From header. Only a Pass result authenticates a domain: the
+// MAIL FROM domain, or the HELO domain when the reverse-path is null.
+func (l *List) SPFAlignment(result *gospf.Result, fromDomain string) Alignment {
+	if result == nil || result.Result != "Pass" {
+		return NotAligned
+	}
+	return l.Alignment(result.Domain, fromDomain)
+}
+
+// Alignment returns the alignment of an authenticated domain with the From domain.
+func (l *List) Alignment(domain string, fromDomain string) Alignment {
+	a, ok := toASCII(trimDot(domain))
+	b, ok2 := toASCII(trimDot(fromDomain))
+	if !ok || !ok2 || a == "" || b == "" {
+		return NotAligned
+	}
+	if a == b {
+		return StrictAlignment
+	}
+	if org := l.OrganizationalDomain(a); org != "" && org == l.OrganizationalDomain(b) {
+		return RelaxedAlignment
+	}
+	return NotAligned
+}
+
+func trimDot(domain string) string {
+	if len(domain) > 0 && domain[len(domain)-1] == '.' {
+		return domain[:len(domain)-1]
+	}
+	return domain
+}
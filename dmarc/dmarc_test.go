@@ -0,0 +1,43 @@
+package dmarc
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf"
+)
+
+func TestSPFAlignment(t *testing.T) {
+	Convey("Testing SPFAlignment", t, func() {
+		tests := []struct {
+			result     string
+			domain     string
+			fromDomain string
+			want       Alignment
+		}{
+			{"Pass", "example.com", "example.com", StrictAlignment},
+			{"Pass", "Example.com.", "example.COM", StrictAlignment},
+			{"Pass", "bounces.example.com", "example.com", RelaxedAlignment},
+			{"Pass", "bounces.example.co.uk", "news.example.co.uk", RelaxedAlignment},
+			{"Pass", "example.co.uk", "other.co.uk", NotAligned},
+			{"Pass", "mail.example.org", "example.com", NotAligned},
+			{"Pass", "a.blogspot.com", "b.blogspot.com", NotAligned},
+			{"Pass", "bounces.xn--85x722f.xn--fiqs8s", "食狮.中国", RelaxedAlignment},
+			{"SoftFail", "example.com", "example.com", NotAligned},
+			{"Pass", "example.com", "", NotAligned},
+		}
+		for _, test := range tests {
+			result := &gospf.Result{Result: test.result, Domain: test.domain}
+			So(SPFAlignment(result, test.fromDomain), ShouldEqual, test.want)
+		}
+		So(SPFAlignment(nil, "example.com"), ShouldEqual, NotAligned)
+
+		So(StrictAlignment.Aligned(Strict), ShouldEqual, true)
+		So(RelaxedAlignment.Aligned(Strict), ShouldEqual, false)
+		So(RelaxedAlignment.Aligned(Relaxed), ShouldEqual, true)
+		So(NotAligned.Aligned(Relaxed), ShouldEqual, false)
+		So(RelaxedAlignment.String(), ShouldEqual, "relaxed")
+		So(OrganizationalDomain("www.example.co.uk"), ShouldEqual, "example.co.uk")
+	})
+}
@@ -0,0 +1,94 @@
+//go:build ignore
+// +build ignore
+
+// gen_psl writes psl_data.go, the Public Suffix List snapshot of the dmarc
+// package, from the list at -in (a URL or a file). Run it with go generate.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	in := flag.String("in", "https://publicsuffix.org/list/public_suffix_list.dat", "URL or path of the Public Suffix List")
+	out := flag.String("out", "psl_data.go", "output file")
+	flag.Parse()
+
+	list, date, err := open(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer list.Close()
+
+	rules := make([]string, 0)
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		// only the first word of a line is the rule
+		rules = append(rules, strings.Fields(line)[0])
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if len(rules) == 0 {
+		log.Fatalf("no rules in %v", *in)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by gen_psl.go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package dmarc\n\n")
+	fmt.Fprintf(&buf, "// SnapshotDate is the date of the embedded Public Suffix List snapshot.\n")
+	fmt.Fprintf(&buf, "const SnapshotDate = %q\n\n", date.UTC().Format("2006-01-02"))
+	fmt.Fprintf(&buf, "// pslSnapshot holds the rules of the Public Suffix List, one per line.\n")
+	fmt.Fprintf(&buf, "const pslSnapshot = `\n%v\n`\n", strings.Join(rules, "\n"))
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// open opens the list and returns its modification date.
+func open(in string) (io.ReadCloser, time.Time, error) {
+	if strings.HasPrefix(in, "http://") || strings.HasPrefix(in, "https://") {
+		resp, err := http.Get(in)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, time.Time{}, fmt.Errorf("GET %v: %v", in, resp.Status)
+		}
+		date, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+		if err != nil {
+			date = time.Now()
+		}
+		return resp.Body, date, nil
+	}
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	return f, info.ModTime(), nil
+}
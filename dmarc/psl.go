@@ -0,0 +1,259 @@
+package dmarc
+
+//go:generate go run gen_psl.go -out psl_data.go
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// rule flags of a name in a List
+const (
+	ruleNormal    = 1 << iota // e.g. "co.uk"
+	ruleWildcard              // "*.<name>", e.g. "*.ck"
+	ruleException             // "!<name>", e.g. "!www.ck"
+)
+
+// List is a Public Suffix List (https://publicsuffix.org), used to find the
+// organizational domain of a domain. Rules and domains in Unicode are
+// converted to their ASCII (punycode) form. A List is safe for concurrent use.
+type List struct {
+	rules map[string]int
+}
+
+var (
+	defaultOnce sync.Once
+	defaultList *List
+)
+
+// Default returns the List of the embedded snapshot (see SnapshotDate).
+// Run go generate in this package to update the snapshot, or use
+// ParseList or LoadList to use a newer list at runtime.
+func Default() *List {
+	defaultOnce.Do(func() {
+		list, err := ParseList(strings.NewReader(pslSnapshot))
+		if err != nil {
+			panic(err)
+		}
+		defaultList = list
+	})
+	return defaultList
+}
+
+// ParseList parses a list in the format of public_suffix_list.dat.
+func ParseList(r io.Reader) (*List, error) {
+	l := &List{rules: make(map[string]int)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule, flag := fields[0], ruleNormal
+		if strings.HasPrefix(rule, "!") {
+			rule, flag = rule[1:], ruleException
+		} else if strings.HasPrefix(rule, "*.") {
+			rule, flag = rule[2:], ruleWildcard
+		}
+		name, ok := toASCII(rule)
+		if !ok {
+			return nil, fmt.Errorf("invalid rule %q on line %v", fields[0], line)
+		}
+		l.rules[name] |= flag
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// LoadList reads a list from the file at path, see ParseList.
+func LoadList(path string) (*List, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseList(f)
+}
+
+// PublicSuffix returns the public suffix of domain, e.g. "co.uk" for
+// "www.example.co.uk". Names that aren't on the list are their own public
+// suffix ("*" rule). It returns "" for invalid domains.
+func (l *List) PublicSuffix(domain string) string {
+	labels, ok := splitDomain(domain)
+	if !ok {
+		return ""
+	}
+	return strings.Join(labels[len(labels)-l.suffixLength(labels):], ".")
+}
+
+// OrganizationalDomain returns the organizational domain of domain as defined
+// by RFC 7489 § 3.2: its public suffix with one more label, e.g. "example.co.uk"
+// for "www.example.co.uk". A public suffix is its own organizational domain.
+// It returns "" for invalid domains.
+func (l *List) OrganizationalDomain(domain string) string {
+	labels, ok := splitDomain(domain)
+	if !ok {
+		return ""
+	}
+	n := l.suffixLength(labels) + 1
+	if n > len(labels) {
+		n = len(labels)
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// suffixLength returns the number of labels of the public suffix.
+func (l *List) suffixLength(labels []string) int {
+	// the prevailing rule is an exception rule, or the one with the most labels
+	length := 1 // the implicit "*" rule
+	for i := range labels {
+		flags := l.rules[strings.Join(labels[i:], ".")]
+		if flags&ruleException != 0 {
+			return len(labels) - i - 1
+		}
+		n := len(labels) - i
+		if flags&ruleNormal != 0 && n > length {
+			length = n
+		}
+		if i > 0 && flags&ruleWildcard != 0 && n+1 > length {
+			length = n + 1
+		}
+	}
+	return length
+}
+
+// splitDomain returns the labels of domain in lower case ASCII.
+func splitDomain(domain string) ([]string, bool) {
+	name, ok := toASCII(strings.TrimSuffix(domain, "."))
+	if !ok || name == "" {
+		return nil, false
+	}
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if label == "" {
+			return nil, false
+		}
+	}
+	return labels, true
+}
+
+// toASCII lowercases name and converts its Unicode labels to punycode (RFC 3492).
+// Unlike IDNA it doesn't normalize or validate the labels.
+func toASCII(name string) (string, bool) {
+	if !utf8.ValidString(name) {
+		return "", false
+	}
+	labels := strings.Split(strings.ToLower(name), ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			labels[i] = "xn--" + punycode(label)
+		}
+	}
+	return strings.Join(labels, "."), true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punycode parameters of RFC 3492 § 5
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// punycode encodes label as described in RFC 3492 § 6.3.
+func punycode(label string) string {
+	runes := []rune(label)
+	out := make([]byte, 0, 2*len(runes))
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(runes) {
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta int, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
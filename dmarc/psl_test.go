@@ -0,0 +1,72 @@
+package dmarc
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPunycode(t *testing.T) {
+	Convey("Testing punycode", t, func() {
+		tests := map[string]string{
+			"中国":            "fiqs8s",
+			"食狮":            "85x722f",
+			"公司":            "55qx5d",
+			"bücher":        "bcher-kva",
+			"münchen":       "mnchen-3ya",
+			"правительство": "80aealotwbjpid2k",
+		}
+		for label, want := range tests {
+			So(punycode(label), ShouldEqual, want)
+		}
+	})
+}
+
+func TestList(t *testing.T) {
+	Convey("Testing the Public Suffix List", t, func() {
+		l := Default()
+
+		tests := []struct {
+			domain string
+			suffix string
+			org    string
+		}{
+			{"com", "com", "com"},
+			{"example.com", "com", "example.com"},
+			{"a.b.Example.COM.", "com", "example.com"},
+			{"www.example.co.uk", "co.uk", "example.co.uk"},
+			{"example.example", "example", "example.example"},
+			{"www.test.ac.jp", "ac.jp", "test.ac.jp"},
+			// wildcard and exception rules: *.kobe.jp, !city.kobe.jp
+			{"c.kobe.jp", "c.kobe.jp", "c.kobe.jp"},
+			{"b.c.kobe.jp", "c.kobe.jp", "b.c.kobe.jp"},
+			{"city.kobe.jp", "kobe.jp", "city.kobe.jp"},
+			{"www.city.kobe.jp", "kobe.jp", "city.kobe.jp"},
+			// *.ck, !www.ck
+			{"www.www.ck", "ck", "www.ck"},
+			{"b.test.ck", "test.ck", "b.test.ck"},
+			// private domains
+			{"foo.blogspot.com", "blogspot.com", "foo.blogspot.com"},
+			// internationalized domains
+			{"www.食狮.中国", "xn--fiqs8s", "xn--85x722f.xn--fiqs8s"},
+			{"www.xn--85x722f.xn--fiqs8s", "xn--fiqs8s", "xn--85x722f.xn--fiqs8s"},
+			{"shishi.公司.cn", "xn--55qx5d.cn", "shishi.xn--55qx5d.cn"},
+			{"", "", ""},
+			{"a..example.com", "", ""},
+		}
+		for _, test := range tests {
+			So(l.PublicSuffix(test.domain), ShouldEqual, test.suffix)
+			So(l.OrganizationalDomain(test.domain), ShouldEqual, test.org)
+		}
+
+		l, err := ParseList(strings.NewReader("// comment\nexample\n*.example\n!www.test.example\n"))
+		So(err, ShouldEqual, nil)
+		So(l.OrganizationalDomain("a.b.c.example"), ShouldEqual, "b.c.example")
+		So(l.OrganizationalDomain("a.www.test.example"), ShouldEqual, "www.test.example")
+		So(l.OrganizationalDomain("a.example.com"), ShouldEqual, "example.com")
+
+		_, err = LoadList("testdata/nonexistent.dat")
+		So(err, ShouldNotEqual, nil)
+	})
+}
@@ -0,0 +1,258 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCacheTTL is the time answers are cached by a CachingResolver
+// when no TTL is set.
+const DefaultCacheTTL = 5 * time.Minute
+
+// DefaultCacheSize is the max number of answers a CachingResolver keeps
+// when no size is set.
+const DefaultCacheSize = 10000
+
+type cacheEntry struct {
+	value   interface{}
+	err     error
+	expires time.Time
+	ttl     bool // whether expires is based on the TTL of the answer
+}
+
+// flight is a query in progress, done is closed once its answer is available.
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	ttl   time.Duration
+	err   error
+}
+
+// CachingResolver is a DnsResolver that caches the answers of another
+// DnsResolver, so it can be shared by the checks of a long running service.
+// Answers and definitive errors (not found, no or multiple SPF records) are
+// cached, temporary errors are not. Concurrent identical queries that miss
+// the cache are sent only once and share the answer, including a temporary
+// error; when the query panics, the others get an error. When Resolver is a
+// TTLResolver, answers are cached for their TTL if it's lower than the TTL
+// of the cache, and the CachingResolver returns the remaining TTL as
+// TTLResolver. A CachingResolver is safe for concurrent use.
+type CachingResolver struct {
+	Resolver DnsResolver
+	// TTL is the time answers are cached, DefaultCacheTTL when zero.
+	TTL time.Duration
+	// Size is the max number of cached answers, DefaultCacheSize when zero.
+	Size int
+
+	hits   int64 // accessed atomically
+	misses int64 // accessed atomically
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	flights map[string]*flight // queries in progress
+	now     func() time.Time
+}
+
+// NewCachingResolver creates a CachingResolver caching the answers of resolver for ttl.
+func NewCachingResolver(resolver DnsResolver, ttl time.Duration) *CachingResolver {
+	return &CachingResolver{Resolver: resolver, TTL: ttl}
+}
+
+// Stats returns the number of cache hits and misses so far. Queries that
+// waited for the answer of an identical query in progress count as hits.
+func (c *CachingResolver) Stats() (hits int64, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+// Flush removes all cached answers.
+func (c *CachingResolver) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+func (c *CachingResolver) GetSPFRecord(name string) (string, error) {
+	record, _, err := c.GetSPFRecordTTL(name)
+	return record, err
+}
+
+func (c *CachingResolver) GetSPFRecordTTL(name string) (string, time.Duration, error) {
+	value, ttl, err := c.lookup("SPF", name, func() (interface{}, time.Duration, error) {
+		if r, ok := c.Resolver.(TTLResolver); ok {
+			return r.GetSPFRecordTTL(name)
+		}
+		record, err := c.Resolver.GetSPFRecord(name)
+		return record, NoTTL, err
+	})
+	record, _ := value.(string)
+	return record, ttl, err
+}
+
+func (c *CachingResolver) GetARecords(name string) ([]string, error) {
+	ips, _, err := c.GetARecordsTTL(name)
+	return ips, err
+}
+
+func (c *CachingResolver) GetARecordsTTL(name string) ([]string, time.Duration, error) {
+	value, ttl, err := c.lookup("A", name, func() (interface{}, time.Duration, error) {
+		if r, ok := c.Resolver.(TTLResolver); ok {
+			return r.GetARecordsTTL(name)
+		}
+		ips, err := c.Resolver.GetARecords(name)
+		return ips, NoTTL, err
+	})
+	ips, _ := value.([]string)
+	return ips, ttl, err
+}
+
+func (c *CachingResolver) GetAAAARecords(name string) ([]string, error) {
+	ips, _, err := c.GetAAAARecordsTTL(name)
+	return ips, err
+}
+
+func (c *CachingResolver) GetAAAARecordsTTL(name string) ([]string, time.Duration, error) {
+	value, ttl, err := c.lookup("AAAA", name, func() (interface{}, time.Duration, error) {
+		if r, ok := c.Resolver.(TTLResolver); ok {
+			return r.GetAAAARecordsTTL(name)
+		}
+		ips, err := c.Resolver.GetAAAARecords(name)
+		return ips, NoTTL, err
+	})
+	ips, _ := value.([]string)
+	return ips, ttl, err
+}
+
+func (c *CachingResolver) GetMXRecords(name string) ([]*net.MX, error) {
+	mxs, _, err := c.GetMXRecordsTTL(name)
+	return mxs, err
+}
+
+func (c *CachingResolver) GetMXRecordsTTL(name string) ([]*net.MX, time.Duration, error) {
+	value, ttl, err := c.lookup("MX", name, func() (interface{}, time.Duration, error) {
+		if r, ok := c.Resolver.(TTLResolver); ok {
+			return r.GetMXRecordsTTL(name)
+		}
+		mxs, err := c.Resolver.GetMXRecords(name)
+		return mxs, NoTTL, err
+	})
+	mxs, _ := value.([]*net.MX)
+	return mxs, ttl, err
+}
+
+func (c *CachingResolver) GetPTRRecords(addr string) ([]string, error) {
+	value, _, err := c.lookup("PTR", addr, func() (interface{}, time.Duration, error) {
+		names, err := c.Resolver.GetPTRRecords(addr)
+		return names, NoTTL, err
+	})
+	names, _ := value.([]string)
+	return names, err
+}
+
+// lookup returns the cached answer of the query and its remaining TTL, or calls
+// query and caches its answer. The returned slices are shared between callers
+// and must not be modified.
+func (c *CachingResolver) lookup(qtype string, name string, query func() (interface{}, time.Duration, error)) (interface{}, time.Duration, error) {
+	key := qtype + " " + strings.ToLower(strings.TrimSuffix(name, "."))
+	now := c.clock()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && now.Before(entry.expires) {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		if !entry.ttl {
+			return entry.value, NoTTL, entry.err
+		}
+		return entry.value, entry.expires.Sub(now), entry.err
+	}
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		<-f.done
+		return f.value, f.ttl, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	if c.flights == nil {
+		c.flights = make(map[string]*flight)
+	}
+	c.flights[key] = f
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	// a panicking query is an error for the queries waiting for it, and
+	// isn't cached
+	defer func() {
+		if r := recover(); r != nil {
+			f.value, f.ttl, f.err = nil, NoTTL, fmt.Errorf("%v query of %v panicked: %v", qtype, name, r)
+			c.mu.Lock()
+			delete(c.flights, key)
+			c.mu.Unlock()
+			close(f.done)
+			panic(r)
+		}
+	}()
+	f.value, f.ttl, f.err = query()
+
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	if f.ttl >= 0 && f.ttl < ttl {
+		ttl = f.ttl
+	} else if f.ttl >= 0 {
+		f.ttl = ttl
+	}
+	c.mu.Lock()
+	delete(c.flights, key)
+	if f.err == nil || isDefinitive(f.err) {
+		if c.entries == nil {
+			c.entries = make(map[string]cacheEntry)
+		}
+		c.evict(now)
+		c.entries[key] = cacheEntry{value: f.value, err: f.err, expires: now.Add(ttl), ttl: f.ttl >= 0}
+	}
+	c.mu.Unlock()
+	close(f.done)
+	return f.value, f.ttl, f.err
+}
+
+// evict makes room for a new entry, first by removing the expired entries
+// and then arbitrary ones. c.mu must be held.
+func (c *CachingResolver) evict(now time.Time) {
+	size := c.Size
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	if len(c.entries) < size {
+		return
+	}
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < size {
+			return
+		}
+		delete(c.entries, key)
+	}
+}
+
+func (c *CachingResolver) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// isDefinitive reports whether err is an answer of the DNS rather than a
+// failure to get one, so it can be cached.
+func isDefinitive(err error) bool {
+	return IsNotFound(err) || errors.Is(err, ErrNoSPFRecord) || errors.Is(err, ErrMultipleSPFRecords)
+}
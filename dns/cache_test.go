@@ -0,0 +1,231 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// countingResolver counts the queries that reach the wrapped resolver.
+type countingResolver struct {
+	*ZoneResolver
+	queries int
+}
+
+func (c *countingResolver) GetSPFRecordTTL(name string) (string, time.Duration, error) {
+	c.queries++
+	return c.ZoneResolver.GetSPFRecordTTL(name)
+}
+
+func (c *countingResolver) GetARecordsTTL(name string) ([]string, time.Duration, error) {
+	c.queries++
+	return c.ZoneResolver.GetARecordsTTL(name)
+}
+
+func (c *countingResolver) GetMXRecordsTTL(name string) ([]*net.MX, time.Duration, error) {
+	c.queries++
+	return c.ZoneResolver.GetMXRecordsTTL(name)
+}
+
+// blockingResolver blocks the queries until release is closed, then
+// answers or panics.
+type blockingResolver struct {
+	DnsResolver
+	release chan struct{}
+	panics  int32 // accessed atomically
+	queries int32 // accessed atomically
+}
+
+func (b *blockingResolver) GetSPFRecord(name string) (string, error) {
+	atomic.AddInt32(&b.queries, 1)
+	<-b.release
+	if atomic.LoadInt32(&b.panics) != 0 {
+		panic("resolver bug")
+	}
+	return b.DnsResolver.GetSPFRecord(name)
+}
+
+func TestCachingResolver(t *testing.T) {
+
+	Convey("Testing CachingResolver", t, func() {
+
+		z := NewZoneResolver()
+		So(z.Load(strings.NewReader(`
+$ORIGIN example.com.
+@     TXT "v=spf1 mx -all"
+      MX  10 mx1
+mx1   A   192.0.2.10
+`), ""), ShouldEqual, nil)
+		counting := &countingResolver{ZoneResolver: z}
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := NewCachingResolver(counting, time.Minute)
+		c.now = func() time.Time { return now }
+
+		Convey("Answers are cached until they expire", func() {
+			for i := 0; i < 3; i++ {
+				record, err := c.GetSPFRecord("example.com")
+				So(err, ShouldEqual, nil)
+				So(record, ShouldEqual, "v=spf1 mx -all")
+			}
+			mxs, err := c.GetMXRecords("EXAMPLE.com.")
+			So(err, ShouldEqual, nil)
+			So(len(mxs), ShouldEqual, 1)
+			_, err = c.GetMXRecords("example.com")
+			So(err, ShouldEqual, nil)
+			So(counting.queries, ShouldEqual, 2)
+
+			hits, misses := c.Stats()
+			So(hits, ShouldEqual, 3)
+			So(misses, ShouldEqual, 2)
+
+			now = now.Add(time.Minute)
+			_, err = c.GetSPFRecord("example.com")
+			So(err, ShouldEqual, nil)
+			So(counting.queries, ShouldEqual, 3)
+
+			c.Flush()
+			_, err = c.GetSPFRecord("example.com")
+			So(err, ShouldEqual, nil)
+			So(counting.queries, ShouldEqual, 4)
+		})
+
+		Convey("Not found answers are cached, failures are not", func() {
+			_, err := c.GetARecords("nonexistent.example.com")
+			So(IsNotFound(err), ShouldEqual, true)
+			_, err = c.GetARecords("nonexistent.example.com")
+			So(IsNotFound(err), ShouldEqual, true)
+			So(counting.queries, ShouldEqual, 1)
+
+			z.Fail("mx1.example.com", ServFail)
+			_, err = c.GetARecords("mx1.example.com")
+			So(err, ShouldNotEqual, nil)
+			So(IsNotFound(err), ShouldEqual, false)
+			z.ClearFailures()
+			ips, err := c.GetARecords("mx1.example.com")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"192.0.2.10"})
+			So(counting.queries, ShouldEqual, 3)
+		})
+
+		Convey("Answers are cached for their TTL", func() {
+			So(z.AddRecord("short.example.com", "A", 30, "192.0.2.20"), ShouldEqual, nil)
+			ips, ttl, err := c.GetARecordsTTL("short.example.com")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"192.0.2.20"})
+			So(ttl, ShouldEqual, 30*time.Second)
+
+			now = now.Add(10 * time.Second)
+			_, ttl, err = c.GetARecordsTTL("short.example.com")
+			So(err, ShouldEqual, nil)
+			So(ttl, ShouldEqual, 20*time.Second)
+			So(counting.queries, ShouldEqual, 1)
+
+			_, ttl, err = c.GetMXRecordsTTL("example.com")
+			So(err, ShouldEqual, nil)
+			So(ttl, ShouldEqual, time.Minute) // capped by the cache TTL
+
+			now = now.Add(20 * time.Second)
+			_, _, err = c.GetARecordsTTL("short.example.com")
+			So(err, ShouldEqual, nil)
+			So(counting.queries, ShouldEqual, 3)
+
+			_, ttl, err = c.GetARecordsTTL("nonexistent.example.com")
+			So(IsNotFound(err), ShouldEqual, true)
+			So(ttl, ShouldEqual, NoTTL)
+		})
+
+		Convey("The cache size is limited", func() {
+			c.Size = 2
+			for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+				c.GetARecords(name)
+			}
+			So(len(c.entries), ShouldEqual, 2)
+		})
+
+		Convey("Concurrent identical queries are sent once", func() {
+			blocking := &blockingResolver{DnsResolver: z, release: make(chan struct{})}
+			c := NewCachingResolver(blocking, time.Minute)
+
+			var wg sync.WaitGroup
+			records := make([]string, 10)
+			errs := make([]error, 10)
+			for i := range records {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					records[i], errs[i] = c.GetSPFRecord("example.com")
+				}(i)
+			}
+			for {
+				hits, misses := c.Stats()
+				if hits+misses == 10 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			close(blocking.release)
+			wg.Wait()
+
+			So(atomic.LoadInt32(&blocking.queries), ShouldEqual, 1)
+			for i := range records {
+				So(errs[i], ShouldEqual, nil)
+				So(records[i], ShouldEqual, "v=spf1 mx -all")
+			}
+			hits, misses := c.Stats()
+			So(hits, ShouldEqual, 9)
+			So(misses, ShouldEqual, 1)
+		})
+
+		Convey("A panicking query fails the identical queries waiting for it", func() {
+			blocking := &blockingResolver{DnsResolver: z, release: make(chan struct{}), panics: 1}
+			c := NewCachingResolver(blocking, time.Minute)
+
+			var wg sync.WaitGroup
+			errs := make([]error, 10)
+			recovered := make([]interface{}, 10)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					defer func() {
+						recovered[i] = recover()
+					}()
+					_, errs[i] = c.GetSPFRecord("example.com")
+				}(i)
+			}
+			for {
+				hits, misses := c.Stats()
+				if hits+misses == 10 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			close(blocking.release)
+			wg.Wait()
+
+			panicked := 0
+			for i := range errs {
+				if recovered[i] != nil {
+					So(recovered[i], ShouldEqual, "resolver bug")
+					panicked++
+					continue
+				}
+				So(errs[i], ShouldNotEqual, nil)
+				So(errs[i].Error(), ShouldEqual, "SPF query of example.com panicked: resolver bug")
+			}
+			So(panicked, ShouldEqual, 1)
+
+			// the failure isn't cached
+			atomic.StoreInt32(&blocking.panics, 0)
+			record, err := c.GetSPFRecord("example.com")
+			So(err, ShouldEqual, nil)
+			So(record, ShouldEqual, "v=spf1 mx -all")
+			So(atomic.LoadInt32(&blocking.queries), ShouldEqual, 2)
+		})
+	})
+}
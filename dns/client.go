@@ -0,0 +1,722 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultClientTimeout is the time a server has to answer a query of a Client.
+const DefaultClientTimeout = 5 * time.Second
+
+// DefaultClientAttempts is the number of times a Client sends a query to
+// each server before giving up.
+const DefaultClientAttempts = 2
+
+// The configuration files of the system resolver, variables for the tests.
+var (
+	resolvConfPath = "/etc/resolv.conf"
+	hostsPath      = "/etc/hosts"
+)
+
+// Record types and classes of the queries of a Client (RFC 1035 § 3.2.2, RFC 3596).
+const (
+	typeA     uint16 = 1
+	typeCNAME uint16 = 5
+	typePTR   uint16 = 12
+	typeMX    uint16 = 15
+	typeTXT   uint16 = 16
+	typeAAAA  uint16 = 28
+	typeOPT   uint16 = 41
+	classINET uint16 = 1
+)
+
+// Header flags and response codes (RFC 1035 § 4.1.1).
+const (
+	flagResponse   uint16 = 1 << 15
+	flagTruncated  uint16 = 1 << 9
+	flagRecursion  uint16 = 1 << 8
+	rcodeSuccess          = 0
+	rcodeServFail         = 2
+	rcodeNameError        = 3
+)
+
+// ednsPayloadSize is the UDP payload size advertised in queries, the size
+// recommended to avoid IP fragmentation.
+const ednsPayloadSize = 1232
+
+// optRecordLength is the length of the OPT record ending the queries.
+const optRecordLength = 11
+
+var errMalformed = errors.New("malformed DNS message")
+
+// Client is a TTLResolver that sends its queries to recursive resolvers
+// itself, so it knows the TTLs of the answers the Go resolver doesn't expose.
+// Use it below a CachingResolver or with a gospf.PolicyCache, which then
+// keep the answers for as long as the DNS allows.
+//
+// Queries are sent over UDP, retried over TCP when the answer is truncated,
+// and sent to the servers in turn, Attempts times, until one answers. Names
+// are always absolute, so the search domains and ndots of resolv.conf don't
+// apply. A Client is safe for concurrent use.
+type Client struct {
+	// Servers are the addresses of the recursive resolvers, "host" or
+	// "host:port", tried in order. When empty, the system configuration is
+	// used: the nameservers and the attempts, timeout and rotate options of
+	// /etc/resolv.conf, and the names of /etc/hosts for A, AAAA and PTR
+	// queries, like the Go resolver. It's read once, at the first query.
+	Servers []string
+	// Timeout is the time a server has to answer, DefaultClientTimeout when zero.
+	Timeout time.Duration
+	// Attempts is the number of times each server is queried,
+	// DefaultClientAttempts when zero.
+	Attempts int
+	// Rotate spreads the queries over the servers instead of always
+	// querying the first one first.
+	Rotate bool
+
+	next   uint32 // first server of the next query with Rotate, accessed atomically
+	once   sync.Once
+	system clientConfig
+	hosts  hostsTable
+}
+
+// NewClient creates a Client querying servers, or using the system
+// configuration when none are given.
+func NewClient(servers ...string) *Client {
+	return &Client{Servers: servers}
+}
+
+// clientConfig is the resolver configuration of a Client.
+type clientConfig struct {
+	servers  []string
+	timeout  time.Duration
+	attempts int
+	rotate   bool
+}
+
+// config returns the configuration of the Client, completed with the system
+// configuration when it has no servers.
+func (c *Client) config() clientConfig {
+	config := clientConfig{servers: c.Servers, timeout: c.Timeout, attempts: c.Attempts, rotate: c.Rotate}
+	if len(config.servers) == 0 {
+		c.loadSystem()
+		config.servers = c.system.servers
+		if config.timeout == 0 {
+			config.timeout = c.system.timeout
+		}
+		if config.attempts == 0 {
+			config.attempts = c.system.attempts
+		}
+		config.rotate = config.rotate || c.system.rotate
+	}
+	if config.timeout <= 0 {
+		config.timeout = DefaultClientTimeout
+	}
+	if config.attempts <= 0 {
+		config.attempts = DefaultClientAttempts
+	}
+	return config
+}
+
+// loadSystem reads the system configuration once.
+func (c *Client) loadSystem() {
+	c.once.Do(func() {
+		c.system = readResolvConf(resolvConfPath)
+		c.hosts = readHosts(hostsPath)
+	})
+}
+
+// dnsRecord is a resource record of an answer.
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	value string   // address of A and AAAA, host name of CNAME, MX and PTR
+	txt   []string // character-strings of TXT
+	pref  uint16   // preference of MX
+}
+
+// GetSPFRecord returns the single SPF record of name.
+// See SelectSPFRecord for the errors returned when there isn't exactly one.
+func (c *Client) GetSPFRecord(name string) (string, error) {
+	record, _, err := c.GetSPFRecordTTL(name)
+	return record, err
+}
+
+// GetSPFRecordTTL is GetSPFRecord returning the TTL of the TXT records too.
+func (c *Client) GetSPFRecordTTL(name string) (string, time.Duration, error) {
+	records, ttl, err := c.lookup(name, typeTXT)
+	if err != nil {
+		return "", NoTTL, err
+	}
+	txts := make([][]string, 0, len(records))
+	for _, record := range records {
+		txts = append(txts, record.txt)
+	}
+	record, err := SelectSPFRecord(txts)
+	if err != nil {
+		return "", ttl, fmt.Errorf("%w for %v", err, name)
+	}
+	return record, ttl, nil
+}
+
+// GetARecords returns the IPv4 addresses (A records) of name.
+func (c *Client) GetARecords(name string) ([]string, error) {
+	ips, _, err := c.lookupValues(name, typeA)
+	return ips, err
+}
+
+// GetARecordsTTL is GetARecords returning the TTL of the records too.
+func (c *Client) GetARecordsTTL(name string) ([]string, time.Duration, error) {
+	return c.lookupValues(name, typeA)
+}
+
+// GetAAAARecords returns the IPv6 addresses (AAAA records) of name.
+func (c *Client) GetAAAARecords(name string) ([]string, error) {
+	ips, _, err := c.lookupValues(name, typeAAAA)
+	return ips, err
+}
+
+// GetAAAARecordsTTL is GetAAAARecords returning the TTL of the records too.
+func (c *Client) GetAAAARecordsTTL(name string) ([]string, time.Duration, error) {
+	return c.lookupValues(name, typeAAAA)
+}
+
+// GetMXRecords returns the MX records of name, sorted by preference.
+func (c *Client) GetMXRecords(name string) ([]*net.MX, error) {
+	mxs, _, err := c.GetMXRecordsTTL(name)
+	return mxs, err
+}
+
+// GetMXRecordsTTL is GetMXRecords returning the TTL of the records too.
+func (c *Client) GetMXRecordsTTL(name string) ([]*net.MX, time.Duration, error) {
+	records, ttl, err := c.lookup(name, typeMX)
+	if err != nil {
+		return nil, NoTTL, err
+	}
+	mxs := make([]*net.MX, 0, len(records))
+	for _, record := range records {
+		mxs = append(mxs, &net.MX{Host: record.value, Pref: record.pref})
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, ttl, nil
+}
+
+// GetPTRRecords returns the names the address addr reverse-maps to.
+func (c *Client) GetPTRRecords(addr string) ([]string, error) {
+	if len(c.Servers) == 0 {
+		c.loadSystem()
+		if ip := net.ParseIP(addr); ip != nil && len(c.hosts.names[ip.String()]) > 0 {
+			return c.hosts.names[ip.String()], nil
+		}
+	}
+	name, err := ReverseName(addr)
+	if err != nil {
+		return nil, err
+	}
+	names, _, err := c.lookupValues(name, typePTR)
+	return names, err
+}
+
+func (c *Client) lookupValues(name string, qtype uint16) ([]string, time.Duration, error) {
+	if ips := c.hostsAddresses(name, qtype); len(ips) > 0 {
+		return ips, NoTTL, nil
+	}
+	records, ttl, err := c.lookup(name, qtype)
+	if err != nil {
+		return nil, NoTTL, err
+	}
+	values := make([]string, 0, len(records))
+	for _, record := range records {
+		values = append(values, record.value)
+	}
+	return values, ttl, nil
+}
+
+// hostsAddresses returns the addresses of type qtype (A or AAAA) of name in
+// /etc/hosts, when the Client uses the system configuration.
+func (c *Client) hostsAddresses(name string, qtype uint16) []string {
+	if len(c.Servers) > 0 || qtype != typeA && qtype != typeAAAA {
+		return nil
+	}
+	c.loadSystem()
+	ips := make([]string, 0)
+	for _, addr := range c.hosts.addrs[canonicalName(name)] {
+		if ip := net.ParseIP(addr); (ip.To4() != nil) == (qtype == typeA) {
+			ips = append(ips, addr)
+		}
+	}
+	return ips
+}
+
+// lookup returns the records of type qtype for name, following CNAMEs, and
+// the lowest TTL of the records and CNAMEs. The target of a CNAME is queried
+// when the answer doesn't include its records. Names without records of the
+// type are not found, like with the Go resolver.
+func (c *Client) lookup(name string, qtype uint16) ([]dnsRecord, time.Duration, error) {
+	name = canonicalName(name)
+	answers, err := c.exchange(name, qtype)
+	if err != nil {
+		return nil, NoTTL, err
+	}
+
+	ttl := NoTTL
+	owner := name
+	for i := 0; i <= maxCNAMEChain; i++ {
+		records := make([]dnsRecord, 0, len(answers))
+		cname := ""
+		for _, record := range answers {
+			if record.name != owner {
+				continue
+			}
+			if record.rtype == qtype {
+				records = append(records, record)
+			} else if record.rtype == typeCNAME && cname == "" {
+				cname = canonicalName(record.value)
+				ttl = minTTL(ttl, time.Duration(record.ttl)*time.Second)
+			}
+		}
+		if len(records) > 0 {
+			for _, record := range records {
+				ttl = minTTL(ttl, time.Duration(record.ttl)*time.Second)
+			}
+			return records, ttl, nil
+		}
+		if cname == "" {
+			return nil, NoTTL, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		owner = cname
+		if !hasOwner(answers, owner) {
+			if answers, err = c.exchange(owner, qtype); err != nil {
+				return nil, NoTTL, err
+			}
+		}
+	}
+	return nil, NoTTL, &net.DNSError{Err: "CNAME chain too long", Name: name, IsTemporary: true}
+}
+
+// hasOwner reports whether answers has records of name.
+func hasOwner(answers []dnsRecord, name string) bool {
+	for _, record := range answers {
+		if record.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange sends the query to the servers in turn, Attempts times, until
+// one answers, and returns the records of the answer section. A name that
+// doesn't exist isn't queried further.
+func (c *Client) exchange(name string, qtype uint16) ([]dnsRecord, error) {
+	config := c.config()
+	start := 0
+	if config.rotate {
+		start = int(atomic.AddUint32(&c.next, 1) % uint32(len(config.servers)))
+	}
+
+	var err error
+	for attempt := 0; attempt < config.attempts; attempt++ {
+		for i := range config.servers {
+			server := config.servers[(start+i)%len(config.servers)]
+			if _, _, splitErr := net.SplitHostPort(server); splitErr != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			var answers []dnsRecord
+			answers, err = exchangeWith(server, name, qtype, config.timeout)
+			if err == nil {
+				return answers, nil
+			}
+			if IsNotFound(err) {
+				return nil, err
+			}
+		}
+	}
+	return nil, err
+}
+
+// exchangeWith sends the query to server over UDP, then over TCP when the
+// answer is truncated.
+func exchangeWith(server string, name string, qtype uint16, timeout time.Duration) ([]dnsRecord, error) {
+	var random [2]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	id := binary.BigEndian.Uint16(random[:])
+	query, err := newQuery(id, name, qtype)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	response, err := roundTrip("udp", server, query, timeout)
+	if err == nil && len(response) >= 4 && binary.BigEndian.Uint16(response[2:])&flagTruncated != 0 {
+		response, err = roundTrip("tcp", server, query, timeout)
+	}
+	if err != nil {
+		dnsErr := &net.DNSError{Err: err.Error(), Name: name, Server: server, IsTemporary: true}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			dnsErr.Err = "i/o timeout"
+			dnsErr.IsTimeout = true
+		}
+		return nil, dnsErr
+	}
+
+	rcode, answers, err := parseResponse(response, id, name, qtype)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, Server: server, IsTemporary: true}
+	}
+	switch rcode {
+	case rcodeSuccess:
+		return answers, nil
+	case rcodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+	case rcodeServFail:
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, Server: server, IsTemporary: true}
+	}
+	return nil, &net.DNSError{Err: fmt.Sprintf("server returned RCODE %v", rcode), Name: name, Server: server}
+}
+
+// roundTrip sends the query to server and reads its response. Over UDP,
+// messages that don't answer the query, like late answers to earlier
+// queries or spoofed ones, are skipped until the deadline. Messages sent over
+// TCP have a two-octet length prefix (RFC 1035 § 4.2.2).
+func roundTrip(network string, server string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		response := make([]byte, 65535)
+		for {
+			n, err := conn.Read(response)
+			if err != nil {
+				return nil, err
+			}
+			if answers(response[:n], query) {
+				return response[:n], nil
+			}
+		}
+	}
+
+	message := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	if _, err := conn.Write(append(message, query...)); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	var length uint16
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(reader, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// answers reports whether msg is a response with the ID and the question
+// of query, ignoring the case of the name.
+func answers(msg []byte, query []byte) bool {
+	question := query[12 : len(query)-optRecordLength]
+	if len(msg) < 12+len(question) || !bytes.Equal(msg[:2], query[:2]) || msg[2]&0x80 == 0 {
+		return false
+	}
+	for i, b := range question {
+		if lower(msg[12+i]) != lower(b) {
+			return false
+		}
+	}
+	return true
+}
+
+func lower(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+// newQuery builds a recursive query for name with an EDNS0 OPT record
+// (RFC 6891), so larger answers fit in a UDP message.
+func newQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	query := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(query[0:], id)
+	binary.BigEndian.PutUint16(query[2:], flagRecursion)
+	binary.BigEndian.PutUint16(query[4:], 1)  // QDCOUNT
+	binary.BigEndian.PutUint16(query[10:], 1) // ARCOUNT
+	query, err := appendName(query, name)
+	if err != nil {
+		return nil, err
+	}
+	query = appendUint16(query, qtype)
+	query = appendUint16(query, classINET)
+
+	// OPT record: root name, type, payload size, extended RCODE and flags, no RDATA
+	query = append(query, 0)
+	query = appendUint16(query, typeOPT)
+	query = appendUint16(query, ednsPayloadSize)
+	query = append(query, 0, 0, 0, 0, 0, 0)
+	return query, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendName appends name in the uncompressed wire format of RFC 1035 § 3.1.
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("name too long: %v", name)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid name: %v", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// parseResponse checks that msg answers the query and returns its RCODE
+// and the records of its answer section.
+func parseResponse(msg []byte, id uint16, name string, qtype uint16) (int, []dnsRecord, error) {
+	if len(msg) < 12 {
+		return 0, nil, errMalformed
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if binary.BigEndian.Uint16(msg[0:]) != id || flags&flagResponse == 0 {
+		return 0, nil, errors.New("response doesn't match the query")
+	}
+	qdcount := binary.BigEndian.Uint16(msg[4:])
+	ancount := binary.BigEndian.Uint16(msg[6:])
+	if qdcount != 1 {
+		return 0, nil, errors.New("response doesn't match the query")
+	}
+
+	qname, offset, err := readName(msg, 12)
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset+4 > len(msg) {
+		return 0, nil, errMalformed
+	}
+	if canonicalName(qname) != name || binary.BigEndian.Uint16(msg[offset:]) != qtype {
+		return 0, nil, errors.New("response doesn't match the query")
+	}
+	offset += 4
+
+	answers := make([]dnsRecord, 0, ancount)
+	for i := 0; i < int(ancount); i++ {
+		var record dnsRecord
+		var class uint16
+		var data []byte
+		record.name, offset, err = readName(msg, offset)
+		if err != nil {
+			return 0, nil, err
+		}
+		if offset+10 > len(msg) {
+			return 0, nil, errMalformed
+		}
+		record.name = canonicalName(record.name)
+		record.rtype = binary.BigEndian.Uint16(msg[offset:])
+		class = binary.BigEndian.Uint16(msg[offset+2:])
+		record.ttl = binary.BigEndian.Uint32(msg[offset+4:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return 0, nil, errMalformed
+		}
+		data = msg[offset : offset+length]
+		if class == classINET {
+			if err := parseRData(msg, offset, data, &record); err != nil {
+				return 0, nil, err
+			}
+			answers = append(answers, record)
+		}
+		offset += length
+	}
+	return int(flags & 0xf), answers, nil
+}
+
+// parseRData parses the RDATA of record, which starts at offset in msg.
+func parseRData(msg []byte, offset int, data []byte, record *dnsRecord) error {
+	var err error
+	switch record.rtype {
+	case typeA:
+		if len(data) != net.IPv4len {
+			return errMalformed
+		}
+		record.value = net.IP(data).String()
+	case typeAAAA:
+		if len(data) != net.IPv6len {
+			return errMalformed
+		}
+		record.value = net.IP(data).String()
+	case typeCNAME, typePTR:
+		record.value, _, err = readName(msg, offset)
+	case typeMX:
+		if len(data) < 3 {
+			return errMalformed
+		}
+		record.pref = binary.BigEndian.Uint16(data)
+		record.value, _, err = readName(msg, offset+2)
+	case typeTXT:
+		for len(data) > 0 {
+			length := int(data[0])
+			if 1+length > len(data) {
+				return errMalformed
+			}
+			record.txt = append(record.txt, string(data[1:1+length]))
+			data = data[1+length:]
+		}
+	}
+	return err
+}
+
+// readName reads the possibly compressed name at offset in msg (RFC 1035
+// § 4.1.4). It returns the name with a trailing dot and the offset after it.
+func readName(msg []byte, offset int) (string, int, error) {
+	var name strings.Builder
+	end := -1
+	for pointers := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errMalformed
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end == -1 {
+				end = offset + 1
+			}
+			if name.Len() == 0 {
+				return ".", end, nil
+			}
+			return name.String(), end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) || pointers > 64 {
+				return "", 0, errMalformed
+			}
+			if end == -1 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			pointers++
+		case length&0xc0 != 0:
+			return "", 0, errMalformed
+		default:
+			if offset+1+length > len(msg) || name.Len()+length+1 > 255 {
+				return "", 0, errMalformed
+			}
+			name.Write(msg[offset+1 : offset+1+length])
+			name.WriteByte('.')
+			offset += 1 + length
+		}
+	}
+}
+
+// readResolvConf returns the nameservers and options of the resolv.conf
+// file at path (resolv.conf(5)), or the local resolver when there are no
+// nameservers.
+func readResolvConf(path string) clientConfig {
+	config := clientConfig{servers: make([]string, 0, 3)}
+	f, err := os.Open(path)
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "nameserver":
+				config.servers = append(config.servers, net.JoinHostPort(fields[1], "53"))
+			case "options":
+				for _, option := range fields[1:] {
+					key, value := option, ""
+					if i := strings.Index(option, ":"); i != -1 {
+						key, value = option[:i], option[i+1:]
+					}
+					n, _ := strconv.Atoi(value)
+					switch {
+					case key == "timeout" && n > 0:
+						config.timeout = time.Duration(n) * time.Second
+					case key == "attempts" && n > 0:
+						config.attempts = n
+					case key == "rotate":
+						config.rotate = true
+					}
+				}
+			}
+		}
+	}
+	if len(config.servers) == 0 {
+		config.servers = append(config.servers, "127.0.0.1:53")
+	}
+	return config
+}
+
+// hostsTable is the static table of a hosts file (hosts(5)).
+type hostsTable struct {
+	addrs map[string][]string // canonical name -> addresses
+	names map[string][]string // address -> names with a trailing dot
+}
+
+// readHosts reads the hosts file at path, an empty table when it's missing.
+func readHosts(path string) hostsTable {
+	hosts := hostsTable{addrs: make(map[string][]string), names: make(map[string][]string)}
+	f, err := os.Open(path)
+	if err != nil {
+		return hosts
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr := fields[0]
+		if i := strings.Index(addr, "%"); i != -1 {
+			addr = addr[:i]
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			hosts.addrs[canonicalName(name)] = append(hosts.addrs[canonicalName(name)], ip.String())
+			hosts.names[ip.String()] = append(hosts.names[ip.String()], strings.TrimSuffix(name, ".")+".")
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,377 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testAnswer is the answer of a testServer to a query.
+type testAnswer struct {
+	rcode     uint16
+	records   [][]byte
+	truncated bool // over UDP, the full answer is sent over TCP
+	silent    bool
+	drop      int  // the first queries are dropped
+	spoofed   bool // over UDP, a response with another ID is sent first
+}
+
+// testServer is a DNS server answering the queries of a Client over UDP and
+// TCP on the same port.
+type testServer struct {
+	udp     net.PacketConn
+	tcp     net.Listener
+	answers map[string]testAnswer // "name type" -> answer
+
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func newTestServer(answers map[string]testAnswer) *testServer {
+	for {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			continue
+		}
+		s := &testServer{udp: udp, tcp: tcp, answers: answers, queries: make(map[string]int)}
+		go s.serveUDP()
+		go s.serveTCP()
+		return s
+	}
+}
+
+func (s *testServer) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *testServer) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *testServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if response := s.respond(buf[:n], true); response != nil {
+			if s.spoofed(buf[:n]) {
+				spoof := append([]byte{}, response...)
+				spoof[0]++
+				s.udp.WriteTo(spoof, addr)
+			}
+			s.udp.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *testServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		var length uint16
+		query := make([]byte, 512)
+		if binary.Read(conn, binary.BigEndian, &length) == nil {
+			if n, _ := conn.Read(query[:length]); n == int(length) {
+				response := s.respond(query[:n], false)
+				conn.Write(append(appendUint16(nil, uint16(len(response))), response...))
+			}
+		}
+		conn.Close()
+	}
+}
+
+// count returns the number of queries received for "name type".
+func (s *testServer) count(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[key]
+}
+
+func (s *testServer) spoofed(query []byte) bool {
+	name, offset, err := readName(query, 12)
+	if err != nil {
+		return false
+	}
+	return s.answers[canonicalName(name)+" "+typeName(binary.BigEndian.Uint16(query[offset:]))].spoofed
+}
+
+// respond returns the response to query, with the question copied from it.
+func (s *testServer) respond(query []byte, udp bool) []byte {
+	name, offset, err := readName(query, 12)
+	if err != nil {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[offset:])
+	key := canonicalName(name) + " " + typeName(qtype)
+	s.mu.Lock()
+	s.queries[key]++
+	queries := s.queries[key]
+	s.mu.Unlock()
+	answer, ok := s.answers[key]
+	if !ok {
+		answer.rcode = rcodeNameError
+	}
+	if answer.silent || queries <= answer.drop {
+		return nil
+	}
+
+	flags := flagResponse | flagRecursion | answer.rcode
+	records := answer.records
+	if udp && answer.truncated {
+		flags |= flagTruncated
+		records = nil
+	}
+	response := append([]byte{}, query[:2]...)
+	response = appendUint16(response, flags)
+	response = appendUint16(response, 1)
+	response = appendUint16(response, uint16(len(records)))
+	response = append(response, 0, 0, 0, 0)
+	response = append(response, query[12:offset+4]...)
+	for _, record := range records {
+		response = append(response, record...)
+	}
+	return response
+}
+
+func typeName(qtype uint16) string {
+	return map[uint16]string{typeA: "A", typeAAAA: "AAAA", typeMX: "MX", typeTXT: "TXT", typePTR: "PTR"}[qtype]
+}
+
+// rr encodes a resource record, a nil name is a pointer to the question.
+func rr(name string, rtype uint16, ttl uint32, rdata []byte) []byte {
+	record := []byte{0xc0, 12}
+	if name != "" {
+		record, _ = appendName(nil, name)
+	}
+	record = appendUint16(record, rtype)
+	record = appendUint16(record, classINET)
+	record = append(record, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+	record = appendUint16(record, uint16(len(rdata)))
+	return append(record, rdata...)
+}
+
+func txt(strs ...string) []byte {
+	data := make([]byte, 0)
+	for _, str := range strs {
+		data = append(append(data, byte(len(str))), str...)
+	}
+	return data
+}
+
+func domainName(name string) []byte {
+	data, _ := appendName(nil, name)
+	return data
+}
+
+func TestClient(t *testing.T) {
+	Convey("Testing the DNS client", t, func() {
+		s := newTestServer(map[string]testAnswer{
+			"example.com TXT": {records: [][]byte{
+				rr("", typeTXT, 300, txt("google-site-verification=abc")),
+				rr("", typeTXT, 600, txt("v=spf1 ip4:192.0.2.0/24 ", "-all")),
+			}},
+			"example.com MX": {records: [][]byte{
+				rr("", typeMX, 3600, append([]byte{0, 20}, domainName("mx2.example.com")...)),
+				rr("", typeMX, 1800, append([]byte{0, 10}, 3, 'm', 'x', '1', 0xc0, 12)),
+			}},
+			"www.example.com A": {records: [][]byte{
+				rr("www.example.com", typeCNAME, 60, domainName("host.example.com")),
+				rr("host.example.com", typeA, 3600, []byte{192, 0, 2, 1}),
+				rr("host.example.com", typeA, 3600, []byte{192, 0, 2, 2}),
+			}},
+			"host.example.com A": {records: [][]byte{
+				rr("", typeA, 3600, []byte{192, 0, 2, 1}),
+			}},
+			"alias.example.com A": {records: [][]byte{
+				rr("", typeCNAME, 30, domainName("host.example.com")),
+			}},
+			"host.example.com AAAA": {records: [][]byte{
+				rr("", typeAAAA, 120, net.ParseIP("2001:db8::1")),
+			}},
+			"1.2.0.192.in-addr.arpa PTR": {records: [][]byte{
+				rr("", typePTR, 86400, domainName("Host.Example.com")),
+			}},
+			"empty.example.com A":  {},
+			"fail.example.com TXT": {rcode: rcodeServFail},
+			"slow.example.com TXT": {silent: true},
+			"large.example.com TXT": {truncated: true, records: [][]byte{
+				rr("", typeTXT, 60, txt("v=spf1 -all")),
+			}},
+			"lossy.example.com TXT": {drop: 1, records: [][]byte{
+				rr("", typeTXT, 60, txt("v=spf1 -all")),
+			}},
+			"spoofed.example.com TXT": {spoofed: true, records: [][]byte{
+				rr("", typeTXT, 60, txt("v=spf1 -all")),
+			}},
+		})
+		defer s.Close()
+		c := NewClient(s.Addr())
+
+		Convey("Answers are returned with their lowest TTL", func() {
+			record, ttl, err := c.GetSPFRecordTTL("Example.com.")
+			So(err, ShouldEqual, nil)
+			So(record, ShouldEqual, "v=spf1 ip4:192.0.2.0/24 -all")
+			So(ttl, ShouldEqual, 300*time.Second)
+
+			mxs, ttl, err := c.GetMXRecordsTTL("example.com")
+			So(err, ShouldEqual, nil)
+			So(mxs, ShouldResemble, []*net.MX{{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}})
+			So(ttl, ShouldEqual, 1800*time.Second)
+
+			// the TTL of the CNAME is the lowest
+			ips, ttl, err := c.GetARecordsTTL("www.example.com")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"192.0.2.1", "192.0.2.2"})
+			So(ttl, ShouldEqual, time.Minute)
+
+			ips, ttl, err = c.GetAAAARecordsTTL("host.example.com")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"2001:db8::1"})
+			So(ttl, ShouldEqual, 2*time.Minute)
+
+			names, err := c.GetPTRRecords("192.0.2.1")
+			So(err, ShouldEqual, nil)
+			So(names, ShouldResemble, []string{"Host.Example.com."})
+
+			// truncated answers are retried over TCP
+			record, err = c.GetSPFRecord("large.example.com")
+			So(err, ShouldEqual, nil)
+			So(record, ShouldEqual, "v=spf1 -all")
+
+			// the target of a CNAME without its records in the answer is queried
+			ips, ttl, err = c.GetARecordsTTL("alias.example.com")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"192.0.2.1"})
+			So(ttl, ShouldEqual, 30*time.Second)
+		})
+
+		Convey("Lost queries are sent again", func() {
+			c.Timeout = 100 * time.Millisecond
+			record, err := c.GetSPFRecord("lossy.example.com")
+			So(err, ShouldEqual, nil)
+			So(record, ShouldEqual, "v=spf1 -all")
+			So(s.count("lossy.example.com TXT"), ShouldEqual, 2)
+
+			c.Attempts = 1
+			_, err = c.GetSPFRecord("slow.example.com")
+			So(err.(*net.DNSError).IsTimeout, ShouldEqual, true)
+			So(s.count("slow.example.com TXT"), ShouldEqual, 1)
+		})
+
+		Convey("Responses to other queries are skipped", func() {
+			c.Timeout = time.Second
+			record, err := c.GetSPFRecord("spoofed.example.com")
+			So(err, ShouldEqual, nil)
+			So(record, ShouldEqual, "v=spf1 -all")
+		})
+
+		Convey("Errors are reported like the Go resolver does", func() {
+			_, ttl, err := c.GetSPFRecordTTL("missing.example.com")
+			So(IsNotFound(err), ShouldEqual, true)
+			So(ttl, ShouldEqual, NoTTL)
+
+			_, err = c.GetARecords("empty.example.com")
+			So(IsNotFound(err), ShouldEqual, true)
+
+			_, err = c.GetSPFRecord("fail.example.com")
+			So(err, ShouldNotEqual, nil)
+			So(IsNotFound(err), ShouldEqual, false)
+			So(err.(*net.DNSError).Temporary(), ShouldEqual, true)
+
+			c.Timeout = 50 * time.Millisecond
+			_, err = c.GetSPFRecord("slow.example.com")
+			So(err, ShouldNotEqual, nil)
+			So(err.(*net.DNSError).IsTimeout, ShouldEqual, true)
+		})
+
+		Convey("The next server is tried when a server fails", func() {
+			down := newTestServer(map[string]testAnswer{"example.com TXT": {rcode: rcodeServFail}})
+			defer down.Close()
+			c := NewClient(down.Addr(), s.Addr())
+			record, err := c.GetSPFRecord("example.com")
+			So(err, ShouldEqual, nil)
+			So(record, ShouldEqual, "v=spf1 ip4:192.0.2.0/24 -all")
+		})
+
+		Convey("A CachingResolver keeps the answers for their TTL", func() {
+			cache := NewCachingResolver(c, time.Hour)
+			_, ttl, err := cache.GetSPFRecordTTL("example.com")
+			So(err, ShouldEqual, nil)
+			So(ttl, ShouldBeLessThanOrEqualTo, 300*time.Second)
+			So(ttl, ShouldBeGreaterThan, 290*time.Second)
+		})
+
+		Convey("Malformed messages are rejected", func() {
+			for _, msg := range [][]byte{
+				{0xc0},
+				{0xc0, 0},
+				{3, 'c', 'o'},
+				{0x40},
+			} {
+				_, _, err := readName(msg, 0)
+				So(err, ShouldEqual, errMalformed)
+			}
+			_, err := appendName(nil, "a..example.com")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Queries are spread over the servers with Rotate", func() {
+			other := newTestServer(map[string]testAnswer{"example.com TXT": {records: [][]byte{rr("", typeTXT, 60, txt("v=spf1 -all"))}}})
+			defer other.Close()
+			c := &Client{Servers: []string{s.Addr(), other.Addr()}, Rotate: true}
+			for i := 0; i < 4; i++ {
+				_, err := c.GetSPFRecord("example.com")
+				So(err, ShouldEqual, nil)
+			}
+			So(s.count("example.com TXT"), ShouldEqual, 2)
+			So(other.count("example.com TXT"), ShouldEqual, 2)
+		})
+
+		Convey("The system configuration is used by default", func() {
+			So(readResolvConf("testdata/resolv.conf"), ShouldResemble, clientConfig{
+				servers:  []string{"192.0.2.53:53", "[2001:db8::53]:53"},
+				timeout:  3 * time.Second,
+				attempts: 4,
+				rotate:   true,
+			})
+			So(readResolvConf("testdata/nonexistent"), ShouldResemble, clientConfig{servers: []string{"127.0.0.1:53"}})
+
+			defer func(conf string, hosts string) {
+				resolvConfPath, hostsPath = conf, hosts
+			}(resolvConfPath, hostsPath)
+			resolvConfPath, hostsPath = "testdata/resolv.conf", "testdata/hosts"
+			c := NewClient()
+			So(c.config(), ShouldResemble, readResolvConf("testdata/resolv.conf"))
+
+			// names of the hosts file are answered without queries
+			ips, err := c.GetARecords("Mail.Example.org.")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"192.0.2.25"})
+			ips, err = c.GetAAAARecords("mail.example.org")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"2001:db8::25"})
+			names, err := c.GetPTRRecords("2001:db8:0::25")
+			So(err, ShouldEqual, nil)
+			So(names, ShouldResemble, []string{"mail.example.org.", "smtp.example.org."})
+
+			// explicit servers don't use the hosts file
+			c = NewClient(s.Addr())
+			_, err = c.GetARecords("mail.example.org")
+			So(IsNotFound(err), ShouldEqual, true)
+		})
+	})
+}
@@ -1,64 +1,163 @@
 package dns
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
 	"strings"
+	"time"
 )
 
 type DnsResolver interface {
 	GetSPFRecord(string) (string, error)
 	GetARecords(string) ([]string, error)
+	GetAAAARecords(string) ([]string, error)
 	GetMXRecords(string) ([]*net.MX, error)
+	GetPTRRecords(string) ([]string, error)
 }
 
-type GoSPFDNS struct {
+// TTLResolver is a DnsResolver that also returns the TTL of its answers, so
+// they can be cached for as long as the DNS allows. The TTL is NoTTL when
+// it's unknown, e.g. for not found answers. The Go resolver doesn't expose
+// TTLs, so GoSPFDNS doesn't implement it, Client does.
+type TTLResolver interface {
+	DnsResolver
+	GetSPFRecordTTL(string) (string, time.Duration, error)
+	GetARecordsTTL(string) ([]string, time.Duration, error)
+	GetAAAARecordsTTL(string) ([]string, time.Duration, error)
+	GetMXRecordsTTL(string) ([]*net.MX, time.Duration, error)
 }
 
-func IsSPF(record string) bool {
-	if strings.HasPrefix(record, "v=spf") {
+// NoTTL is the TTL returned by a TTLResolver when the TTL is unknown.
+const NoTTL time.Duration = -1
+
+// ErrNotFound can be returned (or wrapped) by resolvers when the queried name
+// does not exist (NXDOMAIN) or has no records of the requested type.
+var ErrNotFound = errors.New("no such host")
+
+// IsNotFound reports whether err means the lookup returned no records,
+// either because the name does not exist or because the answer was empty.
+// RFC 7208 § 4.6.4 calls these "void lookups".
+func IsNotFound(err error) bool {
+	if errors.Is(err, ErrNotFound) {
 		return true
 	}
-
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
 	return false
 }
 
+type GoSPFDNS struct {
+}
+
+var (
+	// ErrNoSPFRecord is returned when the TXT RRset of a domain
+	// doesn't contain an SPF record.
+	ErrNoSPFRecord = errors.New("no SPF record found")
+	// ErrMultipleSPFRecords is returned when the TXT RRset of a domain
+	// contains more than one SPF record.
+	ErrMultipleSPFRecords = errors.New("multiple SPF records found")
+)
+
+// IsSPF reports whether the TXT record is an SPF record, i.e. it starts with
+// the version section "v=spf1" followed by a space or the end of the record.
+//
+// RFC 7208 4.5.
+//
+//	Starting with the set of records that were returned by the lookup,
+//	discard records that do not begin with a version section of exactly
+//	"v=spf1".  Note that the version section is terminated by either an
+//	SP character or the end of the record.  As an example, a record with
+//	a version section of "v=spf10" does not match and is discarded.
+func IsSPF(record string) bool {
+	version := "v=spf1"
+	if len(record) < len(version) || !strings.EqualFold(record[:len(version)], version) {
+		return false
+	}
+	return len(record) == len(version) || record[len(version)] == ' '
+}
+
+// IsSupportedProtocol reports whether the record is an SPF record of a
+// supported version. Version 1 is the only SPF version, so it is the same as IsSPF.
 func IsSupportedProtocol(record string) bool {
-	if strings.HasPrefix(record, "v=spf1") {
-		return true
+	return IsSPF(record)
+}
+
+// SelectSPFRecord selects the SPF record from a TXT RRset.
+// Every TXT record is given as its character-strings, which are
+// concatenated without separators (RFC 7208 § 3.3).
+// It returns ErrNoSPFRecord if there is no SPF record in the set and
+// ErrMultipleSPFRecords if there is more than one (RFC 7208 § 4.5).
+func SelectSPFRecord(records [][]string) (string, error) {
+	found := make([]string, 0, 1)
+	for _, strs := range records {
+		record := strings.Join(strs, "")
+		if IsSPF(record) {
+			found = append(found, record)
+		}
 	}
 
-	return false
+	switch len(found) {
+	case 0:
+		return "", ErrNoSPFRecord
+	case 1:
+		return found[0], nil
+	}
+	return "", ErrMultipleSPFRecords
 }
 
+// GetARecords returns the IPv4 addresses (A records) of name.
 func (dns *GoSPFDNS) GetARecords(name string) ([]string, error) {
-	return net.LookupHost(name)
+	return lookupIP("ip4", name)
+}
+
+// GetAAAARecords returns the IPv6 addresses (AAAA records) of name.
+func (dns *GoSPFDNS) GetAAAARecords(name string) ([]string, error) {
+	return lookupIP("ip6", name)
+}
+
+func lookupIP(network string, name string) ([]string, error) {
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), network, name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out, nil
 }
 
 func (dns *GoSPFDNS) GetMXRecords(name string) ([]*net.MX, error) {
 	return net.LookupMX(name)
 }
 
+func (dns *GoSPFDNS) GetPTRRecords(addr string) ([]string, error) {
+	return net.LookupAddr(addr)
+}
+
+// GetSPFRecord returns the single SPF record of name.
+// See SelectSPFRecord for the errors returned when there isn't exactly one.
 func (dns *GoSPFDNS) GetSPFRecord(name string) (string, error) {
 
-	records, err := net.LookupTXT(name)
+	// The Go resolver already concatenates the character-strings of a TXT record.
+	txts, err := net.LookupTXT(name)
 	if err != nil {
 		return "", err
 	}
 
-	for _, record := range records {
-		if !IsSPF(record) {
-			continue
-		}
-
-		if !IsSupportedProtocol(record) {
-			return "", errors.New("Unsupported SPF record: " + record)
-		}
-
-		return record, nil
-
+	records := make([][]string, 0, len(txts))
+	for _, txt := range txts {
+		records = append(records, []string{txt})
 	}
 
-	return "", errors.New("No SPF record found for " + name)
+	record, err := SelectSPFRecord(records)
+	if err != nil {
+		return "", fmt.Errorf("%w for %v", err, name)
+	}
+	return record, nil
 
 }
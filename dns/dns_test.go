@@ -1,7 +1,9 @@
 package dns
 
 import (
-	_ "fmt"
+	"errors"
+	"fmt"
+	"net"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -11,12 +13,18 @@ var validSpfs = []string{
 	"v=spf1 a -all",
 	"v=spf1 a:mail.example.com -all",
 	"v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.123 a -all",
+	"v=spf1",
+	"V=SPF1 -all",
 }
 
 var invalidSpfs = []string{
 	"",
 	"abv=spf",
 	"abda=v=spf1",
+	"v=spf",
+	"v=spf10 -all",
+	"v=spf1-all",
+	"v=spf2.0/pra -all",
 }
 
 func TestIsSPF(t *testing.T) {
@@ -46,6 +54,51 @@ func TestIsSupportedProtocol(t *testing.T) {
 	})
 }
 
+func TestSelectSPFRecord(t *testing.T) {
+
+	Convey("Testing SelectSPFRecord()", t, func() {
+
+		record, err := SelectSPFRecord([][]string{
+			{"google-site-verification=abc"},
+			{"v=spf1 ip4:192.0.2.0/24 ", "include:_spf.example.com -all"},
+		})
+		So(err, ShouldEqual, nil)
+		So(record, ShouldEqual, "v=spf1 ip4:192.0.2.0/24 include:_spf.example.com -all")
+
+		record, err = SelectSPFRecord([][]string{
+			{"v=spf1 a -all"},
+			{"v=spf10 mx -all"},
+		})
+		So(err, ShouldEqual, nil)
+		So(record, ShouldEqual, "v=spf1 a -all")
+
+		_, err = SelectSPFRecord([][]string{
+			{"v=spf1 a -all"},
+			{"v=spf1 mx -all"},
+		})
+		So(err, ShouldEqual, ErrMultipleSPFRecords)
+
+		_, err = SelectSPFRecord([][]string{
+			{"google-site-verification=abc"},
+		})
+		So(err, ShouldEqual, ErrNoSPFRecord)
+
+		_, err = SelectSPFRecord(nil)
+		So(err, ShouldEqual, ErrNoSPFRecord)
+	})
+}
+
+func TestIsNotFound(t *testing.T) {
+
+	Convey("Testing IsNotFound()", t, func() {
+		So(IsNotFound(ErrNotFound), ShouldEqual, true)
+		So(IsNotFound(fmt.Errorf("example.com: %w", ErrNotFound)), ShouldEqual, true)
+		So(IsNotFound(&net.DNSError{Err: "no such host", IsNotFound: true}), ShouldEqual, true)
+		So(IsNotFound(&net.DNSError{Err: "server misbehaving", IsTemporary: true}), ShouldEqual, false)
+		So(IsNotFound(errors.New("lookup failed")), ShouldEqual, false)
+	})
+}
+
 func TestLiveDomains(t *testing.T) {
 
 	if testing.Short() {
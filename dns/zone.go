@@ -0,0 +1,613 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failure is a DNS failure that can be injected into a ZoneResolver.
+type Failure int
+
+const (
+	// ServFail makes lookups fail with a temporary server failure (RCODE 2).
+	ServFail Failure = iota + 1
+	// Timeout makes lookups fail as if the server didn't answer in time.
+	Timeout
+	// NXDomain makes lookups fail as if the name doesn't exist (RCODE 3).
+	NXDomain
+)
+
+func (f Failure) String() string {
+	switch f {
+	case ServFail:
+		return "SERVFAIL"
+	case Timeout:
+		return "TIMEOUT"
+	case NXDomain:
+		return "NXDOMAIN"
+	}
+	return "UNKNOWN"
+}
+
+// maxCNAMEChain is the max number of CNAME records followed during a lookup.
+const maxCNAMEChain = 8
+
+// defaultZoneTTL is used for records when no TTL is given and no $TTL is set.
+const defaultZoneTTL = 3600
+
+type zoneRecord struct {
+	ttl   uint32
+	rdata []string
+}
+
+// ZoneResolver is a DnsResolver that answers from records loaded from
+// RFC 1035 master files (or added with AddRecord), so SPF policies can be
+// tested without network access. Supported record types are TXT, A, AAAA,
+// MX, PTR and CNAME, together with the $ORIGIN and $TTL directives.
+//
+// Failures (SERVFAIL, timeouts, NXDOMAIN) can be injected per name and
+// record type. A ZoneResolver is safe for concurrent use.
+type ZoneResolver struct {
+	mu       sync.RWMutex
+	records  map[string]map[string][]zoneRecord // name -> type -> records
+	failures map[string]map[string]Failure      // name -> type ("" is any) -> failure
+}
+
+// NewZoneResolver creates an empty ZoneResolver.
+func NewZoneResolver() *ZoneResolver {
+	return &ZoneResolver{
+		records:  make(map[string]map[string][]zoneRecord),
+		failures: make(map[string]map[string]Failure),
+	}
+}
+
+// LoadZoneFile creates a ZoneResolver from the master file at path.
+// Relative names are relative to origin until a $ORIGIN directive is found.
+func LoadZoneFile(path string, origin string) (*ZoneResolver, error) {
+	z := NewZoneResolver()
+	if err := z.LoadFile(path, origin); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// LoadFile adds the records of the master file at path.
+func (z *ZoneResolver) LoadFile(path string, origin string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return z.Load(f, origin)
+}
+
+// Load adds the records of the master file read from r.
+func (z *ZoneResolver) Load(r io.Reader, origin string) error {
+	p := zoneParser{
+		origin: canonicalName(origin),
+		ttl:    defaultZoneTTL,
+	}
+
+	scanner := bufio.NewScanner(r)
+	entry := make([]zoneToken, 0)
+	depth := 0
+	startLine := 0
+	line := 0
+	for scanner.Scan() {
+		line++
+		tokens, open, err := tokenizeZoneLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("zone line %v: %v", line, err)
+		}
+		if depth == 0 {
+			startLine = line
+		}
+		entry = append(entry, tokens...)
+		depth += open
+		if depth < 0 {
+			return fmt.Errorf("zone line %v: unbalanced parentheses", line)
+		}
+		if depth > 0 {
+			continue
+		}
+		if len(entry) > 0 {
+			if err := p.parseEntry(z, entry); err != nil {
+				return fmt.Errorf("zone line %v: %v", startLine, err)
+			}
+		}
+		entry = entry[:0]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if depth != 0 {
+		return fmt.Errorf("zone line %v: unbalanced parentheses", startLine)
+	}
+	return nil
+}
+
+// AddRecord adds a record of type qtype for the fully qualified name.
+// The rdata is given as in a master file without quotes: the address for A
+// and AAAA, the preference and exchange for MX, the target name for PTR and
+// CNAME, and the character-strings for TXT.
+func (z *ZoneResolver) AddRecord(name string, qtype string, ttl uint32, rdata ...string) error {
+	qtype = strings.ToUpper(qtype)
+	name = canonicalName(name)
+
+	switch qtype {
+	case "A", "AAAA":
+		if len(rdata) != 1 {
+			return fmt.Errorf("%v record for %v needs one address", qtype, name)
+		}
+		ip := net.ParseIP(rdata[0])
+		if ip == nil || (qtype == "A") != (ip.To4() != nil) {
+			return fmt.Errorf("invalid %v record for %v: %v", qtype, name, rdata[0])
+		}
+		rdata = []string{ip.String()}
+	case "MX":
+		if len(rdata) != 2 {
+			return fmt.Errorf("MX record for %v needs a preference and an exchange", name)
+		}
+		if _, err := strconv.ParseUint(rdata[0], 10, 16); err != nil {
+			return fmt.Errorf("invalid MX preference for %v: %v", name, rdata[0])
+		}
+		rdata = []string{rdata[0], canonicalName(rdata[1])}
+	case "PTR", "CNAME":
+		if len(rdata) != 1 {
+			return fmt.Errorf("%v record for %v needs one target", qtype, name)
+		}
+		rdata = []string{canonicalName(rdata[0])}
+	case "TXT":
+		if len(rdata) == 0 {
+			return fmt.Errorf("TXT record for %v needs at least one string", name)
+		}
+		rdata = append([]string(nil), rdata...)
+	default:
+		return fmt.Errorf("unsupported record type %v for %v", qtype, name)
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	types, ok := z.records[name]
+	if !ok {
+		types = make(map[string][]zoneRecord)
+		z.records[name] = types
+	}
+	types[qtype] = append(types[qtype], zoneRecord{ttl: ttl, rdata: rdata})
+	return nil
+}
+
+// Fail makes every lookup of name fail with the given failure.
+func (z *ZoneResolver) Fail(name string, failure Failure) {
+	z.FailType(name, "", failure)
+}
+
+// FailType makes lookups of record type qtype for name fail with the given failure.
+func (z *ZoneResolver) FailType(name string, qtype string, failure Failure) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	name = canonicalName(name)
+	types, ok := z.failures[name]
+	if !ok {
+		types = make(map[string]Failure)
+		z.failures[name] = types
+	}
+	types[strings.ToUpper(qtype)] = failure
+}
+
+// ClearFailures removes all injected failures.
+func (z *ZoneResolver) ClearFailures() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.failures = make(map[string]map[string]Failure)
+}
+
+// lookup returns the records of type qtype for name, following CNAMEs,
+// and the lowest TTL of the records and CNAMEs (NoTTL on errors).
+func (z *ZoneResolver) lookup(name string, qtype string) ([]zoneRecord, time.Duration, error) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	name = canonicalName(name)
+	ttl := NoTTL
+	for i := 0; i <= maxCNAMEChain; i++ {
+		if err := z.failure(name, qtype); err != nil {
+			return nil, NoTTL, err
+		}
+		types, ok := z.records[name]
+		if !ok {
+			return nil, NoTTL, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		if records, ok := types[qtype]; ok {
+			for _, record := range records {
+				ttl = minTTL(ttl, time.Duration(record.ttl)*time.Second)
+			}
+			return records, ttl, nil
+		}
+		cname, ok := types["CNAME"]
+		if !ok || qtype == "CNAME" {
+			return nil, NoTTL, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		ttl = minTTL(ttl, time.Duration(cname[0].ttl)*time.Second)
+		name = cname[0].rdata[0]
+	}
+	return nil, NoTTL, &net.DNSError{Err: "CNAME chain too long", Name: name, IsTemporary: true}
+}
+
+// minTTL returns the lower of two TTLs, ignoring unknown ones.
+func minTTL(a time.Duration, b time.Duration) time.Duration {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func (z *ZoneResolver) failure(name string, qtype string) error {
+	types, ok := z.failures[name]
+	if !ok {
+		return nil
+	}
+	failure, ok := types[qtype]
+	if !ok {
+		failure, ok = types[""]
+	}
+	if !ok {
+		return nil
+	}
+	switch failure {
+	case ServFail:
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	case Timeout:
+		return &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true, IsTemporary: true}
+	case NXDomain:
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil
+}
+
+// GetSPFRecord returns the single SPF record of name.
+// See SelectSPFRecord for the errors returned when there isn't exactly one.
+func (z *ZoneResolver) GetSPFRecord(name string) (string, error) {
+	record, _, err := z.GetSPFRecordTTL(name)
+	return record, err
+}
+
+// GetSPFRecordTTL is GetSPFRecord returning the TTL of the TXT records too.
+func (z *ZoneResolver) GetSPFRecordTTL(name string) (string, time.Duration, error) {
+	records, ttl, err := z.lookup(name, "TXT")
+	if err != nil {
+		return "", NoTTL, err
+	}
+	txts := make([][]string, 0, len(records))
+	for _, record := range records {
+		txts = append(txts, record.rdata)
+	}
+	record, err := SelectSPFRecord(txts)
+	if err != nil {
+		return "", ttl, fmt.Errorf("%w for %v", err, name)
+	}
+	return record, ttl, nil
+}
+
+// GetARecords returns the IPv4 addresses (A records) of name.
+func (z *ZoneResolver) GetARecords(name string) ([]string, error) {
+	ips, _, err := z.lookupValues(name, "A")
+	return ips, err
+}
+
+// GetARecordsTTL is GetARecords returning the TTL of the records too.
+func (z *ZoneResolver) GetARecordsTTL(name string) ([]string, time.Duration, error) {
+	return z.lookupValues(name, "A")
+}
+
+// GetAAAARecords returns the IPv6 addresses (AAAA records) of name.
+func (z *ZoneResolver) GetAAAARecords(name string) ([]string, error) {
+	ips, _, err := z.lookupValues(name, "AAAA")
+	return ips, err
+}
+
+// GetAAAARecordsTTL is GetAAAARecords returning the TTL of the records too.
+func (z *ZoneResolver) GetAAAARecordsTTL(name string) ([]string, time.Duration, error) {
+	return z.lookupValues(name, "AAAA")
+}
+
+// GetMXRecords returns the MX records of name, sorted by preference.
+func (z *ZoneResolver) GetMXRecords(name string) ([]*net.MX, error) {
+	mxs, _, err := z.GetMXRecordsTTL(name)
+	return mxs, err
+}
+
+// GetMXRecordsTTL is GetMXRecords returning the TTL of the records too.
+func (z *ZoneResolver) GetMXRecordsTTL(name string) ([]*net.MX, time.Duration, error) {
+	records, ttl, err := z.lookup(name, "MX")
+	if err != nil {
+		return nil, NoTTL, err
+	}
+	mxs := make([]*net.MX, 0, len(records))
+	for _, record := range records {
+		pref, _ := strconv.ParseUint(record.rdata[0], 10, 16)
+		mxs = append(mxs, &net.MX{Host: record.rdata[1] + ".", Pref: uint16(pref)})
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, ttl, nil
+}
+
+// GetPTRRecords returns the names the address addr reverse-maps to.
+func (z *ZoneResolver) GetPTRRecords(addr string) ([]string, error) {
+	name, err := ReverseName(addr)
+	if err != nil {
+		return nil, err
+	}
+	names, _, err := z.lookupValues(name, "PTR")
+	if err != nil {
+		return nil, err
+	}
+	for i := range names {
+		names[i] += "."
+	}
+	return names, nil
+}
+
+func (z *ZoneResolver) lookupValues(name string, qtype string) ([]string, time.Duration, error) {
+	records, ttl, err := z.lookup(name, qtype)
+	if err != nil {
+		return nil, NoTTL, err
+	}
+	values := make([]string, 0, len(records))
+	for _, record := range records {
+		values = append(values, record.rdata[0])
+	}
+	return values, ttl, nil
+}
+
+// ReverseName returns the name used for the reverse-mapping of addr,
+// in "in-addr.arpa." for IPv4 and in "ip6.arpa." for IPv6 addresses.
+func ReverseName(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address: %v", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0]), nil
+	}
+	const hex = "0123456789abcdef"
+	out := make([]byte, 0, 64+len("ip6.arpa."))
+	for i := len(ip) - 1; i >= 0; i-- {
+		out = append(out, hex[ip[i]&0x0f], '.', hex[ip[i]>>4], '.')
+	}
+	return string(append(out, "ip6.arpa."...)), nil
+}
+
+// canonicalName lower cases name and strips the trailing dot.
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+type zoneToken struct {
+	value  string
+	quoted bool
+	first  bool // token starts at the beginning of the line
+}
+
+// tokenizeZoneLine splits a master file line into tokens and returns the
+// change in parentheses depth. Comments are stripped.
+func tokenizeZoneLine(line string) ([]zoneToken, int, error) {
+	tokens := make([]zoneToken, 0)
+	depth := 0
+	i := 0
+	for i < len(line) {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == ';':
+			return tokens, depth, nil
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		case c == '"':
+			value, n, err := unquoteZoneString(line[i+1:])
+			if err != nil {
+				return nil, 0, err
+			}
+			tokens = append(tokens, zoneToken{value: value, quoted: true, first: i == 0})
+			i += n + 1
+		default:
+			start := i
+			for i < len(line) && !strings.ContainsRune(" \t\r;()\"", rune(line[i])) {
+				if line[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i > len(line) {
+				i = len(line)
+			}
+			tokens = append(tokens, zoneToken{value: line[start:i], first: start == 0})
+		}
+	}
+	return tokens, depth, nil
+}
+
+// unquoteZoneString reads a quoted string up to the closing quote and
+// resolves the \X and \DDD escapes. It returns the string and the
+// number of bytes read, including the closing quote.
+func unquoteZoneString(s string) (string, int, error) {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return out.String(), i + 1, nil
+		case '\\':
+			if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+				n, _ := strconv.Atoi(s[i+1 : i+4])
+				if n > 255 {
+					return "", 0, fmt.Errorf("invalid escape \\%v", s[i+1:i+4])
+				}
+				out.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+			if i+1 < len(s) {
+				i++
+				out.WriteByte(s[i])
+			}
+		default:
+			out.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quoted string")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+type zoneParser struct {
+	origin string
+	ttl    uint32
+	owner  string
+}
+
+func (p *zoneParser) parseEntry(z *ZoneResolver, tokens []zoneToken) error {
+	if !tokens[0].quoted && strings.HasPrefix(tokens[0].value, "$") {
+		return p.parseDirective(tokens)
+	}
+
+	if tokens[0].first {
+		p.owner = p.absoluteName(tokens[0].value)
+		tokens = tokens[1:]
+	}
+	if p.owner == "" {
+		return fmt.Errorf("record without owner name")
+	}
+
+	// [<TTL>] [<class>] <type> <RDATA> or [<class>] [<TTL>] <type> <RDATA>
+	ttl := p.ttl
+	for len(tokens) > 0 {
+		value := strings.ToUpper(tokens[0].value)
+		if value == "IN" {
+			tokens = tokens[1:]
+			continue
+		}
+		if t, err := parseTTL(value); err == nil {
+			ttl = t
+			tokens = tokens[1:]
+			continue
+		}
+		break
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("record without type")
+	}
+
+	qtype := strings.ToUpper(tokens[0].value)
+	rdata := make([]string, 0, len(tokens)-1)
+	for _, token := range tokens[1:] {
+		rdata = append(rdata, token.value)
+	}
+	switch qtype {
+	case "MX":
+		if len(rdata) == 2 {
+			rdata[1] = p.absoluteName(rdata[1])
+		}
+	case "PTR", "CNAME":
+		if len(rdata) == 1 {
+			rdata[0] = p.absoluteName(rdata[0])
+		}
+	case "TXT":
+		for i, token := range tokens[1:] {
+			if !token.quoted {
+				rdata[i] = unescapeZoneString(token.value)
+			}
+		}
+	}
+	return z.AddRecord(p.owner, qtype, ttl, rdata...)
+}
+
+func (p *zoneParser) parseDirective(tokens []zoneToken) error {
+	switch strings.ToUpper(tokens[0].value) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return fmt.Errorf("$ORIGIN needs one domain name")
+		}
+		p.origin = p.absoluteName(tokens[1].value)
+	case "$TTL":
+		if len(tokens) != 2 {
+			return fmt.Errorf("$TTL needs one value")
+		}
+		ttl, err := parseTTL(tokens[1].value)
+		if err != nil {
+			return err
+		}
+		p.ttl = ttl
+	default:
+		return fmt.Errorf("unsupported directive %v", tokens[0].value)
+	}
+	return nil
+}
+
+// absoluteName resolves "@" and names relative to the current origin.
+func (p *zoneParser) absoluteName(name string) string {
+	if name == "@" {
+		return p.origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return canonicalName(name)
+	}
+	if p.origin == "" {
+		return canonicalName(name)
+	}
+	return canonicalName(name + "." + p.origin)
+}
+
+// parseTTL parses a TTL in seconds, also accepting the BIND style
+// unit suffixes (e.g. "1h30m").
+func parseTTL(value string) (uint32, error) {
+	if n, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	units := map[byte]uint64{'S': 1, 'M': 60, 'H': 3600, 'D': 86400, 'W': 604800}
+	total := uint64(0)
+	start := 0
+	value = strings.ToUpper(value)
+	for i := 0; i < len(value); i++ {
+		if isDigit(value[i]) {
+			continue
+		}
+		unit, ok := units[value[i]]
+		if !ok || i == start {
+			return 0, fmt.Errorf("invalid TTL %v", value)
+		}
+		n, _ := strconv.ParseUint(value[start:i], 10, 32)
+		total += n * unit
+		start = i + 1
+	}
+	if start != len(value) || total > 1<<31-1 {
+		return 0, fmt.Errorf("invalid TTL %v", value)
+	}
+	return uint32(total), nil
+}
+
+// unescapeZoneString resolves the escapes in an unquoted character-string.
+func unescapeZoneString(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	out, _, err := unquoteZoneString(s + "\"")
+	if err != nil {
+		return s
+	}
+	return out
+}
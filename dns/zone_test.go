@@ -0,0 +1,149 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestZoneResolver(t *testing.T) {
+
+	Convey("Testing ZoneResolver", t, func() {
+
+		z, err := LoadZoneFile("testdata/example.com.zone", "")
+		So(err, ShouldEqual, nil)
+
+		Convey("TXT records", func() {
+			record, err := z.GetSPFRecord("example.com")
+			So(err, ShouldEqual, nil)
+			So(record, ShouldEqual, "v=spf1 mx a:relay ip6:2001:db8::/32 include:_spf.example.net -all")
+
+			record, err = z.GetSPFRecord("LONG.example.com.")
+			So(err, ShouldEqual, nil)
+			So(record, ShouldEqual, "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 -all")
+
+			record, err = z.GetSPFRecord("escaped.example.com")
+			So(err, ShouldEqual, nil)
+			So(record, ShouldEqual, `v=spf1 exp="quoted" ; -all`)
+
+			_, err = z.GetSPFRecord("mx1.example.com")
+			So(IsNotFound(err), ShouldEqual, true)
+
+			_, err = z.GetSPFRecord("nonexistent.example.com")
+			So(IsNotFound(err), ShouldEqual, true)
+		})
+
+		Convey("Address records", func() {
+			ips, err := z.GetARecords("mx1.example.com")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"192.0.2.10"})
+
+			ips, err = z.GetARecords("mx2.example.com")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"192.0.2.20"})
+
+			ips, err = z.GetAAAARecords("mx2.example.com")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"2001:db8::20"})
+
+			ips, err = z.GetARecords("relay.example.com")
+			So(err, ShouldEqual, nil)
+			So(ips, ShouldResemble, []string{"192.0.2.10"})
+
+			_, err = z.GetAAAARecords("mx1.example.com")
+			So(IsNotFound(err), ShouldEqual, true)
+		})
+
+		Convey("MX records", func() {
+			mxs, err := z.GetMXRecords("example.com")
+			So(err, ShouldEqual, nil)
+			So(mxs, ShouldResemble, []*net.MX{
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx2.example.com.", Pref: 20},
+			})
+		})
+
+		Convey("PTR records", func() {
+			names, err := z.GetPTRRecords("192.0.2.10")
+			So(err, ShouldEqual, nil)
+			So(names, ShouldResemble, []string{"mx1.example.com."})
+
+			_, err = z.GetPTRRecords("192.0.2.11")
+			So(IsNotFound(err), ShouldEqual, true)
+		})
+
+		Convey("TTLs", func() {
+			z.mu.RLock()
+			defer z.mu.RUnlock()
+			So(z.records["example.com"]["TXT"][0].ttl, ShouldEqual, 3600)
+			So(z.records["mx1.example.com"]["A"][0].ttl, ShouldEqual, 300)
+			So(z.records["mx2.example.com"]["A"][0].ttl, ShouldEqual, 300)
+		})
+
+		Convey("Injected failures", func() {
+			z.Fail("example.com", ServFail)
+			_, err := z.GetSPFRecord("example.com")
+			So(err, ShouldNotEqual, nil)
+			So(IsNotFound(err), ShouldEqual, false)
+			So(err.(*net.DNSError).IsTemporary, ShouldEqual, true)
+
+			z.FailType("mx1.example.com", "a", Timeout)
+			_, err = z.GetARecords("mx1.example.com")
+			So(err.(*net.DNSError).IsTimeout, ShouldEqual, true)
+			_, err = z.GetPTRRecords("192.0.2.10")
+			So(err, ShouldEqual, nil)
+
+			z.Fail("mx2.example.com", NXDomain)
+			_, err = z.GetARecords("mx2.example.com")
+			So(IsNotFound(err), ShouldEqual, true)
+
+			z.ClearFailures()
+			_, err = z.GetSPFRecord("example.com")
+			So(err, ShouldEqual, nil)
+		})
+	})
+
+	Convey("Testing invalid zones", t, func() {
+		zones := []string{
+			"example.com. TXT \"unterminated",
+			"example.com. TXT ( \"v=spf1\"",
+			"example.com. A 2001:db8::1",
+			"example.com. MX mx.example.com.",
+			"example.com. SOA ns.example.com. hostmaster.example.com. 1 2 3 4 5",
+			"$INCLUDE other.zone",
+			"  A 192.0.2.1",
+		}
+		for _, zone := range zones {
+			So(NewZoneResolver().Load(strings.NewReader(zone), ""), ShouldNotEqual, nil)
+		}
+	})
+
+	Convey("Testing programmatic records", t, func() {
+		z := NewZoneResolver()
+		So(z.AddRecord("Example.ORG.", "txt", 60, "v=spf1 ", "-all"), ShouldEqual, nil)
+		So(z.AddRecord("example.org", "A", 60, "192.0.2.1"), ShouldEqual, nil)
+		So(z.AddRecord("example.org", "A", 60, "not-an-ip"), ShouldNotEqual, nil)
+
+		record, err := z.GetSPFRecord("example.org")
+		So(err, ShouldEqual, nil)
+		So(record, ShouldEqual, "v=spf1 -all")
+	})
+}
+
+func TestReverseName(t *testing.T) {
+
+	Convey("Testing ReverseName()", t, func() {
+		name, err := ReverseName("192.0.2.10")
+		So(err, ShouldEqual, nil)
+		So(name, ShouldEqual, "10.2.0.192.in-addr.arpa.")
+
+		name, err = ReverseName("2001:db8::1")
+		So(err, ShouldEqual, nil)
+		So(name, ShouldEqual, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.")
+
+		_, err = ReverseName("example.com")
+		So(err, ShouldNotEqual, nil)
+	})
+}
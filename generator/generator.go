@@ -0,0 +1,514 @@
+// Package generator builds SPF records from an inventory of the sending
+// sources of domains: their outbound addresses, relay hosts and the
+// includes of their ESPs (see Inventory).
+//
+//	g := &generator.Generator{Resolver: resolver}
+//	record, err := g.Generate("example.com", inventory["example.com"])
+//	// record.Text: "v=spf1 ip4:192.0.2.0/30 include:_spf.esp.example a:relay.example.com -all"
+//
+// The networks are aggregated, the terms ordered by volume and the hosts
+// replaced by their addresses when the record would exceed the DNS lookup
+// limit. Every generated record is evaluated with gospf against the inventory
+// to prove it authorizes exactly the same addresses.
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/ipset"
+	"github.com/mistralmail/gospf/provider"
+)
+
+// DefaultMaxLength is the default size budget of a record. Longer records
+// don't fit in the 512 byte DNS responses of UDP with the other fields.
+const DefaultMaxLength = 450
+
+// ErrNotEquivalent is returned when a record doesn't authorize the same
+// addresses as the inventory.
+var ErrNotEquivalent = errors.New("record isn't equivalent to the inventory")
+
+// Generator generates SPF records. At least Resolver must be set.
+type Generator struct {
+	// Resolver looks up the addresses of the hosts and the included policies.
+	Resolver dns.DnsResolver
+	// MaxLookups is the DNS lookup budget of a record, gospf.DNSLookupLimit if 0.
+	MaxLookups int
+	// MaxLength is the size budget of a record, DefaultMaxLength if 0.
+	MaxLength int
+	// Providers names the providers of the terms, provider.Default() if nil.
+	Providers *provider.Catalog
+}
+
+// Record is a generated SPF record.
+type Record struct {
+	Domain     string
+	Text       string   // the record, e.g. "v=spf1 ip4:192.0.2.0/24 -all"
+	Terms      []string // the terms of Text without the version
+	DNSLookups int      // DNS lookups of an evaluation, including the ones of the includes
+	// Flattened are the hosts (or "mx") replaced by their addresses,
+	// because of Sources.Flatten or to stay within MaxLookups.
+	Flattened []string
+	// Providers are the names of the providers of the include and network
+	// terms, by term, e.g. "include:_spf.google.com": "Google Workspace".
+	Providers map[string]string
+}
+
+// candidate is a term that queries DNS.
+type candidate struct {
+	term    string
+	source  string // key of Sources.Volume
+	lookups int
+	volume  int
+	nets    []net.IPNet // addresses of a host or MX term, nil for includes
+	order   int
+}
+
+// Generate builds the smallest record for the sources of domain that stays
+// within the lookup and size budgets, and verifies it with Verify.
+func (g *Generator) Generate(domain string, sources *Sources) (*Record, error) {
+	domain = canonicalName(domain)
+	// candidates merges the hosts into mx, don't change the inventory
+	copied := *sources
+	copied.Volume = make(map[string]int, len(sources.Volume))
+	for source, volume := range sources.Volume {
+		copied.Volume[canonicalName(source)] += volume
+	}
+	sources = &copied
+	all, err := allTerm(sources.All)
+	if err != nil {
+		return nil, err
+	}
+	static, err := parseNetworks(sources.IPs)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := g.candidates(domain, sources)
+	if err != nil {
+		return nil, err
+	}
+	// the volume of the networks, flattened hosts pass theirs on to their addresses
+	volumes := make(map[string]int, len(static))
+	for _, ip := range sources.IPs {
+		volumes[ip] += sources.Volume[canonicalName(ip)]
+	}
+
+	record := &Record{Domain: domain, Flattened: make([]string, 0), Providers: make(map[string]string)}
+	maxLookups := g.MaxLookups
+	if maxLookups <= 0 {
+		maxLookups = gospf.DNSLookupLimit
+	}
+	for {
+		lookups := 0
+		for _, c := range candidates {
+			lookups += c.lookups
+		}
+		// flatten hosts as requested, or the one with the least volume to save lookups
+		flatten := -1
+		for i, c := range candidates {
+			if c.nets == nil {
+				continue
+			}
+			if sources.Flatten {
+				flatten = i
+				break
+			}
+			if lookups > maxLookups && (flatten == -1 || c.volume < candidates[flatten].volume) {
+				flatten = i
+			}
+		}
+		if flatten == -1 {
+			if lookups > maxLookups {
+				return nil, fmt.Errorf("%v needs %v DNS lookups, more than %v", domain, lookups, maxLookups)
+			}
+			record.DNSLookups = lookups
+			break
+		}
+		static = append(static, candidates[flatten].nets...)
+		for _, n := range candidates[flatten].nets {
+			volumes[n.String()] += candidates[flatten].volume
+		}
+		record.Flattened = append(record.Flattened, candidates[flatten].source)
+		candidates = append(candidates[:flatten], candidates[flatten+1:]...)
+	}
+
+	catalog := g.Providers
+	if catalog == nil {
+		catalog = provider.Default()
+	}
+	for _, ipNet := range orderStatic(ipset.New(static...).Networks(), volumes) {
+		record.Terms = append(record.Terms, networkTerm(ipNet))
+		if p := catalog.Network(ipNet); p != nil {
+			record.Providers[networkTerm(ipNet)] = p.Name
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.volume != b.volume {
+			return a.volume > b.volume
+		}
+		if a.lookups != b.lookups {
+			return a.lookups < b.lookups
+		}
+		return a.order < b.order
+	})
+	for _, c := range candidates {
+		record.Terms = append(record.Terms, c.term)
+		if p := catalog.Domain(c.source); c.nets == nil && p != nil {
+			record.Providers[c.term] = p.Name
+		}
+	}
+	record.Terms = append(record.Terms, all)
+	record.Text = "v=spf1 " + strings.Join(record.Terms, " ")
+
+	maxLength := g.MaxLength
+	if maxLength <= 0 {
+		maxLength = DefaultMaxLength
+	}
+	if len(record.Text) > maxLength {
+		return nil, fmt.Errorf("the record of %v is %v bytes long, more than %v", domain, len(record.Text), maxLength)
+	}
+	if err := g.Verify(record, sources); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// candidates returns the DNS querying terms of the sources: a or mx terms
+// for the hosts and include terms.
+func (g *Generator) candidates(domain string, sources *Sources) ([]*candidate, error) {
+	candidates := make([]*candidate, 0)
+	add := func(c *candidate) {
+		c.volume = sources.Volume[c.source]
+		c.order = len(candidates)
+		candidates = append(candidates, c)
+	}
+
+	hosts := make([]string, 0, len(sources.Hosts))
+	for _, host := range sources.Hosts {
+		hosts = append(hosts, canonicalName(host))
+	}
+	mxHosts, err := g.mxHosts(domain, sources.MX || len(hosts) > 1)
+	if err != nil {
+		return nil, err
+	}
+	if !sources.MX && len(mxHosts) > 1 && containsAll(hosts, mxHosts) {
+		// the MX hosts send mail too, one mx term replaces their a terms
+		volume := 0
+		for _, host := range mxHosts {
+			volume += sources.Volume[host]
+			hosts = remove(hosts, host)
+		}
+		sources.Volume["mx"] += volume
+		sources.MX = true
+	}
+
+	if sources.MX {
+		if len(mxHosts) == 0 {
+			return nil, fmt.Errorf("%v has no MX hosts", domain)
+		}
+		nets := make([]net.IPNet, 0)
+		for _, host := range mxHosts {
+			hostNets, err := g.addresses(host)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, hostNets...)
+		}
+		add(&candidate{term: "mx", source: "mx", lookups: 1, nets: nets})
+	}
+	for _, host := range hosts {
+		nets, err := g.addresses(host)
+		if err != nil {
+			return nil, err
+		}
+		term := "a:" + host
+		if host == domain {
+			term = "a"
+		}
+		add(&candidate{term: term, source: host, lookups: 1, nets: nets})
+	}
+	for _, include := range sources.Includes {
+		spf, err := gospf.New(canonicalName(include), g.Resolver)
+		if err != nil {
+			return nil, fmt.Errorf("include %v: %v", include, problem(err))
+		}
+		add(&candidate{term: "include:" + canonicalName(include), source: canonicalName(include), lookups: 1 + spf.DNSLookupCount()})
+	}
+	return candidates, nil
+}
+
+// mxHosts returns the MX hosts of domain, when needed.
+func (g *Generator) mxHosts(domain string, needed bool) ([]string, error) {
+	if !needed {
+		return nil, nil
+	}
+	mxs, err := g.Resolver.GetMXRecords(domain)
+	if err != nil && !dns.IsNotFound(err) {
+		return nil, fmt.Errorf("MX of %v: %v", domain, err)
+	}
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, canonicalName(mx.Host))
+	}
+	if len(hosts) > gospf.DNSLookupLimit {
+		// evaluators only look up the addresses of the first 10
+		return nil, fmt.Errorf("%v has more than %v MX hosts", domain, gospf.DNSLookupLimit)
+	}
+	return hosts, nil
+}
+
+// addresses returns the IPv4 and IPv6 addresses of host.
+func (g *Generator) addresses(host string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0)
+	for _, lookup := range []func(string) ([]string, error){g.Resolver.GetARecords, g.Resolver.GetAAAARecords} {
+		addrs, err := lookup(host)
+		if err != nil && !dns.IsNotFound(err) {
+			return nil, fmt.Errorf("addresses of %v: %v", host, err)
+		}
+		for _, addr := range addrs {
+			ipNet, err := ipset.ParseNetwork(addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %v of %v", addr, host)
+			}
+			nets = append(nets, ipNet)
+		}
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("host %v has no addresses", host)
+	}
+	return nets, nil
+}
+
+// orderStatic orders the networks of ip4 and ip6 terms by the volume of the
+// networks they contain. They don't cost lookups, so they always come first.
+func orderStatic(nets []net.IPNet, volumes map[string]int) []net.IPNet {
+	netVolumes := make([]int, len(nets))
+	for i, ipNet := range nets {
+		for network, volume := range volumes {
+			if n, err := ipset.ParseNetwork(network); err == nil && ipNet.Contains(n.IP) {
+				netVolumes[i] += volume
+			}
+		}
+	}
+	order := make([]int, len(nets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return netVolumes[order[i]] > netVolumes[order[j]]
+	})
+	ordered := make([]net.IPNet, len(nets))
+	for i, j := range order {
+		ordered[i] = nets[j]
+	}
+	return ordered
+}
+
+/*
+Verify evaluates the record with gospf against the sources, and returns an
+error wrapping ErrNotEquivalent when an address gets another result. The
+compared addresses are the first and the last address of every network of
+the sources, of the included policies and of the record, and the addresses
+just outside of them.
+*/
+func (g *Generator) Verify(record *Record, sources *Sources) error {
+	all, err := allTerm(sources.All)
+	if err != nil {
+		return err
+	}
+	otherResult := map[string]string{"-all": "Fail", "~all": "SoftFail", "?all": "Neutral"}[all]
+
+	resolver := &recordResolver{DnsResolver: g.Resolver, domain: record.Domain, record: record.Text}
+	spf, err := gospf.New(record.Domain, resolver)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotEquivalent, problem(err))
+	}
+	if spf.DNSLookupCount() > gospf.DNSLookupLimit {
+		return fmt.Errorf("%w: %v DNS lookups", ErrNotEquivalent, spf.DNSLookupCount())
+	}
+
+	// the addresses authorized by the inventory
+	authorized, err := parseNetworks(sources.IPs)
+	if err != nil {
+		return err
+	}
+	for _, host := range sources.Hosts {
+		nets, err := g.addresses(canonicalName(host))
+		if err != nil {
+			return err
+		}
+		authorized = append(authorized, nets...)
+	}
+	if sources.MX {
+		hosts, err := g.mxHosts(record.Domain, true)
+		if err != nil {
+			return err
+		}
+		for _, host := range hosts {
+			nets, err := g.addresses(host)
+			if err != nil {
+				return err
+			}
+			authorized = append(authorized, nets...)
+		}
+	}
+	includes := make([]*gospf.SPF, 0, len(sources.Includes))
+	for _, include := range sources.Includes {
+		included, err := gospf.New(canonicalName(include), g.Resolver)
+		if err != nil {
+			return fmt.Errorf("include %v: %v", include, problem(err))
+		}
+		includes = append(includes, included)
+	}
+	authorizedSet := ipset.New(authorized...)
+	expected := func(ip string) string {
+		if authorizedSet.Contains(net.ParseIP(ip)) {
+			return "Pass"
+		}
+		for _, included := range includes {
+			result, err := included.CheckIP(ip)
+			if err != nil {
+				return problem(err)
+			}
+			if result == "Pass" {
+				return "Pass"
+			}
+		}
+		return otherResult
+	}
+
+	probes := make(map[string]struct{})
+	addProbes(probes, authorized)
+	addProbes(probes, networksOf(spf))
+	for _, included := range includes {
+		addProbes(probes, networksOf(included))
+	}
+	mismatches := make([]string, 0)
+	for ip := range probes {
+		want := expected(ip)
+		got, err := spf.CheckIP(ip)
+		if err != nil {
+			got = problem(err)
+		}
+		if got != want {
+			mismatches = append(mismatches, fmt.Sprintf("%v: %v instead of %v", ip, got, want))
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return fmt.Errorf("%w: %v", ErrNotEquivalent, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// networksOf returns the networks of spf, its includes and its redirect.
+func networksOf(spf *gospf.SPF) []net.IPNet {
+	nets := make([]net.IPNet, 0)
+	for _, list := range [][]net.IPNet{spf.Pass, spf.Neutral, spf.SoftFail, spf.Fail} {
+		nets = append(nets, list...)
+	}
+	for _, include := range spf.Includes {
+		nets = append(nets, networksOf(include.SPF)...)
+	}
+	if spf.Redirect != nil {
+		nets = append(nets, networksOf(spf.Redirect)...)
+	}
+	return nets
+}
+
+// addProbes adds the first and last address of the networks, and the
+// addresses next to them.
+func addProbes(probes map[string]struct{}, nets []net.IPNet) {
+	for _, n := range nets {
+		r := ipset.New(n).Ranges()[0]
+		for _, ip := range []net.IP{r.First, r.Last, ipset.Prev(r.First), ipset.Next(r.Last)} {
+			if ip != nil {
+				probes[ip.String()] = struct{}{}
+			}
+		}
+	}
+}
+
+// recordResolver returns record as the SPF record of domain.
+type recordResolver struct {
+	dns.DnsResolver
+	domain string
+	record string
+}
+
+func (r *recordResolver) GetSPFRecord(name string) (string, error) {
+	if canonicalName(name) == r.domain {
+		return r.record, nil
+	}
+	return r.DnsResolver.GetSPFRecord(name)
+}
+
+// networkTerm returns the ip4 or ip6 term of n, without the prefix length
+// of single addresses.
+func networkTerm(n net.IPNet) string {
+	ones, bits := n.Mask.Size()
+	mechanism := "ip4:"
+	if bits == 128 {
+		mechanism = "ip6:"
+	}
+	if ones == bits {
+		return mechanism + n.IP.String()
+	}
+	return mechanism + n.String()
+}
+
+func parseNetworks(ips []string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		ipNet, err := ipset.ParseNetwork(ip)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// problem returns the result and the description of an error of gospf.
+func problem(err error) string {
+	if s, ok := err.(fmt.Stringer); ok {
+		return err.Error() + " (" + s.String() + ")"
+	}
+	return err.Error()
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func containsAll(set []string, items []string) bool {
+	for _, item := range items {
+		found := false
+		for _, s := range set {
+			if s == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func remove(list []string, item string) []string {
+	out := list[:0]
+	for _, s := range list {
+		if s != item {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package generator
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/provider"
+)
+
+const generatorZone = `
+$ORIGIN example.com.
+@          A     192.0.2.10
+           MX    10 mx1.example.com.
+           MX    20 mx2.example.com.
+mx1        A     192.0.2.20
+mx2        A     192.0.2.21
+relay      A     198.51.100.7
+           AAAA  2001:db8::7
+$ORIGIN esp.example.
+_spf       TXT   "v=spf1 ip4:203.0.113.0/24 include:_spf2.esp.example -all"
+_spf2      TXT   "v=spf1 ip6:2001:db8:ff::/48 ~all"
+$ORIGIN many.example.
+@          TXT   "v=spf1 a:h1.many.example a:h2.many.example a:h3.many.example a:h4.many.example a:h5.many.example a:h6.many.example a:h7.many.example -all"
+h1         A     192.0.2.101
+h2         A     192.0.2.102
+h3         A     192.0.2.103
+h4         A     192.0.2.104
+h5         A     192.0.2.105
+h6         A     192.0.2.106
+h7         A     192.0.2.107
+`
+
+const inventoryYAML = `
+example.com:
+  all: softfail
+  ips: [192.0.2.1, 192.0.2.2, 192.0.2.3, 192.0.2.0, 2001:db8:1::/48]
+  hosts: [example.com, relay.example.com]
+  includes: [_spf.esp.example]
+  volume:
+    _spf.esp.example: 70
+    relay.example.com: 20
+    192.0.2.1: 5
+    2001:db8:1::/48: 10
+mx.example.com:
+  hosts: [mx1.example.com, mx2.example.com]
+`
+
+func TestGenerate(t *testing.T) {
+	Convey("Testing the record generator", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(generatorZone), ""), ShouldEqual, nil)
+		inventory, err := ParseInventory(strings.NewReader(inventoryYAML))
+		So(err, ShouldEqual, nil)
+		g := &Generator{Resolver: z}
+
+		Convey("Networks are aggregated and terms ordered by volume", func() {
+			record, err := g.Generate("example.com", inventory["example.com"])
+			So(err, ShouldEqual, nil)
+			So(record.Text, ShouldEqual, "v=spf1 ip6:2001:db8:1::/48 ip4:192.0.2.0/30 include:_spf.esp.example a:relay.example.com a ~all")
+			So(record.DNSLookups, ShouldEqual, 4)
+			So(record.Flattened, ShouldBeEmpty)
+			So(record.Providers, ShouldBeEmpty)
+		})
+
+		Convey("The providers of the terms are named", func() {
+			g.Providers, err = provider.NewCatalog(provider.Provider{Name: "Example ESP", Domains: []string{"esp.example"}, Networks: []string{"2001:db8::/32"}})
+			So(err, ShouldEqual, nil)
+			record, err := g.Generate("example.com", inventory["example.com"])
+			So(err, ShouldEqual, nil)
+			So(record.Providers, ShouldResemble, map[string]string{
+				"ip6:2001:db8:1::/48":      "Example ESP",
+				"include:_spf.esp.example": "Example ESP",
+			})
+		})
+
+		Convey("Hosts that are the MX hosts become mx", func() {
+			sources := inventory["mx.example.com"]
+			record, err := g.Generate("example.com", sources)
+			So(err, ShouldEqual, nil)
+			So(record.Text, ShouldEqual, "v=spf1 mx -all")
+			So(sources.MX, ShouldEqual, false)
+		})
+
+		Convey("Hosts are flattened on request or to stay within the budget", func() {
+			sources := *inventory["example.com"]
+			sources.Flatten = true
+			record, err := g.Generate("example.com", &sources)
+			So(err, ShouldEqual, nil)
+			So(record.Text, ShouldEqual, "v=spf1 ip4:198.51.100.7 ip6:2001:db8::7 ip6:2001:db8:1::/48 ip4:192.0.2.0/30 ip4:192.0.2.10 include:_spf.esp.example ~all")
+			So(record.Flattened, ShouldResemble, []string{"example.com", "relay.example.com"})
+
+			g.MaxLookups = 3
+			record, err = g.Generate("example.com", inventory["example.com"])
+			So(err, ShouldEqual, nil)
+			So(record.Flattened, ShouldResemble, []string{"example.com"})
+			So(record.Text, ShouldEqual, "v=spf1 ip6:2001:db8:1::/48 ip4:192.0.2.0/30 ip4:192.0.2.10 include:_spf.esp.example a:relay.example.com ~all")
+
+			g.MaxLookups = 2
+			record, err = g.Generate("example.com", inventory["example.com"])
+			So(err, ShouldEqual, nil)
+			So(record.Flattened, ShouldResemble, []string{"example.com", "relay.example.com"})
+			So(record.DNSLookups, ShouldEqual, 2)
+
+			g.MaxLookups = 1
+			_, err = g.Generate("example.com", inventory["example.com"])
+			So(err.Error(), ShouldEqual, "example.com needs 2 DNS lookups, more than 1")
+		})
+
+		Convey("Includes count with their own lookups", func() {
+			record, err := g.Generate("example.org", &Sources{Includes: []string{"many.example", "_spf.esp.example"}})
+			So(err, ShouldEqual, nil)
+			So(record.DNSLookups, ShouldEqual, 10)
+			_, err = g.Generate("example.org", &Sources{Includes: []string{"many.example", "_spf.esp.example", "_spf2.esp.example"}})
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Records must fit in the size budget", func() {
+			g.MaxLength = 30
+			_, err := g.Generate("example.com", inventory["example.com"])
+			So(err.Error(), ShouldContainSubstring, "more than 30")
+		})
+
+		Convey("Records that authorize other addresses are rejected", func() {
+			sources := &Sources{IPs: []string{"192.0.2.0/30"}}
+			record, err := g.Generate("example.org", sources)
+			So(err, ShouldEqual, nil)
+			record.Text = "v=spf1 ip4:192.0.2.0/29 -all"
+			err = g.Verify(record, sources)
+			So(errors.Is(err, ErrNotEquivalent), ShouldEqual, true)
+			So(err.Error(), ShouldContainSubstring, "192.0.2.7: Pass instead of Fail")
+		})
+
+		Convey("Invalid inventories are rejected", func() {
+			_, err := ParseInventory(strings.NewReader("example.com:\n  ipv4: [192.0.2.1]\n"))
+			So(err, ShouldNotEqual, nil)
+			_, err = ParseInventory(strings.NewReader("example.com:\n"))
+			So(err, ShouldNotEqual, nil)
+			_, err = g.Generate("example.com", &Sources{All: "pass"})
+			So(err, ShouldNotEqual, nil)
+			_, err = g.Generate("example.com", &Sources{IPs: []string{"192.0.2.300"}})
+			So(err, ShouldNotEqual, nil)
+			_, err = g.Generate("example.com", &Sources{Hosts: []string{"none.example.com"}})
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package generator
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Inventory maps domains to their sending sources. It's read from YAML:
+
+	example.com:
+	  all: softfail            # fail (the default), softfail or neutral
+	  ips: [192.0.2.1, 192.0.2.2, 198.51.100.0/24, "2001:db8::/48"]
+	  hosts: [relay1.example.com, relay2.example.com]
+	  mx: true                 # the MX hosts of the domain send mail
+	  includes: [_spf.esp.example]
+	  volume:                  # share of the mail of a source, orders the terms
+	    _spf.esp.example: 70
+	    relay1.example.com: 20
+	  flatten: false           # replace the hosts by their addresses
+*/
+type Inventory map[string]*Sources
+
+// Sources are the sending sources of a domain.
+type Sources struct {
+	// All is the result of other senders: "fail" (the default),
+	// "softfail" or "neutral", or the all term, e.g. "~all".
+	All string `yaml:"all"`
+	// IPs are addresses and networks in CIDR notation.
+	IPs []string `yaml:"ips"`
+	// Hosts are the names of relays, authorized with their addresses.
+	Hosts []string `yaml:"hosts"`
+	// MX authorizes the MX hosts of the domain.
+	MX bool `yaml:"mx"`
+	// Includes are the domains whose policies are included, e.g. of ESPs.
+	Includes []string `yaml:"includes"`
+	// Volume is the relative amount of mail sent by a source, keyed by the
+	// entry in IPs, Hosts or Includes, or "mx". Sources with more volume
+	// come first in the record, so evaluations can stop early.
+	Volume map[string]int `yaml:"volume"`
+	// Flatten authorizes the hosts (and MX hosts) with their addresses
+	// rather than a or mx terms, which saves lookups but doesn't follow
+	// changes of their addresses.
+	Flatten bool `yaml:"flatten"`
+}
+
+// ParseInventory parses an inventory in YAML.
+func ParseInventory(r io.Reader) (Inventory, error) {
+	var inventory Inventory
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&inventory); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid inventory: %v", err)
+	}
+	for domain, sources := range inventory {
+		if sources == nil {
+			return nil, fmt.Errorf("invalid inventory: no sources for %v", domain)
+		}
+	}
+	return inventory, nil
+}
+
+// LoadInventory reads an inventory from the file at path, see ParseInventory.
+func LoadInventory(path string) (Inventory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseInventory(f)
+}
+
+// allTerm returns the all term of the All value of sources.
+func allTerm(all string) (string, error) {
+	switch strings.ToLower(all) {
+	case "", "fail", "-all":
+		return "-all", nil
+	case "softfail", "~all":
+		return "~all", nil
+	case "neutral", "?all":
+		return "?all", nil
+	}
+	return "", fmt.Errorf("invalid all %q, expected fail, softfail or neutral", all)
+}
@@ -2,4 +2,7 @@ module github.com/mistralmail/gospf
 
 go 1.15
 
-require github.com/smartystreets/goconvey v1.6.4
+require (
+	github.com/smartystreets/goconvey v1.6.4
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/provider"
+)
+
+// runAudit prints the audit report of the policy of a domain.
+func runAudit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	format := flags.String("format", "text", "output format: text, json or html")
+	providersPath := flags.String("providers", "", "YAML file of providers added to the built-in ones, see provider.ParseCatalog")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v audit [flags] domain\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Prints the DNS lookups, records, authorized addresses and problems of the SPF policy of a domain\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *format != "text" && *format != "json" && *format != "html" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	opts := make([]gospf.Option, 0)
+	if *providersPath != "" {
+		catalog, err := provider.LoadCatalog(*providersPath)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, gospf.WithProviders(catalog))
+	}
+
+	resolver := dns.NewCachingResolver(&dns.GoSPFDNS{}, dns.DefaultCacheTTL)
+	report, err := gospf.Audit(flags.Arg(0), resolver, opts...)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "html":
+		return report.WriteHTML(os.Stdout)
+	}
+	fmt.Print(report)
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+)
+
+// runDiff prints the semantic difference of two policies.
+func runDiff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	domain := flags.String("domain", "", "domain of inline records (default: the domain of the other policy)")
+	asJSON := flags.Bool("json", false, "print the difference as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v diff [flags] old new\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Prints the addresses that got or lost each result between two policies, given as domains or records (\"v=spf1 ...\")\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	before, after := flags.Arg(0), flags.Arg(1)
+	if *domain == "" {
+		for _, policy := range []string{before, after} {
+			if !gospf.IsRecord(policy) {
+				*domain = policy
+				break
+			}
+		}
+	}
+
+	resolver := dns.NewCachingResolver(&dns.GoSPFDNS{}, dns.DefaultCacheTTL)
+	diff, err := gospf.DiffPolicies(*domain, before, after, resolver)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(diff)
+	}
+	fmt.Print(diff)
+	return nil
+}
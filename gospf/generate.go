@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/generator"
+	"github.com/mistralmail/gospf/provider"
+)
+
+// runGenerate prints the generated records of the domains of an inventory.
+func runGenerate(args []string) error {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	inventoryPath := flags.String("inventory", "", "YAML file of the sending sources per domain, see generator.Inventory")
+	domain := flags.String("domain", "", "generate only the record of this domain of the inventory")
+	maxLookups := flags.Int("max-lookups", gospf.DNSLookupLimit, "DNS lookup budget of a record")
+	maxLength := flags.Int("max-length", generator.DefaultMaxLength, "size budget of a record in bytes")
+	providersPath := flags.String("providers", "", "YAML file of providers added to the built-in ones, see provider.ParseCatalog")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v generate -inventory file [flags]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Prints the smallest SPF records of the sending sources of an inventory as TXT records\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *inventoryPath == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	inventory, err := generator.LoadInventory(*inventoryPath)
+	if err != nil {
+		return err
+	}
+	domains := make([]string, 0, len(inventory))
+	for name := range inventory {
+		if *domain == "" || name == *domain {
+			domains = append(domains, name)
+		}
+	}
+	if len(domains) == 0 {
+		return fmt.Errorf("%v isn't in the inventory", *domain)
+	}
+	sort.Strings(domains)
+
+	g := &generator.Generator{
+		Resolver:   dns.NewCachingResolver(&dns.GoSPFDNS{}, dns.DefaultCacheTTL),
+		MaxLookups: *maxLookups,
+		MaxLength:  *maxLength,
+	}
+	if *providersPath != "" {
+		if g.Providers, err = provider.LoadCatalog(*providersPath); err != nil {
+			return err
+		}
+	}
+	for _, name := range domains {
+		record, err := g.Generate(name, inventory[name])
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		fmt.Printf("; %v DNS lookups, %v bytes", record.DNSLookups, len(record.Text))
+		if len(record.Flattened) > 0 {
+			fmt.Printf(", flattened %v", record.Flattened)
+		}
+		fmt.Println()
+		for _, term := range record.Terms {
+			if p, ok := record.Providers[term]; ok {
+				fmt.Printf("; %v: %v\n", term, p)
+			}
+		}
+		fmt.Printf("%v. IN TXT %q\n", record.Domain, record.Text)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+)
+
+// runGraph prints the graph of includes and redirects of the policy of a domain.
+func runGraph(args []string) error {
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := flags.String("format", "dot", "output format: dot or json")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v graph [flags] domain\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Prints the includes and redirects of the SPF policy of a domain with their DNS lookups, e.g. for Graphviz: %v graph example.com | dot -Tsvg\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *format != "dot" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	resolver := dns.NewCachingResolver(&dns.GoSPFDNS{}, dns.DefaultCacheTTL)
+	spf, err := gospf.New(flags.Arg(0), resolver)
+	if err != nil {
+		// the errors of gospf name their result, their String has the reason
+		if s, ok := err.(fmt.Stringer); ok {
+			return fmt.Errorf("%v: %v", err, s)
+		}
+		return err
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(spf.Graph())
+	}
+	fmt.Print(spf.Graph().DOT())
+	return nil
+}
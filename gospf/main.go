@@ -2,26 +2,56 @@ package main
 
 import (
 	"fmt"
-	_ "net"
 	"os"
 
 	"github.com/mistralmail/gospf"
 	"github.com/mistralmail/gospf/dns"
 )
 
+// commands are the subcommands of gospf, called with the remaining arguments
+var commands = map[string]func(args []string) error{
+	"policyd":  runPolicyd,
+	"milter":   runMilter,
+	"serve":    runServe,
+	"generate": runGenerate,
+	"diff":     runDiff,
+	"watch":    runWatch,
+	"audit":    runAudit,
+	"graph":    runGraph,
+}
+
 func main() {
 
+	if len(os.Args) >= 2 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	fmt.Println("\nGoSPF")
 	fmt.Printf("-----\n")
 
 	if len(os.Args) < 3 {
 		fmt.Println("Usage: " + os.Args[0] + " domain ip [debug]")
+		fmt.Println("       " + os.Args[0] + " policyd [flags]")
+		fmt.Println("       " + os.Args[0] + " milter [flags]")
+		fmt.Println("       " + os.Args[0] + " serve [flags]")
+		fmt.Println("       " + os.Args[0] + " generate -inventory file [flags]")
+		fmt.Println("       " + os.Args[0] + " diff [flags] old new")
+		fmt.Println("       " + os.Args[0] + " watch [flags] [domain ...]")
+		fmt.Println("       " + os.Args[0] + " audit [flags] domain")
+		fmt.Println("       " + os.Args[0] + " graph [flags] domain")
 		return
 	}
 
 	domain := os.Args[1]
+	ip := os.Args[2]
 
-	spf, err := gospf.New(domain, &dns.GoSPFDNS{})
+	spf, err := gospf.NewForIP(domain, ip, &dns.GoSPFDNS{})
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -32,13 +62,12 @@ func main() {
 		fmt.Printf("\n-----\n")
 	}
 
-	ip := os.Args[2]
 	check, err := spf.CheckIP(ip)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	fmt.Printf(ip, "->", check, "\n")
+	fmt.Println(ip, "->", check)
 
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/milter"
+)
+
+// runMilter runs a milter server until SIGINT or SIGTERM.
+func runMilter(args []string) error {
+	flags := flag.NewFlagSet("milter", flag.ExitOnError)
+	listen := flags.String("listen", "tcp:127.0.0.1:8891", "address to listen on, tcp:host:port or unix:/path")
+	receiver := flags.String("receiver", "", "host name used in the added header (default: the system host name)")
+	authResults := flags.Bool("authentication-results", false, "add an Authentication-Results header instead of Received-SPF")
+	rejectFail := flags.Bool("reject-fail", false, "reject the message at MAIL FROM when the result is Fail")
+	tempFail := flags.Bool("tempfail-temperror", false, "reject the message temporarily at MAIL FROM when the result is TempError")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 10*time.Second, "max time to finish SMTP sessions on shutdown")
+	cacheTTL := flags.Duration("cache-ttl", dns.DefaultCacheTTL, "time DNS answers are cached")
+	cacheSize := flags.Int("cache-size", dns.DefaultCacheSize, "max number of cached DNS answers")
+	policyTTL := flags.Duration("policy-cache-ttl", 0, "max time loaded policies are cached (0 disables the cache)")
+	policyStale := flags.Duration("policy-stale", time.Minute, "time expired policies are still used while they are reloaded")
+	localPolicy := flags.String("local-policy", "", "file of trusted networks and forwarders, only its \"*\" entry is used, see gospf.ParseLocalPolicies")
+	dnsServers := flags.String("dns-servers", "", "comma-separated DNS servers, host or host:port, queried directly to cache answers for their TTLs (default: the Go resolver)")
+	bestGuess := flags.String("best-guess", "", "record evaluated for domains without SPF record, e.g. \""+gospf.DefaultBestGuess+"\" (disabled when empty)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v milter [flags]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Milter server for Sendmail and Postfix, configure it in main.cf with e.g.\n")
+		fmt.Fprintf(flags.Output(), "  smtpd_milters = inet:127.0.0.1:8891\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *receiver == "" {
+		*receiver, _ = os.Hostname()
+	}
+	network, address, err := parseListenAddress(*listen)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		os.Remove(address)
+	}
+
+	resolver := dns.NewCachingResolver(newUpstreamResolver(*dnsServers), *cacheTTL)
+	resolver.Size = *cacheSize
+	server := &milter.Server{
+		Resolver:          resolver,
+		Receiver:          *receiver,
+		Header:            milter.HeaderReceivedSPF,
+		RejectFail:        *rejectFail,
+		TempFailTempError: *tempFail,
+		BestGuess:         *bestGuess,
+	}
+	if *authResults {
+		server.Header = milter.HeaderAuthenticationResults
+	}
+	if *policyTTL > 0 {
+		server.Policies = gospf.NewPolicyCache(*policyTTL)
+		server.Policies.Stale = *policyStale
+	}
+	if *localPolicy != "" {
+		local, err := gospf.LoadLocalPolicies(*localPolicy)
+		if err != nil {
+			return err
+		}
+		server.Local = local["*"]
+	}
+
+	log.Printf("milter listening on %v:%v", network, address)
+	return serveUntilSignal(func() error {
+		return server.ListenAndServe(network, address)
+	}, server.Shutdown, milter.ErrServerClosed, *shutdownTimeout)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/policyd"
+)
+
+// runPolicyd runs a Postfix policy delegation server until SIGINT or SIGTERM.
+func runPolicyd(args []string) error {
+	flags := flag.NewFlagSet("policyd", flag.ExitOnError)
+	listen := flags.String("listen", "tcp:127.0.0.1:10030", "address to listen on, tcp:host:port or unix:/path")
+	receiver := flags.String("receiver", "", "host name used in the Received-SPF header (default: the system host name)")
+	actions := flags.String("actions", "", "result to action table, e.g. \"Fail=REJECT,SoftFail=DEFER_IF_PERMIT\"")
+	idleTimeout := flags.Duration("idle-timeout", 5*time.Minute, "close connections idle for this long")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 10*time.Second, "max time to finish requests on shutdown")
+	cacheTTL := flags.Duration("cache-ttl", dns.DefaultCacheTTL, "time DNS answers are cached")
+	cacheSize := flags.Int("cache-size", dns.DefaultCacheSize, "max number of cached DNS answers")
+	policyTTL := flags.Duration("policy-cache-ttl", 0, "max time loaded policies are cached (0 disables the cache)")
+	policyStale := flags.Duration("policy-stale", time.Minute, "time expired policies are still used while they are reloaded")
+	localPolicy := flags.String("local-policy", "", "file of trusted networks and forwarders per recipient domain, see gospf.ParseLocalPolicies")
+	dnsServers := flags.String("dns-servers", "", "comma-separated DNS servers, host or host:port, queried directly to cache answers for their TTLs (default: the Go resolver)")
+	bestGuess := flags.String("best-guess", "", "record evaluated for domains without SPF record, e.g. \""+gospf.DefaultBestGuess+"\" (disabled when empty)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v policyd [flags]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Postfix policy delegation server, configure it in main.cf with e.g.\n")
+		fmt.Fprintf(flags.Output(), "  smtpd_recipient_restrictions = ..., check_policy_service inet:127.0.0.1:10030\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	table, err := policyd.ParseActions(*actions)
+	if err != nil {
+		return err
+	}
+	if *receiver == "" {
+		*receiver, _ = os.Hostname()
+	}
+	network, address, err := parseListenAddress(*listen)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		os.Remove(address)
+	}
+
+	resolver := dns.NewCachingResolver(newUpstreamResolver(*dnsServers), *cacheTTL)
+	resolver.Size = *cacheSize
+	server := &policyd.Server{
+		Resolver:    resolver,
+		Actions:     table,
+		Receiver:    *receiver,
+		IdleTimeout: *idleTimeout,
+		BestGuess:   *bestGuess,
+	}
+	if *policyTTL > 0 {
+		server.Policies = gospf.NewPolicyCache(*policyTTL)
+		server.Policies.Stale = *policyStale
+	}
+	if *localPolicy != "" {
+		server.Local, err = gospf.LoadLocalPolicies(*localPolicy)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("policyd listening on %v:%v", network, address)
+	return serveUntilSignal(func() error {
+		return server.ListenAndServe(network, address)
+	}, server.Shutdown, policyd.ErrServerClosed, *shutdownTimeout)
+}
+
+// newUpstreamResolver returns the resolver the caching resolver of a
+// server queries: a DNS client querying the comma-separated servers, or the
+// Go resolver when empty.
+func newUpstreamResolver(servers string) dns.DnsResolver {
+	if servers == "" {
+		return &dns.GoSPFDNS{}
+	}
+	return dns.NewClient(strings.Split(servers, ",")...)
+}
+
+// parseListenAddress splits "tcp:host:port" or "unix:/path" in network and address.
+func parseListenAddress(listen string) (string, string, error) {
+	index := strings.Index(listen, ":")
+	if index == -1 {
+		return "", "", fmt.Errorf("invalid listen address %q, expected tcp:host:port or unix:/path", listen)
+	}
+	network, address := listen[:index], listen[index+1:]
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return network, address, nil
+	}
+	return "", "", fmt.Errorf("unsupported network %q in listen address", network)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/httpd"
+	"github.com/mistralmail/gospf/metrics"
+)
+
+// runServe runs the HTTP JSON service until SIGINT or SIGTERM.
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8080", "host:port to listen on")
+	receiver := flags.String("receiver", "", "host name used in the Received-SPF header (default: the system host name)")
+	cacheTTL := flags.Duration("cache-ttl", dns.DefaultCacheTTL, "time DNS answers are cached")
+	cacheSize := flags.Int("cache-size", dns.DefaultCacheSize, "max number of cached DNS answers")
+	concurrency := flags.Int("concurrency", 8, "max DNS queries sent concurrently per check (1 disables prefetching)")
+	policyStale := flags.Duration("policy-stale", time.Minute, "time expired policies are still used while they are reloaded")
+	localPolicy := flags.String("local-policy", "", "file of trusted networks and forwarders per recipient domain, see gospf.ParseLocalPolicies")
+	dnsServers := flags.String("dns-servers", "", "comma-separated DNS servers, host or host:port, queried directly to cache answers for their TTLs (default: the Go resolver)")
+	bestGuess := flags.String("best-guess", "", "record evaluated for domains without SPF record, e.g. \""+gospf.DefaultBestGuess+"\" (disabled when empty)")
+	enableMetrics := flags.Bool("metrics", true, "serve Prometheus metrics on /metrics")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 10*time.Second, "max time to finish requests on shutdown")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v serve [flags]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "HTTP JSON service with the endpoints POST /check, GET /record/{domain}, /healthz, /readyz and /metrics\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *receiver == "" {
+		*receiver, _ = os.Hostname()
+	}
+
+	upstream := newUpstreamResolver(*dnsServers)
+	var m *metrics.Metrics
+	if *enableMetrics {
+		m = metrics.New()
+		upstream = m.Resolver(upstream)
+	}
+	resolver := dns.NewCachingResolver(upstream, *cacheTTL)
+	resolver.Size = *cacheSize
+	if m != nil {
+		m.WatchCache(resolver)
+	}
+	handler := &httpd.Handler{
+		Resolver:    resolver,
+		Receiver:    *receiver,
+		Metrics:     m,
+		Concurrency: *concurrency,
+		Policies:    gospf.NewPolicyCache(*cacheTTL),
+		BestGuess:   *bestGuess,
+	}
+	handler.Policies.Stale = *policyStale
+	if m != nil {
+		m.WatchPolicyCache(handler.Policies)
+	}
+	if *localPolicy != "" {
+		local, err := gospf.LoadLocalPolicies(*localPolicy)
+		if err != nil {
+			return err
+		}
+		handler.Local = local
+	}
+	server := &http.Server{
+		Addr:         *listen,
+		Handler:      handler,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	log.Printf("serving on http://%v", *listen)
+	return serveUntilSignal(server.ListenAndServe, func(ctx context.Context) error {
+		handler.SetReady(false)
+		return server.Shutdown(ctx)
+	}, http.ErrServerClosed, *shutdownTimeout)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serveUntilSignal runs serve until SIGINT or SIGTERM, then calls shutdown
+// and waits for it to finish, so requests in progress complete before the
+// process exits. serve must return closed once shutdown started.
+func serveUntilSignal(serve func() error, shutdown func(context.Context) error, closed error, timeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	done := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-signals:
+		case <-stop:
+			return
+		}
+		log.Printf("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- shutdown(ctx)
+	}()
+
+	err := serve()
+	if !errors.Is(err, closed) {
+		return err
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	return nil
+}
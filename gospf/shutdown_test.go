@@ -0,0 +1,72 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/policyd"
+)
+
+// blockingResolver blocks the SPF lookups until release is closed.
+type blockingResolver struct {
+	dns.DnsResolver
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingResolver) GetSPFRecord(name string) (string, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.DnsResolver.GetSPFRecord(name)
+}
+
+func TestServeUntilSignal(t *testing.T) {
+	Convey("Requests in progress are answered after a signal", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(`example.com. TXT "v=spf1 ip4:192.0.2.1 -all"`), ""), ShouldEqual, nil)
+		resolver := &blockingResolver{DnsResolver: z, started: make(chan struct{}, 1), release: make(chan struct{})}
+		server := &policyd.Server{Resolver: resolver, Receiver: "mx.example.org"}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+
+		result := make(chan error, 1)
+		go func() {
+			result <- serveUntilSignal(func() error {
+				return server.Serve(l)
+			}, server.Shutdown, policyd.ErrServerClosed, 10*time.Second)
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldEqual, nil)
+		defer conn.Close()
+		_, err = conn.Write([]byte("request=smtpd_access_policy\nclient_address=192.0.2.1\nhelo_name=mx.example.com\nsender=user@example.com\n\n"))
+		So(err, ShouldEqual, nil)
+		<-resolver.started
+
+		So(syscall.Kill(os.Getpid(), syscall.SIGTERM), ShouldEqual, nil)
+		returned := false
+		select {
+		case <-result:
+			returned = true
+		case <-time.After(100 * time.Millisecond):
+		}
+		So(returned, ShouldEqual, false)
+
+		close(resolver.release)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		So(err, ShouldEqual, nil)
+		So(line, ShouldStartWith, "action=")
+		So(<-result, ShouldEqual, nil)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/watch"
+)
+
+// runWatch checks the policies of domains on a schedule until SIGINT or SIGTERM.
+func runWatch(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	domainsPath := flags.String("domains", "", "file of the watched domains, one per line (# starts a comment)")
+	interval := flags.Duration("interval", time.Hour, "time between the checks of a domain")
+	historyDir := flags.String("history", "gospf-history", "directory of the history of the policies")
+	keep := flags.Int("keep", 100, "number of history entries kept per domain (0 keeps all)")
+	webhook := flags.String("webhook", "", "URL the events are posted to as JSON (default: print them to stdout)")
+	lookupWarning := flags.Int("lookup-warning", gospf.DNSLookupLimit-2, "number of DNS lookups of a policy that raises a warning")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v watch [flags] [domain ...]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Checks the SPF policies of domains on a schedule and reports changed addresses, lookups near the limit and invalid records\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	domains := flags.Args()
+	if *domainsPath != "" {
+		listed, err := readDomains(*domainsPath)
+		if err != nil {
+			return err
+		}
+		domains = append(domains, listed...)
+	}
+	if len(domains) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	w := &watch.Watcher{
+		Resolver:      dns.NewCachingResolver(&dns.GoSPFDNS{}, dns.DefaultCacheTTL),
+		History:       &watch.History{Dir: *historyDir, MaxEntries: *keep},
+		Notifier:      watch.NewJSONWriter(os.Stdout),
+		LookupWarning: *lookupWarning,
+	}
+	if *webhook != "" {
+		w.Notifier = &watch.Webhook{URL: *webhook}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("shutting down")
+		cancel()
+	}()
+
+	log.Printf("watching %v domains every %v", len(domains), *interval)
+	if err := w.Run(ctx, domains, *interval); err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+// readDomains reads a file of domains, one per line.
+func readDomains(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	domains := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			domains = append(domains, line)
+		}
+	}
+	return domains, scanner.Err()
+}
@@ -0,0 +1,119 @@
+package gospf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Graph is the tree of includes and redirects of a policy as nodes and
+// edges, e.g. to draw it with Graphviz (see DOT) or to store it as JSON.
+// A domain that's included more than once is a single node.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode is the policy of a domain.
+type GraphNode struct {
+	Domain string `json:"domain"`
+	// Lookups are the DNS querying terms of the record of the domain and
+	// TotalLookups the ones of the record and of its includes and redirect.
+	// Restored instances (see Restore) don't keep their terms, their nodes
+	// have no Lookups and only the first one has TotalLookups.
+	Lookups      int    `json:"lookups"`
+	TotalLookups int    `json:"total_lookups"`
+	Provider     string `json:"provider,omitempty"` // see (*SPF).Provider
+}
+
+// GraphEdge is an include or a redirect.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"` // "include" or "redirect"
+	Term string `json:"term"` // e.g. "~include:_spf.example.com"
+	// Ignored is set for redirects of records with an all term.
+	Ignored bool `json:"ignored,omitempty"`
+}
+
+// Graph returns the graph of the instance, its includes and its redirect.
+// The first node is the one of the instance.
+func (spf *SPF) Graph() *Graph {
+	g := &Graph{Nodes: make([]GraphNode, 0), Edges: make([]GraphEdge, 0)}
+	spf.graph(g, make(map[string]bool))
+	return g
+}
+
+// graph adds the node of the instance, unless seen, and returns its total
+// lookups.
+func (spf *SPF) graph(g *Graph, seen map[string]bool) int {
+	seen[strings.ToLower(spf.Domain)] = true
+	index := len(g.Nodes)
+	g.Nodes = append(g.Nodes, GraphNode{Domain: spf.Domain, Lookups: spf.ownLookups(), Provider: spf.Provider()})
+
+	total := g.Nodes[index].Lookups
+	follow := func(edge GraphEdge, child *SPF) {
+		g.Edges = append(g.Edges, edge)
+		if !seen[strings.ToLower(child.Domain)] {
+			total += child.graph(g, seen)
+			return
+		}
+		for _, n := range g.Nodes {
+			if strings.EqualFold(n.Domain, child.Domain) {
+				total += n.TotalLookups
+			}
+		}
+	}
+	for _, include := range spf.Includes {
+		follow(GraphEdge{From: spf.Domain, To: include.SPF.Domain, Kind: "include", Term: include.Term}, include.SPF)
+	}
+	if spf.Redirect != nil {
+		follow(GraphEdge{From: spf.Domain, To: spf.Redirect.Domain, Kind: "redirect", Term: "redirect=" + spf.Redirect.Domain, Ignored: spf.All != "undefined"}, spf.Redirect)
+	}
+	g.Nodes[index].TotalLookups = total
+	return total
+}
+
+// ownLookups returns the DNS querying terms of the record of the instance
+// (RFC 7208 § 4.6.4).
+func (spf *SPF) ownLookups() int {
+	lookups := 0
+	for _, directive := range spf.directives {
+		switch directive.Mechanism {
+		case "include", "a", "mx", "ptr", "exists":
+			lookups++
+		}
+	}
+	for _, modifier := range spf.modifiers {
+		if modifier.Key == "redirect" {
+			lookups++
+		}
+	}
+	return lookups
+}
+
+// DOT returns the graph in the Graphviz DOT language, the nodes labeled
+// with their lookups:
+//
+//	gospf graph example.com | dot -Tsvg > example.com.svg
+func (g *Graph) DOT() string {
+	out := "digraph spf {\n"
+	out += "  node [shape=box];\n"
+	for _, n := range g.Nodes {
+		label := fmt.Sprintf("%v\\n%v lookups, %v in total", n.Domain, n.Lookups, n.TotalLookups)
+		if n.Provider != "" {
+			label += "\\n" + n.Provider
+		}
+		out += fmt.Sprintf("  %q [label=\"%v\"];\n", n.Domain, strings.Replace(label, `"`, `\"`, -1))
+	}
+	for _, e := range g.Edges {
+		attrs := fmt.Sprintf("label=%q", e.Term)
+		if e.Kind == "redirect" {
+			attrs += ", style=dashed"
+		}
+		if e.Ignored {
+			attrs += ", color=gray"
+		}
+		out += fmt.Sprintf("  %q -> %q [%v];\n", e.From, e.To, attrs)
+	}
+	return out + "}\n"
+}
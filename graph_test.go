@@ -0,0 +1,79 @@
+package gospf
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+const graphZone = `
+$ORIGIN example.com.
+@          TXT   "v=spf1 a mx include:_spf.example.com ~include:_spf.google.com redirect=_old.example.com -all"
+           A     192.0.2.1
+           MX    10 @
+_spf       TXT   "v=spf1 include:_spf.google.com ip4:198.51.100.0/24 -all"
+_old       TXT   "v=spf1 -all"
+loop       TXT   "v=spf1 include:_a.example.com -all"
+_a         TXT   "v=spf1 ip4:192.0.2.0/24 redirect=_b.example.com"
+_b         TXT   "v=spf1 include:LOOP.example.com. -all"
+self       TXT   "v=spf1 redirect=self.example.com"
+$ORIGIN google.com.
+_spf       TXT   "v=spf1 ip4:209.85.128.0/17 ~all"
+`
+
+func TestGraph(t *testing.T) {
+	Convey("Testing include graphs", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(graphZone), ""), ShouldEqual, nil)
+
+		Convey("Includes and redirects are nodes and edges with their lookups", func() {
+			spf, err := New("example.com", z)
+			So(err, ShouldEqual, nil)
+			g := spf.Graph()
+			So(g.Nodes, ShouldResemble, []GraphNode{
+				{Domain: "example.com", Lookups: 5, TotalLookups: 6},
+				{Domain: "_spf.example.com", Lookups: 1, TotalLookups: 1},
+				{Domain: "_spf.google.com", Provider: "Google Workspace"},
+				{Domain: "_old.example.com"},
+			})
+			So(g.Nodes[0].TotalLookups, ShouldEqual, spf.DNSLookupCount())
+			So(len(g.Edges), ShouldEqual, 4)
+			So(g.Edges[2], ShouldResemble, GraphEdge{From: "example.com", To: "_spf.google.com", Kind: "include", Term: "~include:_spf.google.com"})
+			So(g.Edges[3].Ignored, ShouldEqual, true)
+
+			dot := g.DOT()
+			So(dot, ShouldStartWith, "digraph spf {\n")
+			So(dot, ShouldContainSubstring, `"example.com" [label="example.com\n5 lookups, 6 in total"];`)
+			So(dot, ShouldContainSubstring, `"_spf.example.com" -> "_spf.google.com" [label="include:_spf.google.com"];`)
+			So(dot, ShouldContainSubstring, `"example.com" -> "_old.example.com" [label="redirect=_old.example.com", style=dashed, color=gray];`)
+
+			data, err := json.Marshal(g)
+			So(err, ShouldEqual, nil)
+			So(string(data), ShouldContainSubstring, `{"from":"example.com","to":"_spf.example.com","kind":"include","term":"include:_spf.example.com"}`)
+
+			snapshot, err := spf.MarshalJSON()
+			So(err, ShouldEqual, nil)
+			restored, err := Restore(snapshot, nil)
+			So(err, ShouldEqual, nil)
+			So(restored.Graph(), ShouldResemble, g)
+		})
+
+		Convey("Loops of includes and redirects are a PermError naming the cycle", func() {
+			_, err := New("loop.example.com", z)
+			So(err, ShouldHaveSameTypeAs, &PermError{})
+			So(err.(*PermError).Message, ShouldEqual, "Include loop: loop.example.com -> _a.example.com -> _b.example.com -> loop.example.com.")
+
+			_, err = New("self.example.com", z)
+			So(err, ShouldHaveSameTypeAs, &PermError{})
+			So(err.(*PermError).Message, ShouldEqual, "Redirect loop: self.example.com -> self.example.com")
+
+			result, err := Check("192.0.2.7", "user@loop.example.com", "", z)
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "PermError")
+		})
+	})
+}
@@ -0,0 +1,109 @@
+package gospf
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+// Group coalesces concurrent constructions of the same policy: while New or
+// NewForIP loads the policy of a domain, the calls for the same domain (and
+// address family) with the same Group wait for it instead of sending their
+// own queries. Every caller gets its own SPF instance, which evaluates with
+// the caller's options. The DNS events of the construction are only sent to
+// the Observer of the call that loaded the policy, and lookup limit
+// violations found while loading it are only reported once.
+//
+// All calls using a Group must use the same resolver. The zero value is
+// ready to use and a Group must not be copied after first use.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*groupCall
+}
+
+// groupCall is a construction in progress, done is closed once it returned.
+type groupCall struct {
+	done chan struct{}
+	spf  *SPF
+	err  error
+}
+
+// WithGroup coalesces the construction of the policy with concurrent
+// constructions of the same policy using g.
+func WithGroup(g *Group) Option {
+	return func(o *options) {
+		o.group = g
+	}
+}
+
+// do calls build, unless a call with the same key is in progress, then it
+// waits for that call and returns its answer with shared set.
+func (g *Group) do(key string, build func() (*SPF, error)) (spf *SPF, err error, shared bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.spf, call.err, true
+	}
+	call := &groupCall{done: make(chan struct{})}
+	if g.calls == nil {
+		g.calls = make(map[string]*groupCall)
+	}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.spf, call.err = build()
+	return call.spf, call.err, false
+}
+
+// build creates the SPF instance of domain for New and NewForIP.
+func (o *options) build(domain string, dnsResolver dns.DnsResolver, family addressFamily) (*SPF, error) {
+	if o.policies != nil {
+		return o.policies.get(domain, dnsResolver, family, o)
+	}
+	resolver := o.resolver(dnsResolver)
+	if o.group == nil {
+		return newPolicy(domain, o.prefetch(domain, resolver, family), o, family)
+	}
+
+	spf, err, shared := o.group.do(o.key(domain, family), func() (*SPF, error) {
+		return newPolicy(domain, o.prefetch(domain, resolver, family), o, family)
+	})
+	if !shared || err != nil {
+		return spf, err
+	}
+	return spf.withOptions(o, resolver), nil
+}
+
+// key identifies the policy of domain for family in a Group or PolicyCache.
+func (o *options) key(domain string, family addressFamily) string {
+	key := fmt.Sprintf("%d %v", family, canonicalName(domain))
+	if o.bestGuess != "" {
+		key += " " + o.bestGuess
+	}
+	return key
+}
+
+// withOptions returns a copy of the instance and its includes and redirect
+// that evaluates with o and resolver. The networks are shared.
+func (spf *SPF) withOptions(o *options, resolver dns.DnsResolver) *SPF {
+	c := *spf
+	c.options = o
+	c.dns = resolver
+	c.Includes = make([]Include, len(spf.Includes))
+	for i, include := range spf.Includes {
+		include.SPF = include.SPF.withOptions(o, resolver)
+		c.Includes[i] = include
+	}
+	if spf.Redirect != nil {
+		c.Redirect = spf.Redirect.withOptions(o, resolver)
+	}
+	return &c
+}
@@ -0,0 +1,260 @@
+// Package httpd implements an HTTP JSON service that checks SPF with gospf,
+// for services that can't embed the library.
+//
+//	POST /check           {"ip": "192.0.2.1", "sender": "user@example.com", "helo": "mail.example.com"}
+//	GET  /record/{domain} the SPF record of domain and its DNS lookup counts
+//	GET  /healthz         200 while the process is running
+//	GET  /readyz          200 while the service accepts requests, 503 when shutting down
+//	GET  /metrics         Prometheus metrics, when Handler.Metrics is set
+package httpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/metrics"
+)
+
+// maxBodySize limits the size of a request body.
+const maxBodySize = 64 * 1024
+
+// CheckRequest is the body of POST /check. Either Sender or Domain
+// identifies the checked domain, the HELO identity is checked when both are empty.
+type CheckRequest struct {
+	IP     string `json:"ip"`
+	Domain string `json:"domain,omitempty"`
+	Sender string `json:"sender,omitempty"`
+	Helo   string `json:"helo,omitempty"`
+	// Recipient selects the local policy of its domain, see Handler.Local.
+	Recipient string `json:"recipient,omitempty"`
+	// Trace adds the evaluation steps to the response.
+	Trace bool `json:"trace,omitempty"`
+}
+
+// CheckResponse is the response of POST /check.
+type CheckResponse struct {
+	Result          string   `json:"result"`
+	Explanation     string   `json:"explanation"`
+	Mechanism       string   `json:"mechanism,omitempty"`
+	MechanismDomain string   `json:"mechanism_domain,omitempty"`
+	Problem         string   `json:"problem,omitempty"`
+	IP              string   `json:"ip"`
+	Domain          string   `json:"domain"`
+	Sender          string   `json:"sender"`
+	Helo            string   `json:"helo,omitempty"`
+	Identity        string   `json:"identity"`
+	Local           bool     `json:"local,omitempty"`
+	BestGuess       bool     `json:"best_guess,omitempty"`
+	ReceivedSPF     string   `json:"received_spf"`
+	Trace           []string `json:"trace,omitempty"`
+}
+
+// RecordResponse is the response of GET /record/{domain}. Result is empty
+// when the record was loaded, otherwise it's None, TempError or PermError.
+type RecordResponse struct {
+	Domain      string   `json:"domain"`
+	Record      string   `json:"record,omitempty"`
+	Terms       []string `json:"terms,omitempty"`
+	DNSLookups  int      `json:"dns_lookups"`
+	VoidLookups int      `json:"void_lookups"`
+	Result      string   `json:"result,omitempty"`
+	Problem     string   `json:"problem,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler serves the HTTP JSON API. At least Resolver must be set, it is
+// shared by all requests, so it should be a dns.CachingResolver.
+type Handler struct {
+	Resolver dns.DnsResolver
+	// Receiver is the host name used in the Received-SPF header of the response.
+	Receiver string
+	// Metrics measures the checks and is served on /metrics, when not nil.
+	Metrics *metrics.Metrics
+	// Concurrency is the max number of DNS queries sent concurrently to load
+	// a policy (see gospf.WithConcurrency). Zero or one loads them one by one.
+	Concurrency int
+	// Policies caches the loaded policies, when not nil.
+	Policies *gospf.PolicyCache
+	// Local are the local policies of the recipient domains, evaluated
+	// before the published policy (see gospf.WithLocalPolicy).
+	Local gospf.LocalPolicies
+	// BestGuess is the record evaluated for domains that publish none,
+	// e.g. gospf.DefaultBestGuess (see gospf.WithBestGuess). Empty disables it.
+	BestGuess string
+
+	notReady int32 // accessed atomically
+	once     sync.Once
+	mux      *http.ServeMux
+	group    gospf.Group // coalesces concurrent checks of the same domain
+}
+
+// SetReady sets whether /readyz reports the service as ready, which it does
+// initially. It's typically set to false when the server starts shutting down.
+func (h *Handler) SetReady(ready bool) {
+	if ready {
+		atomic.StoreInt32(&h.notReady, 0)
+	} else {
+		atomic.StoreInt32(&h.notReady, 1)
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.once.Do(func() {
+		h.mux = http.NewServeMux()
+		h.mux.HandleFunc("/check", h.handleCheck)
+		h.mux.HandleFunc("/record/", h.handleRecord)
+		h.mux.HandleFunc("/healthz", h.handleHealth)
+		h.mux.HandleFunc("/readyz", h.handleReady)
+		if h.Metrics != nil {
+			h.mux.Handle("/metrics", h.Metrics)
+		}
+	})
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var request CheckRequest
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+
+	sender := request.Sender
+	if request.Domain != "" {
+		domain := strings.TrimSuffix(strings.ToLower(request.Domain), ".")
+		if sender == "" {
+			sender = domain
+		} else if !strings.EqualFold(sender[strings.LastIndex(sender, "@")+1:], domain) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("domain %v doesn't match the sender %v", request.Domain, sender))
+			return
+		}
+	}
+
+	opts := h.options()
+	if h.Metrics != nil {
+		opts = append(opts, gospf.WithMetrics(h.Metrics))
+	}
+	if local := h.Local.For(request.Recipient); local != nil {
+		opts = append(opts, gospf.WithLocalPolicy(local))
+	}
+	result, err := gospf.Check(request.IP, sender, request.Helo, h.Resolver, opts...)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	response := CheckResponse{
+		Result:          result.Result,
+		Explanation:     result.Explanation(),
+		Mechanism:       result.Mechanism,
+		MechanismDomain: result.MechanismDomain,
+		Problem:         result.Problem,
+		IP:              result.IP,
+		Domain:          result.Domain,
+		Sender:          result.Sender,
+		Helo:            result.Helo,
+		Identity:        result.Identity,
+		Local:           result.Local,
+		BestGuess:       result.BestGuess,
+		ReceivedSPF:     result.ReceivedSPF(h.Receiver),
+	}
+	if request.Trace {
+		response.Trace = result.Trace
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *Handler) handleRecord(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	domain := strings.TrimSuffix(strings.ToLower(strings.TrimPrefix(r.URL.Path, "/record/")), ".")
+	if domain == "" || strings.Contains(domain, "/") {
+		writeError(w, http.StatusBadRequest, "invalid domain: "+domain)
+		return
+	}
+
+	response := RecordResponse{Domain: domain}
+	record, err := h.Resolver.GetSPFRecord(domain)
+	if err == nil {
+		response.Record = record
+		response.Terms = strings.Fields(record)[1:]
+
+		var spf *gospf.SPF
+		spf, err = gospf.New(domain, h.Resolver, h.options()...)
+		if err == nil {
+			response.DNSLookups = spf.DNSLookupCount()
+			response.VoidLookups = spf.VoidLookupCount()
+		}
+	}
+	if err != nil {
+		response.Result, response.Problem = errorResult(err)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// options returns the options of the policy loads.
+func (h *Handler) options() []gospf.Option {
+	opts := []gospf.Option{gospf.WithConcurrency(h.Concurrency), gospf.WithGroup(&h.group)}
+	if h.Policies != nil {
+		opts = append(opts, gospf.WithPolicyCache(h.Policies))
+	}
+	if h.BestGuess != "" {
+		opts = append(opts, gospf.WithBestGuess(h.BestGuess))
+	}
+	return opts
+}
+
+// errorResult returns the result and problem of an error of gospf.New.
+func errorResult(err error) (string, string) {
+	switch e := err.(type) {
+	case *gospf.NoneError, *gospf.TempError, *gospf.PermError:
+		return e.Error(), e.(fmt.Stringer).String()
+	}
+	if dns.IsNotFound(err) {
+		return "None", err.Error()
+	}
+	return "TempError", err.Error()
+}
+
+func (h *Handler) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *Handler) handleReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.notReady) == 1 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: message})
+}
@@ -0,0 +1,168 @@
+package httpd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/metrics"
+)
+
+const testZone = `
+$ORIGIN example.com.
+@        TXT  "v=spf1 ip4:192.0.2.1 include:_spf.example.com -all"
+_spf     TXT  "v=spf1 ip4:198.51.100.0/24 -all"
+mail     TXT  "v=spf1 a -all"
+         A    192.0.2.10
+slow     TXT  "v=spf1 a:timeout.example.com -all"
+broken   TXT  "v=spf1 include:nonexistent.example.com -all"
+www      A    192.0.2.30
+`
+
+func testHandler() *Handler {
+	z := dns.NewZoneResolver()
+	if err := z.Load(strings.NewReader(testZone), ""); err != nil {
+		panic(err)
+	}
+	z.Fail("timeout.example.com", dns.Timeout)
+	return &Handler{Resolver: dns.NewCachingResolver(z, 0), Receiver: "mx.example.org", Concurrency: 4}
+}
+
+func do(h http.Handler, method string, path string, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	response := make(map[string]interface{})
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder, response
+}
+
+func TestCheck(t *testing.T) {
+	Convey("Testing POST /check", t, func() {
+		h := testHandler()
+
+		recorder, response := do(h, "POST", "/check", `{"ip": "192.0.2.1", "sender": "user@example.com", "helo": "mail.example.com"}`)
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+		So(recorder.Header().Get("Content-Type"), ShouldEqual, "application/json")
+		So(response["result"], ShouldEqual, "Pass")
+		So(response["mechanism"], ShouldEqual, "ip4:192.0.2.1")
+		So(response["mechanism_domain"], ShouldEqual, "example.com")
+		So(response["explanation"], ShouldEqual, "domain of user@example.com designates 192.0.2.1 as permitted sender")
+		So(response["received_spf"], ShouldStartWith, "Pass (mx.example.org: domain of user@example.com")
+		So(response["trace"], ShouldEqual, nil)
+
+		_, response = do(h, "POST", "/check", `{"ip": "198.51.100.7", "domain": "example.com", "trace": true}`)
+		So(response["result"], ShouldEqual, "Pass")
+		So(response["sender"], ShouldEqual, "postmaster@example.com")
+		So(response["mechanism"], ShouldEqual, "include:_spf.example.com")
+		So(response["trace"], ShouldResemble, []interface{}{
+			"example.com: evaluating include:_spf.example.com",
+			"_spf.example.com: ip4:198.51.100.0/24 matched -> Pass",
+			"example.com: include:_spf.example.com matched -> Pass",
+		})
+
+		_, response = do(h, "POST", "/check", `{"ip": "203.0.113.1", "sender": "user@example.com"}`)
+		So(response["result"], ShouldEqual, "Fail")
+		So(response["mechanism"], ShouldEqual, "-all")
+
+		_, response = do(h, "POST", "/check", `{"ip": "192.0.2.1", "sender": "user@slow.example.com"}`)
+		So(response["result"], ShouldEqual, "TempError")
+		So(response["problem"], ShouldNotEqual, "")
+
+		_, response = do(h, "POST", "/check", `{"ip": "192.0.2.10", "helo": "mail.example.com"}`)
+		So(response["result"], ShouldEqual, "Pass")
+		So(response["identity"], ShouldEqual, "helo")
+
+		_, response = do(h, "POST", "/check", `{"ip": "192.0.2.31", "sender": "user@www.example.com"}`)
+		So(response["result"], ShouldEqual, "None")
+		h.BestGuess = gospf.DefaultBestGuess
+		_, response = do(h, "POST", "/check", `{"ip": "192.0.2.31", "sender": "user@www.example.com"}`)
+		So(response["result"], ShouldEqual, "Pass")
+		So(response["best_guess"], ShouldEqual, true)
+
+		local, err := gospf.ParseLocalPolicies(strings.NewReader("example.org 203.0.113.0/24\n"))
+		So(err, ShouldEqual, nil)
+		h.Local = local
+		_, response = do(h, "POST", "/check", `{"ip": "203.0.113.1", "sender": "user@example.com", "recipient": "someone@example.org"}`)
+		So(response["result"], ShouldEqual, "Pass")
+		So(response["local"], ShouldEqual, true)
+		So(response["mechanism"], ShouldEqual, "local:203.0.113.0/24")
+
+		for _, body := range []string{
+			`{"ip": "not an ip", "sender": "user@example.com"}`,
+			`{"ip": "192.0.2.1", "sender": "user@example.com", "domain": "example.org"}`,
+			`{"ip": "192.0.2.1", "unknown": true}`,
+			`not json`,
+		} {
+			recorder, response = do(h, "POST", "/check", body)
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(response["error"], ShouldNotEqual, "")
+		}
+
+		recorder, _ = do(h, "GET", "/check", "")
+		So(recorder.Code, ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestRecord(t *testing.T) {
+	Convey("Testing GET /record/{domain}", t, func() {
+		h := testHandler()
+
+		recorder, response := do(h, "GET", "/record/Example.com", "")
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+		So(response["domain"], ShouldEqual, "example.com")
+		So(response["record"], ShouldEqual, "v=spf1 ip4:192.0.2.1 include:_spf.example.com -all")
+		So(response["terms"], ShouldResemble, []interface{}{"ip4:192.0.2.1", "include:_spf.example.com", "-all"})
+		So(response["dns_lookups"], ShouldEqual, 1)
+		So(response["result"], ShouldEqual, nil)
+
+		_, response = do(h, "GET", "/record/none.example.com", "")
+		So(response["result"], ShouldEqual, "None")
+
+		_, response = do(h, "GET", "/record/broken.example.com", "")
+		So(response["record"], ShouldEqual, "v=spf1 include:nonexistent.example.com -all")
+		So(response["result"], ShouldEqual, "PermError")
+
+		recorder, _ = do(h, "GET", "/record/", "")
+		So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+	})
+}
+
+func TestHealth(t *testing.T) {
+	Convey("Testing the health and readiness endpoints", t, func() {
+		h := testHandler()
+
+		recorder, _ := do(h, "GET", "/healthz", "")
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+		recorder, _ = do(h, "GET", "/readyz", "")
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+
+		h.SetReady(false)
+		recorder, _ = do(h, "GET", "/readyz", "")
+		So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+		recorder, _ = do(h, "GET", "/healthz", "")
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Testing GET /metrics", t, func() {
+		h := testHandler()
+		recorder, _ := do(h, "GET", "/metrics", "")
+		So(recorder.Code, ShouldEqual, http.StatusNotFound)
+
+		h = testHandler()
+		h.Metrics = metrics.New()
+		do(h, "POST", "/check", `{"ip": "192.0.2.1", "sender": "user@example.com"}`)
+		recorder, _ = do(h, "GET", "/metrics", "")
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+		So(recorder.Header().Get("Content-Type"), ShouldEqual, metrics.ContentType)
+		So(recorder.Body.String(), ShouldContainSubstring, `gospf_check_results_total{result="pass"} 1`)
+	})
+}
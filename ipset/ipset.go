@@ -0,0 +1,486 @@
+// Package ipset implements sets of IPv4 and IPv6 addresses, stored as sorted
+// ranges, with the set algebra needed to compare SPF policies:
+//
+//	a, _ := ipset.Parse("192.0.2.0/25", "192.0.2.128/25", "2001:db8::1")
+//	b, _ := ipset.Parse("192.0.2.64/26")
+//	a.Networks()                // [192.0.2.0/24 2001:db8::1/128]
+//	a.Difference(b).Networks()  // [192.0.2.0/26 192.0.2.128/25 2001:db8::1/128]
+//	a.ContainsSet(b)            // true
+//
+// IPv4-mapped IPv6 addresses are IPv4 addresses, as in package net. The zero
+// value and nil are empty sets.
+package ipset
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net"
+	"sort"
+	"strings"
+)
+
+// addr is an address as a 128 bit integer, IPv4 addresses use the low 32 bits.
+type addr struct {
+	hi, lo uint64
+}
+
+func (a addr) less(b addr) bool {
+	return a.hi < b.hi || a.hi == b.hi && a.lo < b.lo
+}
+
+func (a addr) next() addr {
+	if a.lo == ^uint64(0) {
+		return addr{a.hi + 1, 0}
+	}
+	return addr{a.hi, a.lo + 1}
+}
+
+func (a addr) prev() addr {
+	if a.lo == 0 {
+		return addr{a.hi - 1, ^uint64(0)}
+	}
+	return addr{a.hi, a.lo - 1}
+}
+
+// hostMask returns the address with the low n bits set.
+func hostMask(n int) addr {
+	switch {
+	case n <= 0:
+		return addr{}
+	case n < 64:
+		return addr{0, 1<<uint(n) - 1}
+	case n < 128:
+		return addr{1<<uint(n-64) - 1, ^uint64(0)}
+	}
+	return addr{^uint64(0), ^uint64(0)}
+}
+
+func (a addr) or(b addr) addr {
+	return addr{a.hi | b.hi, a.lo | b.lo}
+}
+
+func (a addr) andNot(b addr) addr {
+	return addr{a.hi &^ b.hi, a.lo &^ b.lo}
+}
+
+func (a addr) trailingZeros() int {
+	if a.lo != 0 {
+		return bits.TrailingZeros64(a.lo)
+	}
+	return 64 + bits.TrailingZeros64(a.hi)
+}
+
+// family returns the address of ip and its number of bits, 32 or 128.
+func family(ip net.IP) (addr, int, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return addr{0, uint64(ip4[0])<<24 | uint64(ip4[1])<<16 | uint64(ip4[2])<<8 | uint64(ip4[3])}, 32, true
+	}
+	if len(ip) != net.IPv6len {
+		return addr{}, 0, false
+	}
+	var a addr
+	for i := 0; i < 8; i++ {
+		a.hi = a.hi<<8 | uint64(ip[i])
+		a.lo = a.lo<<8 | uint64(ip[i+8])
+	}
+	return a, 128, true
+}
+
+func (a addr) ip(bits int) net.IP {
+	if bits == 32 {
+		return net.IPv4(byte(a.lo>>24), byte(a.lo>>16), byte(a.lo>>8), byte(a.lo)).To4()
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i := 0; i < 8; i++ {
+		ip[7-i] = byte(a.hi >> uint(8*i))
+		ip[15-i] = byte(a.lo >> uint(8*i))
+	}
+	return ip
+}
+
+// span is a range of addresses, first and last included.
+type span struct {
+	first, last addr
+}
+
+// spans is a sorted list of spans that neither overlap nor touch.
+type spans []span
+
+// normalize sorts and merges s in place.
+func normalize(s spans) spans {
+	sort.Slice(s, func(i, j int) bool { return s[i].first.less(s[j].first) })
+	out := s[:0]
+	for _, r := range s {
+		n := len(out)
+		// merge overlapping and adjacent spans, the last address has no next one
+		if n > 0 && (out[n-1].last == hostMask(128) || !out[n-1].last.next().less(r.first)) {
+			if out[n-1].last.less(r.last) {
+				out[n-1].last = r.last
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func union(a, b spans) spans {
+	return normalize(append(append(make(spans, 0, len(a)+len(b)), a...), b...))
+}
+
+func intersect(a, b spans) spans {
+	out := make(spans, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		first, last := a[i].first, a[i].last
+		if first.less(b[j].first) {
+			first = b[j].first
+		}
+		if b[j].last.less(last) {
+			last = b[j].last
+		}
+		if !last.less(first) {
+			out = append(out, span{first, last})
+		}
+		if a[i].last.less(b[j].last) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return out
+}
+
+func difference(a, b spans) spans {
+	out := make(spans, 0, len(a))
+	j := 0
+	for _, r := range a {
+		for j < len(b) && b[j].last.less(r.first) {
+			j++
+		}
+		first := r.first
+		done := false
+		for k := j; k < len(b) && !r.last.less(b[k].first); k++ {
+			if first.less(b[k].first) {
+				out = append(out, span{first, b[k].first.prev()})
+			}
+			if !b[k].last.less(r.last) {
+				done = true
+				break
+			}
+			first = b[k].last.next()
+		}
+		if !done {
+			out = append(out, span{first, r.last})
+		}
+	}
+	return out
+}
+
+func (s spans) contains(a addr) bool {
+	i := sort.Search(len(s), func(i int) bool { return !s[i].last.less(a) })
+	return i < len(s) && !a.less(s[i].first)
+}
+
+// networks splits the spans in the fewest networks.
+func (s spans) networks(bits int) []net.IPNet {
+	out := make([]net.IPNet, 0, len(s))
+	for _, r := range s {
+		first := r.first
+		for {
+			// the largest block aligned at first that ends within the span
+			size := first.trailingZeros()
+			if size > bits {
+				size = bits
+			}
+			for r.last.less(first.or(hostMask(size))) {
+				size--
+			}
+			out = append(out, net.IPNet{IP: first.ip(bits), Mask: net.CIDRMask(bits-size, bits)})
+			last := first.or(hostMask(size))
+			if last == r.last {
+				break
+			}
+			first = last.next()
+		}
+	}
+	return out
+}
+
+// Set is a set of IPv4 and IPv6 addresses.
+type Set struct {
+	v4, v6 spans
+}
+
+// New returns the set of the addresses of nets.
+func New(nets ...net.IPNet) *Set {
+	s := &Set{}
+	s.Add(nets...)
+	return s
+}
+
+// Parse returns the set of addresses and networks in CIDR notation.
+func Parse(networks ...string) (*Set, error) {
+	s := &Set{}
+	for _, network := range networks {
+		n, err := ParseNetwork(network)
+		if err != nil {
+			return nil, err
+		}
+		s.Add(n)
+	}
+	return s, nil
+}
+
+// ParseNetwork parses a network in CIDR notation or a single address.
+func ParseNetwork(network string) (net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(network); err == nil {
+		return *n, nil
+	}
+	ip := net.ParseIP(network)
+	if ip == nil {
+		return net.IPNet{}, fmt.Errorf("invalid address or network %q", network)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Add adds the addresses of nets to the set. Invalid networks are ignored.
+func (s *Set) Add(nets ...net.IPNet) {
+	v4, v6 := s.v4, s.v6
+	for _, n := range nets {
+		r, bits, ok := spanOf(n)
+		switch {
+		case !ok:
+		case bits == 32:
+			v4 = append(v4, r)
+		default:
+			v6 = append(v6, r)
+		}
+	}
+	s.v4, s.v6 = normalize(v4), normalize(v6)
+}
+
+// spanOf returns the span of the addresses of n.
+func spanOf(n net.IPNet) (span, int, bool) {
+	a, bits, ok := family(n.IP)
+	if !ok {
+		return span{}, 0, false
+	}
+	ones, maskBits := n.Mask.Size()
+	if maskBits == 128 && bits == 32 {
+		ones -= 96
+	}
+	if ones < 0 || maskBits == 0 {
+		return span{}, 0, false
+	}
+	host := hostMask(bits - ones)
+	return span{a.andNot(host), a.or(host)}, bits, true
+}
+
+func (s *Set) spans() (spans, spans) {
+	if s == nil {
+		return nil, nil
+	}
+	return s.v4, s.v6
+}
+
+// Union returns the addresses in s or o.
+func (s *Set) Union(o *Set) *Set {
+	a4, a6 := s.spans()
+	b4, b6 := o.spans()
+	return &Set{union(a4, b4), union(a6, b6)}
+}
+
+// Intersect returns the addresses in both s and o.
+func (s *Set) Intersect(o *Set) *Set {
+	a4, a6 := s.spans()
+	b4, b6 := o.spans()
+	return &Set{intersect(a4, b4), intersect(a6, b6)}
+}
+
+// Difference returns the addresses in s but not in o.
+func (s *Set) Difference(o *Set) *Set {
+	a4, a6 := s.spans()
+	b4, b6 := o.spans()
+	return &Set{difference(a4, b4), difference(a6, b6)}
+}
+
+// Contains reports whether ip is in the set.
+func (s *Set) Contains(ip net.IP) bool {
+	a, bits, ok := family(ip)
+	if !ok || s == nil {
+		return false
+	}
+	if bits == 32 {
+		return s.v4.contains(a)
+	}
+	return s.v6.contains(a)
+}
+
+// ContainsNet reports whether all the addresses of n are in the set.
+func (s *Set) ContainsNet(n net.IPNet) bool {
+	return s.ContainsSet(New(n))
+}
+
+// ContainsSet reports whether all the addresses of o are in the set.
+func (s *Set) ContainsSet(o *Set) bool {
+	return o.Difference(s).IsEmpty()
+}
+
+// Overlaps reports whether s and o have addresses in common.
+func (s *Set) Overlaps(o *Set) bool {
+	return !s.Intersect(o).IsEmpty()
+}
+
+// Equal reports whether s and o have the same addresses.
+func (s *Set) Equal(o *Set) bool {
+	a4, a6 := s.spans()
+	b4, b6 := o.spans()
+	if len(a4) != len(b4) || len(a6) != len(b6) {
+		return false
+	}
+	for i := range a4 {
+		if a4[i] != b4[i] {
+			return false
+		}
+	}
+	for i := range a6 {
+		if a6[i] != b6[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// IsEmpty reports whether the set has no addresses.
+func (s *Set) IsEmpty() bool {
+	a4, a6 := s.spans()
+	return len(a4) == 0 && len(a6) == 0
+}
+
+// IPv4 returns the IPv4 addresses of the set.
+func (s *Set) IPv4() *Set {
+	a4, _ := s.spans()
+	return &Set{v4: append(spans(nil), a4...)}
+}
+
+// IPv6 returns the IPv6 addresses of the set.
+func (s *Set) IPv6() *Set {
+	_, a6 := s.spans()
+	return &Set{v6: append(spans(nil), a6...)}
+}
+
+// Size returns the number of addresses of the set.
+func (s *Set) Size() *big.Int {
+	a4, a6 := s.spans()
+	size := new(big.Int)
+	for _, r := range append(append(spans(nil), a4...), a6...) {
+		first := new(big.Int).Lsh(new(big.Int).SetUint64(r.first.hi), 64)
+		first.Or(first, new(big.Int).SetUint64(r.first.lo))
+		last := new(big.Int).Lsh(new(big.Int).SetUint64(r.last.hi), 64)
+		last.Or(last, new(big.Int).SetUint64(r.last.lo))
+		size.Add(size, last.Sub(last, first)).Add(size, big.NewInt(1))
+	}
+	return size
+}
+
+// Networks returns the fewest networks that cover exactly the addresses of
+// the set, IPv4 networks first, each family in address order.
+func (s *Set) Networks() []net.IPNet {
+	a4, a6 := s.spans()
+	return append(a4.networks(32), a6.networks(128)...)
+}
+
+// Range is a range of addresses, First and Last included.
+type Range struct {
+	First, Last net.IP
+}
+
+// String returns the range as a network in CIDR notation when it's one,
+// else as "first-last".
+func (r Range) String() string {
+	if networks := r.Networks(); len(networks) == 1 {
+		return networks[0].String()
+	}
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// Networks returns the fewest networks that cover exactly the range.
+func (r Range) Networks() []net.IPNet {
+	first, bits, ok := family(r.First)
+	last, lastBits, lastOK := family(r.Last)
+	if !ok || !lastOK || bits != lastBits || last.less(first) {
+		return nil
+	}
+	return spans{{first, last}}.networks(bits)
+}
+
+// Ranges returns the largest ranges of the addresses of the set, IPv4 ranges
+// first, each family in address order.
+func (s *Set) Ranges() []Range {
+	a4, a6 := s.spans()
+	out := make([]Range, 0, len(a4)+len(a6))
+	for _, r := range a4 {
+		out = append(out, Range{r.first.ip(32), r.last.ip(32)})
+	}
+	for _, r := range a6 {
+		out = append(out, Range{r.first.ip(128), r.last.ip(128)})
+	}
+	return out
+}
+
+// String returns the networks of the set, separated by spaces.
+func (s *Set) String() string {
+	networks := s.Networks()
+	out := make([]string, len(networks))
+	for i, n := range networks {
+		out[i] = n.String()
+	}
+	return strings.Join(out, " ")
+}
+
+// MarshalJSON encodes the set as the list of its networks.
+func (s *Set) MarshalJSON() ([]byte, error) {
+	networks := s.Networks()
+	out := make([]string, len(networks))
+	for i, n := range networks {
+		out[i] = n.String()
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes a list of addresses and networks.
+func (s *Set) UnmarshalJSON(data []byte) error {
+	var networks []string
+	if err := json.Unmarshal(data, &networks); err != nil {
+		return err
+	}
+	parsed, err := Parse(networks...)
+	if err != nil {
+		return err
+	}
+	*s = *parsed
+	return nil
+}
+
+// Next returns the address after ip, or nil for the last address of its family.
+func Next(ip net.IP) net.IP {
+	a, bits, ok := family(ip)
+	if !ok || a == hostMask(bits) {
+		return nil
+	}
+	return a.next().ip(bits)
+}
+
+// Prev returns the address before ip, or nil for the first address of its family.
+func Prev(ip net.IP) net.IP {
+	a, bits, ok := family(ip)
+	if !ok || a == (addr{}) {
+		return nil
+	}
+	return a.prev().ip(bits)
+}
@@ -0,0 +1,122 @@
+package ipset
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func mustParse(networks ...string) *Set {
+	s, err := Parse(networks...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func TestSet(t *testing.T) {
+	Convey("Testing address sets", t, func() {
+
+		Convey("Networks are aggregated to the fewest networks", func() {
+			tests := []struct {
+				networks []string
+				want     string
+			}{
+				{[]string{}, ""},
+				{[]string{"192.0.2.1", "192.0.2.1", "192.0.2.1/32"}, "192.0.2.1/32"},
+				{[]string{"10.0.0.1", "10.0.0.2", "10.0.0.0/31", "10.0.0.3", "10.0.0.4", "::1", "10.0.0.9", "10.0.0.8/29"},
+					"10.0.0.0/30 10.0.0.4/32 10.0.0.8/29 ::1/128"},
+				{[]string{"192.0.2.0/25", "192.0.2.128/25", "192.0.2.64/26"}, "192.0.2.0/24"},
+				{[]string{"0.0.0.0/1", "128.0.0.0/1"}, "0.0.0.0/0"},
+				{[]string{"::/1", "8000::/1", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"}, "::/0"},
+				{[]string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}, "10.0.0.1/32 10.0.0.2/31 10.0.0.4/31 10.0.0.6/32"},
+				{[]string{"2001:db8::ffff:ffff:ffff:ffff", "2001:db8:0:1::"}, "2001:db8::ffff:ffff:ffff:ffff/128 2001:db8:0:1::/128"},
+				{[]string{"2001:db8::/64", "2001:db8:0:1::/64"}, "2001:db8::/63"},
+				{[]string{"::ffff:192.0.2.1", "192.0.2.0"}, "192.0.2.0/31"},
+			}
+			for _, test := range tests {
+				So(mustParse(test.networks...).String(), ShouldEqual, test.want)
+			}
+
+			_, err := Parse("192.0.2.300")
+			So(err, ShouldNotEqual, nil)
+			_, err = Parse("192.0.2.0/33")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Union, intersection and difference", func() {
+			a := mustParse("192.0.2.0/24", "2001:db8::/32")
+			b := mustParse("192.0.2.64/26", "198.51.100.0/24", "2001:db8:1::/48")
+
+			So(a.Union(b).String(), ShouldEqual, "192.0.2.0/24 198.51.100.0/24 2001:db8::/32")
+			So(a.Intersect(b).String(), ShouldEqual, "192.0.2.64/26 2001:db8:1::/48")
+			So(b.Intersect(a).String(), ShouldEqual, "192.0.2.64/26 2001:db8:1::/48")
+			So(a.Difference(b).String(), ShouldEqual,
+				"192.0.2.0/26 192.0.2.128/25 2001:db8::/48 2001:db8:2::/47 2001:db8:4::/46 2001:db8:8::/45 2001:db8:10::/44 2001:db8:20::/43 2001:db8:40::/42 2001:db8:80::/41 2001:db8:100::/40 2001:db8:200::/39 2001:db8:400::/38 2001:db8:800::/37 2001:db8:1000::/36 2001:db8:2000::/35 2001:db8:4000::/34 2001:db8:8000::/33")
+			So(b.Difference(a).String(), ShouldEqual, "198.51.100.0/24")
+			So(a.Difference(a).IsEmpty(), ShouldEqual, true)
+			So(a.Difference(nil).Equal(a), ShouldEqual, true)
+			So(mustParse("0.0.0.0/0").Difference(mustParse("0.0.0.1", "255.255.255.255")).Ranges(), ShouldResemble, []Range{
+				{net.ParseIP("0.0.0.0").To4(), net.ParseIP("0.0.0.0").To4()},
+				{net.ParseIP("0.0.0.2").To4(), net.ParseIP("255.255.255.254").To4()},
+			})
+			ranges := mustParse("10.0.0.0/8").Difference(mustParse("10.1.0.0/16", "10.5.0.0/16")).Ranges()
+			So(ranges[0].String(), ShouldEqual, "10.0.0.0/16")
+			So(ranges[1].String(), ShouldEqual, "10.2.0.0-10.4.255.255")
+			So(len(ranges[2].Networks()), ShouldEqual, 6)
+
+			var empty *Set
+			So(empty.Union(a).Equal(a), ShouldEqual, true)
+			So(empty.Intersect(a).IsEmpty(), ShouldEqual, true)
+			So(empty.String(), ShouldEqual, "")
+		})
+
+		Convey("Containment", func() {
+			a := mustParse("192.0.2.0/24", "2001:db8::/32")
+			So(a.Contains(net.ParseIP("192.0.2.255")), ShouldEqual, true)
+			So(a.Contains(net.ParseIP("::ffff:192.0.2.1")), ShouldEqual, true)
+			So(a.Contains(net.ParseIP("192.0.3.0")), ShouldEqual, false)
+			So(a.Contains(net.ParseIP("2001:db8:ffff::1")), ShouldEqual, true)
+			So(a.Contains(net.ParseIP("::c000:201")), ShouldEqual, false)
+			So(a.Contains(nil), ShouldEqual, false)
+
+			_, n, _ := net.ParseCIDR("192.0.2.128/25")
+			So(a.ContainsNet(*n), ShouldEqual, true)
+			_, n, _ = net.ParseCIDR("192.0.2.0/23")
+			So(a.ContainsNet(*n), ShouldEqual, false)
+			So(a.ContainsSet(mustParse("192.0.2.1", "2001:db8::1")), ShouldEqual, true)
+			So(a.ContainsSet(mustParse("192.0.2.1", "2001:db9::1")), ShouldEqual, false)
+			So(a.Overlaps(mustParse("192.0.2.0/23")), ShouldEqual, true)
+			So(a.Overlaps(mustParse("192.0.3.0/24")), ShouldEqual, false)
+			So(a.Equal(mustParse("2001:db8::/33", "2001:db8:8000::/33", "192.0.2.0/24")), ShouldEqual, true)
+		})
+
+		Convey("Addresses are counted by family", func() {
+			s := mustParse("192.0.2.0/24", "198.51.100.1", "::/0")
+			So(s.IPv4().Size().String(), ShouldEqual, "257")
+			So(s.IPv6().String(), ShouldEqual, "::/0")
+			So(s.IPv6().Size().String(), ShouldEqual, "340282366920938463463374607431768211456")
+			So(mustParse("0.0.0.0/0").Size().String(), ShouldEqual, "4294967296")
+			So(new(Set).Size().Sign(), ShouldEqual, 0)
+		})
+
+		Convey("Sets are encoded as JSON lists of networks", func() {
+			data, err := json.Marshal(mustParse("192.0.2.1", "192.0.2.0", "2001:db8::/32"))
+			So(err, ShouldEqual, nil)
+			So(string(data), ShouldEqual, `["192.0.2.0/31","2001:db8::/32"]`)
+			var s Set
+			So(json.Unmarshal(data, &s), ShouldEqual, nil)
+			So(s.String(), ShouldEqual, "192.0.2.0/31 2001:db8::/32")
+			So(json.Unmarshal([]byte(`["192.0.2.300"]`), &s), ShouldNotEqual, nil)
+		})
+
+		Convey("Neighbouring addresses", func() {
+			So(Next(net.ParseIP("192.0.2.255")).String(), ShouldEqual, "192.0.3.0")
+			So(Prev(net.ParseIP("2001:db8::")).String(), ShouldEqual, "2001:db7:ffff:ffff:ffff:ffff:ffff:ffff")
+			So(Next(net.ParseIP("255.255.255.255")), ShouldBeNil)
+			So(Prev(net.ParseIP("::")), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,272 @@
+package gospf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+// LocalPolicy is a receiver-side policy for clients the receiver trusts, e.g.
+// its backup MXes and known forwarders, for which SPF legitimately fails.
+// It is evaluated before the published policy of the sender: a trusted client
+// gets the local result instead, without looking up the published record.
+// With Instead set it replaces the published policy for all clients.
+type LocalPolicy struct {
+	// Networks are the trusted client networks.
+	Networks []net.IPNet
+	// Forwarders are the host names of trusted forwarders. A client matches
+	// when its validated reverse DNS name (see the ptr mechanism) is one of
+	// them or a subdomain of one, which costs a PTR query for every check.
+	Forwarders []string
+	// Result is the result of trusted clients, "Pass" when empty.
+	Result string
+	// Instead evaluates the local policy instead of the published policy:
+	// clients that aren't trusted get Otherwise ("None" when empty) and
+	// the published record is never looked up.
+	Instead   bool
+	Otherwise string
+}
+
+// WithLocalPolicy evaluates the local policy p before, or with p.Instead
+// instead of, the published policy.
+// A nil p has no effect.
+func WithLocalPolicy(p *LocalPolicy) Option {
+	return func(o *options) {
+		o.local = p
+	}
+}
+
+// match returns the term of p that matches ip, "local:<network>" or
+// "local:<forwarder>", or "" when the client isn't trusted.
+func (p *LocalPolicy) match(ip net.IP, dnsResolver dns.DnsResolver) string {
+	if p == nil || ip == nil {
+		return ""
+	}
+	for _, ipNet := range p.Networks {
+		if ipNet.Contains(ip) {
+			return "local:" + ipNet.String()
+		}
+	}
+	if len(p.Forwarders) == 0 {
+		return ""
+	}
+
+	names, err := dnsResolver.GetPTRRecords(ip.String())
+	if err != nil {
+		return ""
+	}
+	if len(names) > DNSLookupLimit {
+		names = names[:DNSLookupLimit]
+	}
+	for _, name := range names {
+		name = canonicalName(name)
+		forwarder := ""
+		for _, f := range p.Forwarders {
+			f = canonicalName(f)
+			if name == f || strings.HasSuffix(name, "."+f) {
+				forwarder = f
+				break
+			}
+		}
+		if forwarder == "" {
+			continue
+		}
+		// the name is only trusted when it resolves back to ip
+		var addrs []string
+		if ip.To4() != nil {
+			addrs, err = dnsResolver.GetARecords(name)
+		} else {
+			addrs, err = dnsResolver.GetAAAARecords(name)
+		}
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ip.Equal(net.ParseIP(addr)) {
+				return "local:" + forwarder
+			}
+		}
+	}
+	return ""
+}
+
+func (p *LocalPolicy) result() string {
+	if p.Result == "" {
+		return "Pass"
+	}
+	return p.Result
+}
+
+func (p *LocalPolicy) otherwise() string {
+	if p.Otherwise == "" {
+		return "None"
+	}
+	return p.Otherwise
+}
+
+// evaluateLocal evaluates the local policy of the options, if any, and
+// returns its evaluation when it matches ip or replaces the published
+// policy. It returns nil when the published policy must be evaluated.
+func (o *options) evaluateLocal(ip string, dnsResolver dns.DnsResolver) *Evaluation {
+	if o == nil || o.local == nil {
+		return nil
+	}
+	term := o.local.match(net.ParseIP(ip), dnsResolver)
+	if term == "" {
+		if !o.local.Instead {
+			return nil
+		}
+		result := o.local.otherwise()
+		return &Evaluation{
+			Result: result,
+			Local:  true,
+			Trace:  []string{fmt.Sprintf("local policy: %v not trusted -> %v", ip, result)},
+		}
+	}
+	result := o.local.result()
+	return &Evaluation{
+		Result:    result,
+		Mechanism: term,
+		Local:     true,
+		Trace:     []string{fmt.Sprintf("local policy: %v matched -> %v", term, result)},
+	}
+}
+
+// LocalPolicies are the local policies of recipient domains. The "*" entry
+// applies to recipient domains without a policy of their own.
+type LocalPolicies map[string]*LocalPolicy
+
+// For returns the local policy of the domain of recipient, an address or a
+// domain. Parent domains are tried when the domain has no policy, then "*".
+// It returns nil when no policy applies.
+func (p LocalPolicies) For(recipient string) *LocalPolicy {
+	domain := canonicalName(recipient[strings.LastIndex(recipient, "@")+1:])
+	for domain != "" {
+		if policy, ok := p[domain]; ok {
+			return policy
+		}
+		index := strings.Index(domain, ".")
+		if index == -1 {
+			break
+		}
+		domain = domain[index+1:]
+	}
+	return p["*"]
+}
+
+/*
+ParseLocalPolicies parses local policies, one recipient domain per line
+followed by its trusted networks and forwarder host names. "*" is the
+policy of all other recipient domains, "#" starts a comment. The word
+"instead" evaluates the policy instead of the published one (see
+LocalPolicy.Instead), "result=" sets the result of trusted clients and
+"otherwise=" the result of the other clients in instead mode:
+
+	# recipient domain   trusted networks and forwarders
+	*                    192.0.2.0/24 backup-mx.example.net
+	example.com          2001:db8::/32 forwarder.example.org result=neutral
+	example.net          instead 198.51.100.0/24 otherwise=fail
+
+A domain listed on several lines gets the trusted clients of all of them.
+*/
+func ParseLocalPolicies(r io.Reader) (LocalPolicies, error) {
+	policies := make(LocalPolicies)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if index := strings.Index(text, "#"); index != -1 {
+			text = text[:index]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		domain := fields[0]
+		if domain != "*" {
+			domain = canonicalName(domain)
+			if !isValidDomain(domain) {
+				return nil, fmt.Errorf("invalid recipient domain %q on line %v", fields[0], line)
+			}
+		}
+		policy, ok := policies[domain]
+		if !ok {
+			policy = &LocalPolicy{}
+			policies[domain] = policy
+		}
+		for _, field := range fields[1:] {
+			if field == "instead" {
+				policy.Instead = true
+				continue
+			}
+			if index := strings.Index(field, "="); index != -1 {
+				result := localResult(field[index+1:])
+				if result == "" {
+					return nil, fmt.Errorf("invalid result %q on line %v", field, line)
+				}
+				switch field[:index] {
+				case "result":
+					policy.Result = result
+				case "otherwise":
+					policy.Otherwise = result
+				default:
+					return nil, fmt.Errorf("unknown keyword %q on line %v", field[:index], line)
+				}
+				continue
+			}
+			if ipNet, ok := parseNetwork(field); ok {
+				policy.Networks = append(policy.Networks, ipNet)
+				continue
+			}
+			if strings.Contains(field, "/") || !isValidDomain(canonicalName(field)) {
+				return nil, fmt.Errorf("invalid network or forwarder %q on line %v", field, line)
+			}
+			policy.Forwarders = append(policy.Forwarders, canonicalName(field))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// localResult returns the canonical name of a result of a local policy, or
+// "" when it isn't one.
+func localResult(result string) string {
+	for _, r := range []string{"Pass", "Fail", "SoftFail", "Neutral", "None"} {
+		if strings.EqualFold(r, result) {
+			return r
+		}
+	}
+	return ""
+}
+
+// LoadLocalPolicies reads local policies from the file at path,
+// see ParseLocalPolicies.
+func LoadLocalPolicies(path string) (LocalPolicies, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseLocalPolicies(f)
+}
+
+// parseNetwork parses a network in CIDR notation or a single IP address.
+func parseNetwork(s string) (net.IPNet, bool) {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return *ipNet, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return net.IPNet{}, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, true
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, true
+}
@@ -0,0 +1,184 @@
+package gospf
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+const localZone = `
+$ORIGIN example.com.
+@          TXT  "v=spf1 ip4:192.0.2.1 -all"
+$ORIGIN example.net.
+mx1.backup A    198.51.100.1
+mx2.backup A    203.0.113.99
+$ORIGIN 113.0.203.in-addr.arpa.
+2          PTR  mx2.backup.example.net.
+$ORIGIN 100.51.198.in-addr.arpa.
+1          PTR  mx1.backup.example.net.
+`
+
+// countingPTRResolver counts the reverse DNS queries of the local policy.
+type countingPTRResolver struct {
+	*dns.ZoneResolver
+	queries int
+}
+
+func (c *countingPTRResolver) GetPTRRecords(addr string) ([]string, error) {
+	c.queries++
+	return c.ZoneResolver.GetPTRRecords(addr)
+}
+
+const localPolicies = `
+# recipient domain   trusted networks and forwarders
+*            192.0.2.128/25
+example.org  2001:db8::/32 backup.example.net # backup MXes
+example.org  198.18.0.1
+example.net  instead 192.0.2.0/25 backup.example.net
+example.info instead 192.0.2.0/25 result=Neutral otherwise=softfail
+`
+
+func TestLocalPolicy(t *testing.T) {
+	Convey("Testing local policies", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(localZone), ""), ShouldEqual, nil)
+		policies, err := ParseLocalPolicies(strings.NewReader(localPolicies))
+		So(err, ShouldEqual, nil)
+
+		Convey("Policies are selected by recipient domain", func() {
+			So(policies.For("user@example.org"), ShouldPointTo, policies["example.org"])
+			So(policies.For("user@Sub.Example.org."), ShouldPointTo, policies["example.org"])
+			So(policies.For("example.com"), ShouldPointTo, policies["*"])
+			So(policies.For(""), ShouldPointTo, policies["*"])
+			So(len(policies["example.org"].Networks), ShouldEqual, 2)
+			So(policies["example.org"].Forwarders, ShouldResemble, []string{"backup.example.net"})
+			So(policies["example.org"].Instead, ShouldEqual, false)
+			So(policies["example.net"].Instead, ShouldEqual, true)
+			So(policies["example.net"].Result, ShouldEqual, "")
+			So(policies["example.info"].Result, ShouldEqual, "Neutral")
+			So(policies["example.info"].Otherwise, ShouldEqual, "SoftFail")
+			So(LocalPolicies(nil).For("example.org"), ShouldEqual, nil)
+			So(LocalPolicies{"example.org": {}}.For("example.com"), ShouldEqual, nil)
+
+			_, err := ParseLocalPolicies(strings.NewReader("example.org 192.0.2.0/33\n"))
+			So(err, ShouldNotEqual, nil)
+			_, err = ParseLocalPolicies(strings.NewReader("localhost 192.0.2.1\n"))
+			So(err, ShouldNotEqual, nil)
+			for _, line := range []string{"example.org result=permerror\n", "example.org otherwise=\n", "example.org fallback=fail\n"} {
+				_, err = ParseLocalPolicies(strings.NewReader(line))
+				So(err, ShouldNotEqual, nil)
+			}
+			_, err = LoadLocalPolicies("testdata/nonexistent")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Trusted clients get the local result", func() {
+			local := policies.For("user@example.org")
+			tests := []struct {
+				ip        string
+				result    string
+				mechanism string
+				local     bool
+			}{
+				{"192.0.2.1", "Pass", "ip4:192.0.2.1", false},
+				{"2001:db8::25", "Pass", "local:2001:db8::/32", true},
+				{"198.18.0.1", "Pass", "local:198.18.0.1/32", true},
+				// forward-confirmed reverse DNS name
+				{"198.51.100.1", "Pass", "local:backup.example.net", true},
+				// the PTR name doesn't resolve to the client
+				{"203.0.113.2", "Fail", "-all", false},
+				{"192.0.2.200", "Fail", "-all", false},
+			}
+			for _, test := range tests {
+				result, err := Check(test.ip, "user@example.com", "mx.example.net", z, WithLocalPolicy(local))
+				So(err, ShouldEqual, nil)
+				So(result.Result, ShouldEqual, test.result)
+				So(result.Mechanism, ShouldEqual, test.mechanism)
+				So(result.Local, ShouldEqual, test.local)
+
+				spf, err := New("example.com", z, WithLocalPolicy(local))
+				So(err, ShouldEqual, nil)
+				evaluation, err := spf.Evaluate(test.ip)
+				So(err, ShouldEqual, nil)
+				So(evaluation.Result, ShouldEqual, test.result)
+				So(evaluation.Local, ShouldEqual, test.local)
+			}
+
+			// the published record isn't looked up for trusted clients
+			result, err := Check("192.0.2.200", "user@none.example.com", "mx.example.net", z, WithLocalPolicy(policies["*"]))
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "Pass")
+			So(result.Trace, ShouldResemble, []string{"local policy: local:192.0.2.128/25 matched -> Pass"})
+			So(result.Explanation(), ShouldEqual, "192.0.2.200 is trusted by the local policy of the receiver (local:192.0.2.128/25)")
+			So(result.AuthenticationResults("mx.example.org"), ShouldEqual, "mx.example.org; spf=pass (local policy) smtp.mailfrom=user@none.example.com")
+
+			neutral := &LocalPolicy{Networks: policies["*"].Networks, Result: "Neutral"}
+			result, err = Check("192.0.2.200", "user@example.com", "mx.example.net", z, WithLocalPolicy(neutral))
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "Neutral")
+		})
+
+		Convey("The local policy is evaluated once for untrusted clients", func() {
+			r := &countingPTRResolver{ZoneResolver: z}
+			result, err := Check("203.0.113.2", "user@example.com", "mx.example.net", r, WithLocalPolicy(policies.For("example.org")))
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "Fail")
+			So(r.queries, ShouldEqual, 1)
+		})
+
+		Convey("The local policy can replace the published policy", func() {
+			local := policies.For("user@example.net")
+			tests := []struct {
+				ip        string
+				result    string
+				mechanism string
+			}{
+				{"192.0.2.1", "Pass", "local:192.0.2.0/25"},
+				{"192.0.2.200", "None", ""},
+				{"198.51.100.2", "None", ""},
+				{"198.51.100.1", "Pass", "local:backup.example.net"},
+			}
+			for _, test := range tests {
+				// the published record of missing.example.com isn't looked up
+				for _, domain := range []string{"example.com", "missing.example.com"} {
+					result, err := Check(test.ip, "user@"+domain, "mx.example.net", z, WithLocalPolicy(local))
+					So(err, ShouldEqual, nil)
+					So(result.Result, ShouldEqual, test.result)
+					So(result.Mechanism, ShouldEqual, test.mechanism)
+					So(result.Local, ShouldEqual, true)
+				}
+
+				spf, err := New("example.com", z, WithLocalPolicy(local))
+				So(err, ShouldEqual, nil)
+				evaluation, err := spf.Evaluate(test.ip)
+				So(err, ShouldEqual, nil)
+				So(evaluation.Result, ShouldEqual, test.result)
+				So(evaluation.Mechanism, ShouldEqual, test.mechanism)
+				So(evaluation.Local, ShouldEqual, true)
+			}
+
+			result, err := Check("192.0.2.200", "user@example.com", "mx.example.net", z, WithLocalPolicy(local))
+			So(err, ShouldEqual, nil)
+			So(result.Trace, ShouldResemble, []string{"local policy: 192.0.2.200 not trusted -> None"})
+			So(result.Explanation(), ShouldEqual, "192.0.2.200 is not trusted by the local policy of the receiver")
+
+			// the results set in the file
+			result, err = Check("192.0.2.1", "user@example.com", "mx.example.net", z, WithLocalPolicy(policies.For("example.info")))
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "Neutral")
+			result, err = Check("192.0.2.200", "user@example.com", "mx.example.net", z, WithLocalPolicy(policies.For("example.info")))
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "SoftFail")
+			So(result.Local, ShouldEqual, true)
+
+			otherwise := &LocalPolicy{Networks: local.Networks, Instead: true, Otherwise: "Fail"}
+			result, err = Check("203.0.113.1", "user@example.com", "mx.example.net", z, WithLocalPolicy(otherwise))
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "Fail")
+			So(result.Local, ShouldEqual, true)
+		})
+	})
+}
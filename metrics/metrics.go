@@ -0,0 +1,327 @@
+// Package metrics collects measurements of SPF checks and exposes them in the
+// Prometheus text exposition format.
+//
+//	m := metrics.New()
+//	resolver := dns.NewCachingResolver(m.Resolver(&dns.GoSPFDNS{}), 0)
+//	m.WatchCache(resolver)
+//	m.WatchPolicyCache(policies)
+//	result, err := gospf.Check(ip, sender, helo, resolver, gospf.WithMetrics(m))
+//	http.Handle("/metrics", m)
+//
+// Nothing is measured for checks without gospf.WithMetrics, so library users
+// who don't use this package don't pay for it.
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+)
+
+// ContentType is the content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DurationBuckets are the upper bounds (in seconds) of the check duration histogram.
+var DurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// LookupBuckets are the upper bounds of the DNS lookups per check histogram,
+// which can't exceed the limit of 10 (RFC 7208 § 4.6.4).
+var LookupBuckets = []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	index := sort.SearchFloat64s(h.buckets, value)
+	if index < len(h.buckets) {
+		h.counts[index]++
+	}
+	h.sum += value
+	h.count++
+}
+
+// Metrics implements gospf.Metrics and serves the collected metrics over HTTP.
+// It is safe for concurrent use.
+type Metrics struct {
+	mu            sync.Mutex
+	results       map[string]uint64
+	limits        map[string]uint64
+	queries       map[[2]string]uint64 // [type, rcode]
+	checkDuration *histogram
+	checkLookups  *histogram
+	caches        []*dns.CachingResolver
+	policyCaches  []*gospf.PolicyCache
+}
+
+// New creates a Metrics without measurements.
+func New() *Metrics {
+	return &Metrics{
+		results:       make(map[string]uint64),
+		limits:        make(map[string]uint64),
+		queries:       make(map[[2]string]uint64),
+		checkDuration: newHistogram(DurationBuckets),
+		checkLookups:  newHistogram(LookupBuckets),
+	}
+}
+
+// CheckDone counts the result and records the duration and DNS lookups of a check.
+func (m *Metrics) CheckDone(result string, duration time.Duration, dnsLookups int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results[result]++
+	m.checkDuration.observe(duration.Seconds())
+	m.checkLookups.observe(float64(dnsLookups))
+}
+
+// LimitExceeded counts a violation of the DNS ("dns") or void ("void") lookup limit.
+func (m *Metrics) LimitExceeded(limit string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limits[limit]++
+}
+
+// WatchCache exports the hits and misses of c.
+func (m *Metrics) WatchCache(c *dns.CachingResolver) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.caches = append(m.caches, c)
+}
+
+// WatchPolicyCache exports the fresh and stale hits and the misses of c.
+func (m *Metrics) WatchPolicyCache(c *gospf.PolicyCache) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policyCaches = append(m.policyCaches, c)
+}
+
+// Resolver returns a DnsResolver that counts the queries sent to r by
+// record type and response code. When caching, wrap the returned resolver
+// in the cache so only the queries that reach the DNS are counted. The
+// returned resolver is a dns.TTLResolver when r is one.
+func (m *Metrics) Resolver(r dns.DnsResolver) dns.DnsResolver {
+	if ttl, ok := r.(dns.TTLResolver); ok {
+		return &ttlResolver{resolver: resolver{resolver: r, metrics: m}, ttl: ttl}
+	}
+	return &resolver{resolver: r, metrics: m}
+}
+
+func (m *Metrics) countQuery(qtype string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries[[2]string{qtype, rcode(err)}]++
+}
+
+// rcode returns the response code label of a query error. Go doesn't tell
+// empty answers from non-existent names, both are counted as NXDOMAIN.
+// Errors that don't tell their response code, e.g. refused queries, network
+// errors and errors of other resolvers, are labelled "error".
+func rcode(err error) string {
+	if err == nil || errors.Is(err, dns.ErrNoSPFRecord) || errors.Is(err, dns.ErrMultipleSPFRecords) {
+		return "NOERROR"
+	}
+	if dns.IsNotFound(err) {
+		return "NXDOMAIN"
+	}
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		return "error"
+	}
+	switch {
+	case dnsErr.IsTimeout:
+		return "TIMEOUT"
+	case dnsErr.IsTemporary && dnsErr.Err == "server misbehaving":
+		// the error of the Go resolver for RCODE 2, other response
+		// codes are "server misbehaving" too, but not temporary
+		return "SERVFAIL"
+	}
+	return "error"
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	writeHeader(cw, "gospf_check_results_total", "counter", "SPF checks by result.")
+	for _, result := range []string{"Pass", "Fail", "SoftFail", "Neutral", "None", "TempError", "PermError"} {
+		fmt.Fprintf(cw, "gospf_check_results_total{result=%q} %v\n", strings.ToLower(result), m.results[result])
+	}
+
+	writeHeader(cw, "gospf_limit_exceeded_total", "counter", "Evaluations that exceeded the DNS or void lookup limit.")
+	for _, limit := range []string{"dns", "void"} {
+		fmt.Fprintf(cw, "gospf_limit_exceeded_total{limit=%q} %v\n", limit, m.limits[limit])
+	}
+
+	writeHeader(cw, "gospf_dns_queries_total", "counter", "DNS queries by record type and response code.")
+	keys := make([][2]string, 0, len(m.queries))
+	for key := range m.queries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		fmt.Fprintf(cw, "gospf_dns_queries_total{type=%q,rcode=%q} %v\n", key[0], key[1], m.queries[key])
+	}
+
+	if len(m.caches) > 0 {
+		var hits, misses int64
+		for _, c := range m.caches {
+			hit, miss := c.Stats()
+			hits += hit
+			misses += miss
+		}
+		writeHeader(cw, "gospf_dns_cache_hits_total", "counter", "DNS answers served from the cache.")
+		fmt.Fprintf(cw, "gospf_dns_cache_hits_total %v\n", hits)
+		writeHeader(cw, "gospf_dns_cache_misses_total", "counter", "DNS queries not answered from the cache.")
+		fmt.Fprintf(cw, "gospf_dns_cache_misses_total %v\n", misses)
+	}
+
+	if len(m.policyCaches) > 0 {
+		var hits, stale, misses int64
+		for _, c := range m.policyCaches {
+			hit, staleHit, miss := c.Stats()
+			hits += hit
+			stale += staleHit
+			misses += miss
+		}
+		writeHeader(cw, "gospf_policy_cache_hits_total", "counter", "Policies served fresh from the policy cache.")
+		fmt.Fprintf(cw, "gospf_policy_cache_hits_total %v\n", hits)
+		writeHeader(cw, "gospf_policy_cache_stale_hits_total", "counter", "Expired policies served from the policy cache while refreshed.")
+		fmt.Fprintf(cw, "gospf_policy_cache_stale_hits_total %v\n", stale)
+		writeHeader(cw, "gospf_policy_cache_misses_total", "counter", "Policies not found in the policy cache.")
+		fmt.Fprintf(cw, "gospf_policy_cache_misses_total %v\n", misses)
+	}
+
+	writeHistogram(cw, "gospf_check_duration_seconds", "Time taken by SPF checks.", m.checkDuration)
+	writeHistogram(cw, "gospf_check_dns_lookups", "DNS querying terms per SPF check.", m.checkLookups)
+
+	if err := cw.w.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func writeHistogram(w io.Writer, name string, help string, h *histogram) {
+	writeHeader(w, name, "histogram", help)
+	cumulative := uint64(0)
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%v_bucket{le=%q} %v\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%v_bucket{le=\"+Inf\"} %v\n", name, h.count)
+	fmt.Fprintf(w, "%v_sum %v\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%v_count %v\n", name, h.count)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// resolver counts the queries of the wrapped resolver.
+type resolver struct {
+	resolver dns.DnsResolver
+	metrics  *Metrics
+}
+
+func (r *resolver) GetSPFRecord(name string) (string, error) {
+	record, err := r.resolver.GetSPFRecord(name)
+	r.metrics.countQuery("TXT", err)
+	return record, err
+}
+
+func (r *resolver) GetARecords(name string) ([]string, error) {
+	ips, err := r.resolver.GetARecords(name)
+	r.metrics.countQuery("A", err)
+	return ips, err
+}
+
+func (r *resolver) GetAAAARecords(name string) ([]string, error) {
+	ips, err := r.resolver.GetAAAARecords(name)
+	r.metrics.countQuery("AAAA", err)
+	return ips, err
+}
+
+func (r *resolver) GetMXRecords(name string) ([]*net.MX, error) {
+	mxs, err := r.resolver.GetMXRecords(name)
+	r.metrics.countQuery("MX", err)
+	return mxs, err
+}
+
+func (r *resolver) GetPTRRecords(addr string) ([]string, error) {
+	names, err := r.resolver.GetPTRRecords(addr)
+	r.metrics.countQuery("PTR", err)
+	return names, err
+}
+
+// ttlResolver counts the queries of the wrapped TTLResolver.
+type ttlResolver struct {
+	resolver
+	ttl dns.TTLResolver
+}
+
+func (r *ttlResolver) GetSPFRecordTTL(name string) (string, time.Duration, error) {
+	record, ttl, err := r.ttl.GetSPFRecordTTL(name)
+	r.metrics.countQuery("TXT", err)
+	return record, ttl, err
+}
+
+func (r *ttlResolver) GetARecordsTTL(name string) ([]string, time.Duration, error) {
+	ips, ttl, err := r.ttl.GetARecordsTTL(name)
+	r.metrics.countQuery("A", err)
+	return ips, ttl, err
+}
+
+func (r *ttlResolver) GetAAAARecordsTTL(name string) ([]string, time.Duration, error) {
+	ips, ttl, err := r.ttl.GetAAAARecordsTTL(name)
+	r.metrics.countQuery("AAAA", err)
+	return ips, ttl, err
+}
+
+func (r *ttlResolver) GetMXRecordsTTL(name string) ([]*net.MX, time.Duration, error) {
+	mxs, ttl, err := r.ttl.GetMXRecordsTTL(name)
+	r.metrics.countQuery("MX", err)
+	return mxs, ttl, err
+}
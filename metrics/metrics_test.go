@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+)
+
+const testZone = `
+$ORIGIN example.com.
+@        TXT  "v=spf1 ip4:192.0.2.1 mx -all"
+         MX   10 mx
+mx       A    192.0.2.10
+slow     TXT  "v=spf1 a:timeout.example.com -all"
+void     TXT  "v=spf1 a:a.example.com a:b.example.com a:c.example.com -all"
+`
+
+func TestMetrics(t *testing.T) {
+	Convey("Testing Metrics", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(testZone), ""), ShouldEqual, nil)
+		z.Fail("timeout.example.com", dns.Timeout)
+
+		m := New()
+		resolver := dns.NewCachingResolver(m.Resolver(z), time.Minute)
+		m.WatchCache(resolver)
+		// the TTLs of the zone reach the cache
+		_, ok := m.Resolver(z).(dns.TTLResolver)
+		So(ok, ShouldEqual, true)
+		_, ok = m.Resolver(&dns.GoSPFDNS{}).(dns.TTLResolver)
+		So(ok, ShouldEqual, false)
+
+		checks := []struct {
+			ip     string
+			sender string
+			result string
+		}{
+			{"192.0.2.1", "user@example.com", "Pass"},
+			{"192.0.2.10", "user@example.com", "Pass"},
+			{"203.0.113.1", "user@example.com", "Fail"},
+			{"192.0.2.1", "user@slow.example.com", "TempError"},
+			{"192.0.2.1", "user@void.example.com", "PermError"},
+		}
+		for _, check := range checks {
+			result, err := gospf.Check(check.ip, check.sender, "", resolver, gospf.WithMetrics(m))
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, check.result)
+		}
+
+		var out bytes.Buffer
+		_, err := m.WriteTo(&out)
+		So(err, ShouldEqual, nil)
+		text := out.String()
+
+		for _, line := range []string{
+			"# TYPE gospf_check_results_total counter",
+			`gospf_check_results_total{result="pass"} 2`,
+			`gospf_check_results_total{result="fail"} 1`,
+			`gospf_check_results_total{result="temperror"} 1`,
+			`gospf_check_results_total{result="permerror"} 1`,
+			`gospf_check_results_total{result="none"} 0`,
+			`gospf_limit_exceeded_total{limit="dns"} 0`,
+			`gospf_limit_exceeded_total{limit="void"} 1`,
+			`gospf_dns_queries_total{type="A",rcode="NOERROR"} 1`,
+			`gospf_dns_queries_total{type="A",rcode="NXDOMAIN"} 3`,
+			`gospf_dns_queries_total{type="A",rcode="TIMEOUT"} 1`,
+			`gospf_dns_queries_total{type="MX",rcode="NOERROR"} 1`,
+			`gospf_dns_queries_total{type="TXT",rcode="NOERROR"} 3`,
+			"gospf_dns_cache_hits_total 6",
+			"gospf_dns_cache_misses_total 9",
+			"# TYPE gospf_check_duration_seconds histogram",
+			`gospf_check_duration_seconds_bucket{le="+Inf"} 5`,
+			"gospf_check_duration_seconds_count 5",
+			`gospf_check_dns_lookups_bucket{le="0"} 2`,
+			`gospf_check_dns_lookups_bucket{le="1"} 5`,
+			`gospf_check_dns_lookups_bucket{le="+Inf"} 5`,
+			"gospf_check_dns_lookups_sum 3",
+		} {
+			So(text, ShouldContainSubstring, line+"\n")
+		}
+
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+		So(recorder.Header().Get("Content-Type"), ShouldEqual, ContentType)
+		So(recorder.Body.String(), ShouldEqual, text)
+		So(text, ShouldNotContainSubstring, "gospf_policy_cache")
+
+		policies := gospf.NewPolicyCache(time.Minute)
+		m.WatchPolicyCache(policies)
+		for i := 0; i < 3; i++ {
+			_, err := gospf.Check("192.0.2.1", "user@example.com", "", resolver, gospf.WithPolicyCache(policies))
+			So(err, ShouldEqual, nil)
+		}
+		out.Reset()
+		_, err = m.WriteTo(&out)
+		So(err, ShouldEqual, nil)
+		for _, line := range []string{
+			"# TYPE gospf_policy_cache_hits_total counter",
+			"gospf_policy_cache_hits_total 2",
+			"gospf_policy_cache_stale_hits_total 0",
+			"gospf_policy_cache_misses_total 1",
+		} {
+			So(out.String(), ShouldContainSubstring, line+"\n")
+		}
+	})
+}
+
+func TestRcode(t *testing.T) {
+	Convey("Query errors are labelled with their response code", t, func() {
+		tests := []struct {
+			err   error
+			rcode string
+		}{
+			{nil, "NOERROR"},
+			{fmt.Errorf("%w for example.com", dns.ErrNoSPFRecord), "NOERROR"},
+			{&net.DNSError{Err: "no such host", IsNotFound: true}, "NXDOMAIN"},
+			{dns.ErrNotFound, "NXDOMAIN"},
+			{&net.DNSError{Err: "i/o timeout", IsTimeout: true, IsTemporary: true}, "TIMEOUT"},
+			{&net.DNSError{Err: "server misbehaving", IsTemporary: true}, "SERVFAIL"},
+			// refused queries and other response codes
+			{&net.DNSError{Err: "server misbehaving"}, "error"},
+			{&net.DNSError{Err: "dial udp 192.0.2.53:53: connect: network is unreachable"}, "error"},
+			{errors.New("custom resolver failure"), "error"},
+		}
+		for _, test := range tests {
+			So(rcode(test.err), ShouldEqual, test.rcode)
+		}
+	})
+}
@@ -0,0 +1,450 @@
+// Package milter implements a milter (Sendmail/Postfix mail filter protocol)
+// server that checks SPF with gospf.
+//
+// The client IP is taken from the connect event, the HELO name from the HELO
+// event and the sender from the MAIL FROM event. At the end of every message a
+// Received-SPF or Authentication-Results header is added, and optionally the
+// message is rejected at MAIL FROM when the result is Fail.
+//
+// Postfix:
+//
+//	smtpd_milters = inet:127.0.0.1:8891
+//
+// Sendmail:
+//
+//	INPUT_MAIL_FILTER(`gospf', `S=inet:8891@127.0.0.1')
+package milter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+)
+
+// Header fields the server can add at the end of a message.
+const (
+	HeaderReceivedSPF           = "Received-SPF"
+	HeaderAuthenticationResults = "Authentication-Results"
+)
+
+// Milter protocol version 6, as in libmilter 8.14+.
+const protocolVersion = 6
+
+// Commands sent by the MTA.
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdBodyEOB = 'E'
+	cmdHelo    = 'H'
+	cmdQuitNC  = 'K'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+	cmdUnknown = 'U'
+)
+
+// Responses sent to the MTA.
+const (
+	respAccept    = 'a'
+	respContinue  = 'c'
+	respInsHeader = 'i'
+	respOptNeg    = 'O'
+	respReject    = 'r'
+	respTempFail  = 't'
+	respReplyCode = 'y'
+)
+
+// Action and protocol flags of the option negotiation.
+const (
+	actionAddHeaders = 0x01
+
+	protoNoRcpt    = 0x08
+	protoNoBody    = 0x10
+	protoNoHeaders = 0x20
+	protoNoEOH     = 0x40
+	protoNoUnknown = 0x100
+	protoNoData    = 0x200
+)
+
+// maxPacketSize limits the size of a packet sent by the MTA.
+const maxPacketSize = 1 << 20
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or Close.
+var ErrServerClosed = errors.New("milter: Server closed")
+
+// Server is a milter server. At least Resolver must be set.
+// Every MTA connection is handled in its own goroutine.
+type Server struct {
+	Resolver dns.DnsResolver
+	// Receiver is the host name used in the added header (the authserv-id
+	// of Authentication-Results).
+	Receiver string
+	// Header is the header field added at the end of the message:
+	// HeaderReceivedSPF (the default) or HeaderAuthenticationResults.
+	Header string
+	// RejectFail rejects the message at MAIL FROM when the result is Fail.
+	RejectFail bool
+	// TempFailTempError rejects the message temporarily at MAIL FROM
+	// when the result is TempError.
+	TempFailTempError bool
+	// Policies caches the loaded policies, when not nil.
+	Policies *gospf.PolicyCache
+	// Local is the local policy evaluated before the published policy (see
+	// gospf.WithLocalPolicy). The check runs at MAIL FROM, before the
+	// recipients are known, so it applies to all recipient domains.
+	Local *gospf.LocalPolicy
+	// BestGuess is the record evaluated for domains that publish none,
+	// e.g. gospf.DefaultBestGuess (see gospf.WithBestGuess). Empty disables it.
+	BestGuess string
+	// ErrorLog logs connection errors, the standard logger is used when nil.
+	ErrorLog *log.Logger
+
+	closed    int32 // accessed atomically
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+	group     gospf.Group // coalesces concurrent checks of the same domain
+}
+
+// ListenAndServe listens on the network address and serves milter connections.
+func (s *Server) ListenAndServe(network string, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts MTA connections on l until the server is shut down.
+// It always returns a non-nil error and closes l.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, nil, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.track(l, nil, false)
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !s.track(nil, c, true) {
+			c.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.track(nil, c, false)
+			defer c.Close()
+			if err := s.serveConn(c); err != nil && err != io.EOF && !s.isClosed() {
+				s.logf("milter: %v: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Shutdown closes the listeners and waits for the MTA connections to end,
+// or for ctx to be done, in which case they are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.closed, 1)
+	s.mu.Lock()
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
+
+// Close stops the server immediately, closing all listeners and connections.
+func (s *Server) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+func (s *Server) track(l net.Listener, c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[net.Conn]struct{})
+	}
+	if add && s.isClosed() {
+		return false
+	}
+	switch {
+	case l != nil && add:
+		s.listeners[l] = struct{}{}
+	case l != nil:
+		delete(s.listeners, l)
+	case add:
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+	default:
+		delete(s.conns, c)
+		s.wg.Done()
+	}
+	return true
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// session is the state of one MTA connection (one SMTP session).
+type session struct {
+	server *Server
+	w      *bufio.Writer
+	ip     string
+	helo   string
+	result *gospf.Result // result of the current message
+}
+
+func (s *Server) serveConn(c net.Conn) error {
+	sess := &session{server: s, w: bufio.NewWriter(c)}
+	r := bufio.NewReader(c)
+	for {
+		cmd, data, err := readPacket(r)
+		if err != nil {
+			return err
+		}
+		quit, err := sess.handle(cmd, data)
+		if err != nil {
+			return err
+		}
+		if err := sess.w.Flush(); err != nil {
+			return err
+		}
+		if quit {
+			return nil
+		}
+	}
+}
+
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 || length > maxPacketSize {
+		return 0, nil, fmt.Errorf("invalid packet length %v", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+func writePacket(w io.Writer, cmd byte, data ...[]byte) error {
+	length := 1
+	for _, d := range data {
+		length += len(d)
+	}
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, uint32(length))
+	header[4] = cmd
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for _, d := range data {
+		if _, err := w.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cString returns the NUL terminated string at the start of data and the rest.
+func cString(data []byte) (string, []byte, error) {
+	for i, b := range data {
+		if b == 0 {
+			return string(data[:i]), data[i+1:], nil
+		}
+	}
+	return "", nil, errors.New("string not NUL terminated")
+}
+
+// handle handles a command. It returns true when the connection must be closed.
+func (sess *session) handle(cmd byte, data []byte) (bool, error) {
+	switch cmd {
+	case cmdOptNeg:
+		return false, sess.negotiate(data)
+	case cmdMacro, cmdAbort:
+		// no response expected
+		if cmd == cmdAbort {
+			sess.result = nil
+		}
+		return false, nil
+	case cmdConnect:
+		_, rest, err := cString(data)
+		if err != nil {
+			return false, err
+		}
+		sess.ip = ""
+		if len(rest) > 0 && (rest[0] == '4' || rest[0] == '6') && len(rest) >= 3 {
+			address, _, err := cString(rest[3:])
+			if err != nil {
+				return false, err
+			}
+			// IPv6 addresses may be sent as "IPv6:2001:db8::1"
+			sess.ip = strings.TrimPrefix(address, "IPv6:")
+		}
+		return false, writePacket(sess.w, respContinue)
+	case cmdHelo:
+		helo, _, err := cString(data)
+		if err != nil {
+			return false, err
+		}
+		sess.helo = helo
+		return false, writePacket(sess.w, respContinue)
+	case cmdMail:
+		sender, _, err := cString(data)
+		if err != nil {
+			return false, err
+		}
+		return false, sess.mailFrom(sender)
+	case cmdBodyEOB:
+		return false, sess.endOfMessage()
+	case cmdQuit:
+		return true, nil
+	case cmdQuitNC:
+		// the MTA reuses the connection for a new SMTP session
+		sess.ip, sess.helo, sess.result = "", "", nil
+		return false, nil
+	case cmdRcpt, cmdData, cmdHeader, cmdEOH, cmdBody, cmdUnknown:
+		return false, writePacket(sess.w, respContinue)
+	}
+	return false, fmt.Errorf("unknown command %q", cmd)
+}
+
+// negotiate answers the option negotiation: the server only adds headers
+// and doesn't need the recipients, headers or body of the message.
+func (sess *session) negotiate(data []byte) error {
+	if len(data) < 12 {
+		return errors.New("option negotiation too short")
+	}
+	version := binary.BigEndian.Uint32(data[0:4])
+	actions := binary.BigEndian.Uint32(data[4:8])
+	protocol := binary.BigEndian.Uint32(data[8:12])
+	if version < 2 {
+		return fmt.Errorf("unsupported milter protocol version %v", version)
+	}
+	if actions&actionAddHeaders == 0 {
+		return errors.New("MTA doesn't allow adding headers")
+	}
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	skip := uint32(protoNoRcpt | protoNoBody | protoNoHeaders | protoNoEOH | protoNoUnknown | protoNoData)
+
+	out := make([]byte, 12)
+	binary.BigEndian.PutUint32(out[0:4], version)
+	binary.BigEndian.PutUint32(out[4:8], actionAddHeaders)
+	binary.BigEndian.PutUint32(out[8:12], protocol&skip)
+	return writePacket(sess.w, respOptNeg, out)
+}
+
+func (sess *session) mailFrom(sender string) error {
+	sess.result = nil
+	if sess.ip == "" {
+		// e.g. a local (unix socket) connection, there is nothing to check
+		return writePacket(sess.w, respContinue)
+	}
+
+	opts := []gospf.Option{gospf.WithGroup(&sess.server.group)}
+	if sess.server.Policies != nil {
+		opts = append(opts, gospf.WithPolicyCache(sess.server.Policies))
+	}
+	if sess.server.Local != nil {
+		opts = append(opts, gospf.WithLocalPolicy(sess.server.Local))
+	}
+	if sess.server.BestGuess != "" {
+		opts = append(opts, gospf.WithBestGuess(sess.server.BestGuess))
+	}
+	result, err := gospf.Check(sess.ip, sender, sess.helo, sess.server.Resolver, opts...)
+	if err != nil {
+		return writePacket(sess.w, respContinue)
+	}
+	sess.result = result
+
+	switch {
+	case result.Result == "Fail" && sess.server.RejectFail:
+		reply := fmt.Sprintf("550 5.7.23 SPF check failed: %v is not allowed to send mail for %v", result.IP, result.Domain)
+		return writePacket(sess.w, respReplyCode, []byte(reply), []byte{0})
+	case result.Result == "TempError" && sess.server.TempFailTempError:
+		reply := fmt.Sprintf("451 4.4.3 SPF check of %v temporarily failed, try again later", result.Domain)
+		return writePacket(sess.w, respReplyCode, []byte(reply), []byte{0})
+	}
+	return writePacket(sess.w, respContinue)
+}
+
+// endOfMessage adds the header at the top of the message and accepts it.
+func (sess *session) endOfMessage() error {
+	if sess.result != nil {
+		name, value := HeaderReceivedSPF, sess.result.ReceivedSPF(sess.server.Receiver)
+		if sess.server.Header == HeaderAuthenticationResults {
+			name, value = HeaderAuthenticationResults, sess.result.AuthenticationResults(sess.server.Receiver)
+		}
+		index := make([]byte, 4)
+		if err := writePacket(sess.w, respInsHeader, index, []byte(name), []byte{0}, []byte(value), []byte{0}); err != nil {
+			return err
+		}
+	}
+	sess.result = nil
+	return writePacket(sess.w, respAccept)
+}
@@ -0,0 +1,255 @@
+package milter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+const testZone = `
+$ORIGIN example.com.
+@        TXT  "v=spf1 ip4:192.0.2.1 ip6:2001:db8::1 ~ip4:192.0.2.2 -all"
+mail     TXT  "v=spf1 a -all"
+         A    192.0.2.10
+slow     TXT  "v=spf1 a:timeout.example.com -all"
+`
+
+func testResolver() *dns.ZoneResolver {
+	z := dns.NewZoneResolver()
+	if err := z.Load(strings.NewReader(testZone), ""); err != nil {
+		panic(err)
+	}
+	z.Fail("timeout.example.com", dns.Timeout)
+	return z
+}
+
+// fakeMTA is the MTA side of the milter protocol.
+type fakeMTA struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type packet struct {
+	cmd  byte
+	data []byte
+}
+
+func dialMTA(t *testing.T, addr string) *fakeMTA {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return &fakeMTA{t: t, conn: c, r: bufio.NewReader(c)}
+}
+
+func (m *fakeMTA) send(cmd byte, data ...string) {
+	if err := writePacket(m.conn, cmd, []byte(strings.Join(data, ""))); err != nil {
+		m.t.Fatal(err)
+	}
+}
+
+func (m *fakeMTA) receive() packet {
+	cmd, data, err := readPacket(m.r)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return packet{cmd, data}
+}
+
+// negotiate offers protocol version 6 with all actions and protocol flags.
+func (m *fakeMTA) negotiate() packet {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:4], 6)
+	binary.BigEndian.PutUint32(data[4:8], 0x1ff)
+	binary.BigEndian.PutUint32(data[8:12], 0x1fffff)
+	m.send(cmdOptNeg, string(data))
+	return m.receive()
+}
+
+func (m *fakeMTA) connect(family byte, ip string) packet {
+	m.send(cmdMacro, "C", "j\x00mx.example.org\x00")
+	m.send(cmdConnect, "client.example.net\x00", string(family), "\x00\x19", ip, "\x00")
+	return m.receive()
+}
+
+func (m *fakeMTA) helo(name string) packet {
+	m.send(cmdHelo, name, "\x00")
+	return m.receive()
+}
+
+func (m *fakeMTA) mail(sender string) packet {
+	m.send(cmdMacro, "M", "i\x00ABC123\x00")
+	m.send(cmdMail, sender, "\x00", "SIZE=100\x00")
+	return m.receive()
+}
+
+// endOfMessage sends the rest of the message and returns the
+// modifications and the final response.
+func (m *fakeMTA) endOfMessage() []packet {
+	for _, cmd := range []byte{cmdRcpt, cmdData, cmdHeader, cmdEOH, cmdBody} {
+		m.send(cmd, "x\x00")
+		if p := m.receive(); p.cmd != respContinue {
+			m.t.Fatalf("expected continue for %q, got %q", cmd, p.cmd)
+		}
+	}
+	m.send(cmdBodyEOB)
+	packets := make([]packet, 0)
+	for {
+		p := m.receive()
+		packets = append(packets, p)
+		if p.cmd != respInsHeader {
+			return packets
+		}
+	}
+}
+
+// header splits the data of an insheader response.
+func header(p packet) (int, string, string) {
+	fields := strings.Split(string(p.data[4:]), "\x00")
+	return int(binary.BigEndian.Uint32(p.data[0:4])), fields[0], fields[1]
+}
+
+func startServer(s *Server) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+	return l.Addr().String(), done
+}
+
+func TestServer(t *testing.T) {
+	Convey("Testing the milter server with a fake MTA", t, func() {
+		s := &Server{
+			Resolver: testResolver(),
+			Receiver: "mx.example.org",
+			ErrorLog: log.New(ioutil.Discard, "", 0),
+		}
+		addr, done := startServer(s)
+		m := dialMTA(t, addr)
+		defer m.conn.Close()
+
+		Convey("Option negotiation", func() {
+			p := m.negotiate()
+			So(p.cmd, ShouldEqual, respOptNeg)
+			So(binary.BigEndian.Uint32(p.data[0:4]), ShouldEqual, 6)
+			So(binary.BigEndian.Uint32(p.data[4:8]), ShouldEqual, actionAddHeaders)
+			So(binary.BigEndian.Uint32(p.data[8:12]), ShouldEqual, protoNoRcpt|protoNoBody|protoNoHeaders|protoNoEOH|protoNoUnknown|protoNoData)
+		})
+
+		Convey("Received-SPF header at end of message", func() {
+			m.negotiate()
+			So(m.connect('4', "192.0.2.1").cmd, ShouldEqual, respContinue)
+			So(m.helo("mail.example.com").cmd, ShouldEqual, respContinue)
+			So(m.mail("<user@example.com>").cmd, ShouldEqual, respContinue)
+
+			packets := m.endOfMessage()
+			So(len(packets), ShouldEqual, 2)
+			So(packets[0].cmd, ShouldEqual, respInsHeader)
+			index, name, value := header(packets[0])
+			So(index, ShouldEqual, 0)
+			So(name, ShouldEqual, "Received-SPF")
+			So(value, ShouldStartWith, "Pass (mx.example.org: domain of user@example.com designates 192.0.2.1 as permitted sender)")
+			So(packets[1].cmd, ShouldEqual, respAccept)
+
+			Convey("Second message of the session", func() {
+				So(m.mail("<user@example.com>").cmd, ShouldEqual, respContinue)
+				m.send(cmdAbort)
+				So(m.mail("<>").cmd, ShouldEqual, respContinue)
+				packets := m.endOfMessage()
+				_, _, value := header(packets[0])
+				So(value, ShouldStartWith, "Fail (mx.example.org: domain of postmaster@mail.example.com")
+			})
+		})
+
+		Convey("IPv6 client", func() {
+			m.negotiate()
+			m.connect('6', "IPv6:2001:db8::1")
+			m.helo("mail.example.com")
+			m.mail("<user@example.com>")
+			_, _, value := header(m.endOfMessage()[0])
+			So(value, ShouldStartWith, "Pass (mx.example.org: domain of user@example.com designates 2001:db8::1")
+		})
+
+		Convey("Authentication-Results header", func() {
+			s.Header = HeaderAuthenticationResults
+			m.negotiate()
+			m.connect('4', "192.0.2.2")
+			m.helo("mail.example.com")
+			m.mail("<user@example.com>")
+			_, name, value := header(m.endOfMessage()[0])
+			So(name, ShouldEqual, "Authentication-Results")
+			So(value, ShouldEqual, "mx.example.org; spf=softfail smtp.mailfrom=user@example.com")
+		})
+
+		Convey("Fail is only rejected when configured", func() {
+			m.negotiate()
+			m.connect('4', "192.0.2.3")
+			m.helo("mail.example.com")
+			So(m.mail("<user@example.com>").cmd, ShouldEqual, respContinue)
+			m.send(cmdAbort)
+
+			s.RejectFail = true
+			p := m.mail("<user@example.com>")
+			So(p.cmd, ShouldEqual, respReplyCode)
+			So(string(p.data), ShouldStartWith, "550 5.7.23 SPF check failed: 192.0.2.3 is not allowed to send mail for example.com")
+		})
+
+		Convey("TempError is only deferred when configured", func() {
+			m.negotiate()
+			m.connect('4', "192.0.2.1")
+			m.helo("mail.example.com")
+			So(m.mail("<user@slow.example.com>").cmd, ShouldEqual, respContinue)
+			m.send(cmdAbort)
+
+			s.TempFailTempError = true
+			p := m.mail("<user@slow.example.com>")
+			So(p.cmd, ShouldEqual, respReplyCode)
+			So(string(p.data), ShouldStartWith, "451 4.4.3")
+		})
+
+		Convey("Unix socket clients are not checked", func() {
+			m.negotiate()
+			m.send(cmdConnect, "localhost\x00", "U")
+			So(m.receive().cmd, ShouldEqual, respContinue)
+			m.mail("<user@example.com>")
+			packets := m.endOfMessage()
+			So(len(packets), ShouldEqual, 1)
+			So(packets[0].cmd, ShouldEqual, respAccept)
+		})
+
+		Convey("Shutdown waits for the MTA to quit", func() {
+			m.negotiate()
+			m.connect('4', "192.0.2.1")
+
+			shutdown := make(chan error, 1)
+			go func() {
+				shutdown <- s.Shutdown(context.Background())
+			}()
+			So(<-done, ShouldEqual, ErrServerClosed)
+
+			So(m.helo("mail.example.com").cmd, ShouldEqual, respContinue)
+			m.send(cmdQuit)
+			So(<-shutdown, ShouldEqual, nil)
+		})
+
+		Reset(func() {
+			s.Close()
+		})
+	})
+}
@@ -0,0 +1,178 @@
+package gospf
+
+import (
+	"net"
+	"time"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+// EventKind is the kind of an evaluation Event.
+type EventKind int
+
+const (
+	// TermStart is sent before a term of a record is resolved (in New) or
+	// evaluated against the client IP (ptr and include terms in CheckIP).
+	TermStart EventKind = iota + 1
+	// TermEnd is sent after a term, with its Duration and Err.
+	TermEnd
+	// DNSQuery is sent before a DNS query.
+	DNSQuery
+	// DNSAnswer is sent after a DNS query, with its Answers, Duration and Err.
+	DNSAnswer
+	// LimitExceeded is sent when the DNS ("dns") or void ("void") lookup limit
+	// of RFC 7208 § 4.6.4 is exceeded, with the limit in Name.
+	LimitExceeded
+	// ResultEvent is sent when CheckIP or Evaluate returns, with the IP,
+	// Result, the matched mechanism in Term and the error, if any, in Err.
+	ResultEvent
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case TermStart:
+		return "TermStart"
+	case TermEnd:
+		return "TermEnd"
+	case DNSQuery:
+		return "DNSQuery"
+	case DNSAnswer:
+		return "DNSAnswer"
+	case LimitExceeded:
+		return "LimitExceeded"
+	case ResultEvent:
+		return "Result"
+	}
+	return "Unknown"
+}
+
+// Event is a step of an evaluation. Only the fields documented for its Kind are set.
+type Event struct {
+	Kind     EventKind
+	Domain   string        // domain of the record being evaluated (empty for DNS events)
+	Term     string        // term, e.g. "include:_spf.example.com" or "-all"
+	QType    string        // DNS record type, e.g. "TXT" or "MX"
+	Name     string        // queried name, or the exceeded limit
+	Answers  []string      // DNS answers
+	IP       string        // client IP
+	Result   string        // result of the evaluation
+	Duration time.Duration // duration of the term or DNS query
+	Err      error
+}
+
+// Observer is notified of the steps of evaluations, e.g. to log them or to
+// create tracing spans. Observe is called synchronously, from the goroutine
+// calling New, NewForIP, Check or CheckIP, so it should return quickly.
+// With WithConcurrency, DNS events are also sent from prefetching goroutines.
+// To relate the events to a request, pass a new Observer to every call.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc is an adapter to use a function as Observer.
+type ObserverFunc func(Event)
+
+// Observe calls f(e).
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+// WithObserver notifies o of every step of the evaluation.
+// Without it no events are created.
+func WithObserver(o Observer) Option {
+	return func(opts *options) {
+		opts.observer = o
+	}
+}
+
+func (o *options) observe(e Event) {
+	if o != nil && o.observer != nil {
+		o.observer.Observe(e)
+	}
+}
+
+// observed reports whether an observer must be notified.
+func (o *options) observed() bool {
+	return o != nil && o.observer != nil
+}
+
+// resolver wraps dnsResolver to notify the observer of DNS queries.
+func (o *options) resolver(dnsResolver dns.DnsResolver) dns.DnsResolver {
+	if !o.observed() {
+		return dnsResolver
+	}
+	return &observedResolver{resolver: dnsResolver, options: o}
+}
+
+func (spf *SPF) termStart(term string) time.Time {
+	if !spf.options.observed() {
+		return time.Time{}
+	}
+	spf.options.observe(Event{Kind: TermStart, Domain: spf.Domain, Term: term})
+	return time.Now()
+}
+
+func (spf *SPF) termEnd(term string, start time.Time, err error) {
+	if !spf.options.observed() {
+		return
+	}
+	spf.options.observe(Event{Kind: TermEnd, Domain: spf.Domain, Term: term, Duration: time.Since(start), Err: err})
+}
+
+// observedResolver notifies the observer of the queries of the wrapped resolver.
+type observedResolver struct {
+	resolver dns.DnsResolver
+	options  *options
+}
+
+func (r *observedResolver) query(qtype string, name string) time.Time {
+	r.options.observe(Event{Kind: DNSQuery, QType: qtype, Name: name})
+	return time.Now()
+}
+
+func (r *observedResolver) answer(qtype string, name string, start time.Time, answers []string, err error) {
+	r.options.observe(Event{Kind: DNSAnswer, QType: qtype, Name: name, Answers: answers, Duration: time.Since(start), Err: err})
+}
+
+func (r *observedResolver) GetSPFRecord(name string) (string, error) {
+	start := r.query("TXT", name)
+	record, err := r.resolver.GetSPFRecord(name)
+	answers := []string{}
+	if err == nil {
+		answers = append(answers, record)
+	}
+	r.answer("TXT", name, start, answers, err)
+	return record, err
+}
+
+func (r *observedResolver) GetARecords(name string) ([]string, error) {
+	start := r.query("A", name)
+	ips, err := r.resolver.GetARecords(name)
+	r.answer("A", name, start, ips, err)
+	return ips, err
+}
+
+func (r *observedResolver) GetAAAARecords(name string) ([]string, error) {
+	start := r.query("AAAA", name)
+	ips, err := r.resolver.GetAAAARecords(name)
+	r.answer("AAAA", name, start, ips, err)
+	return ips, err
+}
+
+func (r *observedResolver) GetMXRecords(name string) ([]*net.MX, error) {
+	start := r.query("MX", name)
+	mxs, err := r.resolver.GetMXRecords(name)
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, mx.Host)
+	}
+	r.answer("MX", name, start, hosts, err)
+	return mxs, err
+}
+
+func (r *observedResolver) GetPTRRecords(addr string) ([]string, error) {
+	start := r.query("PTR", addr)
+	names, err := r.resolver.GetPTRRecords(addr)
+	r.answer("PTR", addr, start, names, err)
+	return names, err
+}
@@ -0,0 +1,57 @@
+package gospf
+
+import (
+	"time"
+
+	"github.com/mistralmail/gospf/provider"
+)
+
+// Metrics receives measurements of SPF evaluations, e.g. to export them to
+// Prometheus (see the metrics package). Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	// CheckDone is called by Check with the result, the time it took and
+	// the number of DNS querying terms of the evaluated policy (zero when
+	// the policy couldn't be loaded).
+	CheckDone(result string, duration time.Duration, dnsLookups int)
+	// LimitExceeded is called when an evaluation exceeds the DNS lookup
+	// limit ("dns") or the void lookup limit ("void") of RFC 7208 § 4.6.4.
+	LimitExceeded(limit string)
+}
+
+// Option configures New, NewForIP and Check. The options given to New and
+// NewForIP also apply to the CheckIP and Evaluate calls of the instance.
+type Option func(*options)
+
+type options struct {
+	metrics     Metrics
+	observer    Observer
+	concurrency int
+	group       *Group
+	policies    *PolicyCache
+	local       *LocalPolicy
+	bestGuess   string
+	providers   *provider.Catalog
+}
+
+// WithMetrics reports measurements to m. Without it nothing is measured.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *options) limitExceeded(domain string, limit string) {
+	if o != nil && o.metrics != nil {
+		o.metrics.LimitExceeded(limit)
+	}
+	o.observe(Event{Kind: LimitExceeded, Domain: domain, Name: limit})
+}
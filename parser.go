@@ -180,7 +180,8 @@ func (d *Directive) getMechanism() string {
 	if isQualifier(d.term[0]) {
 		term = term[1:]
 	}
-	index := strings.Index(term, ":")
+	// the mechanism ends at its domain-spec or at its dual-cidr-length (e.g. "a/24")
+	index := strings.IndexAny(term, ":/")
 	if index == -1 {
 		return term
 	}
@@ -107,6 +107,14 @@ func TestDirective(t *testing.T) {
 				d: Directive{term: "a"},
 				m: "a",
 			},
+			{
+				d: Directive{term: "a/24"},
+				m: "a",
+			},
+			{
+				d: Directive{term: "?mx//64"},
+				m: "mx",
+			},
 			{
 				d: Directive{term: "mx:mail.example.com"},
 				m: "mx",
@@ -0,0 +1,290 @@
+package gospf
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+// DefaultPolicyCacheSize is the max number of policies a PolicyCache keeps
+// when no size is set.
+const DefaultPolicyCacheSize = 10000
+
+// PolicyCache keeps the SPF instances created by New and NewForIP (with
+// WithPolicyCache), so the policies of busy domains are loaded once and
+// shared by all checks. A policy expires at the lowest TTL of the TXT, A,
+// AAAA and MX records it was built from, when the resolver is a
+// dns.TTLResolver, and after TTL at the latest. Policies that failed with a
+// PermError or None are cached too, TempErrors are not.
+//
+// After expiring a policy is still returned for Stale, while it's reloaded
+// in the background, so busy domains never wait for a reload. Concurrent
+// loads of the same policy are coalesced like with a Group.
+//
+// All calls using a PolicyCache must use the same resolver; a PolicyCache
+// is safe for concurrent use.
+type PolicyCache struct {
+	// TTL is the max time a policy is cached, dns.DefaultCacheTTL when zero.
+	TTL time.Duration
+	// Stale is the time an expired policy is still returned while it's
+	// reloaded in the background. Zero disables it.
+	Stale time.Duration
+	// Size is the max number of cached policies, DefaultPolicyCacheSize when zero.
+	Size int
+
+	hits   int64 // accessed atomically
+	stale  int64 // accessed atomically
+	misses int64 // accessed atomically
+
+	mu         sync.Mutex
+	entries    map[string]*policyEntry
+	generation int // incremented by Invalidate and Flush
+	group      Group
+	refreshes  sync.WaitGroup
+	now        func() time.Time
+}
+
+type policyEntry struct {
+	spf        *SPF
+	err        error
+	expires    time.Time
+	names      map[string]struct{} // names queried to build the policy
+	refreshing bool
+}
+
+// NewPolicyCache creates a PolicyCache keeping policies for at most ttl.
+func NewPolicyCache(ttl time.Duration) *PolicyCache {
+	return &PolicyCache{TTL: ttl}
+}
+
+// WithPolicyCache returns the policy from c, or loads and caches it.
+func WithPolicyCache(c *PolicyCache) Option {
+	return func(o *options) {
+		o.policies = c
+	}
+}
+
+// Stats returns the number of fresh and stale cache hits and of misses so far.
+func (c *PolicyCache) Stats() (hits int64, stale int64, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.stale), atomic.LoadInt64(&c.misses)
+}
+
+// Invalidate removes the cached policies that depend on a record of domain,
+// i.e. the policy of domain and the policies including it or referring to it
+// in a, mx or exists. Note that the resolver may still cache the old records.
+func (c *PolicyCache) Invalidate(domain string) {
+	name := canonicalName(domain)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, entry := range c.entries {
+		if _, ok := entry.names[name]; ok {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Flush removes all cached policies.
+func (c *PolicyCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = nil
+}
+
+// get returns the cached policy of domain, or loads it.
+func (c *PolicyCache) get(domain string, dnsResolver dns.DnsResolver, family addressFamily, o *options) (*SPF, error) {
+	key := o.key(domain, family)
+	now := c.clock()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && now.Before(entry.expires) {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		return entry.result(o, dnsResolver)
+	}
+	if ok && now.Before(entry.expires.Add(c.Stale)) {
+		if !entry.refreshing {
+			entry.refreshing = true
+			c.refreshes.Add(1)
+			go c.refresh(key, domain, dnsResolver, family, &options{concurrency: o.concurrency, metrics: o.metrics, bestGuess: o.bestGuess})
+		}
+		c.mu.Unlock()
+		atomic.AddInt64(&c.stale, 1)
+		return entry.result(o, dnsResolver)
+	}
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	spf, err, shared := c.group.do(key, func() (*SPF, error) {
+		return c.load(key, domain, dnsResolver, family, o)
+	})
+	if !shared || err != nil {
+		return spf, err
+	}
+	return spf.withOptions(o, o.resolver(dnsResolver)), nil
+}
+
+// refresh reloads an expired policy in the background.
+func (c *PolicyCache) refresh(key string, domain string, dnsResolver dns.DnsResolver, family addressFamily, o *options) {
+	defer c.refreshes.Done()
+	_, err, _ := c.group.do(key, func() (*SPF, error) {
+		return c.load(key, domain, dnsResolver, family, o)
+	})
+	if _, ok := err.(*TempError); ok {
+		// keep returning the stale policy, the next hit retries
+		c.mu.Lock()
+		if entry, ok := c.entries[key]; ok {
+			entry.refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// load builds the policy of domain and caches it, unless it failed
+// temporarily or the cache was invalidated in the meantime.
+func (c *PolicyCache) load(key string, domain string, dnsResolver dns.DnsResolver, family addressFamily, o *options) (*SPF, error) {
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+
+	recorder := &ttlRecorder{resolver: dnsResolver, ttl: dns.NoTTL, names: make(map[string]struct{})}
+	resolver := o.resolver(recorder)
+	spf, err := newPolicy(domain, o.prefetch(domain, resolver, family), o, family)
+	if _, ok := err.(*TempError); ok {
+		return spf, err
+	}
+
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = dns.DefaultCacheTTL
+	}
+	recorder.mu.Lock()
+	if recorder.ttl >= 0 && recorder.ttl < ttl {
+		ttl = recorder.ttl
+	}
+	names := recorder.names
+	recorder.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return spf, err
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*policyEntry)
+	}
+	now := c.clock()
+	c.evict(now)
+	c.entries[key] = &policyEntry{spf: spf, err: err, expires: now.Add(ttl), names: names}
+	return spf, err
+}
+
+// evict makes room for a new entry, first by removing the entries that are
+// expired (including Stale) and then arbitrary ones. c.mu must be held.
+func (c *PolicyCache) evict(now time.Time) {
+	size := c.Size
+	if size <= 0 {
+		size = DefaultPolicyCacheSize
+	}
+	if len(c.entries) < size {
+		return
+	}
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires.Add(c.Stale)) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < size {
+			return
+		}
+		delete(c.entries, key)
+	}
+}
+
+func (c *PolicyCache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// result returns the cached policy for a caller with the options o.
+func (e *policyEntry) result(o *options, dnsResolver dns.DnsResolver) (*SPF, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.spf.withOptions(o, o.resolver(dnsResolver)), nil
+}
+
+// ttlRecorder records the lowest TTL of the answers and the queried names
+// while a policy is built.
+type ttlRecorder struct {
+	resolver dns.DnsResolver
+	mu       sync.Mutex
+	ttl      time.Duration
+	names    map[string]struct{}
+}
+
+func (r *ttlRecorder) record(name string, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names[canonicalName(name)] = struct{}{}
+	if ttl >= 0 && (r.ttl < 0 || ttl < r.ttl) {
+		r.ttl = ttl
+	}
+}
+
+func (r *ttlRecorder) GetSPFRecord(name string) (string, error) {
+	if t, ok := r.resolver.(dns.TTLResolver); ok {
+		record, ttl, err := t.GetSPFRecordTTL(name)
+		r.record(name, ttl)
+		return record, err
+	}
+	r.record(name, dns.NoTTL)
+	return r.resolver.GetSPFRecord(name)
+}
+
+func (r *ttlRecorder) GetARecords(name string) ([]string, error) {
+	if t, ok := r.resolver.(dns.TTLResolver); ok {
+		ips, ttl, err := t.GetARecordsTTL(name)
+		r.record(name, ttl)
+		return ips, err
+	}
+	r.record(name, dns.NoTTL)
+	return r.resolver.GetARecords(name)
+}
+
+func (r *ttlRecorder) GetAAAARecords(name string) ([]string, error) {
+	if t, ok := r.resolver.(dns.TTLResolver); ok {
+		ips, ttl, err := t.GetAAAARecordsTTL(name)
+		r.record(name, ttl)
+		return ips, err
+	}
+	r.record(name, dns.NoTTL)
+	return r.resolver.GetAAAARecords(name)
+}
+
+func (r *ttlRecorder) GetMXRecords(name string) ([]*net.MX, error) {
+	if t, ok := r.resolver.(dns.TTLResolver); ok {
+		mxs, ttl, err := t.GetMXRecordsTTL(name)
+		r.record(name, ttl)
+		return mxs, err
+	}
+	r.record(name, dns.NoTTL)
+	return r.resolver.GetMXRecords(name)
+}
+
+func (r *ttlRecorder) GetPTRRecords(addr string) ([]string, error) {
+	return r.resolver.GetPTRRecords(addr)
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,133 @@
+package gospf
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+const policyZone = `
+$ORIGIN example.net.
+@        300  TXT  "v=spf1 include:_spf.example.net a:host.example.net -all"
+_spf     60   TXT  "v=spf1 ip4:198.51.100.0/24 -all"
+host     3600 A    203.0.113.1
+other    300  TXT  "v=spf1 ip4:192.0.2.0/24 -all"
+`
+
+// countingTTLResolver counts the TXT queries that reach the zone.
+type countingTTLResolver struct {
+	*dns.ZoneResolver
+	queries int
+}
+
+func (c *countingTTLResolver) GetSPFRecordTTL(name string) (string, time.Duration, error) {
+	c.queries++
+	return c.ZoneResolver.GetSPFRecordTTL(name)
+}
+
+func TestPolicyCache(t *testing.T) {
+	Convey("Testing PolicyCache", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(policyZone), ""), ShouldEqual, nil)
+		r := &countingTTLResolver{ZoneResolver: z}
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := NewPolicyCache(time.Hour)
+		c.Stale = 30 * time.Second
+		c.now = func() time.Time { return now }
+
+		Convey("Policies expire at the lowest TTL of their records", func() {
+			spf, err := New("example.net", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+			So(r.queries, ShouldEqual, 2)
+			So(c.entries["0 example.net"].expires, ShouldEqual, now.Add(time.Minute))
+
+			results := 0
+			observer := ObserverFunc(func(e Event) {
+				if e.Kind == ResultEvent {
+					results++
+				}
+			})
+			cached, err := New("Example.net.", r, WithPolicyCache(c), WithObserver(observer))
+			So(err, ShouldEqual, nil)
+			So(r.queries, ShouldEqual, 2)
+			So(cached, ShouldNotPointTo, spf)
+			check, err := cached.CheckIP("198.51.100.7")
+			So(err, ShouldEqual, nil)
+			So(check, ShouldEqual, "Pass")
+			So(results, ShouldEqual, 1)
+
+			// stale policies are returned while they are reloaded
+			now = now.Add(time.Minute + time.Second)
+			_, err = New("example.net", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+			c.refreshes.Wait()
+			So(r.queries, ShouldEqual, 4)
+			So(c.entries["0 example.net"].expires, ShouldEqual, now.Add(time.Minute))
+
+			now = now.Add(2 * time.Minute)
+			_, err = New("example.net", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+			So(r.queries, ShouldEqual, 6)
+
+			hits, stale, misses := c.Stats()
+			So(hits, ShouldEqual, 1)
+			So(stale, ShouldEqual, 1)
+			So(misses, ShouldEqual, 2)
+		})
+
+		Convey("Policies depending on a domain are invalidated", func() {
+			_, err := New("example.net", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+			_, err = NewForIP("example.net", "203.0.113.1", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+			_, err = New("other.example.net", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+			So(len(c.entries), ShouldEqual, 3)
+
+			c.Invalidate("HOST.example.net.")
+			So(len(c.entries), ShouldEqual, 1)
+			c.Invalidate("other.example.net")
+			So(len(c.entries), ShouldEqual, 0)
+
+			_, err = New("other.example.net", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+			c.Flush()
+			So(len(c.entries), ShouldEqual, 0)
+		})
+
+		Convey("Errors are cached, except TempErrors", func() {
+			for i := 0; i < 2; i++ {
+				_, err := New("none.example.net", r, WithPolicyCache(c))
+				So(err, ShouldNotEqual, nil)
+				So(err.Error(), ShouldEqual, "None")
+			}
+			So(r.queries, ShouldEqual, 1)
+
+			z.Fail("other.example.net", dns.ServFail)
+			_, err := New("other.example.net", r, WithPolicyCache(c))
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldEqual, "TempError")
+			z.ClearFailures()
+			_, err = New("other.example.net", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+			So(r.queries, ShouldEqual, 3)
+		})
+
+		Convey("A failed reload keeps the stale policy", func() {
+			_, err := New("other.example.net", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+			now = now.Add(300 * time.Second)
+			z.Fail("other.example.net", dns.ServFail)
+			_, err = New("other.example.net", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+			c.refreshes.Wait()
+			So(c.entries["0 other.example.net"].refreshing, ShouldEqual, false)
+			_, err = New("other.example.net", r, WithPolicyCache(c))
+			So(err, ShouldEqual, nil)
+		})
+	})
+}
@@ -0,0 +1,415 @@
+// Package policyd implements a Postfix SMTPD policy delegation server
+// (http://www.postfix.org/SMTPD_POLICY_README.html) that checks SPF with gospf.
+//
+// Postfix sends a request of name=value lines terminated by an empty line,
+// and the server answers with a single "action=..." line and an empty line:
+//
+//	request=smtpd_access_policy
+//	client_address=192.0.2.1
+//	helo_name=mail.example.com
+//	sender=user@example.com
+//
+//	action=PREPEND Received-SPF: Pass (...)
+//
+// The action taken for every SPF result is configured with Server.Actions.
+package policyd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+)
+
+// Actions of the result-to-action table.
+const (
+	// ActionPrepend accepts the message and prepends a Received-SPF header.
+	ActionPrepend = "PREPEND"
+	// ActionReject rejects the message.
+	ActionReject = "REJECT"
+	// ActionDeferIfPermit defers the message unless another restriction rejects it.
+	ActionDeferIfPermit = "DEFER_IF_PERMIT"
+	// ActionDunno leaves the decision to the next restriction.
+	ActionDunno = "DUNNO"
+)
+
+// DefaultActions is the result-to-action table used when Server.Actions is nil.
+var DefaultActions = map[string]string{
+	"Pass":      ActionPrepend,
+	"Neutral":   ActionPrepend,
+	"SoftFail":  ActionPrepend,
+	"None":      ActionPrepend,
+	"Fail":      ActionReject,
+	"TempError": ActionDeferIfPermit,
+	"PermError": ActionPrepend,
+}
+
+// maxRequestSize limits the size of a single policy request.
+const maxRequestSize = 64 * 1024
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or Close.
+var ErrServerClosed = errors.New("policyd: Server closed")
+
+// Server is a policy delegation server. Its zero value isn't usable,
+// at least Resolver must be set. A Server handles every connection in its own
+// goroutine; Postfix may send several requests over one connection.
+type Server struct {
+	Resolver dns.DnsResolver
+	// Actions maps SPF results to actions, results that are missing get DUNNO.
+	// DefaultActions is used when nil.
+	Actions map[string]string
+	// Receiver is the host name used in the Received-SPF header.
+	Receiver string
+	// IdleTimeout closes connections that don't send a request in time.
+	// Zero means no timeout.
+	IdleTimeout time.Duration
+	// Policies caches the loaded policies, when not nil.
+	Policies *gospf.PolicyCache
+	// Local are the local policies of the recipient domains, evaluated
+	// before the published policy (see gospf.WithLocalPolicy).
+	Local gospf.LocalPolicies
+	// BestGuess is the record evaluated for domains that publish none,
+	// e.g. gospf.DefaultBestGuess (see gospf.WithBestGuess). Empty disables it.
+	BestGuess string
+	// ErrorLog logs connection errors, the standard logger is used when nil.
+	ErrorLog *log.Logger
+
+	closed    int32 // accessed atomically
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	wg        sync.WaitGroup
+	group     gospf.Group // coalesces concurrent checks of the same domain
+}
+
+type conn struct {
+	net.Conn
+	mu   sync.Mutex
+	busy bool // handling a request
+}
+
+// Request is a policy delegation request.
+type Request map[string]string
+
+// ListenAndServe listens on the network address (e.g. "tcp", "127.0.0.1:10030"
+// or "unix", "/var/spool/postfix/private/gospf") and serves requests.
+func (s *Server) ListenAndServe(network string, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves requests until the server is
+// shut down. It always returns a non-nil error and closes l.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		c := &conn{Conn: nc}
+		if !s.trackConn(c, true) {
+			nc.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(c)
+	}
+}
+
+// Shutdown stops the server gracefully: it closes the listeners and idle
+// connections, and waits for requests in progress to be answered or for ctx
+// to be done, in which case the remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.closed, 1)
+	s.mu.Lock()
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.mu.Lock()
+		if !c.busy {
+			// unblock connections waiting for their next request
+			c.SetReadDeadline(time.Now())
+		}
+		c.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
+
+// Close stops the server immediately, closing all listeners and connections.
+func (s *Server) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.isClosed() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(c *conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*conn]struct{})
+	}
+	if add {
+		if s.isClosed() {
+			return false
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+	} else {
+		delete(s.conns, c)
+		s.wg.Done()
+	}
+	return true
+}
+
+func (s *Server) serveConn(c *conn) {
+	defer s.trackConn(c, false)
+	defer c.Close()
+
+	reader := bufio.NewReader(c)
+	for {
+		// Shutdown sets the read deadline of idle connections while holding c.mu
+		c.mu.Lock()
+		if s.isClosed() {
+			c.mu.Unlock()
+			return
+		}
+		if s.IdleTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		c.mu.Unlock()
+
+		request, err := readRequest(reader, c)
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				var ne net.Error
+				if !(errors.As(err, &ne) && ne.Timeout()) {
+					s.logf("policyd: %v: %v", c.RemoteAddr(), err)
+				}
+			}
+			return
+		}
+
+		response := s.Handle(request)
+
+		c.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		_, err = io.WriteString(c, "action="+response+"\n\n")
+		c.mu.Lock()
+		c.busy = false
+		c.mu.Unlock()
+		if err != nil {
+			s.logf("policyd: %v: %v", c.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// readRequest reads the attributes of one request. The connection is
+// marked busy once the first line is read, so Shutdown lets it finish.
+func readRequest(reader *bufio.Reader, c *conn) (Request, error) {
+	request := make(Request)
+	size := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && (len(request) > 0 || line != "") {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if size == 0 {
+			c.mu.Lock()
+			c.busy = true
+			c.SetReadDeadline(time.Time{})
+			c.mu.Unlock()
+		}
+		size += len(line)
+		if size > maxRequestSize {
+			return nil, fmt.Errorf("request exceeds %v bytes", maxRequestSize)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return request, nil
+		}
+		index := strings.Index(line, "=")
+		if index == -1 {
+			return nil, fmt.Errorf("invalid attribute: %q", line)
+		}
+		request[line[:index]] = line[index+1:]
+	}
+}
+
+// Handle checks SPF for the request and returns the action (without "action=").
+func (s *Server) Handle(request Request) string {
+	if request["request"] != "smtpd_access_policy" {
+		return ActionDunno
+	}
+
+	opts := []gospf.Option{gospf.WithGroup(&s.group)}
+	if s.Policies != nil {
+		opts = append(opts, gospf.WithPolicyCache(s.Policies))
+	}
+	if local := s.Local.For(request["recipient"]); local != nil {
+		opts = append(opts, gospf.WithLocalPolicy(local))
+	}
+	if s.BestGuess != "" {
+		opts = append(opts, gospf.WithBestGuess(s.BestGuess))
+	}
+	result, err := gospf.Check(request["client_address"], request["sender"], request["helo_name"], s.Resolver, opts...)
+	if err != nil {
+		// e.g. client_address is missing
+		return ActionDunno
+	}
+
+	return s.action(result)
+}
+
+func (s *Server) action(result *gospf.Result) string {
+	actions := s.Actions
+	if actions == nil {
+		actions = DefaultActions
+	}
+	action, ok := actions[result.Result]
+	if !ok {
+		return ActionDunno
+	}
+
+	switch action {
+	case ActionPrepend:
+		return ActionPrepend + " Received-SPF: " + result.ReceivedSPF(s.Receiver)
+	case ActionReject:
+		return ActionReject + " " + s.explanation(result)
+	case ActionDeferIfPermit:
+		return ActionDeferIfPermit + " " + s.explanation(result)
+	}
+	return action
+}
+
+// explanation returns the text that comes with a REJECT or DEFER_IF_PERMIT action.
+func (s *Server) explanation(result *gospf.Result) string {
+	switch result.Result {
+	case "Fail":
+		return fmt.Sprintf("SPF check failed: %v is not allowed to send mail for %v", result.IP, result.Domain)
+	case "SoftFail":
+		return fmt.Sprintf("SPF check soft failed: %v is probably not allowed to send mail for %v", result.IP, result.Domain)
+	case "TempError":
+		return fmt.Sprintf("SPF check of %v temporarily failed, try again later", result.Domain)
+	case "PermError":
+		return fmt.Sprintf("SPF record of %v can't be interpreted: %v", result.Domain, result.Problem)
+	}
+	return fmt.Sprintf("SPF check result for %v: %v", result.Domain, result.Result)
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// ParseActions parses a result-to-action table of the form
+// "Fail=REJECT,SoftFail=DEFER_IF_PERMIT" on top of DefaultActions.
+func ParseActions(spec string) (map[string]string, error) {
+	actions := make(map[string]string, len(DefaultActions))
+	for result, action := range DefaultActions {
+		actions[result] = action
+	}
+	if strings.TrimSpace(spec) == "" {
+		return actions, nil
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		index := strings.Index(pair, "=")
+		if index == -1 {
+			return nil, fmt.Errorf("invalid action %q, expected result=action", pair)
+		}
+		result := canonicalResult(strings.TrimSpace(pair[:index]))
+		if result == "" {
+			return nil, fmt.Errorf("unknown SPF result %q", pair[:index])
+		}
+		action := strings.ToUpper(strings.TrimSpace(pair[index+1:]))
+		if action == "" {
+			return nil, fmt.Errorf("no action given for %v", result)
+		}
+		actions[result] = action
+	}
+	return actions, nil
+}
+
+func canonicalResult(result string) string {
+	for r := range DefaultActions {
+		if strings.EqualFold(r, result) {
+			return r
+		}
+	}
+	return ""
+}
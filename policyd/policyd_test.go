@@ -0,0 +1,241 @@
+package policyd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+)
+
+const testZone = `
+$ORIGIN example.com.
+@        TXT  "v=spf1 ip4:192.0.2.1 ~ip4:192.0.2.2 -all"
+mail     TXT  "v=spf1 a -all"
+         A    192.0.2.10
+slow     TXT  "v=spf1 a:timeout.example.com -all"
+`
+
+func testResolver() *dns.ZoneResolver {
+	z := dns.NewZoneResolver()
+	if err := z.Load(strings.NewReader(testZone), ""); err != nil {
+		panic(err)
+	}
+	z.Fail("timeout.example.com", dns.Timeout)
+	return z
+}
+
+func request(ip string, sender string, helo string) string {
+	return "request=smtpd_access_policy\n" +
+		"protocol_state=RCPT\n" +
+		"protocol_name=ESMTP\n" +
+		"client_address=" + ip + "\n" +
+		"helo_name=" + helo + "\n" +
+		"sender=" + sender + "\n" +
+		"recipient=someone@example.org\n" +
+		"\n"
+}
+
+func readResponse(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	empty, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if empty != "\n" {
+		return "", fmt.Errorf("expected empty line, got %q", empty)
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+func startServer(s *Server) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+	return l.Addr().String(), done
+}
+
+func TestHandle(t *testing.T) {
+	Convey("Testing Server.Handle()", t, func() {
+		s := &Server{Resolver: testResolver(), Receiver: "mx.example.org"}
+
+		tests := []struct {
+			ip     string
+			sender string
+			helo   string
+			prefix string
+		}{
+			{"192.0.2.1", "user@example.com", "mail.example.com", "PREPEND Received-SPF: Pass (mx.example.org: domain of user@example.com designates 192.0.2.1"},
+			{"192.0.2.2", "user@example.com", "mail.example.com", "PREPEND Received-SPF: SoftFail (mx.example.org: domain of transitioning user@example.com"},
+			{"192.0.2.3", "user@example.com", "mail.example.com", "REJECT SPF check failed: 192.0.2.3 is not allowed to send mail for example.com"},
+			{"192.0.2.10", "", "mail.example.com", "PREPEND Received-SPF: Pass (mx.example.org: domain of postmaster@mail.example.com"},
+			{"192.0.2.1", "user@slow.example.com", "mail.example.com", "DEFER_IF_PERMIT SPF check of slow.example.com temporarily failed"},
+			{"192.0.2.1", "user@none.example.com", "mail.example.com", "PREPEND Received-SPF: None (mx.example.org: domain of user@none.example.com does not provide an SPF record)"},
+		}
+		for _, test := range tests {
+			action := s.Handle(Request{
+				"request":        "smtpd_access_policy",
+				"client_address": test.ip,
+				"sender":         test.sender,
+				"helo_name":      test.helo,
+			})
+			So(action, ShouldStartWith, test.prefix)
+		}
+
+		So(s.Handle(Request{"request": "something_else"}), ShouldEqual, "DUNNO")
+		So(s.Handle(Request{"request": "smtpd_access_policy"}), ShouldEqual, "DUNNO")
+
+		local, err := gospf.ParseLocalPolicies(strings.NewReader("example.org 192.0.2.3\n"))
+		So(err, ShouldEqual, nil)
+		s.Local = local
+		trusted := Request{"request": "smtpd_access_policy", "client_address": "192.0.2.3", "sender": "user@example.com", "recipient": "someone@example.org"}
+		So(s.Handle(trusted), ShouldStartWith, "PREPEND Received-SPF: Pass (mx.example.org: 192.0.2.3 is trusted by the local policy of the receiver (local:192.0.2.3/32))")
+		trusted["recipient"] = "someone@example.net"
+		So(s.Handle(trusted), ShouldStartWith, "REJECT SPF check failed")
+		s.Local = nil
+
+		s.Actions = map[string]string{"Pass": "OK", "Fail": "DEFER_IF_PERMIT"}
+		So(s.Handle(Request{"request": "smtpd_access_policy", "client_address": "192.0.2.1", "sender": "user@example.com"}), ShouldEqual, "OK")
+		So(s.Handle(Request{"request": "smtpd_access_policy", "client_address": "192.0.2.3", "sender": "user@example.com"}), ShouldStartWith, "DEFER_IF_PERMIT SPF check failed")
+		So(s.Handle(Request{"request": "smtpd_access_policy", "client_address": "192.0.2.2", "sender": "user@example.com"}), ShouldEqual, "DUNNO")
+	})
+}
+
+func TestParseActions(t *testing.T) {
+	Convey("Testing ParseActions()", t, func() {
+		actions, err := ParseActions("")
+		So(err, ShouldEqual, nil)
+		So(actions, ShouldResemble, DefaultActions)
+
+		actions, err = ParseActions("softfail=defer_if_permit, Fail=DUNNO")
+		So(err, ShouldEqual, nil)
+		So(actions["SoftFail"], ShouldEqual, "DEFER_IF_PERMIT")
+		So(actions["Fail"], ShouldEqual, "DUNNO")
+		So(actions["Pass"], ShouldEqual, "PREPEND")
+
+		for _, spec := range []string{"Fail", "Bogus=REJECT", "Fail="} {
+			_, err = ParseActions(spec)
+			So(err, ShouldNotEqual, nil)
+		}
+	})
+}
+
+func TestServer(t *testing.T) {
+	Convey("Testing Server over TCP", t, func() {
+		s := &Server{
+			Resolver: testResolver(),
+			Receiver: "mx.example.org",
+			ErrorLog: log.New(ioutil.Discard, "", 0),
+		}
+		addr, done := startServer(s)
+
+		Convey("Several requests over one connection", func() {
+			c, err := net.Dial("tcp", addr)
+			So(err, ShouldEqual, nil)
+			defer c.Close()
+			r := bufio.NewReader(c)
+
+			_, err = c.Write([]byte(request("192.0.2.1", "user@example.com", "mail.example.com")))
+			So(err, ShouldEqual, nil)
+			response, err := readResponse(r)
+			So(err, ShouldEqual, nil)
+			So(response, ShouldStartWith, "action=PREPEND Received-SPF: Pass")
+
+			_, err = c.Write([]byte(request("192.0.2.3", "user@example.com", "mail.example.com")))
+			So(err, ShouldEqual, nil)
+			response, err = readResponse(r)
+			So(err, ShouldEqual, nil)
+			So(response, ShouldStartWith, "action=REJECT")
+		})
+
+		Convey("Concurrent connections", func() {
+			var wg sync.WaitGroup
+			errs := make(chan error, 20)
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c, err := net.Dial("tcp", addr)
+					if err != nil {
+						errs <- err
+						return
+					}
+					defer c.Close()
+					c.Write([]byte(request("192.0.2.1", "user@example.com", "mail.example.com")))
+					response, err := readResponse(bufio.NewReader(c))
+					if err != nil {
+						errs <- err
+						return
+					}
+					if !strings.HasPrefix(response, "action=PREPEND Received-SPF: Pass") {
+						errs <- fmt.Errorf("unexpected response %q", response)
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				So(err, ShouldEqual, nil)
+			}
+		})
+
+		Convey("Graceful shutdown", func() {
+			idle, err := net.Dial("tcp", addr)
+			So(err, ShouldEqual, nil)
+			defer idle.Close()
+
+			busy, err := net.Dial("tcp", addr)
+			So(err, ShouldEqual, nil)
+			defer busy.Close()
+			// send the first half of a request, the connection is busy from now on
+			_, err = busy.Write([]byte("request=smtpd_access_policy\nclient_address=192.0.2.1\n"))
+			So(err, ShouldEqual, nil)
+			time.Sleep(50 * time.Millisecond)
+
+			shutdown := make(chan error, 1)
+			go func() {
+				shutdown <- s.Shutdown(context.Background())
+			}()
+			So(<-done, ShouldEqual, ErrServerClosed)
+
+			// the idle connection is closed
+			idle.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = bufio.NewReader(idle).ReadString('\n')
+			So(err, ShouldNotEqual, nil)
+
+			// the busy connection gets its answer
+			_, err = busy.Write([]byte("sender=user@example.com\n\n"))
+			So(err, ShouldEqual, nil)
+			response, err := readResponse(bufio.NewReader(busy))
+			So(err, ShouldEqual, nil)
+			So(response, ShouldStartWith, "action=PREPEND Received-SPF: Pass")
+
+			So(<-shutdown, ShouldEqual, nil)
+
+			_, err = net.Dial("tcp", addr)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Reset(func() {
+			s.Close()
+		})
+	})
+}
@@ -0,0 +1,260 @@
+package gospf
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+// WithConcurrency lets New, NewForIP and Check prefetch the independent DNS
+// queries of a policy (the records of include and redirect targets, the
+// addresses of a targets and the MX hosts of mx terms, exists targets) with
+// at most n queries in flight, so the time to load a policy is roughly the
+// depth of its include tree instead of the sum of all round trips.
+//
+// The policy is still built in record order from the prefetched answers and
+// evaluated in record order, the first matching mechanism determining the
+// result, so results and lookup limit accounting are exactly the same as
+// without prefetching. Prefetching stops after DNSLookupLimit DNS querying terms.
+// With n > 1 the resolver, and the Observer of DNS events, are called from
+// several goroutines, so they must be safe for concurrent use.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
+
+// prefetch returns a resolver answering the queries of the policy of domain
+// from memory after prefetching them, or dnsResolver without concurrency.
+func (o *options) prefetch(domain string, dnsResolver dns.DnsResolver, family addressFamily) dns.DnsResolver {
+	if o.concurrency <= 1 {
+		return dnsResolver
+	}
+	memo := newMemoResolver(dnsResolver)
+	prefetch(domain, memo, family, o.concurrency)
+	return memo
+}
+
+// memoEntry is the answer of a query, done is closed once it's available.
+type memoEntry struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// memoResolver remembers the answers of the wrapped resolver during the
+// construction of a policy. Concurrent identical queries are sent only once.
+type memoResolver struct {
+	resolver dns.DnsResolver
+	mu       sync.Mutex
+	entries  map[string]*memoEntry
+}
+
+func newMemoResolver(resolver dns.DnsResolver) *memoResolver {
+	return &memoResolver{resolver: resolver, entries: make(map[string]*memoEntry)}
+}
+
+func (m *memoResolver) lookup(qtype string, name string, query func() (interface{}, error)) (interface{}, error) {
+	key := qtype + " " + canonicalName(name)
+	m.mu.Lock()
+	entry, ok := m.entries[key]
+	if !ok {
+		entry = &memoEntry{done: make(chan struct{})}
+		m.entries[key] = entry
+	}
+	m.mu.Unlock()
+
+	if ok {
+		<-entry.done
+		return entry.value, entry.err
+	}
+	// a panicking query is an error for the queries waiting for it
+	defer close(entry.done)
+	defer func() {
+		if r := recover(); r != nil {
+			entry.value, entry.err = nil, fmt.Errorf("%v query of %v panicked: %v", qtype, name, r)
+			panic(r)
+		}
+	}()
+	entry.value, entry.err = query()
+	return entry.value, entry.err
+}
+
+func (m *memoResolver) GetSPFRecord(name string) (string, error) {
+	value, err := m.lookup("SPF", name, func() (interface{}, error) {
+		return m.resolver.GetSPFRecord(name)
+	})
+	record, _ := value.(string)
+	return record, err
+}
+
+func (m *memoResolver) GetARecords(name string) ([]string, error) {
+	value, err := m.lookup("A", name, func() (interface{}, error) {
+		return m.resolver.GetARecords(name)
+	})
+	ips, _ := value.([]string)
+	return ips, err
+}
+
+func (m *memoResolver) GetAAAARecords(name string) ([]string, error) {
+	value, err := m.lookup("AAAA", name, func() (interface{}, error) {
+		return m.resolver.GetAAAARecords(name)
+	})
+	ips, _ := value.([]string)
+	return ips, err
+}
+
+func (m *memoResolver) GetMXRecords(name string) ([]*net.MX, error) {
+	value, err := m.lookup("MX", name, func() (interface{}, error) {
+		return m.resolver.GetMXRecords(name)
+	})
+	mxs, _ := value.([]*net.MX)
+	return mxs, err
+}
+
+func (m *memoResolver) GetPTRRecords(addr string) ([]string, error) {
+	value, err := m.lookup("PTR", addr, func() (interface{}, error) {
+		return m.resolver.GetPTRRecords(addr)
+	})
+	names, _ := value.([]string)
+	return names, err
+}
+
+// prefetcher walks the include tree of a policy and sends its queries
+// concurrently, storing the answers in a memoResolver.
+type prefetcher struct {
+	memo   *memoResolver
+	family addressFamily
+	slots  chan struct{} // bounds the queries in flight
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	terms int // DNS querying terms scheduled so far
+}
+
+// prefetch loads the answers needed to build the policy of domain into memo
+// and returns once all queries are answered.
+func prefetch(domain string, memo *memoResolver, family addressFamily, concurrency int) {
+	p := &prefetcher{
+		memo:   memo,
+		family: family,
+		slots:  make(chan struct{}, concurrency),
+	}
+	p.goRecord(domain)
+	p.wg.Wait()
+}
+
+// query runs a lookup in a slot. Slots are only held during the lookup
+// itself, so nested prefetching can't deadlock.
+func (p *prefetcher) query(lookup func()) {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+	lookup()
+}
+
+func (p *prefetcher) do(f func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		// a panicking resolver doesn't crash the process, the policy gets
+		// the error of the query when it's built
+		defer func() {
+			recover()
+		}()
+		f()
+	}()
+}
+
+// allow counts a DNS querying term and reports whether it may be prefetched.
+func (p *prefetcher) allow() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.terms++
+	return p.terms <= DNSLookupLimit
+}
+
+func (p *prefetcher) goRecord(domain string) {
+	p.do(func() {
+		var record string
+		var err error
+		p.query(func() {
+			record, err = p.memo.GetSPFRecord(domain)
+		})
+		if err != nil {
+			return
+		}
+		directives, modifiers, err := getTerms(record)
+		if err != nil {
+			return
+		}
+		d := Directives(directives)
+		d.process()
+		m := Modifiers(modifiers)
+		m.process()
+
+		for _, directive := range d {
+			p.directive(domain, directive)
+		}
+		for _, modifier := range m {
+			if modifier.Key == "redirect" && modifier.Value != "" && p.allow() {
+				p.goRecord(modifier.Value)
+			}
+		}
+	})
+}
+
+func (p *prefetcher) directive(domain string, directive Directive) {
+	target := domain
+	if d, ok := directive.Arguments["domain"]; ok && d != "" {
+		target = d
+	}
+
+	switch directive.Mechanism {
+	case "include":
+		if _, ok := directive.Arguments["domain"]; ok && p.allow() {
+			p.goRecord(target)
+		}
+	case "a":
+		if p.allow() {
+			p.do(func() {
+				p.query(func() {
+					lookupAddresses(p.memo, p.family, target)
+				})
+			})
+		}
+	case "mx":
+		if p.allow() {
+			p.do(func() {
+				var mxs []*net.MX
+				var err error
+				p.query(func() {
+					mxs, err = p.memo.GetMXRecords(target)
+				})
+				if err != nil || len(mxs) > DNSLookupLimit {
+					return
+				}
+				for _, mx := range mxs {
+					host := mx.Host
+					p.do(func() {
+						p.query(func() {
+							lookupAddresses(p.memo, p.family, host)
+						})
+					})
+				}
+			})
+		}
+	case "exists":
+		if _, ok := directive.Arguments["domain"]; ok && p.allow() {
+			p.do(func() {
+				p.query(func() {
+					p.memo.GetARecords(target)
+				})
+			})
+		}
+	case "ptr":
+		// depends on the client IP
+		p.allow()
+	}
+}
@@ -0,0 +1,52 @@
+package provider
+
+// builtin are the providers of the default catalog. The networks are the
+// ones published by the providers at the time of writing, they're used for
+// records that list them instead of including the policies of the providers.
+var builtin = []Provider{
+	{
+		Name:    "Google Workspace",
+		Domains: []string{"_spf.google.com", "_netblocks.google.com", "_netblocks2.google.com", "_netblocks3.google.com"},
+		Networks: []string{
+			"35.190.247.0/24", "64.233.160.0/19", "66.102.0.0/20", "66.249.80.0/20", "72.14.192.0/18",
+			"74.125.0.0/16", "108.177.8.0/21", "173.194.0.0/16", "209.85.128.0/17", "216.58.192.0/19",
+			"216.239.32.0/19", "2001:4860:4000::/36", "2404:6800:4000::/36", "2607:f8b0:4000::/36",
+			"2800:3f0:4000::/36", "2a00:1450:4000::/36", "2c0f:fb50:4000::/36",
+		},
+	},
+	{
+		Name:    "Microsoft 365",
+		Domains: []string{"spf.protection.outlook.com"},
+		Networks: []string{
+			"40.92.0.0/15", "40.107.0.0/16", "52.100.0.0/15", "52.102.0.0/16", "104.47.0.0/17",
+			"2a01:111:f400::/48", "2a01:111:f403::/48",
+		},
+	},
+	{Name: "Amazon SES", Domains: []string{"amazonses.com"}},
+	{Name: "SendGrid", Domains: []string{"sendgrid.net"}},
+	{Name: "Mailgun", Domains: []string{"mailgun.org"}},
+	{Name: "Mailchimp", Domains: []string{"servers.mcsv.net", "spf.mandrillapp.com"}},
+	{Name: "Postmark", Domains: []string{"spf.mtasv.net"}},
+	{Name: "SparkPost", Domains: []string{"sparkpostmail.com"}},
+	{Name: "Brevo", Domains: []string{"spf.sendinblue.com", "spf.brevo.com"}},
+	{Name: "Salesforce", Domains: []string{"_spf.salesforce.com"}},
+	{Name: "HubSpot", Domains: []string{"hubspotemail.net"}},
+	{Name: "Zendesk", Domains: []string{"mail.zendesk.com"}},
+	{Name: "Freshdesk", Domains: []string{"email.freshdesk.com"}},
+	{Name: "Atlassian", Domains: []string{"_spf.atlassian.net"}},
+	{Name: "Zoho Mail", Domains: []string{"zoho.com", "zoho.eu"}},
+	{Name: "Fastmail", Domains: []string{"spf.messagingengine.com"}},
+	{Name: "Mimecast", Domains: []string{"_netblocks.mimecast.com"}},
+	{Name: "Proofpoint", Domains: []string{"pphosted.com"}},
+}
+
+// Builtin returns a copy of the built-in providers.
+func Builtin() []Provider {
+	providers := make([]Provider, 0, len(builtin))
+	for _, p := range builtin {
+		p.Domains = append([]string(nil), p.Domains...)
+		p.Networks = append([]string(nil), p.Networks...)
+		providers = append(providers, p)
+	}
+	return providers
+}
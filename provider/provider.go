@@ -0,0 +1,160 @@
+// Package provider names the email service providers behind the terms of
+// SPF records, from a catalog of their SPF domains and sending networks:
+//
+//	catalog := provider.Default()
+//	catalog.Domain("_spf.google.com").Name             // "Google Workspace"
+//	catalog.Domain("spf.protection.outlook.com").Name  // "Microsoft 365"
+//
+// The built-in catalog can be extended with NewCatalog and the providers of
+// a YAML file (see ParseCatalog).
+package provider
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mistralmail/gospf/ipset"
+)
+
+// Provider is an email service provider.
+type Provider struct {
+	Name string `yaml:"name"`
+	// Domains are the domains of the policies of the provider. Their
+	// subdomains belong to the provider too.
+	Domains []string `yaml:"domains"`
+	// Networks are the sending networks of the provider in CIDR notation.
+	Networks []string `yaml:"networks"`
+}
+
+// Catalog matches domains and networks to providers. It's safe for
+// concurrent use.
+type Catalog struct {
+	providers []*Provider
+	domains   map[string]*Provider
+	networks  []*ipset.Set // networks of the providers, by index
+}
+
+// NewCatalog returns a catalog of providers. Providers that come later take
+// precedence for the same domain, so the built-in providers can be
+// overridden:
+//
+//	catalog, err := provider.NewCatalog(append(provider.Builtin(), custom...)...)
+func NewCatalog(providers ...Provider) (*Catalog, error) {
+	c := &Catalog{domains: make(map[string]*Provider)}
+	for i := range providers {
+		p := providers[i]
+		if p.Name == "" {
+			return nil, fmt.Errorf("provider without name")
+		}
+		networks, err := ipset.Parse(p.Networks...)
+		if err != nil {
+			return nil, fmt.Errorf("provider %v: %v", p.Name, err)
+		}
+		for _, domain := range p.Domains {
+			domain = canonicalName(domain)
+			if domain == "" {
+				return nil, fmt.Errorf("provider %v: empty domain", p.Name)
+			}
+			c.domains[domain] = &p
+		}
+		c.providers = append(c.providers, &p)
+		c.networks = append(c.networks, networks)
+	}
+	return c, nil
+}
+
+// ParseCatalog parses a list of providers in YAML and returns them together
+// with the built-in providers:
+//
+//   - name: Example ESP
+//     domains: [spf.esp.example]
+//     networks: [192.0.2.0/24, "2001:db8::/32"]
+func ParseCatalog(r io.Reader) (*Catalog, error) {
+	var providers []Provider
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&providers); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid provider catalog: %v", err)
+	}
+	return NewCatalog(append(Builtin(), providers...)...)
+}
+
+// LoadCatalog reads a catalog from the file at path, see ParseCatalog.
+func LoadCatalog(path string) (*Catalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseCatalog(f)
+}
+
+var (
+	defaultOnce    sync.Once
+	defaultCatalog *Catalog
+)
+
+// Default returns the catalog of the built-in providers.
+func Default() *Catalog {
+	defaultOnce.Do(func() {
+		catalog, err := NewCatalog(Builtin()...)
+		if err != nil {
+			panic(err)
+		}
+		defaultCatalog = catalog
+	})
+	return defaultCatalog
+}
+
+// Providers returns the providers of the catalog.
+func (c *Catalog) Providers() []Provider {
+	providers := make([]Provider, 0, len(c.providers))
+	for _, p := range c.providers {
+		providers = append(providers, *p)
+	}
+	return providers
+}
+
+// Domain returns the provider of domain or of its closest parent domain,
+// nil if there's none.
+func (c *Catalog) Domain(domain string) *Provider {
+	if c == nil {
+		return nil
+	}
+	for name := canonicalName(domain); name != ""; {
+		if p, ok := c.domains[name]; ok {
+			return p
+		}
+		i := strings.IndexByte(name, '.')
+		if i == -1 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return nil
+}
+
+// Network returns the provider whose networks contain n, nil if there's none.
+func (c *Catalog) Network(n net.IPNet) *Provider {
+	if c == nil {
+		return nil
+	}
+	// later providers take precedence, as for domains
+	for i := len(c.providers) - 1; i >= 0; i-- {
+		if c.networks[i].ContainsNet(n) {
+			return c.providers[i]
+		}
+	}
+	return nil
+}
+
+// canonicalName returns the lowercase name without the trailing dot.
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCatalog(t *testing.T) {
+	Convey("Testing provider catalogs", t, func() {
+		network := func(s string) net.IPNet {
+			_, n, err := net.ParseCIDR(s)
+			So(err, ShouldEqual, nil)
+			return *n
+		}
+
+		Convey("Domains and their subdomains match the built-in providers", func() {
+			c := Default()
+			So(c.Domain("_spf.google.com").Name, ShouldEqual, "Google Workspace")
+			So(c.Domain("SPF.Protection.Outlook.com.").Name, ShouldEqual, "Microsoft 365")
+			So(c.Domain("eu-west-1.amazonses.com").Name, ShouldEqual, "Amazon SES")
+			So(c.Domain("google.com"), ShouldBeNil)
+			So(c.Domain("notamazonses.com"), ShouldBeNil)
+			So(c.Network(network("209.85.128.0/24")).Name, ShouldEqual, "Google Workspace")
+			So(c.Network(network("209.85.0.0/16")), ShouldBeNil)
+			So(len(c.Providers()), ShouldEqual, len(builtin))
+		})
+
+		Convey("Catalogs are extended from YAML", func() {
+			c, err := ParseCatalog(strings.NewReader(`
+- name: Example ESP
+  domains: [spf.esp.example]
+  networks: [192.0.2.0/24, "2001:db8::/32"]
+- name: Google relay
+  domains: [_spf.google.com]
+`))
+			So(err, ShouldEqual, nil)
+			So(c.Domain("eu.spf.esp.example").Name, ShouldEqual, "Example ESP")
+			So(c.Domain("_spf.google.com").Name, ShouldEqual, "Google relay")
+			So(c.Domain("_netblocks.google.com").Name, ShouldEqual, "Google Workspace")
+			So(c.Network(network("2001:db8:1::/48")).Name, ShouldEqual, "Example ESP")
+			// the default catalog is unchanged
+			So(Default().Domain("spf.esp.example"), ShouldBeNil)
+
+			_, err = ParseCatalog(strings.NewReader("- name: Broken\n  networks: [192.0.2.0/33]\n"))
+			So(err, ShouldNotEqual, nil)
+			_, err = ParseCatalog(strings.NewReader("- domains: [esp.example]\n"))
+			So(err, ShouldNotEqual, nil)
+			_, err = ParseCatalog(strings.NewReader("- name: Typo\n  domain: [esp.example]\n"))
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("A nil catalog matches nothing", func() {
+			var c *Catalog
+			So(c.Domain("_spf.google.com"), ShouldBeNil)
+			So(c.Network(network("209.85.128.0/24")), ShouldBeNil)
+		})
+	})
+}
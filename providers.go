@@ -0,0 +1,82 @@
+package gospf
+
+import (
+	"github.com/mistralmail/gospf/provider"
+)
+
+// ProviderMatch is a term of a policy that authorizes a provider.
+type ProviderMatch struct {
+	Provider string `json:"provider"` // name of the provider
+	Domain   string `json:"domain"`   // domain of the record of the term
+	Term     string `json:"term"`     // e.g. "include:_spf.google.com" or "ip4:209.85.128.0/17"
+}
+
+// WithProviders names the providers of the instance with catalog, see
+// Provider and Providers. Without it provider.Default() is used.
+func WithProviders(catalog *provider.Catalog) Option {
+	return func(o *options) {
+		o.providers = catalog
+	}
+}
+
+func (spf *SPF) catalog() *provider.Catalog {
+	if spf.options != nil && spf.options.providers != nil {
+		return spf.options.providers
+	}
+	return provider.Default()
+}
+
+// Provider returns the name of the provider of the domain of the instance,
+// e.g. "Google Workspace" for the policy of _spf.google.com, or "" if it's
+// unknown.
+func (spf *SPF) Provider() string {
+	if p := spf.catalog().Domain(spf.Domain); p != nil {
+		return p.Name
+	}
+	return ""
+}
+
+// Providers returns the terms of the policy, its includes and its redirect
+// that authorize known providers, in evaluation order: includes and
+// redirects of the domains of a provider, and networks of a provider. The
+// terms of a policy of a provider aren't listed again.
+func (spf *SPF) Providers() []ProviderMatch {
+	matches := make([]ProviderMatch, 0)
+	spf.providers(spf.catalog(), &matches)
+	return matches
+}
+
+func (spf *SPF) providers(catalog *provider.Catalog, matches *[]ProviderMatch) {
+	for _, t := range spf.termNets {
+		if p := catalog.Network(t.ipNet); p != nil {
+			*matches = append(*matches, ProviderMatch{Provider: p.Name, Domain: spf.Domain, Term: t.directive.term})
+		}
+	}
+	follow := func(term string, included *SPF) {
+		if p := catalog.Domain(included.Domain); p != nil {
+			*matches = append(*matches, ProviderMatch{Provider: p.Name, Domain: spf.Domain, Term: term})
+			return
+		}
+		included.providers(catalog, matches)
+	}
+	for _, include := range spf.Includes {
+		follow(include.Term, include.SPF)
+	}
+	if spf.Redirect != nil && spf.All == "undefined" {
+		follow("redirect="+spf.Redirect.Domain, spf.Redirect)
+	}
+}
+
+// ProviderNames returns the names of the providers of Providers, without
+// duplicates, e.g. to show that a domain sends via them.
+func (spf *SPF) ProviderNames() []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, m := range spf.Providers() {
+		if !seen[m.Provider] {
+			seen[m.Provider] = true
+			names = append(names, m.Provider)
+		}
+	}
+	return names
+}
@@ -0,0 +1,67 @@
+package gospf
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/provider"
+)
+
+const providersZone = `
+$ORIGIN example.com.
+@          TXT   "v=spf1 ip4:192.0.2.0/24 ip4:40.107.1.0/24 include:_spf.example.com include:_spf.google.com -all"
+_spf       TXT   "v=spf1 include:spf.esp.example redirect=spf.protection.outlook.com"
+$ORIGIN google.com.
+_spf       TXT   "v=spf1 include:_netblocks.google.com ~all"
+_netblocks TXT   "v=spf1 ip4:209.85.128.0/17 ~all"
+$ORIGIN outlook.com.
+spf.protection TXT "v=spf1 ip4:40.92.0.0/15 -all"
+$ORIGIN esp.example.
+spf        TXT   "v=spf1 ip4:198.51.100.0/24 -all"
+`
+
+func TestProviders(t *testing.T) {
+	Convey("Testing the providers of policies", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(providersZone), ""), ShouldEqual, nil)
+
+		Convey("Includes, redirects and networks of known providers are named", func() {
+			spf, err := New("example.com", z)
+			So(err, ShouldEqual, nil)
+			So(spf.Provider(), ShouldEqual, "")
+			So(spf.Includes[1].SPF.Provider(), ShouldEqual, "Google Workspace")
+			So(spf.Providers(), ShouldResemble, []ProviderMatch{
+				{Provider: "Microsoft 365", Domain: "example.com", Term: "ip4:40.107.1.0/24"},
+				{Provider: "Microsoft 365", Domain: "_spf.example.com", Term: "redirect=spf.protection.outlook.com"},
+				{Provider: "Google Workspace", Domain: "example.com", Term: "include:_spf.google.com"},
+			})
+			So(spf.ProviderNames(), ShouldResemble, []string{"Microsoft 365", "Google Workspace"})
+		})
+
+		Convey("Custom catalogs apply to the includes and to restored instances", func() {
+			catalog, err := provider.NewCatalog(append(provider.Builtin(), provider.Provider{Name: "Example ESP", Domains: []string{"esp.example"}})...)
+			So(err, ShouldEqual, nil)
+			spf, err := New("example.com", z, WithProviders(catalog))
+			So(err, ShouldEqual, nil)
+			So(spf.ProviderNames(), ShouldResemble, []string{"Microsoft 365", "Example ESP", "Google Workspace"})
+			So(spf.Includes[0].SPF.Includes[0].SPF.Provider(), ShouldEqual, "Example ESP")
+
+			data, err := spf.MarshalJSON()
+			So(err, ShouldEqual, nil)
+			restored, err := Restore(data, nil, WithProviders(catalog))
+			So(err, ShouldEqual, nil)
+			So(restored.Providers(), ShouldResemble, spf.Providers())
+		})
+
+		Convey("Audit reports name the providers", func() {
+			report, err := Audit("example.com", z)
+			So(err, ShouldEqual, nil)
+			So(report.Providers, ShouldResemble, []string{"Microsoft 365", "Google Workspace"})
+			So(report.Nodes[len(report.Nodes)-2].Provider, ShouldEqual, "Google Workspace")
+			So(report.String(), ShouldContainSubstring, "include:_spf.google.com [Google Workspace] (")
+		})
+	})
+}
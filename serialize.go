@@ -0,0 +1,436 @@
+package gospf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+// snapshotVersion is the version of the JSON and binary snapshot formats,
+// bumped whenever their layout changes. Version 2 keeps the record, the
+// mechanisms in record order and the best-guess flag; version 1 snapshots
+// can't be restored in record order and are rejected.
+const snapshotVersion = 2
+
+// flags of a binary snapshot
+const snapshotBestGuess = 1
+
+// binaryMagic starts a binary snapshot, followed by the version byte.
+const binaryMagic = "GSPF"
+
+// maxSnapshotDepth limits the nesting of includes and redirects when
+// restoring a snapshot. New stops much earlier, at DNSLookupLimit.
+const maxSnapshotDepth = 64
+
+// maxSnapshotValue bounds the numbers of a binary snapshot.
+const maxSnapshotValue = 1 << 24
+
+// ErrInvalidSnapshot is returned when restoring a snapshot that wasn't
+// created by MarshalJSON or MarshalBinary (of a supported version).
+var ErrInvalidSnapshot = errors.New("invalid SPF snapshot")
+
+// spfJSON is the JSON form of an SPF instance. The terms are rebuilt from
+// the record, Terms are what its mechanisms resolved to in record order.
+type spfJSON struct {
+	Domain      string     `json:"domain"`
+	Family      string     `json:"family,omitempty"`
+	Record      string     `json:"record"`
+	Terms       []termJSON `json:"terms,omitempty"`
+	Redirect    *spfJSON   `json:"redirect,omitempty"`
+	DNSLookups  int        `json:"dns_lookups"`
+	VoidLookups int        `json:"void_lookups"`
+}
+
+// termJSON is a mechanism of the record: the networks a, mx, ip4, ip6 and
+// exists resolved to or the included policy.
+type termJSON struct {
+	Term     string   `json:"term"`
+	Networks []string `json:"networks,omitempty"`
+	SPF      *spfJSON `json:"spf,omitempty"`
+}
+
+type snapshotJSON struct {
+	Version   int  `json:"version"`
+	BestGuess bool `json:"best_guess,omitempty"`
+	spfJSON
+}
+
+// MarshalJSON returns a snapshot of the resolved policy, including its
+// includes and redirect, that can be restored without DNS queries with
+// UnmarshalJSON or Restore.
+func (spf *SPF) MarshalJSON() ([]byte, error) {
+	return json.Marshal(snapshotJSON{Version: snapshotVersion, BestGuess: spf.BestGuess, spfJSON: *spf.toJSON()})
+}
+
+// UnmarshalJSON restores a snapshot created by MarshalJSON. The restored
+// instance has no resolver, so CheckIP returns a TempError when it reaches
+// a ptr mechanism; use Restore to give it one.
+func (spf *SPF) UnmarshalJSON(data []byte) error {
+	var snapshot snapshotJSON
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != snapshotVersion {
+		return unsupportedVersion(snapshot.Version)
+	}
+	restored, err := fromJSON(&snapshot.spfJSON, 0)
+	if err != nil {
+		return err
+	}
+	restored.BestGuess = snapshot.BestGuess
+	*spf = *restored
+	return nil
+}
+
+// MarshalBinary returns a compact binary snapshot of the resolved policy,
+// like MarshalJSON.
+func (spf *SPF) MarshalBinary() ([]byte, error) {
+	w := &snapshotWriter{}
+	w.buf.WriteString(binaryMagic)
+	w.buf.WriteByte(snapshotVersion)
+	flags := 0
+	if spf.BestGuess {
+		flags |= snapshotBestGuess
+	}
+	w.uvarint(flags)
+	w.spf(spf)
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalBinary restores a snapshot created by MarshalBinary, like UnmarshalJSON.
+func (spf *SPF) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(binaryMagic)) || len(data) <= len(binaryMagic) {
+		return ErrInvalidSnapshot
+	}
+	if version := data[len(binaryMagic)]; version != snapshotVersion {
+		return unsupportedVersion(int(version))
+	}
+	r := &snapshotReader{data: data[len(binaryMagic)+1:]}
+	flags := r.uvarint()
+	restored := r.spf(0)
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.data) > 0 || flags&^snapshotBestGuess != 0 {
+		return ErrInvalidSnapshot
+	}
+	restored.BestGuess = flags&snapshotBestGuess != 0
+	*spf = *restored
+	return nil
+}
+
+// unsupportedVersion is the error of a snapshot of another version.
+func unsupportedVersion(version int) error {
+	return fmt.Errorf("%w: unsupported version %v, the policy must be resolved again", ErrInvalidSnapshot, version)
+}
+
+// Restore restores a snapshot created by MarshalJSON or MarshalBinary. The
+// ptr mechanisms, which depend on the client IP, look up with dnsResolver.
+// It may be nil, like for UnmarshalJSON, if the policy has no ptr
+// mechanisms. The options apply to the evaluations of the instance.
+func Restore(data []byte, dnsResolver dns.DnsResolver, opts ...Option) (*SPF, error) {
+	spf := &SPF{}
+	var err error
+	if bytes.HasPrefix(data, []byte(binaryMagic)) {
+		err = spf.UnmarshalBinary(data)
+	} else {
+		err = spf.UnmarshalJSON(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dnsResolver == nil {
+		dnsResolver = noResolver{}
+	}
+	o := newOptions(opts)
+	return spf.withOptions(o, o.resolver(dnsResolver)), nil
+}
+
+func (spf *SPF) toJSON() *spfJSON {
+	out := &spfJSON{
+		Domain:      spf.Domain,
+		Family:      spf.family.String(),
+		Record:      spf.record,
+		DNSLookups:  spf.dnsLookupCount,
+		VoidLookups: spf.voidLookupCount,
+	}
+	for _, m := range spf.mechanisms {
+		term := termJSON{Term: m.directive.term}
+		if m.directive.Mechanism == "include" {
+			term.SPF = spf.Includes[m.include].SPF.toJSON()
+		}
+		for _, ipNet := range m.nets {
+			term.Networks = append(term.Networks, ipNet.String())
+		}
+		out.Terms = append(out.Terms, term)
+	}
+	if spf.Redirect != nil {
+		out.Redirect = spf.Redirect.toJSON()
+	}
+	return out
+}
+
+func fromJSON(in *spfJSON, depth int) (*SPF, error) {
+	if depth > maxSnapshotDepth {
+		return nil, ErrInvalidSnapshot
+	}
+	spf, err := restoredSPF(in.Domain, in.Family, in.Record, in.DNSLookups, in.VoidLookups)
+	if err != nil {
+		return nil, err
+	}
+	if len(in.Terms) != len(spf.directives) {
+		return nil, ErrInvalidSnapshot
+	}
+	for i, directive := range spf.directives {
+		term := in.Terms[i]
+		if term.Term != directive.term {
+			return nil, ErrInvalidSnapshot
+		}
+		ipNets := make([]net.IPNet, 0, len(term.Networks))
+		for _, network := range term.Networks {
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+			}
+			ipNets = append(ipNets, *ipNet)
+		}
+		var included *SPF
+		if term.SPF != nil {
+			if included, err = fromJSON(term.SPF, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		if err := spf.restoreMechanism(directive, ipNets, included); err != nil {
+			return nil, err
+		}
+	}
+	if in.Redirect != nil {
+		spf.Redirect, err = fromJSON(in.Redirect, depth+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return spf, nil
+}
+
+// restoredSPF creates an instance of a snapshot with the terms of its
+// record, to restore their mechanisms into.
+func restoredSPF(domain string, family string, record string, dnsLookups int, voidLookups int) (*SPF, error) {
+	f, ok := parseFamily(family)
+	if !ok {
+		return nil, ErrInvalidSnapshot
+	}
+	spf := emptySPF(domain, noResolver{}, nil, f, dnsLookups, voidLookups)
+	if err := spf.parse(record); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	return spf, nil
+}
+
+// restoreMechanism adds a directive of the record of a snapshot with what
+// it resolved to, like load does when resolving it.
+func (spf *SPF) restoreMechanism(directive Directive, ipNets []net.IPNet, included *SPF) error {
+	if !validQualifier(directive.Qualifier) {
+		return ErrInvalidSnapshot
+	}
+	if (directive.Mechanism == "include") != (included != nil) {
+		return ErrInvalidSnapshot
+	}
+	nets := len(spf.termNets)
+	switch directive.Mechanism {
+	case "all":
+		if spf.All == "undefined" {
+			spf.All = directive.Qualifier
+		}
+	case "ptr":
+	case "include":
+		spf.Includes = append(spf.Includes, Include{Qualifier: directive.Qualifier, Term: directive.term, SPF: included})
+	case "a", "mx", "ip4", "ip6", "exists":
+		spf.handleDirectiveNets(ipNets, directive)
+	default:
+		return ErrInvalidSnapshot
+	}
+	spf.addMechanism(directive, spf.termNets[nets:])
+	return nil
+}
+
+func validQualifier(qualifier string) bool {
+	switch qualifier {
+	case "", "+", "-", "~", "?":
+		return true
+	}
+	return false
+}
+
+func (f addressFamily) String() string {
+	switch f {
+	case familyIPv4:
+		return "ip4"
+	case familyIPv6:
+		return "ip6"
+	}
+	return ""
+}
+
+func parseFamily(s string) (addressFamily, bool) {
+	for _, f := range []addressFamily{familyAny, familyIPv4, familyIPv6} {
+		if f.String() == s {
+			return f, true
+		}
+	}
+	return familyAny, false
+}
+
+// snapshotWriter writes the binary form: strings and slices are prefixed
+// with their length as uvarint, networks are the IP (prefixed with its
+// length) followed by the prefix length.
+type snapshotWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *snapshotWriter) uvarint(v int) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], uint64(v))])
+}
+
+func (w *snapshotWriter) string(s string) {
+	w.uvarint(len(s))
+	w.buf.WriteString(s)
+}
+
+func (w *snapshotWriter) spf(spf *SPF) {
+	w.string(spf.Domain)
+	w.string(spf.family.String())
+	w.string(spf.record)
+	w.uvarint(spf.dnsLookupCount)
+	w.uvarint(spf.voidLookupCount)
+
+	// the mechanisms are those of the record, in the same order
+	for _, m := range spf.mechanisms {
+		switch m.directive.Mechanism {
+		case "all", "ptr":
+		case "include":
+			w.spf(spf.Includes[m.include].SPF)
+		default:
+			w.uvarint(len(m.nets))
+			for _, ipNet := range m.nets {
+				ones, _ := ipNet.Mask.Size()
+				w.uvarint(len(ipNet.IP))
+				w.buf.Write(ipNet.IP)
+				w.uvarint(ones)
+			}
+		}
+	}
+	if spf.Redirect == nil {
+		w.buf.WriteByte(0)
+	} else {
+		w.buf.WriteByte(1)
+		w.spf(spf.Redirect)
+	}
+}
+
+// snapshotReader reads the binary form, the first error is kept in err.
+type snapshotReader struct {
+	data []byte
+	err  error
+}
+
+func (r *snapshotReader) fail() {
+	if r.err == nil {
+		r.err = ErrInvalidSnapshot
+	}
+	r.data = nil
+}
+
+func (r *snapshotReader) uvarint() int {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 || v > maxSnapshotValue {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return int(v)
+}
+
+func (r *snapshotReader) bytes(n int) []byte {
+	if n > len(r.data) {
+		r.fail()
+		return nil
+	}
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *snapshotReader) string() string {
+	return string(r.bytes(r.uvarint()))
+}
+
+func (r *snapshotReader) spf(depth int) *SPF {
+	if depth > maxSnapshotDepth {
+		r.fail()
+		return nil
+	}
+	domain, family, record := r.string(), r.string(), r.string()
+	dnsLookups, voidLookups := r.uvarint(), r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	spf, err := restoredSPF(domain, family, record, dnsLookups, voidLookups)
+	if err != nil {
+		r.fail()
+		return nil
+	}
+
+	for _, directive := range spf.directives {
+		var included *SPF
+		ipNets := make([]net.IPNet, 0)
+		switch directive.Mechanism {
+		case "all", "ptr":
+		case "include":
+			included = r.spf(depth + 1)
+		default:
+			for count := r.uvarint(); count > 0 && r.err == nil; count-- {
+				ip := net.IP(r.bytes(r.uvarint()))
+				ones := r.uvarint()
+				if len(ip) != net.IPv4len && len(ip) != net.IPv6len || ones > len(ip)*8 {
+					r.fail()
+					return nil
+				}
+				ipNets = append(ipNets, net.IPNet{IP: ip, Mask: net.CIDRMask(ones, len(ip)*8)})
+			}
+		}
+		if r.err != nil {
+			return nil
+		}
+		if err := spf.restoreMechanism(directive, ipNets, included); err != nil {
+			r.fail()
+			return nil
+		}
+	}
+	if redirect := r.bytes(1); r.err == nil && redirect[0] == 1 {
+		spf.Redirect = r.spf(depth + 1)
+	} else if r.err == nil && redirect[0] != 0 {
+		r.fail()
+	}
+	if r.err != nil {
+		return nil
+	}
+	return spf
+}
+
+// noResolver is the resolver of restored instances, it fails every query.
+type noResolver struct{}
+
+var errNoResolver = errors.New("no resolver for restored SPF policy")
+
+func (noResolver) GetSPFRecord(string) (string, error)     { return "", errNoResolver }
+func (noResolver) GetARecords(string) ([]string, error)    { return nil, errNoResolver }
+func (noResolver) GetAAAARecords(string) ([]string, error) { return nil, errNoResolver }
+func (noResolver) GetMXRecords(string) ([]*net.MX, error)  { return nil, errNoResolver }
+func (noResolver) GetPTRRecords(string) ([]string, error)  { return nil, errNoResolver }
@@ -0,0 +1,143 @@
+package gospf
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+const snapshotZone = `
+$ORIGIN example.org.
+@        TXT  "v=spf1 ip4:192.0.2.128/25 -ip4:192.0.2.130 ~ip6:2001:db8::/32 include:_spf.example.org ptr:ptr.example.org redirect=other.example.org"
+_spf     TXT  "v=spf1 a:host.example.org mx ?exists:exists.example.org -all"
+         MX   10 mx
+host     A    198.51.100.1
+         AAAA 2001:db8:1::1
+mx       A    198.51.100.2
+exists   A    127.0.0.2
+other    TXT  "v=spf1 -ip4:203.0.113.0/24 all"
+ptr      A    192.0.2.7
+7.2.0.192.in-addr.arpa. PTR ptr.example.org.
+`
+
+func TestSnapshot(t *testing.T) {
+	Convey("Testing snapshots of SPF instances", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(snapshotZone), ""), ShouldEqual, nil)
+		spf, err := New("example.org", z)
+		So(err, ShouldEqual, nil)
+
+		jsonData, err := json.Marshal(spf)
+		So(err, ShouldEqual, nil)
+		binaryData, err := spf.MarshalBinary()
+		So(err, ShouldEqual, nil)
+		So(len(binaryData), ShouldBeLessThan, len(jsonData)/2)
+
+		fromJSON := &SPF{}
+		So(json.Unmarshal(jsonData, fromJSON), ShouldEqual, nil)
+		fromBinary, err := Restore(binaryData, z)
+		So(err, ShouldEqual, nil)
+
+		for _, restored := range []*SPF{fromJSON, fromBinary} {
+			So(restored.String(), ShouldEqual, spf.String())
+			So(restored.Record(), ShouldEqual, spf.Record())
+			So(restored.Redirect.Record(), ShouldEqual, "v=spf1 -ip4:203.0.113.0/24 all")
+			So(restored.Graph(), ShouldResemble, spf.Graph())
+			So(restored.DynamicTerms(), ShouldResemble, spf.DynamicTerms())
+			So(restored.DNSLookupCount(), ShouldEqual, spf.DNSLookupCount())
+			So(restored.VoidLookupCount(), ShouldEqual, spf.VoidLookupCount())
+			So(restored.Includes[0].Term, ShouldEqual, "include:_spf.example.org")
+		}
+
+		// the terms are restored in record order
+		for _, restored := range []*SPF{fromJSON, fromBinary} {
+			result, err := restored.CheckIP("192.0.2.130")
+			So(err, ShouldEqual, nil)
+			So(result, ShouldEqual, "Pass")
+		}
+
+		for _, ip := range []string{"192.0.2.200", "2001:db8::1", "198.51.100.1", "2001:db8:1::1", "198.51.100.2", "203.0.113.1", "192.0.2.7", "10.0.0.1"} {
+			want, err := spf.Evaluate(ip)
+			So(err, ShouldEqual, nil)
+			got, err := fromBinary.Evaluate(ip)
+			So(err, ShouldEqual, nil)
+			So(got, ShouldResemble, want)
+
+			// without resolver the ptr mechanism can't be evaluated
+			got, err = fromJSON.Evaluate(ip)
+			if want.Mechanism == "ptr:ptr.example.org" || want.Domain == "other.example.org" {
+				So(err, ShouldNotEqual, nil)
+				So(err.Error(), ShouldEqual, "TempError")
+				continue
+			}
+			So(err, ShouldEqual, nil)
+			So(got, ShouldResemble, want)
+		}
+		evaluation, err := fromBinary.Evaluate("192.0.2.7")
+		So(err, ShouldEqual, nil)
+		So(evaluation.Mechanism, ShouldEqual, "ptr:ptr.example.org")
+
+		for _, data := range [][]byte{
+			binaryData[:len(binaryData)-1],
+			append(append([]byte{}, binaryData...), 0),
+			[]byte("GSPF\x03"),
+			[]byte(`{"version": 3, "domain": "example.org"}`),
+			[]byte(`{"version": 2, "domain": "example.org", "record": "v=spf1 -any", "terms": [{"term": "-any"}]}`),
+			[]byte(`{"version": 2, "domain": "example.org", "record": "v=spf1 ip4:x", "terms": [{"term": "ip4:x", "networks": ["x"]}]}`),
+			[]byte(`{"version": 2, "domain": "example.org", "record": "v=spf1 include:x", "terms": [{"term": "include:x"}]}`),
+			[]byte(`{"version": 2, "domain": "example.org", "record": "v=spf1 -all", "terms": []}`),
+			[]byte(`{"version": 2, "domain": "example.org", "record": "v=spf1 -all", "terms": [{"term": "~all"}]}`),
+			[]byte(`{"version": 2, "domain": "example.org", "terms": []}`),
+		} {
+			_, err := Restore(data, nil)
+			So(errors.Is(err, ErrInvalidSnapshot), ShouldEqual, true)
+		}
+	})
+}
+
+func TestSnapshotVersions(t *testing.T) {
+	Convey("Testing snapshots of earlier versions", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(snapshotZone), ""), ShouldEqual, nil)
+		spf, err := New("example.org", z)
+		So(err, ShouldEqual, nil)
+
+		Convey("Snapshots of the current version are restored", func() {
+			for _, file := range []string{"testdata/snapshot-v2.json", "testdata/snapshot-v2.bin"} {
+				data, err := ioutil.ReadFile(file)
+				So(err, ShouldEqual, nil)
+				restored, err := Restore(data, z)
+				So(err, ShouldEqual, nil)
+				So(restored.String(), ShouldEqual, spf.String())
+				So(restored.Record(), ShouldEqual, spf.Record())
+				So(restored.Graph(), ShouldResemble, spf.Graph())
+
+				// an unchanged layout gives the same snapshot
+				var snapshot []byte
+				if strings.HasSuffix(file, ".json") {
+					snapshot, err = restored.MarshalJSON()
+				} else {
+					snapshot, err = restored.MarshalBinary()
+				}
+				So(err, ShouldEqual, nil)
+				So(snapshot, ShouldResemble, data)
+			}
+		})
+
+		Convey("Version 1 snapshots, without the records, are rejected", func() {
+			for _, file := range []string{"testdata/snapshot-v1.json", "testdata/snapshot-v1.bin"} {
+				data, err := ioutil.ReadFile(file)
+				So(err, ShouldEqual, nil)
+				_, err = Restore(data, z)
+				So(errors.Is(err, ErrInvalidSnapshot), ShouldEqual, true)
+				So(err.Error(), ShouldEqual, "invalid SPF snapshot: unsupported version 1, the policy must be resolved again")
+			}
+		})
+	})
+}
@@ -0,0 +1,98 @@
+//go:build go1.21
+// +build go1.21
+
+// Package slogobserver is a gospf.Observer that writes the evaluation events
+// as structured log/slog records.
+//
+//	observer := slogobserver.New(slog.Default())
+//	result, err := gospf.Check(ip, sender, helo, resolver, gospf.WithObserver(observer))
+//
+// Terms and DNS queries are logged at debug level, exceeded limits at warn
+// level and results at info level.
+package slogobserver
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/mistralmail/gospf"
+)
+
+// Observer logs evaluation events to a slog.Logger.
+type Observer struct {
+	logger *slog.Logger
+	ctx    context.Context
+}
+
+// New creates an Observer logging to logger, slog.Default() when nil.
+func New(logger *slog.Logger) *Observer {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Observer{logger: logger, ctx: context.Background()}
+}
+
+// WithContext returns an Observer passing ctx to the handler of the logger,
+// e.g. to add the trace and request IDs it carries to the records.
+func (o *Observer) WithContext(ctx context.Context) *Observer {
+	return &Observer{logger: o.logger, ctx: ctx}
+}
+
+// Observe logs the event.
+func (o *Observer) Observe(e gospf.Event) {
+	level := slog.LevelDebug
+	switch e.Kind {
+	case gospf.LimitExceeded:
+		level = slog.LevelWarn
+	case gospf.ResultEvent:
+		level = slog.LevelInfo
+	}
+	if !o.logger.Enabled(o.ctx, level) {
+		return
+	}
+
+	attrs := make([]slog.Attr, 0, 6)
+	message := ""
+
+	switch e.Kind {
+	case gospf.TermStart:
+		message = "spf term start"
+		attrs = append(attrs, slog.String("domain", e.Domain), slog.String("term", e.Term))
+	case gospf.TermEnd:
+		message = "spf term end"
+		attrs = append(attrs, slog.String("domain", e.Domain), slog.String("term", e.Term), slog.Duration("duration", e.Duration))
+	case gospf.DNSQuery:
+		message = "spf dns query"
+		attrs = append(attrs, slog.String("qtype", e.QType), slog.String("name", e.Name))
+	case gospf.DNSAnswer:
+		message = "spf dns answer"
+		attrs = append(attrs, slog.String("qtype", e.QType), slog.String("name", e.Name),
+			slog.Any("answers", e.Answers), slog.Duration("duration", e.Duration))
+	case gospf.LimitExceeded:
+		message = "spf lookup limit exceeded"
+		attrs = append(attrs, slog.String("domain", e.Domain), slog.String("limit", e.Name))
+	case gospf.ResultEvent:
+		message = "spf result"
+		attrs = append(attrs, slog.String("domain", e.Domain), slog.String("ip", e.IP), slog.String("result", e.Result))
+		if e.Term != "" {
+			attrs = append(attrs, slog.String("mechanism", e.Term))
+		}
+	default:
+		message = "spf event"
+		attrs = append(attrs, slog.String("kind", e.Kind.String()))
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.String("error", errorMessage(e.Err)))
+	}
+
+	o.logger.LogAttrs(o.ctx, level, message, attrs...)
+}
+
+// errorMessage returns the message of the gospf error types, whose Error
+// method only returns the result name.
+func errorMessage(err error) string {
+	if s, ok := err.(interface{ String() string }); ok {
+		return err.Error() + ": " + s.String()
+	}
+	return err.Error()
+}
@@ -0,0 +1,92 @@
+//go:build go1.21
+// +build go1.21
+
+package slogobserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+)
+
+const testZone = `
+$ORIGIN example.com.
+@        TXT  "v=spf1 mx include:_spf.example.com -all"
+         MX   10 mx
+mx       A    192.0.2.10
+_spf     TXT  "v=spf1 ip4:198.51.100.0/24 -all"
+`
+
+func records(out *bytes.Buffer) []map[string]interface{} {
+	records := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		record := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			panic(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestObserver(t *testing.T) {
+	Convey("Testing the slog observer", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(testZone), ""), ShouldEqual, nil)
+
+		var out bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+		result, err := gospf.Check("198.51.100.7", "user@example.com", "", z, gospf.WithObserver(New(logger)))
+		So(err, ShouldEqual, nil)
+		So(result.Result, ShouldEqual, "Pass")
+
+		messages := make([]string, 0)
+		for _, record := range records(&out) {
+			messages = append(messages, record["msg"].(string))
+		}
+		So(messages, ShouldResemble, []string{
+			"spf dns query", "spf dns answer", // TXT example.com
+			"spf term start", "spf dns query", "spf dns answer", "spf dns query", "spf dns answer", "spf term end", // mx
+			"spf term start", "spf dns query", "spf dns answer", // include
+			"spf term start", "spf term end", "spf term start", "spf term end", // ip4 and -all of the included record
+			"spf term end",                   // include
+			"spf term start", "spf term end", // -all
+			"spf term start", "spf term end", // include evaluated for the IP
+			"spf result",
+		})
+
+		last := records(&out)[len(messages)-1]
+		So(last["level"], ShouldEqual, "INFO")
+		So(last["domain"], ShouldEqual, "example.com")
+		So(last["result"], ShouldEqual, "Pass")
+		So(last["mechanism"], ShouldEqual, "include:_spf.example.com")
+
+		Convey("Only the enabled levels are logged", func() {
+			out.Reset()
+			logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}))
+			_, err := gospf.Check("203.0.113.1", "user@example.com", "", z, gospf.WithObserver(New(logger)))
+			So(err, ShouldEqual, nil)
+			So(len(records(&out)), ShouldEqual, 1)
+			So(records(&out)[0]["result"], ShouldEqual, "Fail")
+		})
+
+		Convey("Errors", func() {
+			out.Reset()
+			z.Fail("_spf.example.com", dns.ServFail)
+			result, err := gospf.Check("203.0.113.1", "user@example.com", "", z, gospf.WithObserver(New(logger)))
+			So(err, ShouldEqual, nil)
+			So(result.Result, ShouldEqual, "TempError")
+			last := records(&out)[len(records(&out))-1]
+			So(last["result"], ShouldEqual, "TempError")
+			So(last["error"], ShouldStartWith, "TempError: ")
+		})
+	})
+}
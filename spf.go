@@ -1,8 +1,10 @@
 package gospf
 
 import (
+	"errors"
 	"fmt"
 	"github.com/mistralmail/gospf/dns"
+	"github.com/mistralmail/gospf/ipset"
 	"net"
 	"strconv"
 	"strings"
@@ -15,24 +17,76 @@ const (
 	VoidLookupLimit = 2
 )
 
-type include struct {
-	qualifier string
-	spf       *SPF
+// addressFamily restricts the address lookups of the "a" and "mx" mechanisms
+// to the family of the connecting client.
+type addressFamily int
+
+const (
+	familyAny addressFamily = iota
+	familyIPv4
+	familyIPv6
+)
+
+// familyOf returns the address family of ip_str.
+// IPv4-mapped IPv6 addresses are treated as IPv4.
+func familyOf(ip_str string) (addressFamily, error) {
+	ip := net.ParseIP(ip_str)
+	if ip == nil {
+		return familyAny, fmt.Errorf("Invalid IP address: %v", ip_str)
+	}
+	if ip.To4() != nil {
+		return familyIPv4, nil
+	}
+	return familyIPv6, nil
+}
+
+// Include is an include mechanism together with the included policy.
+type Include struct {
+	Qualifier string // qualifier of the mechanism, e.g. "+" or "-"
+	Term      string // the mechanism, e.g. "include:_spf.example.com"
+	SPF       *SPF
+}
+
+// termNet is an IP network together with the directive it was resolved from.
+type termNet struct {
+	ipNet     net.IPNet
+	directive Directive
+}
+
+// mechanism is a resolved mechanism of the record. The mechanisms are
+// evaluated in record order and the first one that matches determines the
+// result (RFC 7208 § 4.6.2).
+type mechanism struct {
+	directive Directive
+	nets      []net.IPNet // networks of a, mx, ip4, ip6 and exists
+	include   int         // index in Includes of an include
 }
 
 type SPF struct {
+	// Pass, Neutral, SoftFail and Fail are the networks of the mechanisms
+	// with that qualifier. CheckIP evaluates the mechanisms in record order,
+	// so an address in Pass fails when a -ip4 term before it matches.
 	Pass     []net.IPNet // IPs that pass
 	Neutral  []net.IPNet // IPs that are neutral
 	SoftFail []net.IPNet // IP's that fail weakly
 	Fail     []net.IPNet // IP's that fail
-	All      string      // qualifier of 'all' directive
+	All      string      // qualifier of the first 'all' directive
 	Domain   string
-	Includes []include // Processed SPF object of include mechanism
+	Includes []Include // Processed SPF object of include mechanism
 	Redirect *SPF      // Processed SPF object of include mechanism
+	// BestGuess is set when the domain publishes no record and the
+	// instance evaluates the best-guess record, see WithBestGuess.
+	BestGuess bool
 
 	dns             dns.DnsResolver
+	options         *options
+	record          string   // the loaded record
+	path            []string // domains that include or redirect to the instance, from the root
+	family          addressFamily
 	directives      Directives
 	modifiers       Modifiers
+	mechanisms      []mechanism // in record order
+	termNets        []termNet   // networks of Pass, Neutral, SoftFail and Fail in record order
 	dnsLookupCount  int
 	voidLookupCount int
 }
@@ -41,50 +95,144 @@ func (spf SPF) String() string {
 	return spf.toString("")
 }
 
+// DNSLookupCount returns the number of DNS querying terms that were
+// evaluated while constructing this SPF instance (RFC 7208 § 4.6.4).
+func (spf *SPF) DNSLookupCount() int {
+	return spf.dnsLookupCount
+}
+
+// Record returns the SPF record the instance was loaded from.
+func (spf *SPF) Record() string {
+	return spf.record
+}
+
+// VoidLookupCount returns the number of DNS querying terms that yielded
+// an empty answer or a non-existent domain (RFC 7208 § 4.6.4).
+func (spf *SPF) VoidLookupCount() int {
+	return spf.voidLookupCount
+}
+
 // New create a new SPF instance
 // fully loaded with all the SPF directives
-// (so no more DNS lookups must be done after constructing the instance)
-func New(domain string, dnsResolver dns.DnsResolver) (*SPF, error) {
-	return newSPF(domain, dnsResolver, 0, 0)
+// (so no more DNS lookups must be done after constructing the instance,
+// except for ptr mechanisms: they depend on the client IP, so CheckIP
+// looks up its PTR and address records when it reaches one)
+func New(domain string, dnsResolver dns.DnsResolver, opts ...Option) (*SPF, error) {
+	return newOptions(opts).build(domain, dnsResolver, familyAny)
+}
+
+// NewForIP creates a new SPF instance like New, but the "a" and "mx"
+// mechanisms only look up the address type (A or AAAA) matching the
+// connection type of ip, as RFC 7208 § 5.3 prescribes.
+// The instance must therefore only be used to check IPs of the same family.
+func NewForIP(domain string, ip string, dnsResolver dns.DnsResolver, opts ...Option) (*SPF, error) {
+	family, err := familyOf(ip)
+	if err != nil {
+		return nil, err
+	}
+	return newOptions(opts).build(domain, dnsResolver, family)
+}
+
+func newSPF(domain string, dnsResolver dns.DnsResolver, opts *options, family addressFamily, dnsLookupCount int, voidLookupCount int) (*SPF, error) {
+	return emptySPF(domain, dnsResolver, opts, family, dnsLookupCount, voidLookupCount).fetch()
 }
 
-func newSPF(domain string, dnsResolver dns.DnsResolver, dnsLookupCount int, voidLookupCount int) (*SPF, error) {
-	spf := SPF{
+// fetch looks up the record of the domain of the instance and loads it.
+func (spf *SPF) fetch() (*SPF, error) {
+	domain := spf.Domain
+	/*
+		RFC 7208 4.5.
+			If the resultant record set includes no records, check_host()
+			produces the "none" result.  If the resultant record set includes
+			more than one record, check_host() produces the "permerror" result.
+	*/
+	record, err := spf.dns.GetSPFRecord(domain)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			if err := spf.incVoidLookupCount(1); err != nil {
+				return nil, err
+			}
+			return nil, &NoneError{err.Error()}
+		}
+		if errors.Is(err, dns.ErrNoSPFRecord) {
+			return nil, &NoneError{err.Error()}
+		}
+		if errors.Is(err, dns.ErrMultipleSPFRecords) {
+			return nil, &PermError{err.Error()}
+		}
+		/*
+			RFC 7208 4.4.
+				If the DNS lookup returns a server failure (RCODE 2) or some other
+				error (RCODE other than 0 or 3), or if the lookup times out, then
+				check_host() terminates immediately with the result "temperror".
+		*/
+		return nil, &TempError{err.Error()}
+	}
+	if err := spf.load(record); err != nil {
+		return nil, err
+	}
+	return spf, nil
+}
+
+// child loads the policy of domain, which the instance includes or
+// redirects to (kind "Include" or "Redirect"). Domains that are already on
+// the path from the root are a PermError naming the loop, rather than
+// running out of DNS lookups.
+func (spf *SPF) child(kind string, domain string) (*SPF, error) {
+	path := append(append([]string(nil), spf.path...), spf.Domain)
+	for i, d := range path {
+		if strings.EqualFold(strings.TrimSuffix(d, "."), strings.TrimSuffix(domain, ".")) {
+			cycle := append(path[i:], domain)
+			return nil, &PermError{fmt.Sprintf("%v loop: %v", kind, strings.Join(cycle, " -> "))}
+		}
+	}
+	child := emptySPF(domain, spf.dns, spf.options, spf.family, spf.dnsLookupCount, spf.voidLookupCount)
+	child.path = path
+	return child.fetch()
+}
+
+// emptySPF returns an instance without terms, to load a record into.
+func emptySPF(domain string, dnsResolver dns.DnsResolver, opts *options, family addressFamily, dnsLookupCount int, voidLookupCount int) *SPF {
+	return &SPF{
 		Pass:            make([]net.IPNet, 0),
 		Neutral:         make([]net.IPNet, 0),
 		SoftFail:        make([]net.IPNet, 0),
 		Fail:            make([]net.IPNet, 0),
 		Domain:          domain,
-		Includes:        make([]include, 0),
+		Includes:        make([]Include, 0),
 		Redirect:        nil,
 		All:             "undefined",
 		dns:             dnsResolver,
+		options:         opts,
+		family:          family,
 		dnsLookupCount:  dnsLookupCount,
 		voidLookupCount: voidLookupCount,
 	}
-	record, err := spf.dns.GetSPFRecord(domain)
-	if err != nil {
-		return nil, &PermError{err.Error()}
+}
+
+// load parses record and resolves its terms.
+func (spf *SPF) load(record string) error {
+	if err := spf.parse(record); err != nil {
+		return err
 	}
+	if err := spf.handleDirectives(); err != nil {
+		return err
+	}
+	return spf.handleModifiers()
+}
+
+// parse sets the record of the instance and its terms, without resolving them.
+func (spf *SPF) parse(record string) error {
 	directives, modifiers, err := getTerms(record)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	spf.record = record
 	spf.directives = Directives(directives)
 	spf.directives.process()
 	spf.modifiers = Modifiers(modifiers)
 	spf.modifiers.process()
-
-	err = spf.handleDirectives()
-	if err != nil {
-		return nil, err
-	}
-	err = spf.handleModifiers()
-	if err != nil {
-		return nil, err
-	}
-
-	return &spf, nil
+	return nil
 }
 
 func (spf *SPF) handleIPNets(ips []net.IPNet, qualifier string) {
@@ -116,303 +264,402 @@ func (spf *SPF) handleIPNets(ips []net.IPNet, qualifier string) {
 		panic("Unknown qualifier")
 	}
 
-	*list = append(*list, ips...)
+	// keep the fewest networks, records often list overlapping ones
+	*list = ipset.New(append(*list, ips...)...).Networks()
+}
+
+// handleDirectiveNets adds the networks a directive resolved to,
+// remembering the directive to report it when it matches.
+func (spf *SPF) handleDirectiveNets(ips []net.IPNet, directive Directive) {
+	ips = ipset.New(ips...).Networks()
+	spf.handleIPNets(ips, directive.Qualifier)
+	for _, ip := range ips {
+		spf.termNets = append(spf.termNets, termNet{ipNet: ip, directive: directive})
+	}
 }
 
 func (spf *SPF) handleDirectives() error {
 
 	for _, directive := range spf.directives {
+		start := spf.termStart(directive.term)
+		nets := len(spf.termNets)
+		err := spf.handleDirective(directive)
+		spf.termEnd(directive.term, start, err)
+		if err != nil {
+			return err
+		}
+		spf.addMechanism(directive, spf.termNets[nets:])
+	}
 
-		switch directive.Mechanism {
-		case "all":
-			{
-				/*
-					RFC 7208 5.1
-						The "all" mechanism is a test that always matches.  It is used as the
-						rightmost mechanism in a record to provide an explicit default.
+	return nil
 
-						For example:
+}
 
-						   v=spf1 a mx -all
-				*/
+// addMechanism adds a resolved directive to the mechanisms to evaluate,
+// together with the networks it resolved to.
+func (spf *SPF) addMechanism(directive Directive, termNets []termNet) {
+	m := mechanism{directive: directive, include: -1}
+	switch directive.Mechanism {
+	case "all", "ptr":
+	case "include":
+		m.include = len(spf.Includes) - 1
+	case "a", "mx", "ip4", "ip6", "exists":
+		m.nets = make([]net.IPNet, 0, len(termNets))
+		for _, t := range termNets {
+			m.nets = append(m.nets, t.ipNet)
+		}
+	default:
+		return
+	}
+	spf.mechanisms = append(spf.mechanisms, m)
+}
+
+// handleDirective resolves the networks of a directive.
+func (spf *SPF) handleDirective(directive Directive) error {
+
+	switch directive.Mechanism {
+	case "all":
+		{
+			/*
+				RFC 7208 5.1
+					The "all" mechanism is a test that always matches.  It is used as the
+					rightmost mechanism in a record to provide an explicit default.
+
+					For example:
+
+					   v=spf1 a mx -all
+			*/
+			if spf.All == "undefined" {
 				spf.All = directive.Qualifier
+			}
 
-				/*
-					Mechanisms after "all" will never be tested.  Mechanisms listed after
-					"all" MUST be ignored.  Any "redirect" modifier (Section 6.1) MUST be
-					ignored when there is an "all" mechanism in the record, regardless of
-					the relative ordering of the terms.
-				*/
+			/*
+				Mechanisms after "all" will never be tested.  Mechanisms listed after
+				"all" MUST be ignored.  Any "redirect" modifier (Section 6.1) MUST be
+				ignored when there is an "all" mechanism in the record, regardless of
+				the relative ordering of the terms.
+			*/
+		}
+	case "include":
+		{
+			/*
+				RFC 7208 5.2
+					include          = "include"  ":" domain-spec
+
+					The "include" mechanism triggers a recursive evaluation of
+					check_host().
+			*/
+			if _, ok := directive.Arguments["domain"]; !ok {
+				return &PermError{"No domain given for include mechanism"}
+			}
+			err := spf.incDNSLookupCount(1)
+			if err != nil {
+				return err
+			}
+			include_spf, err := spf.child("Include", directive.Arguments["domain"])
+			if err != nil {
+				return noneToPermError(err)
+			}
+			err = spf.incDNSLookupCount(include_spf.dnsLookupCount - spf.dnsLookupCount)
+			if err != nil {
+				return err
+			}
+			err = spf.incVoidLookupCount(include_spf.voidLookupCount - spf.voidLookupCount)
+			if err != nil {
+				return err
+			}
+			spf.Includes = append(spf.Includes, Include{Qualifier: directive.Qualifier, Term: directive.term, SPF: include_spf})
+		}
+	case "a":
+		{
+			/*
+				RFC 7208 5.3
+					This mechanism matches if <ip> is one of the <target-name>'s IP
+					addresses.  For clarity, this means the "a" mechanism also matches
+					AAAA records.
+
+					a                = "a"      [ ":" domain-spec ] [ dual-cidr-length ]
+
+					An address lookup is done on the <target-name> using the type of
+					lookup (A or AAAA) appropriate for the connection type (IPv4 or
+					IPv6).  The <ip> is compared to the returned address(es).  If any
+					address matches, the mechanism matches.
+			*/
+			domain := spf.Domain
+			if d, ok := directive.Arguments["domain"]; ok && d != "" {
+				domain = d
+			}
+			err := spf.incDNSLookupCount(1)
+			if err != nil {
+				return err
+			}
+			ips, err := spf.lookupAddresses(domain)
+			if err = spf.handleVoidLookup(len(ips), err); err != nil {
+				return err
 			}
-		case "include":
-			{
-				/*
-					RFC 7208 5.2
-						include          = "include"  ":" domain-spec
-
-						The "include" mechanism triggers a recursive evaluation of
-						check_host().
-				*/
-				if _, ok := directive.Arguments["domain"]; !ok {
-					return &PermError{"No domain given for include mechanism"}
-				}
-				err := spf.incDNSLookupCount(1)
-				if err != nil {
-					return err
-				}
-				include_spf, err := newSPF(
-					directive.Arguments["domain"], spf.dns, spf.dnsLookupCount, spf.voidLookupCount)
-				if err != nil {
-					return err
-				}
-				err = spf.incDNSLookupCount(include_spf.dnsLookupCount - spf.dnsLookupCount)
-				if err != nil {
-					return err
-				}
-				err = spf.incVoidLookupCount(include_spf.voidLookupCount - spf.voidLookupCount)
-				if err != nil {
-					return err
-				}
-				spf.Includes = append(spf.Includes, include{qualifier: directive.Qualifier, spf: include_spf})
-			}
-		case "a":
-			{
-				/*
-					RFC 7208 5.3
-						This mechanism matches if <ip> is one of the <target-name>'s IP
-						addresses.  For clarity, this means the "a" mechanism also matches
-						AAAA records.
-
-						a                = "a"      [ ":" domain-spec ] [ dual-cidr-length ]
-
-						An address lookup is done on the <target-name> using the type of
-						lookup (A or AAAA) appropriate for the connection type (IPv4 or
-						IPv6).  The <ip> is compared to the returned address(es).  If any
-						address matches, the mechanism matches.
-				*/
-				domain := spf.Domain
-				if d, ok := directive.Arguments["domain"]; ok && d != "" {
-					domain = d
-				}
-				ips, err := spf.dns.GetARecords(domain)
-				if err != nil {
-					return err
-				}
-				err = spf.incDNSLookupCount(1)
-				if err != nil {
-					return err
-				}
 
-				ip_nets, err := GetRanges(ips, directive.Arguments["ip4-cidr"], directive.Arguments["ip6-cidr"])
-				if err != nil {
-					return err
-				}
-				spf.handleIPNets(ip_nets, directive.Qualifier)
-			}
-		case "mx":
-			{
-				/*
-					RFC 7208 5.4
-						This mechanism matches if <ip> is one of the MX hosts for a domain
-						name.
-
-						mx               = "mx"     [ ":" domain-spec ] [ dual-cidr-length ]
-
-						check_host() first performs an MX lookup on the <target-name>.  Then
-						it performs an address lookup on each MX name returned.  The <ip> is
-						compared to each returned IP address.  To prevent denial-of-service
-						(DoS) attacks, the processing limits defined in Section 4.6.4 MUST be
-						followed.  If the MX lookup limit is exceeded, then "permerror" is
-						returned and the evaluation is terminated.  If any address matches,
-						the mechanism matches.
-
-						Note regarding implicit MXes: If the <target-name> has no MX record,
-						check_host() MUST NOT apply the implicit MX rules of [RFC5321] by
-						querying for an A or AAAA record for the same name.
-
-					RFC 1035 3.3.9.
-						PREFERENCE      A 16 bit integer which specifies the preference given to
-										this RR among others at the same owner.  Lower values
-										are preferred.
-
-						EXCHANGE        A <domain-name> which specifies a host willing to act as
-										a mail exchange for the owner name.
-				*/
-				domain := spf.Domain
-				if d, ok := directive.Arguments["domain"]; ok && d != "" {
-					domain = d
-				}
-				// Get mx records
-				mxRecords, err := spf.dns.GetMXRecords(domain)
-				if err != nil {
-					return err
-				}
-				err = spf.incDNSLookupCount(len(mxRecords))
-				if err != nil {
-					return err
-				}
-				// Get A/AAAA records of MX hosts and process them
-				for _, mx := range mxRecords {
-
-					ips, err := spf.dns.GetARecords(mx.Host)
-					if err != nil {
-						return err
-					}
-					// Return an error if the number of A/AAAA records per MX record exceeds
-					// the DNSLookupLimit.  Reference: RFC 7208 §4.6.4.
-					if len(ips) > DNSLookupLimit {
-						return &PermError{fmt.Sprintf("Exceeded A record lookup limit of %v", DNSLookupLimit)}
-					}
-
-					ip_nets, err := GetRanges(ips, directive.Arguments["ip4-cidr"], directive.Arguments["ip6-cidr"])
-					if err != nil {
-						return err
-					}
-					spf.handleIPNets(ip_nets, directive.Qualifier)
+			ip_nets, err := GetRanges(ips, directive.Arguments["ip4-cidr"], directive.Arguments["ip6-cidr"])
+			if err != nil {
+				return err
+			}
+			spf.handleDirectiveNets(ip_nets, directive)
+		}
+	case "mx":
+		{
+			/*
+				RFC 7208 5.4
+					This mechanism matches if <ip> is one of the MX hosts for a domain
+					name.
+
+					mx               = "mx"     [ ":" domain-spec ] [ dual-cidr-length ]
+
+					check_host() first performs an MX lookup on the <target-name>.  Then
+					it performs an address lookup on each MX name returned.  The <ip> is
+					compared to each returned IP address.  To prevent denial-of-service
+					(DoS) attacks, the processing limits defined in Section 4.6.4 MUST be
+					followed.  If the MX lookup limit is exceeded, then "permerror" is
+					returned and the evaluation is terminated.  If any address matches,
+					the mechanism matches.
+
+					Note regarding implicit MXes: If the <target-name> has no MX record,
+					check_host() MUST NOT apply the implicit MX rules of [RFC5321] by
+					querying for an A or AAAA record for the same name.
+
+				RFC 1035 3.3.9.
+					PREFERENCE      A 16 bit integer which specifies the preference given to
+									this RR among others at the same owner.  Lower values
+									are preferred.
+
+					EXCHANGE        A <domain-name> which specifies a host willing to act as
+									a mail exchange for the owner name.
+			*/
+			domain := spf.Domain
+			if d, ok := directive.Arguments["domain"]; ok && d != "" {
+				domain = d
+			}
+			err := spf.incDNSLookupCount(1)
+			if err != nil {
+				return err
+			}
+			// Get mx records
+			mxRecords, err := spf.dns.GetMXRecords(domain)
+			if err = spf.handleVoidLookup(len(mxRecords), err); err != nil {
+				return err
+			}
+			/*
+				RFC 7208 4.6.4.
+					When evaluating the "mx" mechanism, the number of "MX" resource
+					records queried is included in the overall limit of 10 mechanisms/
+					modifiers that cause DNS lookups as described above.  In addition to
+					that limit, the evaluation of each "MX" record MUST NOT result in
+					querying more than 10 address records -- either "A" or "AAAA"
+					resource records.  If this limit is exceeded, the "mx" mechanism
+					MUST produce a "permerror" result.
+			*/
+			if len(mxRecords) > DNSLookupLimit {
+				return &PermError{fmt.Sprintf("Domain %v exceeds MX lookup limit of %v", domain, DNSLookupLimit)}
+			}
+			// Get A/AAAA records of MX hosts and process them
+			for _, mx := range mxRecords {
 
+				ips, err := spf.lookupAddresses(mx.Host)
+				if err != nil && !dns.IsNotFound(err) {
+					return &TempError{err.Error()}
 				}
 
-			}
-		case "ptr":
-			{
-				// not (yet) supported
-				/*
-					RFC 7208 5.5
-						This mechanism tests whether the DNS reverse-mapping for <ip> exists
-						and correctly points to a domain name within a particular domain.
-						This mechanism SHOULD NOT be published.  See the note at the end of
-						this section for more information.
-				*/
-			}
-		case "ip4":
-			{
-				/*
-					RFC 7208 5.6
-						These mechanisms test whether <ip> is contained within a given
-						IP network.
-
-						ip4  = "ip4"   ":" ip4-network   [ ip4-cidr-length ]
-						ip4-cidr-length  = "/" ("0" / %x31-39 0*1DIGIT) ; value range 0-32
-				*/
-				ips := []string{directive.Arguments["ip"]}
-				ip_nets, err := GetRanges(ips, directive.Arguments["ip4-cidr"], directive.Arguments["ip6-cidr"])
-				if err != nil {
-					return err
-				}
-				spf.handleIPNets(ip_nets, directive.Qualifier)
-			}
-		case "ip6":
-			{
-				/*
-					ip6  = "ip6"   ":" ip6-network   [ ip6-cidr-length ]
-					ip6-cidr-length  = "/" ("0" / %x31-39 0*2DIGIT) ; value range 0-128
-				*/
-				ips := []string{directive.Arguments["ip"]}
 				ip_nets, err := GetRanges(ips, directive.Arguments["ip4-cidr"], directive.Arguments["ip6-cidr"])
 				if err != nil {
 					return err
 				}
-				spf.handleIPNets(ip_nets, directive.Qualifier)
-			}
-		case "exists":
-			{
-				/*
-					RFC 7208 5.7
-						The resulting domain name is used for a DNS A RR lookup
-						(even when the connection type is IPv6).
-						If any A record is returned, this mechanism matches.
-				*/
-				// TODO
+				spf.handleDirectiveNets(ip_nets, directive)
+
 			}
-		default:
-			{
 
+		}
+	case "ptr":
+		{
+			/*
+				RFC 7208 5.5
+					This mechanism tests whether the DNS reverse-mapping for <ip> exists
+					and correctly points to a domain name within a particular domain.
+					This mechanism SHOULD NOT be published.  See the note at the end of
+					this section for more information.
+
+					ptr              = "ptr"    [ ":" domain-spec ]
+
+				The reverse lookup depends on <ip>, so the mechanism is only
+				counted here and evaluated in CheckIP.
+			*/
+			err := spf.incDNSLookupCount(1)
+			if err != nil {
+				return err
 			}
 		}
+	case "ip4":
+		{
+			/*
+				RFC 7208 5.6
+					These mechanisms test whether <ip> is contained within a given
+					IP network.
+
+					ip4  = "ip4"   ":" ip4-network   [ ip4-cidr-length ]
+					ip4-cidr-length  = "/" ("0" / %x31-39 0*1DIGIT) ; value range 0-32
+			*/
+			ips := []string{directive.Arguments["ip"]}
+			ip_nets, err := GetRanges(ips, directive.Arguments["ip4-cidr"], directive.Arguments["ip6-cidr"])
+			if err != nil {
+				return err
+			}
+			spf.handleDirectiveNets(ip_nets, directive)
+		}
+	case "ip6":
+		{
+			/*
+				ip6  = "ip6"   ":" ip6-network   [ ip6-cidr-length ]
+				ip6-cidr-length  = "/" ("0" / %x31-39 0*2DIGIT) ; value range 0-128
+			*/
+			ips := []string{directive.Arguments["ip"]}
+			ip_nets, err := GetRanges(ips, directive.Arguments["ip4-cidr"], directive.Arguments["ip6-cidr"])
+			if err != nil {
+				return err
+			}
+			spf.handleDirectiveNets(ip_nets, directive)
+		}
+	case "exists":
+		{
+			/*
+				RFC 7208 5.7
+					The resulting domain name is used for a DNS A RR lookup
+					(even when the connection type is IPv6).
+					If any A record is returned, this mechanism matches.
+
+					exists           = "exists"   ":" domain-spec
+
+				NOTE: Macros are not implemented, so the outcome doesn't depend
+				on <ip> and a match authorizes every address that reaches it.
+			*/
+			domain, ok := directive.Arguments["domain"]
+			if !ok || domain == "" {
+				return &PermError{"No domain given for exists mechanism"}
+			}
+			err := spf.incDNSLookupCount(1)
+			if err != nil {
+				return err
+			}
+			ips, err := spf.dns.GetARecords(domain)
+			if err = spf.handleVoidLookup(len(ips), err); err != nil {
+				return err
+			}
+			if len(ips) == 0 {
+				return nil
+			}
+			ip_nets, err := GetRanges([]string{"0.0.0.0", "::"}, "0", "0")
+			if err != nil {
+				return err
+			}
+			spf.handleDirectiveNets(ip_nets, directive)
+		}
+	default:
+		{
 
+		}
 	}
 
 	return nil
-
 }
 
 func (spf *SPF) handleModifiers() error {
 	for _, modifier := range spf.modifiers {
+		start := spf.termStart(modifier.term)
+		err := spf.handleModifier(modifier)
+		spf.termEnd(modifier.term, start, err)
+		if err != nil {
+			return err
+		}
+	}
 
-		switch modifier.Key {
-		case "redirect":
-			{
-				/*
-					RFC 7208 6.1.
-						The "redirect" modifier is intended for consolidating both
-						authorizations and policy into a common set to be shared within a
-						single ADMD.  It is possible to control both authorized hosts and
-						policy for an arbitrary number of domains from a single record.
-
-						redirect         = "redirect" "=" domain-spec
-
-						If all mechanisms fail to match, and a "redirect" modifier is
-						present, then processing proceeds as follows:
-
-						The <domain-spec> portion of the redirect section is expanded as per
-						the macro rules in Section 7.  Then check_host() is evaluated with
-						the resulting string as the <domain>.  The <ip> and <sender>
-						arguments remain the same as in the current evaluation of
-						check_host().
-
-						The result of this new evaluation of check_host() is then considered
-						the result of the current evaluation with the exception that if no
-						SPF record is found, or if the <target-name> is malformed, the result
-						is a "permerror" rather than "none".
-
-						Note that the newly queried domain can itself specify redirect
-						processing.
-
-					NOTE: Macros are not implemented
-				*/
-				if spf.Redirect != nil {
-					return &PermError{"Duplicate redirect modifier"}
-				}
-				if modifier.Value == "" {
-					return &PermError{"No domain given for redirect modifier"}
-				}
-				redirect_spf, err := newSPF(modifier.Value, spf.dns, spf.dnsLookupCount, spf.voidLookupCount)
-				if err != nil {
-					return err
-				}
-				err = spf.incDNSLookupCount(redirect_spf.dnsLookupCount)
-				if err != nil {
-					return err
-				}
-				err = spf.incVoidLookupCount(redirect_spf.voidLookupCount)
-				if err != nil {
-					return err
-				}
-				spf.Redirect = redirect_spf
+	return nil
+}
 
+// handleModifier processes a modifier.
+func (spf *SPF) handleModifier(modifier Modifier) error {
+
+	switch modifier.Key {
+	case "redirect":
+		{
+			/*
+				RFC 7208 6.1.
+					The "redirect" modifier is intended for consolidating both
+					authorizations and policy into a common set to be shared within a
+					single ADMD.  It is possible to control both authorized hosts and
+					policy for an arbitrary number of domains from a single record.
+
+					redirect         = "redirect" "=" domain-spec
+
+					If all mechanisms fail to match, and a "redirect" modifier is
+					present, then processing proceeds as follows:
+
+					The <domain-spec> portion of the redirect section is expanded as per
+					the macro rules in Section 7.  Then check_host() is evaluated with
+					the resulting string as the <domain>.  The <ip> and <sender>
+					arguments remain the same as in the current evaluation of
+					check_host().
+
+					The result of this new evaluation of check_host() is then considered
+					the result of the current evaluation with the exception that if no
+					SPF record is found, or if the <target-name> is malformed, the result
+					is a "permerror" rather than "none".
+
+					Note that the newly queried domain can itself specify redirect
+					processing.
+
+				NOTE: Macros are not implemented
+			*/
+			if spf.Redirect != nil {
+				return &PermError{"Duplicate redirect modifier"}
 			}
-
-		case "exp":
-			{
-				/*
-					RFC 7208 6.2.
-						If check_host() results in a "fail" due to a mechanism match (such as
-						"-all"), and the "exp" modifier is present, then the explanation
-						string returned is computed as described below.  If no "exp" modifier
-						is present, then either a default explanation string or an empty
-						explanation string MUST be returned to the calling application.
-
-						The <domain-spec> is macro expanded (see Section 7) and becomes the
-						<target-name>.  The DNS TXT RRset for the <target-name> is fetched.
-
-						If there are any DNS processing errors (any RCODE other than 0), or
-						if no records are returned, or if more than one record is returned,
-						or if there are syntax errors in the explanation string, then proceed
-						as if no "exp" modifier was given.
-				*/
-				// TODO
+			if modifier.Value == "" {
+				return &PermError{"No domain given for redirect modifier"}
+			}
+			err := spf.incDNSLookupCount(1)
+			if err != nil {
+				return err
+			}
+			redirect_spf, err := spf.child("Redirect", modifier.Value)
+			if err != nil {
+				return noneToPermError(err)
+			}
+			err = spf.incDNSLookupCount(redirect_spf.dnsLookupCount - spf.dnsLookupCount)
+			if err != nil {
+				return err
 			}
+			err = spf.incVoidLookupCount(redirect_spf.voidLookupCount - spf.voidLookupCount)
+			if err != nil {
+				return err
+			}
+			spf.Redirect = redirect_spf
+
+		}
 
+	case "exp":
+		{
+			/*
+				RFC 7208 6.2.
+					If check_host() results in a "fail" due to a mechanism match (such as
+					"-all"), and the "exp" modifier is present, then the explanation
+					string returned is computed as described below.  If no "exp" modifier
+					is present, then either a default explanation string or an empty
+					explanation string MUST be returned to the calling application.
+
+					The <domain-spec> is macro expanded (see Section 7) and becomes the
+					<target-name>.  The DNS TXT RRset for the <target-name> is fetched.
+
+					If there are any DNS processing errors (any RCODE other than 0), or
+					if no records are returned, or if more than one record is returned,
+					or if there are syntax errors in the explanation string, then proceed
+					as if no "exp" modifier was given.
+			*/
+			// TODO
 		}
 
 	}
@@ -440,6 +687,7 @@ RFC 7208:
 func (s *SPF) incDNSLookupCount(amt int) error {
 	s.dnsLookupCount = s.dnsLookupCount + amt
 	if s.dnsLookupCount > DNSLookupLimit {
+		s.options.limitExceeded(s.Domain, "dns")
 		return &PermError{fmt.Sprintf("Domain %v exceeds max amount of dns queries: %v", s.Domain, DNSLookupLimit)}
 	}
 	return nil
@@ -459,12 +707,54 @@ RFC 7208:
 */
 func (s *SPF) incVoidLookupCount(amt int) error {
 	s.voidLookupCount = s.voidLookupCount + amt
-	if s.voidLookupCount >= VoidLookupLimit {
+	if s.voidLookupCount > VoidLookupLimit {
+		s.options.limitExceeded(s.Domain, "void")
 		return &PermError{fmt.Sprintf("Domain %v exceeds max amount of void lookups: %v", s.Domain, VoidLookupLimit)}
 	}
 	return nil
 }
 
+// lookupAddresses looks up the A and/or AAAA records of name,
+// depending on the address family the instance was created for.
+func (s *SPF) lookupAddresses(name string) ([]string, error) {
+	return lookupAddresses(s.dns, s.family, name)
+}
+
+func lookupAddresses(resolver dns.DnsResolver, family addressFamily, name string) ([]string, error) {
+	switch family {
+	case familyIPv4:
+		return resolver.GetARecords(name)
+	case familyIPv6:
+		return resolver.GetAAAARecords(name)
+	}
+
+	ips, err := resolver.GetARecords(name)
+	if err != nil && !dns.IsNotFound(err) {
+		return nil, err
+	}
+	ip6s, err6 := resolver.GetAAAARecords(name)
+	if err6 != nil && !dns.IsNotFound(err6) {
+		return nil, err6
+	}
+	ips = append(ips, ip6s...)
+	if err != nil && err6 != nil {
+		return ips, err
+	}
+	return ips, nil
+}
+
+// handleVoidLookup counts a lookup that returned no records (count == 0 or a
+// not found error) as a void lookup. Other lookup errors result in a TempError.
+func (s *SPF) handleVoidLookup(count int, err error) error {
+	if err != nil && !dns.IsNotFound(err) {
+		return &TempError{err.Error()}
+	}
+	if err != nil || count == 0 {
+		return s.incVoidLookupCount(1)
+	}
+	return nil
+}
+
 // PermError means the domain's published records could not be correctly interpreted.
 // These are described in RFC 7208 Section 8.7.
 type PermError struct {
@@ -479,6 +769,43 @@ func (l *PermError) String() string {
 	return l.Message
 }
 
+// TempError means a transient (generally DNS) error occurred during the check.
+// These are described in RFC 7208 Section 2.6.6.
+type TempError struct {
+	Message string
+}
+
+func (l *TempError) Error() string {
+	return "TempError"
+}
+
+func (l *TempError) String() string {
+	return l.Message
+}
+
+// NoneError means no SPF record was found for the domain.
+// This is described in RFC 7208 Section 2.6.1.
+type NoneError struct {
+	Message string
+}
+
+func (l *NoneError) Error() string {
+	return "None"
+}
+
+func (l *NoneError) String() string {
+	return l.Message
+}
+
+// noneToPermError turns a NoneError of an included or redirected domain
+// into a PermError, see the tables in RFC 7208 Sections 5.2 and 6.1.
+func noneToPermError(err error) error {
+	if none, ok := err.(*NoneError); ok {
+		return &PermError{none.Message}
+	}
+	return err
+}
+
 // GetRanges composes the CIDR IP ranges following RFC 4632 and RFC 4291
 // of the given IPs, with a given IPv4 CIDR and IPv6 CIDR
 func GetRanges(ips []string, ip4_cidr string, ip6_cidr string) ([]net.IPNet, error) {
@@ -569,75 +896,148 @@ CheckIP checks if the given IP is a valid sender
 	   definitely requires DNS operator intervention to be resolved.
 */
 func (spf *SPF) CheckIP(ip_str string) (string, error) {
-	ip := net.ParseIP(ip_str)
-	for _, ip_net := range spf.Fail {
-		if ip_net.Contains(ip) {
-			return "Fail", nil
-		}
+	evaluation, err := spf.Evaluate(ip_str)
+	if err != nil {
+		return "", err
 	}
-	for _, ip_net := range spf.SoftFail {
-		if ip_net.Contains(ip) {
-			return "SoftFail", nil
-		}
+	return evaluation.Result, nil
+}
+
+// Evaluation is the detailed outcome of checking an IP, see SPF.Evaluate.
+type Evaluation struct {
+	Result    string   // same as the result of CheckIP
+	Mechanism string   // matched mechanism, e.g. "ip4:192.0.2.0/24" or "-all", empty when none matched
+	Domain    string   // domain of the record containing Mechanism
+	Local     bool     // the result is from the local policy (see WithLocalPolicy), Mechanism is its term
+	BestGuess bool     // the result is from the best-guess record (see WithBestGuess)
+	Trace     []string // evaluation steps, e.g. "example.com: include:example.net matched"
+}
+
+func (e *Evaluation) tracef(format string, args ...interface{}) {
+	e.Trace = append(e.Trace, fmt.Sprintf(format, args...))
+}
+
+// match records the mechanism of domain that determined the result.
+func (e *Evaluation) match(domain string, mechanism string, result string) string {
+	e.Mechanism, e.Domain = mechanism, domain
+	e.tracef("%v: %v matched -> %v", domain, mechanism, result)
+	return result
+}
+
+// Evaluate checks the given IP like CheckIP, and also reports which
+// mechanism matched and the steps that led to the result.
+// For an include that matched, Mechanism is the include mechanism itself,
+// the mechanism of the included record that matched is in the Trace.
+// The local policy given with WithLocalPolicy is evaluated first.
+func (spf *SPF) Evaluate(ip_str string) (*Evaluation, error) {
+	if evaluation := spf.options.evaluateLocal(ip_str, spf.dns); evaluation != nil {
+		spf.options.observe(Event{Kind: ResultEvent, Domain: spf.Domain, IP: ip_str, Result: evaluation.Result, Term: evaluation.Mechanism})
+		return evaluation, nil
 	}
-	for _, ip_net := range spf.Neutral {
-		if ip_net.Contains(ip) {
-			return "Neutral", nil
-		}
+	return spf.evaluatePublished(ip_str)
+}
+
+// evaluatePublished evaluates the published policy, without the local policy.
+func (spf *SPF) evaluatePublished(ip_str string) (*Evaluation, error) {
+	evaluation := &Evaluation{Trace: make([]string, 0), BestGuess: spf.BestGuess}
+	if spf.BestGuess {
+		evaluation.tracef("%v: no SPF record, evaluating the best guess", spf.Domain)
 	}
-	for _, ip_net := range spf.Pass {
-		if ip_net.Contains(ip) {
-			return "Pass", nil
-		}
+	result, err := spf.evaluate(ip_str, evaluation)
+	if err != nil && spf.BestGuess {
+		_, problem := errorToResult(err)
+		evaluation.tracef("%v: best guess failed: %v", spf.Domain, problem)
+		result, err = "None", nil
+		evaluation.BestGuess = false
 	}
+	if err != nil {
+		spf.options.observe(Event{Kind: ResultEvent, Domain: spf.Domain, IP: ip_str, Result: err.Error(), Err: err})
+		return nil, err
+	}
+	evaluation.Result = result
+	if result == "None" {
+		evaluation.Mechanism, evaluation.Domain = "", ""
+	}
+	spf.options.observe(Event{Kind: ResultEvent, Domain: spf.Domain, IP: ip_str, Result: result, Term: evaluation.Mechanism})
+	return evaluation, nil
+}
 
-	for _, include := range spf.Includes {
-		/*
-			RFC 7208 5.2
-				The "include" mechanism triggers a recursive evaluation of
-				check_host().
-
-				1.  The <domain-spec> is expanded as per Section 7.
-
-				2.  check_host() is evaluated with the resulting string as the
-					<domain>.  The <ip> and <sender> arguments remain the same as in
-					the current evaluation of check_host().
-
-				3.  The recursive evaluation returns match, not-match, or an error.
-
-				4.  If it returns match, then the appropriate result for the
-					"include" mechanism is used (e.g., include or +include produces a
-					"pass" result and -include produces "fail").
-
-				5.  If it returns not-match or an error, the parent check_host()
-					resumes processing as per the table below, with the previous
-					value of <domain> restored.
-
-				+---------------------------------+---------------------------------+
-				| A recursive check_host() result | Causes the "include" mechanism  |
-				| of:                             | to:                             |
-				+---------------------------------+---------------------------------+
-				| pass                            | match                           |
-				|                                 |                                 |
-				| fail                            | not match                       |
-				|                                 |                                 |
-				| softfail                        | not match                       |
-				|                                 |                                 |
-				| neutral                         | not match                       |
-				|                                 |                                 |
-				| temperror                       | return temperror                |
-				|                                 |                                 |
-				| permerror                       | return permerror                |
-				|                                 |                                 |
-				| none                            | return permerror                |
-				+---------------------------------+---------------------------------+
-		*/
-		check, err := include.spf.CheckIP(ip_str)
-		if err != nil {
-			return "", nil
-		}
-		if check == "Pass" {
-			return qualifierToResult(include.qualifier), nil
+func (spf *SPF) evaluate(ip_str string, evaluation *Evaluation) (string, error) {
+	ip := net.ParseIP(ip_str)
+	for _, m := range spf.mechanisms {
+		result := qualifierToResult(m.directive.Qualifier)
+		switch m.directive.Mechanism {
+		case "all":
+			return evaluation.match(spf.Domain, m.directive.term, result), nil
+		case "ptr":
+			start := spf.termStart(m.directive.term)
+			match, err := spf.checkPTR(ip, m.directive)
+			spf.termEnd(m.directive.term, start, err)
+			if err != nil {
+				return "", err
+			}
+			if match {
+				return evaluation.match(spf.Domain, m.directive.term, result), nil
+			}
+		case "include":
+			/*
+				RFC 7208 5.2
+					The "include" mechanism triggers a recursive evaluation of
+					check_host().
+
+					1.  The <domain-spec> is expanded as per Section 7.
+
+					2.  check_host() is evaluated with the resulting string as the
+						<domain>.  The <ip> and <sender> arguments remain the same as in
+						the current evaluation of check_host().
+
+					3.  The recursive evaluation returns match, not-match, or an error.
+
+					4.  If it returns match, then the appropriate result for the
+						"include" mechanism is used (e.g., include or +include produces a
+						"pass" result and -include produces "fail").
+
+					5.  If it returns not-match or an error, the parent check_host()
+						resumes processing as per the table below, with the previous
+						value of <domain> restored.
+
+					+---------------------------------+---------------------------------+
+					| A recursive check_host() result | Causes the "include" mechanism  |
+					| of:                             | to:                             |
+					+---------------------------------+---------------------------------+
+					| pass                            | match                           |
+					|                                 |                                 |
+					| fail                            | not match                       |
+					|                                 |                                 |
+					| softfail                        | not match                       |
+					|                                 |                                 |
+					| neutral                         | not match                       |
+					|                                 |                                 |
+					| temperror                       | return temperror                |
+					|                                 |                                 |
+					| permerror                       | return permerror                |
+					|                                 |                                 |
+					| none                            | return permerror                |
+					+---------------------------------+---------------------------------+
+			*/
+			include := spf.Includes[m.include]
+			evaluation.tracef("%v: evaluating %v", spf.Domain, include.Term)
+			start := spf.termStart(include.Term)
+			check, err := include.SPF.evaluate(ip_str, evaluation)
+			spf.termEnd(include.Term, start, err)
+			if err != nil {
+				return "", err
+			}
+			if check == "Pass" {
+				return evaluation.match(spf.Domain, include.Term, result), nil
+			}
+			evaluation.tracef("%v: %v not matched (%v)", spf.Domain, include.Term, check)
+		default:
+			for _, ip_net := range m.nets {
+				if ip_net.Contains(ip) {
+					return evaluation.match(spf.Domain, m.directive.term, result), nil
+				}
+			}
 		}
 	}
 
@@ -650,16 +1050,98 @@ func (spf *SPF) CheckIP(ip_str string) (string, error) {
 	*/
 	if spf.All == "undefined" {
 		if spf.Redirect != nil {
-			return spf.Redirect.CheckIP(ip_str)
+			evaluation.tracef("%v: redirect=%v", spf.Domain, spf.Redirect.Domain)
+			return spf.Redirect.evaluate(ip_str, evaluation)
 		}
 	}
 
-	// No results found -> check all
-	if spf.All != "undefined" {
-		return qualifierToResult(spf.All), nil
+	/*
+		RFC 7208 4.7.
+			If none of the mechanisms match and there is no "redirect" modifier,
+			then the check_host() returns a result of "neutral", just as if
+			"?all" were specified as the last directive.
+	*/
+	evaluation.Mechanism, evaluation.Domain = "", ""
+	evaluation.tracef("%v: no mechanism matched", spf.Domain)
+	return "Neutral", nil
+}
+
+/*
+checkPTR evaluates a ptr mechanism for the given IP.
+
+	RFC 7208 5.5
+		The <ip>'s name is looked up using this procedure:
+
+		o  Perform a DNS reverse-mapping for <ip>: Look up the corresponding
+		   PTR record in "in-addr.arpa." if the address is an IPv4 address
+		   and in "ip6.arpa." if it is an IPv6 address.
+
+		o  For each record returned, validate the domain name by looking up
+		   its IP addresses.  To prevent DoS attacks, the PTR processing
+		   limits per Section 4.6.4 MUST be applied.  If they are exceeded,
+		   processing is terminated and the mechanism does not match.
+
+		o  If <ip> is among the returned IP addresses, then that domain name
+		   is validated.
+
+		Check all validated domain names to see if they either match the
+		<target-name> domain or are a subdomain of the <target-name> domain.
+		If any do, this mechanism matches.  If no validated domain name can
+		be found, or if none of the validated domain names match or are a
+		subdomain of the <target-name>, this mechanism fails to match.  If a
+		DNS error occurs while doing the PTR RR lookup, then this mechanism
+		fails to match.
+*/
+func (spf *SPF) checkPTR(ip net.IP, ptr Directive) (bool, error) {
+	target := spf.Domain
+	if d, ok := ptr.Arguments["domain"]; ok && d != "" {
+		target = d
+	}
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+
+	names, err := spf.dns.GetPTRRecords(ip.String())
+	if errors.Is(err, errNoResolver) {
+		// a restored instance can't tell whether the mechanism matches
+		return false, &TempError{fmt.Sprintf("%v: %v can't be evaluated: %v", spf.Domain, ptr.term, err)}
+	}
+	if err != nil && !dns.IsNotFound(err) {
+		return false, nil
+	}
+	if len(names) == 0 {
+		// CheckIP doesn't modify the instance, so the void lookup is only
+		// checked against the count collected while constructing it.
+		if spf.voidLookupCount+1 > VoidLookupLimit {
+			spf.options.limitExceeded(spf.Domain, "void")
+			return false, &PermError{fmt.Sprintf("Domain %v exceeds max amount of void lookups: %v", spf.Domain, VoidLookupLimit)}
+		}
+		return false, nil
+	}
+	if len(names) > DNSLookupLimit {
+		names = names[:DNSLookupLimit]
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		var addrs []string
+		if ip.To4() != nil {
+			addrs, err = spf.dns.GetARecords(name)
+		} else {
+			addrs, err = spf.dns.GetAAAARecords(name)
+		}
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ip.Equal(net.ParseIP(addr)) {
+				return true, nil
+			}
+		}
 	}
 
-	return "None", nil
+	return false, nil
 }
 
 func qualifierToResult(qualifier string) string {
@@ -704,8 +1186,8 @@ func (spf SPF) toString(prefix string) string {
 	out += func() string {
 		out := ""
 		for _, i := range spf.Includes {
-			out += i.qualifier
-			out += i.spf.toString(prefix + "    ")
+			out += i.Qualifier
+			out += i.SPF.toString(prefix + "    ")
 		}
 		return out
 	}()
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mistralmail/gospf/dns"
 )
@@ -25,6 +28,13 @@ func TestHandleIPNets(t *testing.T) {
 		spf.handleIPNets(ip_net, "-")
 		So(len(spf.Fail), ShouldEqual, 2)
 
+		// overlapping and adjacent networks are merged
+		ip_net, err = GetRanges([]string{"69.208.0.0", "69.208.1.0", "1.1.1.1"}, "24", "")
+		So(err, ShouldEqual, nil)
+		spf.handleIPNets(ip_net, "+")
+		So(len(spf.Pass), ShouldEqual, 2)
+		So(spf.Pass[1].String(), ShouldEqual, "69.208.0.0/23")
+
 	})
 }
 
@@ -153,6 +163,15 @@ func runSPFTest(testName string, t *testing.T, tests []SPFTestParams) {
 				continue
 			}
 			So(check, ShouldEqual, test.Want)
+
+			// prefetching must not change the result or the counts
+			prefetched, err := New(test.Domain, testResolver, WithConcurrency(4))
+			So(err, ShouldEqual, nil)
+			So(prefetched.dnsLookupCount, ShouldEqual, spf.dnsLookupCount)
+			So(prefetched.voidLookupCount, ShouldEqual, spf.voidLookupCount)
+			check, err = prefetched.CheckIP(test.IP)
+			So(err, ShouldEqual, nil)
+			So(check, ShouldEqual, test.Want)
 		}
 	})
 }
@@ -218,7 +237,12 @@ func TestTooManyLookups(t *testing.T) {
 			Want:   "PermError",
 		},
 		{
-			Domain: "too-many-a-records.example.com",
+			Domain: "too-many-mx-records.example.com",
+			IP:     "1.2.3.1",
+			Want:   "PermError",
+		},
+		{
+			Domain: "too-many-lookups.example.com",
 			IP:     "1.1.1.1",
 			Want:   "PermError",
 		},
@@ -244,6 +268,18 @@ func TestADirective(t *testing.T) {
 
 func TestMXDirective(t *testing.T) {
 	tests := []SPFTestParams{
+		{
+			// Only the number of MX names is limited, not the number of
+			// addresses of a single MX host.
+			Domain: "too-many-a-records.example.com",
+			IP:     "1.1.1.12",
+			Want:   "Pass",
+		},
+		{
+			Domain: "mx-check.example.com",
+			IP:     "aaaa::1",
+			Want:   "Pass",
+		},
 		{
 			Domain: "mx-check.example.com",
 			IP:     "1.2.3.1",
@@ -325,17 +361,556 @@ func TestQualifiers(t *testing.T) {
 	runSPFTest("Testing qualifiers", t, tests)
 }
 
+func TestFirstMatch(t *testing.T) {
+	tests := []SPFTestParams{
+		{
+			Domain: "order.example.com",
+			IP:     "1.1.1.1",
+			Want:   "Pass",
+		},
+		{
+			Domain: "order.example.com",
+			IP:     "2.2.2.2",
+			Want:   "Fail",
+		},
+		{
+			Domain: "reverse-order.example.com",
+			IP:     "1.1.1.1",
+			Want:   "Fail",
+		},
+		{
+			Domain: "reverse-order.example.com",
+			IP:     "1.1.1.2",
+			Want:   "Pass",
+		},
+		{
+			Domain: "all-first.example.com",
+			IP:     "1.1.1.1",
+			Want:   "Fail",
+		},
+		{
+			Domain: "no-all.example.com",
+			IP:     "2.2.2.2",
+			Want:   "Neutral",
+		},
+	}
+	runSPFTest("Testing first match evaluation", t, tests)
+}
+
 func TestNonexistentSPF(t *testing.T) {
 	tests := []SPFTestParams{
 		{
 			Domain: "nonexistent.example.com",
 			IP:     "1.1.1.1",
+			Want:   "None",
+		},
+		{
+			Domain: "no-spf.example.com",
+			IP:     "1.1.1.1",
+			Want:   "None",
+		},
+		{
+			Domain: "spf10.example.com",
+			IP:     "1.1.1.1",
+			Want:   "None",
+		},
+		{
+			Domain: "include-none.example.com",
+			IP:     "1.1.1.1",
+			Want:   "PermError",
+		},
+		{
+			Domain: "redirect-none.example.com",
+			IP:     "1.1.1.1",
 			Want:   "PermError",
 		},
 	}
 	runSPFTest("Testing nonexistent SPF record", t, tests)
 }
 
+func TestMultipleSPFRecords(t *testing.T) {
+	tests := []SPFTestParams{
+		{
+			Domain: "multiple.example.com",
+			IP:     "1.1.1.1",
+			Want:   "PermError",
+		},
+		{
+			Domain: "multi-string.example.com",
+			IP:     "1.1.1.1",
+			Want:   "Pass",
+		},
+		{
+			Domain: "multi-string.example.com",
+			IP:     "2.2.2.2",
+			Want:   "Fail",
+		},
+	}
+	runSPFTest("Testing multiple SPF records", t, tests)
+}
+
+func TestVoidLookups(t *testing.T) {
+	tests := []SPFTestParams{
+		{
+			Domain: "two-void.example.com",
+			IP:     "1.1.1.1",
+			Want:   "Pass",
+		},
+		{
+			Domain: "two-void.example.com",
+			IP:     "2.2.2.2",
+			Want:   "Fail",
+		},
+		{
+			Domain: "three-void.example.com",
+			IP:     "1.1.1.1",
+			Want:   "PermError",
+		},
+		{
+			Domain: "void-include.example.com",
+			IP:     "1.1.1.1",
+			Want:   "PermError",
+		},
+		{
+			Domain: "void-redirect.example.com",
+			IP:     "1.1.1.1",
+			Want:   "PermError",
+		},
+		{
+			Domain: "ptr-void.example.com",
+			IP:     "1.1.1.1",
+			Want:   "PermError",
+		},
+	}
+	runSPFTest("Testing void lookups", t, tests)
+
+	Convey("Testing void lookup counter", t, func() {
+		spf, err := New("two-void.example.com", &TestResolver{})
+		So(err, ShouldEqual, nil)
+		So(spf.VoidLookupCount(), ShouldEqual, 2)
+		So(spf.DNSLookupCount(), ShouldEqual, 2)
+	})
+}
+
+func TestExistsDirective(t *testing.T) {
+	tests := []SPFTestParams{
+		{
+			Domain: "exists.example.com",
+			IP:     "8.8.8.8",
+			Want:   "Pass",
+		},
+		{
+			Domain: "exists.example.com",
+			IP:     "aaaa::5",
+			Want:   "Pass",
+		},
+		{
+			// a matching exists only applies to the addresses that reach it
+			Domain: "late-exists.example.com",
+			IP:     "8.8.8.8",
+			Want:   "Fail",
+		},
+		{
+			Domain: "late-exists.example.com",
+			IP:     "8.8.4.4",
+			Want:   "Pass",
+		},
+	}
+	runSPFTest("Testing exists directive", t, tests)
+}
+
+func TestPTRDirective(t *testing.T) {
+	tests := []SPFTestParams{
+		{
+			Domain: "ptr.example.com",
+			IP:     "1.2.3.10",
+			Want:   "Pass",
+		},
+		{
+			Domain: "ptr.example.com",
+			IP:     "1.2.3.11",
+			Want:   "Fail",
+		},
+		{
+			Domain: "ptr.example.com",
+			IP:     "8.8.8.8",
+			Want:   "Fail",
+		},
+	}
+	runSPFTest("Testing PTR directive", t, tests)
+}
+
+// familyResolver records which address record types were queried
+type familyResolver struct {
+	TestResolver
+	queried map[string]int
+}
+
+func (r *familyResolver) GetARecords(domain string) ([]string, error) {
+	r.queried["A"]++
+	return r.TestResolver.GetARecords(domain)
+}
+
+func (r *familyResolver) GetAAAARecords(domain string) ([]string, error) {
+	r.queried["AAAA"]++
+	return r.TestResolver.GetAAAARecords(domain)
+}
+
+func TestNewForIP(t *testing.T) {
+	Convey("Testing NewForIP()", t, func() {
+		tests := []struct {
+			ip      string
+			want    string
+			queried string
+		}{
+			{ip: "1.2.3.1", want: "Pass", queried: "A"},
+			{ip: "::ffff:1.2.3.1", want: "Pass", queried: "A"},
+			{ip: "aaaa::1", want: "Pass", queried: "AAAA"},
+			{ip: "8.8.8.8", want: "SoftFail", queried: "A"},
+		}
+
+		for _, test := range tests {
+			resolver := &familyResolver{queried: map[string]int{}}
+			spf, err := NewForIP("mx-check.example.com", test.ip, resolver)
+			So(err, ShouldEqual, nil)
+			So(len(resolver.queried), ShouldEqual, 1)
+			So(resolver.queried[test.queried], ShouldBeGreaterThan, 0)
+			check, err := spf.CheckIP(test.ip)
+			So(err, ShouldEqual, nil)
+			So(check, ShouldEqual, test.want)
+		}
+
+		_, err := NewForIP("mx-check.example.com", "not-an-ip", &TestResolver{})
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+const failureZone = `
+$ORIGIN example.org.
+@        TXT  "v=spf1 a:host.example.org mx include:_spf.example.org -all"
+host     A    192.0.2.1
+         MX   10 mx
+mx       A    192.0.2.2
+_spf     TXT  "v=spf1 ip4:198.51.100.0/24 -all"
+`
+
+func TestTempError(t *testing.T) {
+	Convey("Testing DNS failures with a zone resolver", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(failureZone), ""), ShouldEqual, nil)
+
+		spf, err := New("example.org", z)
+		So(err, ShouldEqual, nil)
+		check, err := spf.CheckIP("198.51.100.7")
+		So(err, ShouldEqual, nil)
+		So(check, ShouldEqual, "Pass")
+
+		z.Fail("example.org", dns.ServFail)
+		_, err = New("example.org", z)
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldEqual, "TempError")
+
+		z.ClearFailures()
+		z.FailType("host.example.org", "A", dns.Timeout)
+		_, err = NewForIP("example.org", "192.0.2.1", z)
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldEqual, "TempError")
+
+		z.ClearFailures()
+		z.Fail("_spf.example.org", dns.ServFail)
+		_, err = New("example.org", z)
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldEqual, "TempError")
+
+		z.ClearFailures()
+		z.Fail("_spf.example.org", dns.NXDomain)
+		_, err = New("example.org", z)
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldEqual, "PermError")
+
+		z.ClearFailures()
+		z.Fail("example.org", dns.NXDomain)
+		_, err = New("example.org", z)
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldEqual, "None")
+	})
+}
+
+func TestEvaluate(t *testing.T) {
+	Convey("Testing SPF.Evaluate()", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(failureZone), ""), ShouldEqual, nil)
+		spf, err := NewForIP("example.org", "192.0.2.1", z)
+		So(err, ShouldEqual, nil)
+
+		tests := []struct {
+			ip        string
+			result    string
+			mechanism string
+		}{
+			{"192.0.2.1", "Pass", "a:host.example.org"},
+			{"198.51.100.7", "Pass", "include:_spf.example.org"},
+			{"203.0.113.1", "Fail", "-all"},
+		}
+		for _, test := range tests {
+			evaluation, err := spf.Evaluate(test.ip)
+			So(err, ShouldEqual, nil)
+			So(evaluation.Result, ShouldEqual, test.result)
+			So(evaluation.Mechanism, ShouldEqual, test.mechanism)
+			So(evaluation.Domain, ShouldEqual, "example.org")
+		}
+
+		evaluation, err := spf.Evaluate("203.0.113.1")
+		So(err, ShouldEqual, nil)
+		So(evaluation.Trace, ShouldResemble, []string{
+			"example.org: evaluating include:_spf.example.org",
+			"_spf.example.org: -all matched -> Fail",
+			"example.org: include:_spf.example.org not matched (Fail)",
+			"example.org: -all matched -> Fail",
+		})
+	})
+}
+
+const prefetchZone = `
+$ORIGIN example.net.
+@        TXT  "v=spf1 include:a.example.net include:b.example.net include:c.example.net include:d.example.net mx -all"
+         MX   10 mx1
+         MX   20 mx2
+mx1      A    192.0.2.1
+mx2      A    192.0.2.2
+a        TXT  "v=spf1 a:host.example.net -all"
+b        TXT  "v=spf1 ip4:198.51.100.0/24 -all"
+c        TXT  "v=spf1 exists:host.example.net -all"
+d        TXT  "v=spf1 redirect=b.example.net"
+order    TXT  "v=spf1 ip4:1.1.1.0/24 -ip4:1.1.1.1 include:b.example.net -all"
+host     A    203.0.113.1
+`
+
+// slowResolver delays every query and records the maximum number of queries in flight.
+type slowResolver struct {
+	dns.DnsResolver
+	delay    time.Duration
+	mu       sync.Mutex
+	inFlight int
+	max      int
+	queries  int
+}
+
+func (r *slowResolver) wait() {
+	r.mu.Lock()
+	r.inFlight++
+	r.queries++
+	if r.inFlight > r.max {
+		r.max = r.inFlight
+	}
+	r.mu.Unlock()
+	time.Sleep(r.delay)
+	r.mu.Lock()
+	r.inFlight--
+	r.mu.Unlock()
+}
+
+func (r *slowResolver) GetSPFRecord(name string) (string, error) {
+	r.wait()
+	return r.DnsResolver.GetSPFRecord(name)
+}
+
+func (r *slowResolver) GetARecords(name string) ([]string, error) {
+	r.wait()
+	return r.DnsResolver.GetARecords(name)
+}
+
+func (r *slowResolver) GetAAAARecords(name string) ([]string, error) {
+	r.wait()
+	return r.DnsResolver.GetAAAARecords(name)
+}
+
+func (r *slowResolver) GetMXRecords(name string) ([]*net.MX, error) {
+	r.wait()
+	return r.DnsResolver.GetMXRecords(name)
+}
+
+// panickingResolver panics on the SPF lookups of name, once release is closed.
+type panickingResolver struct {
+	dns.DnsResolver
+	name    string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *panickingResolver) GetSPFRecord(name string) (string, error) {
+	if name != r.name {
+		return r.DnsResolver.GetSPFRecord(name)
+	}
+	if r.started != nil {
+		close(r.started)
+		<-r.release
+	}
+	panic("resolver bug")
+}
+
+func TestConcurrency(t *testing.T) {
+	Convey("Testing WithConcurrency()", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(prefetchZone), ""), ShouldEqual, nil)
+
+		r := &slowResolver{DnsResolver: z, delay: 20 * time.Millisecond}
+		start := time.Now()
+		sequential, err := NewForIP("example.net", "192.0.2.1", r)
+		So(err, ShouldEqual, nil)
+		sequentialTime := time.Since(start)
+		So(r.max, ShouldEqual, 1)
+
+		r = &slowResolver{DnsResolver: z, delay: 20 * time.Millisecond}
+		start = time.Now()
+		prefetched, err := NewForIP("example.net", "192.0.2.1", r, WithConcurrency(3))
+		So(err, ShouldEqual, nil)
+		So(time.Since(start), ShouldBeLessThan, sequentialTime/2)
+		So(r.max, ShouldBeBetweenOrEqual, 2, 3)
+
+		So(prefetched.dnsLookupCount, ShouldEqual, sequential.dnsLookupCount)
+		So(prefetched.voidLookupCount, ShouldEqual, sequential.voidLookupCount)
+		for _, ip := range []string{"192.0.2.1", "192.0.2.2", "198.51.100.7", "203.0.113.1", "203.0.113.2"} {
+			want, err := sequential.Evaluate(ip)
+			So(err, ShouldEqual, nil)
+			got, err := prefetched.Evaluate(ip)
+			So(err, ShouldEqual, nil)
+			So(got, ShouldResemble, want)
+		}
+
+		// the result is still the first match in record order
+		for _, n := range []int{1, 4} {
+			spf, err := NewForIP("order.example.net", "1.1.1.1", z, WithConcurrency(n))
+			So(err, ShouldEqual, nil)
+			check, err := spf.CheckIP("1.1.1.1")
+			So(err, ShouldEqual, nil)
+			So(check, ShouldEqual, "Pass")
+		}
+
+		// a panicking resolver fails the queries waiting for the same answer
+		panicking := &panickingResolver{DnsResolver: z, name: "b.example.net", started: make(chan struct{}), release: make(chan struct{})}
+		memo := newMemoResolver(panicking)
+		recovered := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				recovered <- recover()
+			}()
+			memo.GetSPFRecord("b.example.net")
+		}()
+		<-panicking.started
+		waited := make(chan error, 1)
+		go func() {
+			_, err := memo.GetSPFRecord("b.example.net")
+			waited <- err
+		}()
+		close(panicking.release)
+		So(<-recovered, ShouldEqual, "resolver bug")
+		err = <-waited
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldEqual, "SPF query of b.example.net panicked: resolver bug")
+
+		// and the policy gets the error when it's prefetched
+		_, err = NewForIP("example.net", "192.0.2.1", &panickingResolver{DnsResolver: z, name: "b.example.net"}, WithConcurrency(3))
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldEqual, "TempError")
+
+		z.FailType("b.example.net", "TXT", dns.ServFail)
+		_, err = NewForIP("example.net", "192.0.2.1", z, WithConcurrency(3))
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldEqual, "TempError")
+	})
+}
+
+func TestGroup(t *testing.T) {
+	Convey("Testing WithGroup()", t, func() {
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(prefetchZone), ""), ShouldEqual, nil)
+		r := &slowResolver{DnsResolver: z, delay: 20 * time.Millisecond}
+		sequential, err := New("example.net", r)
+		So(err, ShouldEqual, nil)
+		queries := r.queries
+
+		r = &slowResolver{DnsResolver: z, delay: 20 * time.Millisecond}
+		group := &Group{}
+		var wg sync.WaitGroup
+		spfs := make([]*SPF, 10)
+		errs := make([]error, 10)
+		results := make([]int, 10)
+		for i := range spfs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				observer := ObserverFunc(func(e Event) {
+					if e.Kind == ResultEvent {
+						results[i]++
+					}
+				})
+				spfs[i], errs[i] = New("Example.net", r, WithGroup(group), WithObserver(observer))
+			}(i)
+		}
+		wg.Wait()
+		So(r.queries, ShouldEqual, queries)
+
+		for i, spf := range spfs {
+			So(errs[i], ShouldEqual, nil)
+			for j := 0; j < i; j++ {
+				So(spf, ShouldNotPointTo, spfs[j])
+			}
+			So(spf.DNSLookupCount(), ShouldEqual, sequential.DNSLookupCount())
+			check, err := spf.CheckIP("198.51.100.7")
+			So(err, ShouldEqual, nil)
+			So(check, ShouldEqual, "Pass")
+			So(results[i], ShouldEqual, 1)
+		}
+
+		z.FailType("b.example.net", "TXT", dns.ServFail)
+		_, err = New("example.net", z, WithGroup(group))
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldEqual, "TempError")
+	})
+}
+
+func TestObserver(t *testing.T) {
+	Convey("Testing WithObserver()", t, func() {
+		events := make([]Event, 0)
+		observer := ObserverFunc(func(e Event) {
+			events = append(events, e)
+		})
+
+		z := dns.NewZoneResolver()
+		So(z.Load(strings.NewReader(failureZone), ""), ShouldEqual, nil)
+		spf, err := NewForIP("example.org", "198.51.100.7", z, WithObserver(observer))
+		So(err, ShouldEqual, nil)
+		So(events[0], ShouldResemble, Event{Kind: DNSQuery, QType: "TXT", Name: "example.org"})
+		So(events[2].Kind, ShouldEqual, TermStart)
+		So(events[2].Term, ShouldEqual, "a:host.example.org")
+
+		events = events[:0]
+		check, err := spf.CheckIP("198.51.100.7")
+		So(err, ShouldEqual, nil)
+		So(check, ShouldEqual, "Pass")
+		kinds := make([]EventKind, 0)
+		for _, e := range events {
+			kinds = append(kinds, e.Kind)
+		}
+		So(kinds, ShouldResemble, []EventKind{TermStart, TermEnd, ResultEvent})
+		So(events[2].Result, ShouldEqual, "Pass")
+		So(events[2].Term, ShouldEqual, "include:_spf.example.org")
+
+		events = events[:0]
+		_, err = New("three-void.example.com", &TestResolver{}, WithObserver(observer))
+		So(err, ShouldNotEqual, nil)
+		limits := 0
+		for _, e := range events {
+			if e.Kind == LimitExceeded {
+				limits++
+				So(e.Name, ShouldEqual, "void")
+			}
+		}
+		So(limits, ShouldEqual, 1)
+	})
+}
+
 // Tests functions that don't actually need test coverage so they
 // are not counted against the coverage percentage by `go test -cover`
 //
@@ -352,6 +927,14 @@ func TestCoverage(t *testing.T) {
 	// PermError.String
 	p := PermError{}
 	_ = p.String()
+
+	// TempError.String
+	te := TempError{}
+	_ = te.String()
+
+	// NoneError.String
+	n := NoneError{}
+	_ = n.String()
 }
 
 // Fixtures for SPF processing and recursion
@@ -368,20 +951,50 @@ var txtRecords = map[string][]string{
 	"_spf.example.com": []string{"v=spf1 include:spf1.example.com " +
 		"include:spf2.example.com " +
 		"include:spf3.example.com"},
-	"spf1.example.com":               []string{"v=spf1 ip4:1.1.1.1/24 ~all"},
-	"spf2.example.com":               []string{"v=spf1 ip4:1.1.2.1/24 ip4:1.1.3.1/24 ip4:1.1.4.1/24 ~all"},
-	"spf3.example.com":               []string{"v=spf1 ip6:1111::1/48 ~all"},
-	"matchall.example.com":           []string{"v=spf1 ip4:0.0.0.0/0 ip6:0::1/0 -all"},
-	"recursive.example.com":          []string{"v=spf1 include:example.com include:recursive.example.com -all"},
-	"too-many-a-records.example.com": []string{"v=spf1 mx -all"},
-	"mx-check.example.com":           []string{"v=spf1 mx:example.com ~all"},
-	"redirect.example.com":           []string{"v=spf1 redirect=example.com"},
-	"ignore-redirect.example.com":    []string{"v=spf1 ip4:3.3.3.3/32 redirect=example.com -all"},
+	"spf1.example.com":                []string{"v=spf1 ip4:1.1.1.1/24 ~all"},
+	"spf2.example.com":                []string{"v=spf1 ip4:1.1.2.1/24 ip4:1.1.3.1/24 ip4:1.1.4.1/24 ~all"},
+	"spf3.example.com":                []string{"v=spf1 ip6:1111::1/48 ~all"},
+	"matchall.example.com":            []string{"v=spf1 ip4:0.0.0.0/0 ip6:0::1/0 -all"},
+	"recursive.example.com":           []string{"v=spf1 include:example.com include:recursive.example.com -all"},
+	"too-many-a-records.example.com":  []string{"v=spf1 mx -all"},
+	"too-many-mx-records.example.com": []string{"v=spf1 mx -all"},
+	"too-many-lookups.example.com": []string{"v=spf1 mx:example.com mx:example.com mx:example.com " +
+		"mx:example.com mx:example.com mx:example.com mx:example.com mx:example.com " +
+		"mx:example.com mx:example.com mx:example.com -all"},
+	"mx-check.example.com":        []string{"v=spf1 mx:example.com ~all"},
+	"redirect.example.com":        []string{"v=spf1 redirect=example.com"},
+	"ignore-redirect.example.com": []string{"v=spf1 ip4:3.3.3.3/32 redirect=example.com -all"},
 	"dup-redirect.example.com": []string{"v=spf1 ip4:3.3.3.3/32 redirect=example.com " +
 		"redirect=example.com -all"},
 	"blank-redirect.example.com": []string{"v=spf1 ip4:3.3.3.3/32 redirect="},
 	"a.example.com":              []string{"v=spf1 a:example.com -all"},
 	"reject.example.com":         []string{"v=spf1 -ip4:1.1.1.1 ~ip4:2.2.2.2 ?ip4:3.3.3.3 +ip4:4.4.4.4 ?all"},
+	"order.example.com":          []string{"v=spf1 ip4:1.1.1.0/24 -ip4:1.1.1.1 -all"},
+	"reverse-order.example.com":  []string{"v=spf1 -ip4:1.1.1.1 ip4:1.1.1.0/24 -all"},
+	"all-first.example.com":      []string{"v=spf1 -all ip4:1.1.1.1"},
+	"no-all.example.com":         []string{"v=spf1 ip4:1.1.1.1"},
+	"two-void.example.com":       []string{"v=spf1 a:void1.example.com mx:void2.example.com ip4:1.1.1.1 -all"},
+	"three-void.example.com": []string{"v=spf1 a:void1.example.com mx:void2.example.com " +
+		"exists:void3.example.com ip4:1.1.1.1 -all"},
+	"void-include.example.com":  []string{"v=spf1 a:void1.example.com exists:void2.example.com include:void3.example.com -all"},
+	"void-redirect.example.com": []string{"v=spf1 a:void1.example.com exists:void2.example.com redirect=void3.example.com"},
+	"exists.example.com":        []string{"v=spf1 exists:test.com -all"},
+	"late-exists.example.com":   []string{"v=spf1 -ip4:8.8.8.8 exists:test.com -all"},
+	"ptr.example.com":           []string{"v=spf1 ptr -all"},
+	"ptr-void.example.com":      []string{"v=spf1 a:void1.example.com a:void2.example.com ptr ~all"},
+	"no-spf.example.com":        []string{"google-site-verification=abc"},
+	"spf10.example.com":         []string{"v=spf10 ip4:1.1.1.1 -all"},
+	"include-none.example.com":  []string{"v=spf1 include:no-spf.example.com -all"},
+	"redirect-none.example.com": []string{"v=spf1 redirect=no-spf.example.com"},
+	"multiple.example.com":      []string{"v=spf1 ip4:1.1.1.1 -all", "v=spf1 ip4:2.2.2.2 -all"},
+}
+
+// TXT records consisting of multiple character-strings
+var multiStringTXTRecords = map[string][][]string{
+	"multi-string.example.com": [][]string{
+		[]string{"v=spf1 ip4:3.3.3.3 ", "ip4:1.1.1.1 -all"},
+		[]string{"some other record"},
+	},
 }
 
 var mxRecords = map[string][]*net.MX{
@@ -405,6 +1018,7 @@ var mxRecords = map[string][]*net.MX{
 	"too-many-a-records.example.com": []*net.MX{
 		&net.MX{Host: "too-many-a-records.example.com", Pref: 1},
 	},
+	"void2.example.com": []*net.MX{},
 }
 
 var aRecords = map[string][]string{
@@ -424,6 +1038,12 @@ var aRecords = map[string][]string{
 	"test.com": []string{
 		"10.10.10.1",
 	},
+	"mail.ptr.example.com": []string{
+		"1.2.3.10",
+	},
+	"spoofed.ptr.example.com": []string{
+		"1.2.3.12",
+	},
 	"too-many-a-records.example.com": []string{
 		"1.1.1.1",
 		"1.1.1.2",
@@ -440,6 +1060,17 @@ var aRecords = map[string][]string{
 	},
 }
 
+var ptrRecords = map[string][]string{
+	"1.2.3.10": []string{"mail.ptr.example.com.", "mail.other.example.com."},
+	"1.2.3.11": []string{"spoofed.ptr.example.com."},
+}
+
+var aaaaRecords = map[string][]string{
+	"mxa.example.com": []string{
+		"aaaa::1",
+	},
+}
+
 // Set up test DNS resolver
 type TestResolver struct {
 }
@@ -447,7 +1078,15 @@ type TestResolver struct {
 func (t *TestResolver) GetARecords(domain string) ([]string, error) {
 	val, ok := aRecords[domain]
 	if !ok {
-		return val, fmt.Errorf("%v lookup failed", domain)
+		return val, fmt.Errorf("%v lookup failed: %w", domain, dns.ErrNotFound)
+	}
+	return val, nil
+}
+
+func (t *TestResolver) GetAAAARecords(domain string) ([]string, error) {
+	val, ok := aaaaRecords[domain]
+	if !ok {
+		return val, fmt.Errorf("%v lookup failed: %w", domain, dns.ErrNotFound)
 	}
 	return val, nil
 }
@@ -455,26 +1094,32 @@ func (t *TestResolver) GetARecords(domain string) ([]string, error) {
 func (t *TestResolver) GetMXRecords(domain string) ([]*net.MX, error) {
 	val, ok := mxRecords[domain]
 	if !ok {
-		return val, fmt.Errorf("%v lookup failed", domain)
+		return val, fmt.Errorf("%v lookup failed: %w", domain, dns.ErrNotFound)
+	}
+	return val, nil
+}
+
+func (t *TestResolver) GetPTRRecords(addr string) ([]string, error) {
+	val, ok := ptrRecords[addr]
+	if !ok {
+		return val, fmt.Errorf("%v lookup failed: %w", addr, dns.ErrNotFound)
 	}
 	return val, nil
 }
 
 func (t *TestResolver) GetSPFRecord(domain string) (string, error) {
+	if records, ok := multiStringTXTRecords[domain]; ok {
+		return dns.SelectSPFRecord(records)
+	}
 	records, ok := txtRecords[domain]
 	if !ok {
-		return "", fmt.Errorf("%v lookup failed", domain)
+		return "", fmt.Errorf("%v lookup failed: %w", domain, dns.ErrNotFound)
 	}
+	txts := make([][]string, 0, len(records))
 	for _, record := range records {
-		if !dns.IsSPF(record) {
-			continue
-		}
-		if !dns.IsSupportedProtocol(record) {
-			return "", fmt.Errorf("Unsupported SPF record: " + record)
-		}
-		return record, nil
+		txts = append(txts, []string{record})
 	}
-	return "", fmt.Errorf("No SPF record found for " + domain)
+	return dns.SelectSPFRecord(txts)
 }
 
 // end setup of test resolver
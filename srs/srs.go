@@ -0,0 +1,306 @@
+// Package srs implements the Sender Rewriting Scheme, which lets forwarders
+// rewrite the envelope sender of forwarded mail into their own domain, so the
+// message passes SPF at the next hop, while bounces can still be returned.
+//
+//	r := srs.New("forwarder.example", "secret")
+//	sender, err := r.Forward("alice@example.com")
+//	// SRS0=HHHH=TT=example.com=alice@forwarder.example
+//	orig, err := r.Reverse(sender)
+//	// alice@example.com
+//
+// Addresses use the "guarded" format of libsrs2, which postsrsd and most
+// MTA plugins use as well, so addresses round-trip with those
+// implementations when they share the secret and hash length:
+//
+//	SRS0=<hash>=<timestamp>=<domain>=<local part>@<forwarder>
+//	SRS1=<hash>=<first forwarder>==<hash>=<timestamp>=<domain>=<local part>@<forwarder>
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultHashLength is the number of base64 characters of the hash.
+	DefaultHashLength = 4
+	// DefaultMaxAge is the number of days an address can be reversed.
+	DefaultMaxAge = 21
+)
+
+const (
+	srs0Tag = "SRS0"
+	srs1Tag = "SRS1"
+	srsSep  = '='
+
+	timeBaseChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	timeSlots     = 1024 // two base32 characters
+	timePrecision = 24 * time.Hour
+)
+
+var (
+	// ErrNotSRS is returned by Reverse for addresses that aren't SRS addresses.
+	ErrNotSRS = errors.New("srs: not an SRS address")
+	// ErrInvalidAddress is returned for malformed addresses.
+	ErrInvalidAddress = errors.New("srs: invalid address")
+	// ErrNoSecret is returned when a Rewriter has no secrets.
+	ErrNoSecret = errors.New("srs: no secret")
+	// ErrHashTooShort is returned for hashes shorter than HashMin.
+	ErrHashTooShort = errors.New("srs: hash too short")
+	// ErrHashInvalid is returned for hashes that don't match any secret.
+	ErrHashInvalid = errors.New("srs: invalid hash")
+	// ErrTimestampInvalid is returned for malformed timestamps.
+	ErrTimestampInvalid = errors.New("srs: invalid timestamp")
+	// ErrTimestampExpired is returned for addresses older than MaxAge.
+	ErrTimestampExpired = errors.New("srs: timestamp expired")
+)
+
+// Rewriter rewrites addresses for a forwarder. A Rewriter is safe for
+// concurrent use as long as its fields aren't modified.
+type Rewriter struct {
+	// Domain is the domain of the forwarder, used in rewritten addresses.
+	Domain string
+	// Secrets are the HMAC keys. Addresses are signed with the first one and
+	// verified against all of them, so a key can be rotated by prepending the
+	// new key and dropping the old one after MaxAge days.
+	Secrets []string
+	// Separator follows the SRS0 and SRS1 tags: '=' (the default), '+' or '-'.
+	// Any of them is accepted when reversing.
+	Separator byte
+	// HashLength is the number of hash characters of new addresses,
+	// DefaultHashLength if 0.
+	HashLength int
+	// HashMin is the minimal number of hash characters accepted when
+	// reversing, HashLength if 0.
+	HashMin int
+	// MaxAge is the number of days an SRS0 address can be reversed,
+	// DefaultMaxAge if 0.
+	MaxAge int
+	// AlwaysRewrite also rewrites senders in Domain.
+	AlwaysRewrite bool
+
+	now func() time.Time
+}
+
+// New returns a Rewriter for the forwarder domain with the default settings.
+func New(domain string, secrets ...string) *Rewriter {
+	return &Rewriter{Domain: domain, Secrets: secrets}
+}
+
+// IsSRS reports whether address is an SRS0 or SRS1 address.
+func IsSRS(address string) bool {
+	local := localPart(address)
+	return hasTag(local, srs0Tag) || hasTag(local, srs1Tag)
+}
+
+// Forward rewrites the envelope sender of a message forwarded by r.Domain.
+// SRS0 and SRS1 senders are rewritten to SRS1 addresses that point back at
+// the first forwarder. Senders in r.Domain are returned unchanged, unless
+// AlwaysRewrite is set. The null reverse-path must not be rewritten.
+func (r *Rewriter) Forward(sender string) (string, error) {
+	if len(r.Secrets) == 0 {
+		return "", ErrNoSecret
+	}
+	at := strings.IndexByte(sender, '@')
+	if at <= 0 || at == len(sender)-1 || r.Domain == "" {
+		return "", ErrInvalidAddress
+	}
+	user, host := sender[:at], sender[at+1:]
+	if !r.AlwaysRewrite && strings.EqualFold(host, r.Domain) {
+		return sender, nil
+	}
+
+	switch {
+	case hasTag(user, srs1Tag):
+		// keep the first forwarder and its address, but sign them again
+		fields := strings.SplitN(user[5:], string(srsSep), 3)
+		if len(fields) != 3 || fields[1] == "" {
+			return "", ErrInvalidAddress
+		}
+		return r.srs1(fields[1], fields[2]), nil
+	case hasTag(user, srs0Tag):
+		// the part after the tag includes its separator, hence "=="
+		return r.srs1(host, user[4:]), nil
+	}
+	stamp := timestamp(r.clock())
+	hash := r.hash(0, stamp, host, user)
+	return srs0Tag + string(r.separator()) + join(hash, stamp, host, user) + "@" + r.Domain, nil
+}
+
+// Reverse returns the address an SRS address was rewritten from, checking its
+// hash and, for SRS0 addresses, its timestamp. The domain of address isn't
+// checked. An SRS1 address is reversed to the SRS0 address of the first
+// forwarder, which in turn reverses it.
+func (r *Rewriter) Reverse(address string) (string, error) {
+	if len(r.Secrets) == 0 {
+		return "", ErrNoSecret
+	}
+	local := localPart(address)
+	switch {
+	case hasTag(local, srs1Tag):
+		fields := strings.SplitN(local[5:], string(srsSep), 3)
+		if len(fields) != 3 || fields[1] == "" {
+			return "", ErrInvalidAddress
+		}
+		hash, host, user := fields[0], fields[1], fields[2]
+		if err := r.checkHash(hash, host, user); err != nil {
+			return "", err
+		}
+		return srs0Tag + user + "@" + host, nil
+	case hasTag(local, srs0Tag):
+		fields := strings.SplitN(local[5:], string(srsSep), 4)
+		if len(fields) != 4 || fields[2] == "" || fields[3] == "" {
+			return "", ErrInvalidAddress
+		}
+		hash, stamp, host, user := fields[0], fields[1], fields[2], fields[3]
+		if err := r.checkTimestamp(stamp); err != nil {
+			return "", err
+		}
+		if err := r.checkHash(hash, stamp, host, user); err != nil {
+			return "", err
+		}
+		return user + "@" + host, nil
+	}
+	return "", ErrNotSRS
+}
+
+func (r *Rewriter) srs1(host string, user string) string {
+	hash := r.hash(0, host, user)
+	return srs1Tag + string(r.separator()) + join(hash, host, user) + "@" + r.Domain
+}
+
+// hash returns the base64 encoded HMAC-SHA1 of the lowercased data with
+// secret i, truncated to HashLength characters.
+func (r *Rewriter) hash(i int, data ...string) string {
+	mac := hmac.New(sha1.New, []byte(r.Secrets[i]))
+	for _, d := range data {
+		mac.Write([]byte(lowerASCII(d)))
+	}
+	hash := base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+	if n := r.hashLength(); n < len(hash) {
+		hash = hash[:n]
+	}
+	return hash
+}
+
+// checkHash compares hash case-insensitively with the hashes of all secrets,
+// as base64 can't survive MTAs that change the case of local parts.
+func (r *Rewriter) checkHash(hash string, data ...string) error {
+	min := r.HashMin
+	if min <= 0 {
+		min = r.hashLength()
+	}
+	if len(hash) < min {
+		return ErrHashTooShort
+	}
+	given := []byte(lowerASCII(hash))
+	for i := range r.Secrets {
+		want := r.hash(i, data...)
+		if len(want) < len(given) {
+			continue
+		}
+		if subtle.ConstantTimeCompare(given, []byte(lowerASCII(want[:len(given)]))) == 1 {
+			return nil
+		}
+	}
+	return ErrHashInvalid
+}
+
+func (r *Rewriter) checkTimestamp(stamp string) error {
+	if len(stamp) != 2 {
+		return ErrTimestampInvalid
+	}
+	then := 0
+	for i := 0; i < len(stamp); i++ {
+		c := strings.IndexByte(timeBaseChars, upperASCII(stamp[i]))
+		if c < 0 {
+			return ErrTimestampInvalid
+		}
+		then = then<<5 | c
+	}
+	now := days(r.clock()) % timeSlots
+	for now < then {
+		now += timeSlots
+	}
+	maxAge := r.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	if now > then+maxAge {
+		return ErrTimestampExpired
+	}
+	return nil
+}
+
+func (r *Rewriter) hashLength() int {
+	if r.HashLength <= 0 {
+		return DefaultHashLength
+	}
+	return r.HashLength
+}
+
+func (r *Rewriter) separator() byte {
+	if isSeparator(r.Separator) {
+		return r.Separator
+	}
+	return srsSep
+}
+
+func (r *Rewriter) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// timestamp returns the day of t as two base32 characters.
+func timestamp(t time.Time) string {
+	d := days(t)
+	return string([]byte{timeBaseChars[(d>>5)&31], timeBaseChars[d&31]})
+}
+
+func days(t time.Time) int {
+	return int(t.Unix() / int64(timePrecision/time.Second))
+}
+
+func join(fields ...string) string {
+	return strings.Join(fields, string(srsSep))
+}
+
+// hasTag reports whether local starts with tag, in any case, and a separator.
+func hasTag(local string, tag string) bool {
+	return len(local) > len(tag) && strings.EqualFold(local[:len(tag)], tag) && isSeparator(local[len(tag)])
+}
+
+func isSeparator(c byte) bool {
+	return c == '=' || c == '+' || c == '-'
+}
+
+func localPart(address string) string {
+	if at := strings.IndexByte(address, '@'); at >= 0 {
+		return address[:at]
+	}
+	return address
+}
+
+func lowerASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+func upperASCII(c byte) byte {
+	if 'a' <= c && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
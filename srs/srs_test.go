@@ -0,0 +1,136 @@
+package srs
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSRS(t *testing.T) {
+	Convey("Testing SRS", t, func() {
+		now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+		clock := func() time.Time { return now }
+		first := &Rewriter{Domain: "forwarder.example", Secrets: []string{"secret"}, now: clock}
+		second := &Rewriter{Domain: "second.example", Secrets: []string{"other"}, now: clock}
+
+		Convey("Forward and reverse SRS0 addresses", func() {
+			// the addresses libsrs2 and postsrsd create with the same secret
+			srs0, err := first.Forward("Alice@example.com")
+			So(err, ShouldEqual, nil)
+			So(srs0, ShouldEqual, "SRS0=C5hN=46=example.com=Alice@forwarder.example")
+			So(IsSRS(srs0), ShouldEqual, true)
+
+			orig, err := first.Reverse(srs0)
+			So(err, ShouldEqual, nil)
+			So(orig, ShouldEqual, "Alice@example.com")
+
+			// case changes of the local part don't break the hash
+			orig, err = first.Reverse("srs0=c5hn=46=EXAMPLE.COM=ALICE@forwarder.example")
+			So(err, ShouldEqual, nil)
+			So(orig, ShouldEqual, "ALICE@EXAMPLE.COM")
+
+			// local parts with separators
+			srs0, err = first.Forward("a=b+c@example.com")
+			So(err, ShouldEqual, nil)
+			orig, err = first.Reverse(srs0)
+			So(err, ShouldEqual, nil)
+			So(orig, ShouldEqual, "a=b+c@example.com")
+		})
+
+		Convey("Forward and reverse SRS1 addresses", func() {
+			srs0, _ := first.Forward("alice@example.com")
+			srs1, err := second.Forward(srs0)
+			So(err, ShouldEqual, nil)
+			So(srs1, ShouldEqual, "SRS1=IDun=forwarder.example==C5hN=46=example.com=alice@second.example")
+
+			third := &Rewriter{Domain: "third.example", Secrets: []string{"third"}, now: clock}
+			srs1b, err := third.Forward(srs1)
+			So(err, ShouldEqual, nil)
+			So(srs1b, ShouldStartWith, "SRS1=")
+			So(srs1b, ShouldEndWith, "=forwarder.example==C5hN=46=example.com=alice@third.example")
+
+			back, err := third.Reverse(srs1b)
+			So(err, ShouldEqual, nil)
+			So(back, ShouldEqual, srs0)
+			back, err = second.Reverse(srs1)
+			So(err, ShouldEqual, nil)
+			So(back, ShouldEqual, srs0)
+			orig, err := first.Reverse(back)
+			So(err, ShouldEqual, nil)
+			So(orig, ShouldEqual, "alice@example.com")
+
+			_, err = first.Reverse(srs1)
+			So(err, ShouldEqual, ErrHashInvalid)
+		})
+
+		Convey("Rotate secrets", func() {
+			srs0, _ := first.Forward("alice@example.com")
+			rotated := &Rewriter{Domain: "forwarder.example", Secrets: []string{"new", "secret"}, now: clock}
+			orig, err := rotated.Reverse(srs0)
+			So(err, ShouldEqual, nil)
+			So(orig, ShouldEqual, "alice@example.com")
+
+			srs0, _ = rotated.Forward("alice@example.com")
+			_, err = first.Reverse(srs0)
+			So(err, ShouldEqual, ErrHashInvalid)
+		})
+
+		Convey("Check timestamps", func() {
+			srs0, _ := first.Forward("alice@example.com")
+			now = now.Add(DefaultMaxAge * 24 * time.Hour)
+			_, err := first.Reverse(srs0)
+			So(err, ShouldEqual, nil)
+			now = now.Add(24 * time.Hour)
+			_, err = first.Reverse(srs0)
+			So(err, ShouldEqual, ErrTimestampExpired)
+
+			// timestamps wrap around after 1024 days
+			now = time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC).Add(94 * 24 * time.Hour)
+			srs0, _ = first.Forward("alice@example.com")
+			So(srs0, ShouldContainSubstring, "=74=")
+			now = now.Add(6 * 24 * time.Hour)
+			_, err = first.Reverse(srs0)
+			So(err, ShouldEqual, nil)
+
+			_, err = first.Reverse("SRS0=C5hN=4!=example.com=alice@forwarder.example")
+			So(err, ShouldEqual, ErrTimestampInvalid)
+		})
+
+		Convey("Reject invalid addresses", func() {
+			_, err := first.Reverse("alice@example.com")
+			So(err, ShouldEqual, ErrNotSRS)
+			_, err = first.Reverse("SRS0=C5hN=46=example.com@forwarder.example")
+			So(err, ShouldEqual, ErrInvalidAddress)
+			_, err = first.Reverse("SRS0=C5h=46=example.com=alice@forwarder.example")
+			So(err, ShouldEqual, ErrHashTooShort)
+			_, err = first.Reverse("SRS0=C5hX=46=example.com=alice@forwarder.example")
+			So(err, ShouldEqual, ErrHashInvalid)
+			_, err = first.Reverse("SRS1=IDun=forwarder.example@second.example")
+			So(err, ShouldEqual, ErrInvalidAddress)
+
+			_, err = first.Forward("")
+			So(err, ShouldEqual, ErrInvalidAddress)
+			_, err = first.Forward("alice")
+			So(err, ShouldEqual, ErrInvalidAddress)
+			_, err = New("forwarder.example").Forward("alice@example.com")
+			So(err, ShouldEqual, ErrNoSecret)
+			So(IsSRS("srs-forwarding@example.com"), ShouldEqual, false)
+		})
+
+		Convey("Options", func() {
+			sender, err := first.Forward("bob@forwarder.example")
+			So(err, ShouldEqual, nil)
+			So(sender, ShouldEqual, "bob@forwarder.example")
+
+			r := &Rewriter{Domain: "forwarder.example", Secrets: []string{"secret"}, Separator: '+', HashLength: 8, AlwaysRewrite: true, now: clock}
+			sender, err = r.Forward("bob@forwarder.example")
+			So(err, ShouldEqual, nil)
+			So(sender, ShouldStartWith, "SRS0+")
+			So(len(sender), ShouldEqual, len("SRS0+12345678=46=forwarder.example=bob@forwarder.example"))
+			orig, err := r.Reverse(sender)
+			So(err, ShouldEqual, nil)
+			So(orig, ShouldEqual, "bob@forwarder.example")
+		})
+	})
+}
@@ -0,0 +1,152 @@
+package watch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StatusOK is the status of the entries whose policy was loaded.
+const StatusOK = "ok"
+
+// Entry is the resolved policy of a domain at some time.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Domain string    `json:"domain"`
+	// Status is StatusOK when the policy was loaded, else the SPF result of
+	// the error: "PermError", "TempError" or "None".
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Records are the raw SPF records of the domain and of its includes and
+	// redirects, by name.
+	Records map[string]string `json:"records"`
+	// Policy is the resolved tree, a snapshot to restore with gospf.Restore.
+	Policy     json.RawMessage `json:"policy,omitempty"`
+	DNSLookups int             `json:"dns_lookups"`
+}
+
+// entryTimeFormat names the files of the entries, so they sort by time.
+const entryTimeFormat = "20060102T150405.000000000Z"
+
+// History stores the entries of the domains in a directory, one JSON file
+// per entry in a subdirectory per domain:
+//
+//	history/example.com/20240102T030405.000000000Z.json
+type History struct {
+	Dir string
+	// MaxEntries is the number of entries kept per domain, older ones are
+	// removed. Zero keeps all of them.
+	MaxEntries int
+}
+
+// domainDir returns the directory of the entries of domain.
+func (h *History) domainDir(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" || strings.HasPrefix(domain, ".") || strings.ContainsAny(domain, `/\`) {
+		return "", fmt.Errorf("invalid domain %q", domain)
+	}
+	return filepath.Join(h.Dir, domain), nil
+}
+
+// Add stores e and removes the entries beyond MaxEntries.
+func (h *History) Add(e *Entry) error {
+	dir, err := h.domainDir(e.Domain)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so readers never see partial entries
+	path := filepath.Join(dir, e.Time.UTC().Format(entryTimeFormat)+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if h.MaxEntries <= 0 {
+		return nil
+	}
+	names, err := h.names(dir)
+	if err != nil {
+		return err
+	}
+	for len(names) > h.MaxEntries {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// names returns the file names of the entries in dir, oldest first.
+func (h *History) names(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Entries returns the stored entries of domain, oldest first.
+func (h *History) Entries(domain string) ([]*Entry, error) {
+	dir, err := h.domainDir(domain)
+	if err != nil {
+		return nil, err
+	}
+	names, err := h.names(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0, len(names))
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		e := &Entry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return nil, fmt.Errorf("invalid history entry %v: %v", name, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Latest returns the newest entry of domain whose status isn't
+// "TempError", or nil if there's none.
+func (h *History) Latest(domain string) (*Entry, error) {
+	entries, err := h.Entries(domain)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Status != "TempError" {
+			return entries[i], nil
+		}
+	}
+	return nil, nil
+}
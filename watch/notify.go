@@ -0,0 +1,68 @@
+package watch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Notifier sends the events of a Watcher.
+type Notifier interface {
+	Notify(Event) error
+}
+
+// JSONWriter writes the events as JSON, one per line.
+type JSONWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONWriter returns a Notifier that writes to w, e.g. os.Stdout.
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{w: w}
+}
+
+// Notify writes e.
+func (j *JSONWriter) Notify(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.w.Write(append(data, '\n'))
+	return err
+}
+
+// Webhook posts the events as JSON to URL.
+type Webhook struct {
+	URL string
+	// Client sends the requests, http.DefaultClient is used when nil.
+	Client *http.Client
+}
+
+// Notify posts e, responses other than 2xx are errors.
+func (w *Webhook) Notify(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %v: %v", w.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+// Package watch resolves the SPF policies of domains on a schedule, keeps
+// their history on disk and notifies of the changes that break mail:
+//
+//	w := &watch.Watcher{
+//		Resolver: resolver,
+//		History:  &watch.History{Dir: "/var/lib/gospf"},
+//		Notifier: &watch.Webhook{URL: "https://hooks.example.com/spf"},
+//	}
+//	err := w.Run(ctx, []string{"example.com", "example.org"}, time.Hour)
+//
+// Events are sent when the authorized addresses change, when the DNS lookups
+// of a policy reach LookupWarning, when a policy becomes a PermError or
+// disappears, and when it's fixed again.
+package watch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mistralmail/gospf"
+	"github.com/mistralmail/gospf/dns"
+)
+
+// EventKind is the kind of an Event.
+type EventKind string
+
+const (
+	// Changed is sent when the addresses that get a result changed, with
+	// the Changes.
+	Changed EventKind = "changed"
+	// LookupWarning is sent when the DNS lookups of a policy reach
+	// Watcher.LookupWarning.
+	LookupWarning EventKind = "lookup_warning"
+	// PermError is sent when a policy becomes a PermError, with the Error.
+	PermError EventKind = "permerror"
+	// NoRecord is sent when a domain stops publishing a policy.
+	NoRecord EventKind = "no_record"
+	// Recovered is sent when a PermError or missing policy is fixed.
+	Recovered EventKind = "recovered"
+)
+
+// Event is a change of the policy of a domain.
+type Event struct {
+	Time       time.Time          `json:"time"`
+	Kind       EventKind          `json:"kind"`
+	Domain     string             `json:"domain"`
+	Message    string             `json:"message"`
+	Error      string             `json:"error,omitempty"`
+	DNSLookups int                `json:"dns_lookups"`
+	Changes    []gospf.ResultDiff `json:"changes,omitempty"`
+}
+
+// Watcher checks the policies of domains. At least Resolver and History
+// must be set.
+type Watcher struct {
+	// Resolver resolves the policies. A resolver with a Flush method, like
+	// dns.CachingResolver, is flushed before every round of Run, so the
+	// changes are seen at the next round whatever the TTL of its cache.
+	Resolver dns.DnsResolver
+	History  *History
+	// Notifier sends the events, they're only returned by Check when nil.
+	Notifier Notifier
+	// LookupWarning is the number of DNS lookups that raises a warning,
+	// two below gospf.DNSLookupLimit when zero.
+	LookupWarning int
+	// Options are used to load the policies.
+	Options []gospf.Option
+	// ErrorLog logs the errors of Run, the standard logger is used when nil.
+	ErrorLog *log.Logger
+
+	now func() time.Time
+}
+
+// Run checks the domains now and then at every interval, until ctx is done.
+// Errors are logged to ErrorLog. It returns the error of ctx.
+func (w *Watcher) Run(ctx context.Context, domains []string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if f, ok := w.Resolver.(flusher); ok {
+			f.Flush()
+		}
+		for _, domain := range domains {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if _, err := w.Check(domain); err != nil {
+				w.logf("%v: %v", domain, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check resolves the policy of domain, stores it in the history and sends
+// the events of the changes since the previous check. Temporary DNS errors
+// are stored but raise no events.
+func (w *Watcher) Check(domain string) ([]Event, error) {
+	now := time.Now
+	if w.now != nil {
+		now = w.now
+	}
+	recorder := &recordingResolver{DnsResolver: w.Resolver, records: make(map[string]string)}
+	spf, err := gospf.New(domain, recorder, w.Options...)
+	entry := &Entry{Time: now(), Domain: domain, Status: StatusOK, Records: recorder.recorded()}
+	if err != nil {
+		entry.Status, entry.Error = errorStatus(err)
+	} else {
+		entry.DNSLookups = spf.DNSLookupCount()
+		if entry.Policy, err = spf.MarshalJSON(); err != nil {
+			return nil, err
+		}
+	}
+
+	previous, err := w.History.Latest(domain)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.History.Add(entry); err != nil {
+		return nil, err
+	}
+	events, err := w.events(previous, entry, spf)
+	if err != nil {
+		return nil, err
+	}
+	if w.Notifier != nil {
+		for _, e := range events {
+			if notifyErr := w.Notifier.Notify(e); notifyErr != nil && err == nil {
+				err = notifyErr
+			}
+		}
+	}
+	return events, err
+}
+
+// events returns the events of the change from previous, which may be nil,
+// to current, whose loaded policy is spf.
+func (w *Watcher) events(previous *Entry, current *Entry, spf *gospf.SPF) ([]Event, error) {
+	events := make([]Event, 0)
+	event := func(kind EventKind, format string, args ...interface{}) *Event {
+		events = append(events, Event{
+			Time:       current.Time,
+			Kind:       kind,
+			Domain:     current.Domain,
+			Message:    fmt.Sprintf(format, args...),
+			Error:      current.Error,
+			DNSLookups: current.DNSLookups,
+		})
+		return &events[len(events)-1]
+	}
+	previousStatus := ""
+	if previous != nil {
+		previousStatus = previous.Status
+	}
+
+	switch current.Status {
+	case "PermError":
+		if previousStatus != "PermError" {
+			event(PermError, "the SPF record of %v became invalid: %v", current.Domain, current.Error)
+		}
+		return events, nil
+	case "None":
+		if previousStatus != "None" {
+			event(NoRecord, "%v publishes no SPF record", current.Domain)
+		}
+		return events, nil
+	case "TempError":
+		return events, nil
+	}
+
+	if previousStatus == "PermError" || previousStatus == "None" {
+		event(Recovered, "the SPF record of %v is valid again", current.Domain)
+	}
+	if previousStatus == StatusOK {
+		before, err := gospf.Restore(previous.Policy, nil)
+		if err != nil {
+			return nil, fmt.Errorf("history entry of %v: %v", previous.Time, err)
+		}
+		if changes := gospf.Compare(before, spf).Results; len(changes) > 0 {
+			summary := make([]string, 0, len(changes))
+			for _, c := range changes {
+				summary = append(summary, fmt.Sprintf("%v +%v -%v", c.Result, len(c.Added.Ranges()), len(c.Removed.Ranges())))
+			}
+			event(Changed, "the addresses authorized by %v changed (ranges %v)", current.Domain, strings.Join(summary, ", ")).Changes = changes
+		}
+	}
+
+	warning := w.LookupWarning
+	if warning <= 0 {
+		warning = gospf.DNSLookupLimit - 2
+	}
+	if current.DNSLookups >= warning && (previousStatus != StatusOK || previous.DNSLookups < warning) {
+		event(LookupWarning, "the SPF record of %v needs %v of %v DNS lookups", current.Domain, current.DNSLookups, gospf.DNSLookupLimit)
+	}
+	return events, nil
+}
+
+// errorStatus returns the status and the message of an error of gospf.New.
+func errorStatus(err error) (string, string) {
+	switch e := err.(type) {
+	case *gospf.PermError:
+		return "PermError", e.Message
+	case *gospf.TempError:
+		return "TempError", e.Message
+	case *gospf.NoneError:
+		return "None", e.Message
+	}
+	return "PermError", err.Error()
+}
+
+func (w *Watcher) logf(format string, args ...interface{}) {
+	if w.ErrorLog != nil {
+		w.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// flusher is a resolver with a cache, like dns.CachingResolver.
+type flusher interface {
+	Flush()
+}
+
+// recordingResolver records the SPF records it looks up.
+type recordingResolver struct {
+	dns.DnsResolver
+	mu      sync.Mutex
+	records map[string]string
+}
+
+func (r *recordingResolver) GetSPFRecord(name string) (string, error) {
+	record, err := r.DnsResolver.GetSPFRecord(name)
+	if err == nil {
+		r.mu.Lock()
+		r.records[strings.ToLower(strings.TrimSuffix(name, "."))] = record
+		r.mu.Unlock()
+	}
+	return record, err
+}
+
+// recorded returns a copy of the records.
+func (r *recordingResolver) recorded() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records := make(map[string]string, len(r.records))
+	for name, record := range r.records {
+		records[name] = record
+	}
+	return records
+}
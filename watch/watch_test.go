@@ -0,0 +1,198 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mistralmail/gospf/dns"
+)
+
+func zone(records string) *dns.ZoneResolver {
+	z := dns.NewZoneResolver()
+	if err := z.Load(strings.NewReader("$ORIGIN example.com.\n"+records), ""); err != nil {
+		panic(err)
+	}
+	return z
+}
+
+// changingResolver publishes the next of its records at every query.
+type changingResolver struct {
+	dns.DnsResolver
+	records []string
+	queries int
+}
+
+func (c *changingResolver) GetSPFRecord(name string) (string, error) {
+	record := c.records[len(c.records)-1]
+	if c.queries < len(c.records) {
+		record = c.records[c.queries]
+	}
+	c.queries++
+	return record, nil
+}
+
+type notifierFunc func(Event) error
+
+func (f notifierFunc) Notify(e Event) error {
+	return f(e)
+}
+
+func TestWatcher(t *testing.T) {
+	Convey("Testing the watcher", t, func() {
+		dir, err := ioutil.TempDir("", "gospf-watch")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(dir)
+
+		var out bytes.Buffer
+		clock := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		w := &Watcher{
+			History:  &History{Dir: dir, MaxEntries: 3},
+			Notifier: NewJSONWriter(&out),
+			now: func() time.Time {
+				clock = clock.Add(time.Hour)
+				return clock
+			},
+		}
+		check := func(records string) []Event {
+			w.Resolver = zone(records)
+			events, err := w.Check("example.com")
+			So(err, ShouldEqual, nil)
+			return events
+		}
+
+		Convey("Changes of the policies raise events", func() {
+			events := check(`@ TXT "v=spf1 ip4:192.0.2.0/24 include:_spf.example.com -all"
+_spf TXT "v=spf1 ip4:198.51.100.0/24 -all"`)
+			So(events, ShouldBeEmpty)
+
+			// the same addresses in other terms
+			events = check(`@ TXT "v=spf1 ip4:192.0.2.0/25 ip4:192.0.2.128/25 include:_spf.example.com -all"
+_spf TXT "v=spf1 ip4:198.51.100.0/24 -all"`)
+			So(events, ShouldBeEmpty)
+
+			events = check(`@ TXT "v=spf1 ip4:192.0.2.0/24 include:_spf.example.com -all"
+_spf TXT "v=spf1 ip4:198.51.100.0/25 -all"`)
+			So(len(events), ShouldEqual, 1)
+			So(events[0].Kind, ShouldEqual, Changed)
+			So(events[0].Message, ShouldEqual, "the addresses authorized by example.com changed (ranges Pass +0 -1, Fail +1 -0)")
+			So(events[0].Changes[0].Removed.String(), ShouldEqual, "198.51.100.128/25")
+
+			events = check(`@ TXT "v=spf1 ip4:192.0.2.0/24 include:_spf.example.com -all"`)
+			So(len(events), ShouldEqual, 1)
+			So(events[0].Kind, ShouldEqual, PermError)
+
+			// temporary errors are ignored
+			w.Resolver = zone(`@ TXT "v=spf1 -all"`)
+			w.Resolver.(*dns.ZoneResolver).Fail("example.com", dns.ServFail)
+			events, err = w.Check("example.com")
+			So(err, ShouldEqual, nil)
+			So(events, ShouldBeEmpty)
+
+			events = check(`@ TXT "v=spf1 ip4:192.0.2.0/24 include:_spf.example.com -all"`)
+			So(events, ShouldBeEmpty)
+
+			events = check(`@ TXT "v=spf1 a a a a a a a a -all"
+@ A 192.0.2.1`)
+			So(len(events), ShouldEqual, 2)
+			So(events[0].Kind, ShouldEqual, Recovered)
+			So(events[1].Kind, ShouldEqual, LookupWarning)
+			So(events[1].DNSLookups, ShouldEqual, 8)
+
+			events = check(`@ TXT "google-site-verification=abc"`)
+			So(len(events), ShouldEqual, 1)
+			So(events[0].Kind, ShouldEqual, NoRecord)
+
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			So(len(lines), ShouldEqual, 5)
+			var e Event
+			So(json.Unmarshal([]byte(lines[0]), &e), ShouldEqual, nil)
+			So(e.Kind, ShouldEqual, Changed)
+			So(e.Changes[0].Result, ShouldEqual, "Pass")
+			So(e.Changes[0].Removed.String(), ShouldEqual, "198.51.100.128/25")
+		})
+
+		Convey("The history keeps the newest entries with their records", func() {
+			check(`@ TXT "v=spf1 include:_spf.example.com -all"
+_spf TXT "v=spf1 ip4:198.51.100.0/24 -all"`)
+			for i := 0; i < 3; i++ {
+				check(`@ TXT "v=spf1 -all"`)
+			}
+			entries, err := w.History.Entries("example.com")
+			So(err, ShouldEqual, nil)
+			So(len(entries), ShouldEqual, 3)
+			So(entries[2].Time, ShouldEqual, clock)
+			So(entries[2].Records, ShouldResemble, map[string]string{"example.com": "v=spf1 -all"})
+
+			check(`@ TXT "v=spf1 include:_spf.example.com -all"
+_spf TXT "v=spf1 ip4:198.51.100.0/24 -all"`)
+			latest, err := w.History.Latest("Example.com.")
+			So(err, ShouldEqual, nil)
+			So(latest.Status, ShouldEqual, StatusOK)
+			So(latest.DNSLookups, ShouldEqual, 1)
+			So(latest.Records["_spf.example.com"], ShouldEqual, "v=spf1 ip4:198.51.100.0/24 -all")
+
+			latest, err = w.History.Latest("example.org")
+			So(err, ShouldEqual, nil)
+			So(latest, ShouldBeNil)
+			_, err = w.History.Entries("../example.com")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Cached answers are flushed before every round", func() {
+			w.Resolver = dns.NewCachingResolver(&changingResolver{
+				DnsResolver: zone(""),
+				records:     []string{"v=spf1 ip4:192.0.2.0/24 -all", "v=spf1 ip4:198.51.100.0/24 -all"},
+			}, time.Hour)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var changed []Event
+			w.Notifier = notifierFunc(func(e Event) error {
+				changed = append(changed, e)
+				cancel()
+				return nil
+			})
+			So(w.Run(ctx, []string{"example.com"}, time.Millisecond), ShouldEqual, context.Canceled)
+			So(len(changed), ShouldEqual, 1)
+			So(changed[0].Kind, ShouldEqual, Changed)
+		})
+
+		Convey("Events are posted to webhooks", func() {
+			received := make(chan Event, 1)
+			status := http.StatusNoContent
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				var e Event
+				if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&e) != nil {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				received <- e
+				rw.WriteHeader(status)
+			}))
+			defer server.Close()
+			w.Notifier = &Webhook{URL: server.URL}
+
+			events := check(`@ TXT "v=spf1 ip4:192.0.2.0/24 ip4:192.0.2.0/33 -all"`)
+			So(len(events), ShouldEqual, 1)
+			e := <-received
+			So(e.Kind, ShouldEqual, PermError)
+			So(e.Domain, ShouldEqual, "example.com")
+			So(e.Error, ShouldNotEqual, "")
+
+			status = http.StatusInternalServerError
+			w.Resolver = zone(`@ TXT "google-site-verification=abc"`)
+			_, err := w.Check("example.com")
+			So(err, ShouldNotEqual, nil)
+			So((<-received).Kind, ShouldEqual, NoRecord)
+		})
+	})
+}